@@ -0,0 +1,3 @@
+// Package benchmarks measures end-to-end throughput of carbon-clickhouse pipeline with mocked ClickHouse.
+// make bench runs benchmarks and compares results with baseline.txt by benchstat
+package benchmarks
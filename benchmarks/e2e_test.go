@@ -0,0 +1,237 @@
+//go:build go1.13 && !windows
+// +build go1.13,!windows
+
+package benchmarks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/carbon"
+)
+
+// series is count of distinct names sent by benchmark
+const series = 10000
+
+// mockClickHouse counts points inserted into data table and latency of each point. Value of point is send time in ns
+type mockClickHouse struct {
+	sync.Mutex
+	received  int
+	latencies []time.Duration
+	done      chan struct{} // closed when expected points are received
+	expected  int
+}
+
+func (m *mockClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.URL.Query().Get("query"), "INSERT INTO graphite ") {
+		return
+	}
+	now := time.Now().UnixNano()
+
+	m.Lock()
+	defer m.Unlock()
+
+	for len(body) > 0 {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < size+18 {
+			http.Error(w, "broken row", http.StatusBadRequest)
+			return
+		}
+		body = body[n+int(size):]
+		sent := math.Float64frombits(binary.LittleEndian.Uint64(body))
+		body = body[18:]
+
+		m.latencies = append(m.latencies, time.Duration(now-int64(sent)))
+		m.received++
+		if m.received == m.expected {
+			close(m.done)
+		}
+	}
+}
+
+// p99 returns 99th percentile of latencies
+func (m *mockClickHouse) p99() time.Duration {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(m.latencies) == 0 {
+		return 0
+	}
+	sort.Sort(durations(m.latencies))
+	return m.latencies[len(m.latencies)*99/100]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// heapSampler records max heap size until stop
+func heapSampler(stop chan struct{}) chan uint64 {
+	result := make(chan uint64, 1)
+	go func() {
+		var max uint64
+		var stats runtime.MemStats
+		t := time.NewTicker(100 * time.Millisecond)
+		defer t.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > max {
+				max = stats.HeapAlloc
+			}
+			select {
+			case <-stop:
+				result <- max
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return result
+}
+
+// send writes count metrics to addr at rate metrics/s
+func send(b *testing.B, addr string, count int, rate int) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(conn, 64*1024)
+	line := make([]byte, 0, 128)
+	start := time.Now()
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+
+	for sent := 0; sent < count; {
+		// metrics due by now
+		due := int(time.Since(start).Seconds()*float64(rate)) + 1
+		if due > count {
+			due = count
+		}
+		if due <= sent {
+			w.Flush()
+			time.Sleep(time.Millisecond)
+			continue
+		}
+
+		for ; sent < due; sent++ {
+			line = append(line[:0], "benchmark.e2e.metric"...)
+			line = strconv.AppendInt(line, int64(sent%series), 10)
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, time.Now().UnixNano(), 10)
+			line = append(line, ' ')
+			line = append(line, timestamp...)
+			line = append(line, '\n')
+			w.Write(line)
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func benchmarkE2E(b *testing.B, rate int) {
+	mock := &mockClickHouse{done: make(chan struct{}), expected: b.N}
+	srv := httptest.NewServer(mock)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := carbon.New("")
+	if err = app.ParseConfig(); err != nil {
+		b.Fatal(err)
+	}
+
+	app.Config.Common.MaxCPU = runtime.NumCPU()
+	app.Config.ClickHouse.Url = srv.URL
+	app.Config.Data.Path = dir
+	app.Config.ClickHouse.ScanInterval.Duration = 100 * time.Millisecond
+	app.Config.Data.FileInterval.Duration = 100 * time.Millisecond
+	app.Config.Tcp.Listen = "127.0.0.1:0"
+	app.Config.Udp.Enabled = false
+	app.Config.Pickle.Enabled = false
+
+	if err = app.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer app.Stop()
+
+	if err = app.WaitReady(5 * time.Second); err != nil {
+		b.Fatal(err)
+	}
+	addr := app.TCP.(interface {
+		Addr() net.Addr
+	}).Addr().String()
+
+	var memStart, memEnd runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&memStart)
+	stopSampler := make(chan struct{})
+	maxHeap := heapSampler(stopSampler)
+	cpuStart := cpuTime()
+
+	b.ResetTimer()
+	start := time.Now()
+
+	send(b, addr, b.N, rate)
+	select {
+	case <-mock.done:
+	case <-time.After(time.Minute):
+		mock.Lock()
+		received := mock.received
+		mock.Unlock()
+		b.Fatalf("received %d of %d metrics", received, b.N)
+	}
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	cpu := cpuTime() - cpuStart
+	close(stopSampler)
+	runtime.ReadMemStats(&memEnd)
+
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "metrics/s")
+	b.ReportMetric(float64(mock.p99())/float64(time.Millisecond), "p99-ms")
+	b.ReportMetric(float64(memEnd.TotalAlloc-memStart.TotalAlloc)/float64(b.N), "alloc-B/metric")
+	b.ReportMetric(float64(<-maxHeap), "max-heap-B")
+	b.ReportMetric(100*cpu.Seconds()/elapsed.Seconds(), "cpu-%")
+}
+
+// BenchmarkE2E sends b.N metrics by tcp at fixed rates. Achieved metrics/s is lower than rate if pipeline is
+// saturated. Latency is measured from send to insert and includes data.chunk-interval and clickhouse.scan-interval
+func BenchmarkE2E(b *testing.B) {
+	for _, rate := range []int{10000, 100000, 500000, 1000000} {
+		b.Run(fmt.Sprintf("rate=%dk", rate/1000), func(b *testing.B) {
+			benchmarkE2E(b, rate)
+		})
+	}
+}
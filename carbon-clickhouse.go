@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -9,10 +10,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/lomik/carbon-clickhouse/carbon"
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
 	"github.com/lomik/zapwriter"
 	"go.uber.org/zap"
 
@@ -37,9 +42,96 @@ func httpServe(addr string) (func(), error) {
 	return func() { listener.Close() }, nil
 }
 
+// configHandler serves active config of app with generation in JSON. Passwords are redacted
+func configHandler(app *carbon.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET is required", http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := app.ConfigStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// requeueHandler moves files of dead letter path back to data path and responds with count of moved files in JSON
+func requeueHandler(app *carbon.App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+			return
+		}
+		count, err := app.RequeueDeadLetters()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"requeued": count})
+	}
+}
+
+// reloadOnHUP reloads config of app on each SIGHUP. Signal is subscribed before return
+func reloadOnHUP(app *carbon.App, logger *zap.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for {
+			<-c
+			logger.Info("HUP received. Reload config")
+			if err := app.ReloadConfig(); err == carbon.ErrConfigUnchanged {
+				logger.Info("config unchanged")
+			} else if err != nil {
+				logger.Error("config reload failed", zap.Error(err))
+			} else {
+				logger.Info("config successfully reloaded")
+			}
+		}
+	}()
+}
+
+// dump prints rows of data file. Arguments are flags of dump subcommand
+func dump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	file := flags.String("file", "", "RowBinary data file")
+	limit := flags.Int("limit", 0, "Max printed rows, 0 - unlimited")
+	filter := flags.String("filter", "", "Print only names matching regexp")
+	format := flags.String("format", RowBinary.DumpFormatText, "Output format: text (<timestamp>\\t<name>\\t<value>) or json")
+	offset := flags.Int64("offset", 0, "Skip rows before printing. Row index of file (data.row-index) is used if exists")
+	flags.Parse(args)
+
+	if *file == "" {
+		log.Fatal("dump: --file is required")
+	}
+
+	opts := RowBinary.DumpOptions{Limit: *limit, Format: *format, Offset: *offset}
+	if *filter != "" {
+		re, err := regexp.Compile(*filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Filter = re
+	}
+
+	if _, err := RowBinary.Dump(os.Stdout, *file, opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	var err error
 
+	if len(os.Args) > 1 && os.Args[1] == "dump" {
+		dump(os.Args[2:])
+		return
+	}
+
 	/* CONFIG start */
 
 	configFile := flag.String("config", "/etc/carbon-clickhouse/carbon-clickhouse.conf", "Filename of config")
@@ -48,6 +140,9 @@ func main() {
 	printVersion := flag.Bool("version", false, "Print version")
 	cat := flag.String("cat", "", "Print RowBinary file in TabSeparated format")
 	bincat := flag.String("recover", "", "Read all good records from corrupted data file. Write binary data to stdout")
+	sendTest := flag.Bool("send-test", false, "Start pipeline, send test metric and wait it in ClickHouse. Exit code 1 on failure")
+	sendTestTimeout := flag.Duration("timeout", 30*time.Second, "Timeout of send-test")
+	dryRunVerbose := flag.Bool("dry-run-verbose", false, "Log SQL of queries changing ClickHouse instead of execution, see clickhouse.dry-run-verbose")
 
 	flag.Parse()
 
@@ -99,6 +194,7 @@ func main() {
 	}
 
 	app := carbon.New(*configFile)
+	app.DryRunVerbose = *dryRunVerbose
 
 	if err = app.ParseConfig(); err != nil {
 		log.Fatal(err)
@@ -115,10 +211,75 @@ func main() {
 		log.Fatal(err)
 	}
 
-	mainLogger := zapwriter.Logger("main")
+	logging.SetInstance(cfg.Common.InstanceName)
+	mainLogger := logging.Logger("main")
 
 	/* CONFIG end */
 
+	// machine-readable status on pprof listener
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.Status())
+	})
+
+	// upload state of each ClickHouse table
+	http.HandleFunc("/admin/uploader/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.UploaderStatus())
+	})
+
+	// start new ClickHouse session of INSERT queries
+	http.HandleFunc("/admin/reset-session", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := app.ResetSession(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	// active config, generation is incremented by each successful reload
+	http.HandleFunc("/admin/config", configHandler(app))
+
+	// changes of config by reload. Current generation without parameter
+	http.HandleFunc("/admin/config/diff", func(w http.ResponseWriter, r *http.Request) {
+		generation := 0
+		if s := r.URL.Query().Get("generation"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, "generation should be positive number", http.StatusBadRequest)
+				return
+			}
+			generation = n
+		}
+		diff, err := app.ConfigDiff(generation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+	})
+
+	// close current data file and upload it without waiting for chunk-interval
+	http.HandleFunc("/admin/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST is required", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := app.Flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	// move files of dead letter path back to data path for upload, e.g. after fix of ClickHouse schema
+	http.HandleFunc("/admin/requeue-dead-letters", requeueHandler(app))
+
 	// pprof
 	if cfg.Pprof.Enabled {
 		_, err = httpServe(cfg.Pprof.Listen)
@@ -133,6 +294,19 @@ func main() {
 		mainLogger.Info("app started")
 	}
 
+	if *sendTest {
+		err = app.SmokeTest(*sendTestTimeout)
+		app.Stop()
+
+		if err != nil {
+			mainLogger.Error("send-test failed", zap.Error(err))
+			os.Exit(1)
+		}
+
+		mainLogger.Info("send-test success")
+		return
+	}
+
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGUSR1)
@@ -144,6 +318,8 @@ func main() {
 		}
 	}()
 
+	reloadOnHUP(app, mainLogger)
+
 	app.Loop()
 
 	mainLogger.Info("app stopped")
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/carbon"
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"github.com/lomik/carbon-clickhouse/uploader"
+	"go.uber.org/zap"
+)
+
+func TestConfigHandlerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "carbon-clickhouse.conf")
+	write := func(body string) {
+		if err := ioutil.WriteFile(filename, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("[clickhouse]\nthreads = 2\npassword = \"secret\"\nuser = \"default\"\n")
+	app := carbon.New(filename)
+	if err = app.ParseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Stop()
+
+	reloadOnHUP(app, zap.NewNop())
+	handler := configHandler(app)
+
+	get := func() (*carbon.ConfigStatus, string) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/admin/config", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d: %s", w.Code, w.Body.String())
+		}
+		var status carbon.ConfigStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return &status, w.Body.String()
+	}
+
+	threads := func(status *carbon.ConfigStatus) interface{} {
+		return status.Config["clickhouse"].(map[string]interface{})["threads"]
+	}
+
+	status, body := get()
+	if status.Generation != 1 || threads(status) != float64(2) {
+		t.Fatalf("%s", body)
+	}
+	if strings.Contains(body, "secret") {
+		t.Fatalf("password is not redacted: %s", body)
+	}
+
+	write("[clickhouse]\nthreads = 4\npassword = \"secret\"\nuser = \"default\"\n")
+	if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); status.Generation != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("config is not reloaded: %s", body)
+		}
+		status, body = get()
+	}
+	if threads(status) != float64(4) {
+		t.Fatalf("%s", body)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/admin/config", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("%d", w.Code)
+	}
+}
+
+func TestRequeueHandler(t *testing.T) {
+	var uploaded, uploadedHot int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch query := r.URL.Query().Get("query"); {
+		case strings.HasPrefix(query, "INSERT INTO graphite "):
+			atomic.AddInt32(&uploaded, int32(bytes.Count(body, []byte("requeue.metric."))))
+		case strings.HasPrefix(query, "INSERT INTO graphite_hot "):
+			atomic.AddInt32(&uploadedHot, int32(bytes.Count(body, []byte("requeue.metric."))))
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataPath, hotPath, deadLetterPath := path.Join(dir, "data"), path.Join(dir, "hot"), path.Join(dir, "dead-letter")
+	for _, p := range []string{dataPath, hotPath, uploader.DeadLetterDir(deadLetterPath, dataPath), uploader.DeadLetterDir(deadLetterPath, hotPath)} {
+		if err = os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// files failed before start, last one is file of table path
+	now := uint32(time.Now().Unix())
+	days := (&days1970.Days{}).TimestampWithNow(now, now)
+	for i := 0; i < 5; i++ {
+		wb := RowBinary.GetWriteBuffer()
+		for j := 0; j < 10; j++ {
+			wb.WriteGraphitePoint([]byte(fmt.Sprintf("requeue.metric.%d", j)), float64(j), now, days, now)
+		}
+		p := dataPath
+		if i == 4 {
+			p = hotPath
+		}
+		err = ioutil.WriteFile(path.Join(uploader.DeadLetterDir(deadLetterPath, p), fmt.Sprintf("default.%d", i+1)), wb.Bytes(), 0644)
+		wb.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// table with own data path
+	configFile := path.Join(dir, "carbon-clickhouse.conf")
+	config := fmt.Sprintf("[clickhouse]\ndata-tables = [\"graphite_hot\"]\n[clickhouse.table-options.graphite_hot]\ndata-path = %q\n", hotPath)
+	if err = ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	app := carbon.New(configFile)
+	if err = app.ParseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	app.Config.ClickHouse.Url = srv.URL
+	app.Config.Data.Path = dataPath
+	app.Config.Data.DeadLetterPath = deadLetterPath
+	app.Config.Tcp.Enabled = false
+	app.Config.Udp.Enabled = false
+	app.Config.Pickle.Enabled = false
+
+	if err = app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Stop()
+
+	handler := requeueHandler(app)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/admin/requeue-dead-letters", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"requeued":5}` {
+		t.Fatalf("%d: %s", w.Code, w.Body.String())
+	}
+
+	if err = app.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	// file of table path is uploaded only to own table
+	if n, hot := atomic.LoadInt32(&uploaded), atomic.LoadInt32(&uploadedHot); n != 40 || hot != 10 {
+		t.Fatalf("uploaded %d, to table of own path %d", n, hot)
+	}
+	for _, p := range []string{dataPath, hotPath} {
+		if files, _ := ioutil.ReadDir(uploader.DeadLetterDir(deadLetterPath, p)); len(files) != 0 {
+			t.Fatalf("%d files in dead letter path of %s", len(files), p)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/admin/requeue-dead-letters", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("%d", w.Code)
+	}
+}
@@ -1,20 +1,27 @@
 package carbon
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
 	"github.com/lomik/carbon-clickhouse/receiver"
 	"github.com/lomik/carbon-clickhouse/uploader"
 	"github.com/lomik/carbon-clickhouse/writer"
-	"github.com/lomik/zapwriter"
 )
 
 type App struct {
@@ -25,10 +32,23 @@ type App struct {
 	UDP            receiver.Receiver
 	TCP            receiver.Receiver
 	Pickle         receiver.Receiver
+	Ingest         receiver.Receiver
+	Namespaces     *receiver.Namespaces
+	Tenants        *receiver.Tenants
+	RateLimits     *receiver.RateLimits
+	Dedup          *receiver.Dedup
+	WAL            *receiver.WAL
+	Newest         *receiver.NewestTimestamp
+	Sharding       *receiver.Sharding
 	Collector      *Collector // (!!!) Should be re-created on every change config/modules
 	writeChan      chan *RowBinary.WriteBuffer
+	configHistory  []ConfigGenerationDiff  // last changes of config, generation of last item is current
+	preUploadPath  string                  // filename of loaded clickhouse.pre-upload-plugin
+	preUpload      RowBinary.TransformFunc // transform of loaded plugin
+	startTime      time.Time
 	exit           chan bool
 	ConfigFilename string
+	DryRunVerbose  bool // clickhouse.dry-run-verbose of command line, kept by reload
 }
 
 // New App instance
@@ -41,21 +61,252 @@ func New(configFilename string) *App {
 	return app
 }
 
+// checkClickHouseURL validates scheme, host and port of ClickHouse http url
+func checkClickHouseURL(dsn string) error {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme supports only http and https. %#v is unsupported", u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("host is required in %#v", dsn)
+	}
+
+	if port := u.Port(); port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("port %#v is invalid", port)
+		}
+	}
+
+	return nil
+}
+
+// urlCredentials returns true if ClickHouse url has user info or user, password parameters
+func urlCredentials(dsn string) bool {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return false
+	}
+	q := u.Query()
+	return u.User != nil || q.Get("user") != "" || q.Get("password") != ""
+}
+
+// checkCredentials validates users of Basic Auth. ClickHouse rejects request authenticated both by Basic Auth
+// and by url, so urls with credentials can't be used with users
+func checkCredentials(ch clickhouseConfig) error {
+	users := false
+	for _, c := range [][3]string{
+		{"", ch.User, ch.Password},
+		{"ddl-", ch.DDLUser, ch.DDLPassword},
+		{"dml-", ch.DMLUser, ch.DMLPassword},
+	} {
+		if c[1] == "" && c[2] != "" {
+			return fmt.Errorf("clickhouse.%spassword is set without clickhouse.%suser", c[0], c[0])
+		}
+		users = users || c[1] != ""
+	}
+	if !users {
+		return nil
+	}
+
+	if urlCredentials(ch.Url) {
+		return fmt.Errorf("clickhouse.url has credentials, they can't be used with clickhouse.user, ddl-user and dml-user")
+	}
+	for table, o := range ch.TableOptions {
+		if urlCredentials(o.Url) {
+			return fmt.Errorf("clickhouse.table-options.%s.url has credentials, they can't be used with clickhouse.user, ddl-user and dml-user", table)
+		}
+	}
+	return nil
+}
+
+// parseThreads returns starting count of tcp and udp parse goroutines and limits of auto scaling. 0 min is fixed count
+func parseThreads(c commonConfig) (threads int, min int, max int, err error) {
+	threads = runtime.GOMAXPROCS(-1) * 2
+
+	switch c.ParseThreads {
+	case "":
+		return threads, 0, 0, nil
+	case ParseThreadsAuto:
+		min, max = c.ParseThreadsMin, c.ParseThreadsMax
+		if max == 0 {
+			max = runtime.GOMAXPROCS(-1) * 8
+		}
+		if min <= 0 {
+			return 0, 0, 0, fmt.Errorf("common.parse-threads-min should be positive. %d is unsupported", c.ParseThreadsMin)
+		}
+		if max < min {
+			return 0, 0, 0, fmt.Errorf("common.parse-threads-max should be 0 or not less than parse-threads-min. %d is unsupported", c.ParseThreadsMax)
+		}
+		if threads < min {
+			threads = min
+		}
+		if threads > max {
+			threads = max
+		}
+		return threads, min, max, nil
+	}
+
+	threads, err = strconv.Atoi(c.ParseThreads)
+	if err != nil || threads <= 0 {
+		return 0, 0, 0, fmt.Errorf("common.parse-threads should be positive number or %#v. %#v is unsupported", ParseThreadsAuto, c.ParseThreads)
+	}
+	return threads, 0, 0, nil
+}
+
+// databaseName is valid value of clickhouse.database, database of "<db>.<table>" table names
+// and name of clickhouse.per-request-settings
+var databaseName = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+
+// clusterName is valid value of distributed-cluster, it is passed in string literal of system.clusters query
+var clusterName = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// checkDatabases validates clickhouse.database and databases of data tables
+func checkDatabases(ch clickhouseConfig) error {
+	if ch.Database != "" && !databaseName.MatchString(ch.Database) {
+		return fmt.Errorf("clickhouse.database should contain only [a-zA-Z0-9_]. %#v is unsupported", ch.Database)
+	}
+	for _, t := range append(append([]string{ch.DataTable}, ch.DataTables...), ch.ReverseDataTables...) {
+		if i := strings.Index(t, "."); i >= 0 && !databaseName.MatchString(t[:i]) {
+			return fmt.Errorf("database of table %#v should contain only [a-zA-Z0-9_]", t)
+		}
+	}
+	return nil
+}
+
+// valueTransforms compiles transforms of received values. Each transform has one of multiply-by or divide-by
+func valueTransforms(transforms []*transformConfig) ([]receiver.Transform, error) {
+	result := make([]receiver.Transform, 0, len(transforms))
+	for _, t := range transforms {
+		re, err := regexp.Compile(t.Match)
+		if err != nil {
+			return nil, fmt.Errorf("receiver.transforms.match %#v: %s", t.Match, err.Error())
+		}
+
+		var factor float64
+		switch {
+		case t.MultiplyBy != nil && t.DivideBy == nil:
+			factor = *t.MultiplyBy
+		case t.DivideBy != nil && t.MultiplyBy == nil:
+			if *t.DivideBy == 0 {
+				return nil, fmt.Errorf("receiver.transforms.divide-by of %#v should be non-zero", t.Match)
+			}
+			factor = 1 / *t.DivideBy
+		default:
+			return nil, fmt.Errorf("receiver.transforms of %#v should have one of multiply-by and divide-by", t.Match)
+		}
+
+		result = append(result, receiver.Transform{Match: re, Factor: factor})
+	}
+	return result, nil
+}
+
+// checkTenants validates names, prefixes and tables of tenants. Prefixes shouldn't overlap,
+// so each metric belongs to one tenant at most
+func checkTenants(tenants []*tenantConfig, ch clickhouseConfig) error {
+	dataTables := make(map[string]bool)
+	for _, t := range append(append([]string{ch.DataTable}, ch.DataTables...), ch.ReverseDataTables...) {
+		dataTables[t] = true
+	}
+
+	names := make(map[string]bool)
+	for i, t := range tenants {
+		if t.Name == "" || strings.ContainsAny(t.Name, ". ;") {
+			return fmt.Errorf("tenants.name should be non-empty without dots, spaces and semicolons. %#v is unsupported", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenant %#v is duplicated", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.Prefix == "" {
+			return fmt.Errorf("tenants.prefix of %#v is required", t.Name)
+		}
+		if t.DataTable == "" {
+			return fmt.Errorf("tenants.data-table of %#v is required", t.Name)
+		}
+		if dataTables[t.DataTable] {
+			return fmt.Errorf("tenants.data-table of %#v can't be clickhouse data or reverse data table. %#v is unsupported", t.Name, t.DataTable)
+		}
+		if t.MaxSeries < 0 {
+			return fmt.Errorf("tenants.max-series of %#v should be positive or 0. %d is unsupported", t.Name, t.MaxSeries)
+		}
+		if t.MaxMetricsPerSecond < 0 {
+			return fmt.Errorf("tenants.max-metrics-per-second of %#v should be positive or 0. %d is unsupported", t.Name, t.MaxMetricsPerSecond)
+		}
+
+		for _, other := range tenants[:i] {
+			if strings.HasPrefix(t.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, t.Prefix) {
+				return fmt.Errorf("prefixes of tenants %#v and %#v overlap", other.Name, t.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkSharding validates nodes of consistent hash ring
+func checkSharding(cfg shardingConfig) error {
+	if len(cfg.Nodes) == 0 {
+		return fmt.Errorf("sharding.nodes is required for %s mode", ShardingConsistentHash)
+	}
+
+	found := false
+	uniq := make(map[string]bool)
+	for _, node := range cfg.Nodes {
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			return fmt.Errorf("sharding.nodes: %s", err.Error())
+		}
+		if uniq[node] {
+			return fmt.Errorf("sharding.nodes contains duplicate %#v", node)
+		}
+		uniq[node] = true
+		if node == cfg.ThisNode {
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("sharding.this-node %#v is not found in sharding.nodes", cfg.ThisNode)
+	}
+
+	if cfg.PoolSize <= 0 {
+		return fmt.Errorf("sharding.pool-size should be positive. %d is unsupported", cfg.PoolSize)
+	}
+
+	return nil
+}
+
 // configure loads config from config file, schemas.conf, aggregation.conf
 func (app *App) configure() error {
 	cfg, err := ReadConfig(app.ConfigFilename)
 	if err != nil {
 		return err
 	}
+	if app.DryRunVerbose {
+		cfg.ClickHouse.DryRunVerbose = true
+	}
 
-	// carbon-cache prefix
-	if hostname, err := os.Hostname(); err == nil {
-		hostname = strings.Replace(hostname, ".", "_", -1)
-		cfg.Common.MetricPrefix = strings.Replace(cfg.Common.MetricPrefix, "{host}", hostname, -1)
-	} else {
-		cfg.Common.MetricPrefix = strings.Replace(cfg.Common.MetricPrefix, "{host}", "localhost", -1)
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	if cfg.Common.InstanceName == "" {
+		cfg.Common.InstanceName = hostname
+	}
+	if strings.ContainsAny(cfg.Common.InstanceName, "/ \t\r\n") {
+		return fmt.Errorf("common.instance-name %#v should not contain slash or whitespace", cfg.Common.InstanceName)
 	}
 
+	// carbon-cache prefix
+	cfg.Common.MetricPrefix = strings.Replace(cfg.Common.MetricPrefix, "{host}", strings.Replace(hostname, ".", "_", -1), -1)
+	cfg.Common.MetricPrefix = strings.Replace(cfg.Common.MetricPrefix, "{instance}", strings.Replace(cfg.Common.InstanceName, ".", "_", -1), -1)
+
 	if cfg.Common.MetricEndpoint == "" {
 		cfg.Common.MetricEndpoint = MetricEndpointLocal
 	}
@@ -72,6 +323,455 @@ func (app *App) configure() error {
 		}
 	}
 
+	if cfg.ClickHouse.InsertFormat != RowBinary.FormatRowBinary &&
+		cfg.ClickHouse.InsertFormat != RowBinary.FormatRowBinaryWithNamesAndTypes {
+		return fmt.Errorf("clickhouse.insert-format supports only %s and %s. %#v is unsupported",
+			RowBinary.FormatRowBinary, RowBinary.FormatRowBinaryWithNamesAndTypes, cfg.ClickHouse.InsertFormat)
+	}
+
+	if cfg.ClickHouse.HTTP2 {
+		u, err := url.Parse(cfg.ClickHouse.Url)
+		if err != nil {
+			return fmt.Errorf("clickhouse.url parse error: %s", err.Error())
+		}
+
+		if u.Scheme != "https" {
+			return fmt.Errorf("clickhouse.http2 requires https url. %#v is unsupported", u.Scheme)
+		}
+	}
+
+	switch cfg.ClickHouse.UploadOrder {
+	case uploader.UploadOrderOldestFirst, uploader.UploadOrderNewestFirst, uploader.UploadOrderRoundRobin:
+		// pass
+	default:
+		return fmt.Errorf("clickhouse.upload-order supports only %s, %s and %s. %#v is unsupported",
+			uploader.UploadOrderOldestFirst, uploader.UploadOrderNewestFirst, uploader.UploadOrderRoundRobin,
+			cfg.ClickHouse.UploadOrder)
+	}
+
+	for table, o := range cfg.ClickHouse.TableOptions {
+		switch o.DateColumnType {
+		case "", RowBinary.DateTypeDate, RowBinary.DateTypeDate32, RowBinary.DateTypeDateTime:
+			// pass
+		default:
+			return fmt.Errorf("clickhouse.table-options.%s.date-column-type supports only %s, %s and %s. %#v is unsupported",
+				table, RowBinary.DateTypeDate, RowBinary.DateTypeDate32, RowBinary.DateTypeDateTime, o.DateColumnType)
+		}
+
+		if o.TableEngine != "" && o.TableEngine != uploader.EngineAggregatingMergeTree {
+			return fmt.Errorf("clickhouse.table-options.%s.table-engine supports only %s. %#v is unsupported",
+				table, uploader.EngineAggregatingMergeTree, o.TableEngine)
+		}
+
+		if o.Url != "" {
+			if err := checkClickHouseURL(o.Url); err != nil {
+				return fmt.Errorf("clickhouse.table-options.%s.url: %s", table, err.Error())
+			}
+		}
+
+		if o.ShardKey != "" && o.Cluster == "" {
+			return fmt.Errorf("clickhouse.table-options.%s.distributed-sharding-key requires distributed-cluster", table)
+		}
+
+		if o.Cluster != "" && !clusterName.MatchString(o.Cluster) {
+			return fmt.Errorf("clickhouse.table-options.%s.distributed-cluster should contain only [a-zA-Z0-9_-]. %#v is unsupported",
+				table, o.Cluster)
+		}
+
+		if o.DataPath != "" {
+			isDataTable := false
+			for _, t := range append(append([]string{cfg.ClickHouse.DataTable}, cfg.ClickHouse.DataTables...), cfg.ClickHouse.ReverseDataTables...) {
+				isDataTable = isDataTable || t == table
+			}
+			if !isDataTable {
+				return fmt.Errorf("clickhouse.table-options.%s.data-path is supported only by data and reverse data tables", table)
+			}
+			if cfg.Data.Backend != DataBackendFile {
+				return fmt.Errorf("clickhouse.table-options.%s.data-path requires data.backend %s", table, DataBackendFile)
+			}
+			if p := path.Clean(o.DataPath); p == path.Clean(cfg.Data.Path) || (cfg.Data.DeadLetterPath != "" && p == path.Clean(cfg.Data.DeadLetterPath)) {
+				return fmt.Errorf("clickhouse.table-options.%s.data-path should differ from data.path and data.dead-letter-path", table)
+			}
+		}
+
+		if o.FallbackTable != "" {
+			for _, t := range append(append([]string{cfg.ClickHouse.DataTable}, cfg.ClickHouse.DataTables...), cfg.ClickHouse.ReverseDataTables...) {
+				if o.FallbackTable == t {
+					return fmt.Errorf("clickhouse.table-options.%s.fallback-table can't be data or reverse data table. %#v is unsupported", table, o.FallbackTable)
+				}
+			}
+		}
+	}
+
+	if t := cfg.ClickHouse.TagsIndexTable; t != "" {
+		for _, other := range append(append([]string{cfg.ClickHouse.DataTable, cfg.ClickHouse.TreeTable, cfg.ClickHouse.ReverseTreeTable},
+			cfg.ClickHouse.DataTables...), cfg.ClickHouse.ReverseDataTables...) {
+			if t == other {
+				return fmt.Errorf("clickhouse.tags-index-table can't be data or tree table. %#v is unsupported", t)
+			}
+		}
+	}
+
+	for _, k := range uploader.ReservedQuerySettings {
+		if _, exists := cfg.ClickHouse.QuerySettings[k]; exists {
+			return fmt.Errorf("clickhouse.query-settings can't override %#v", k)
+		}
+		if _, exists := cfg.ClickHouse.TreeQuerySettings[k]; exists {
+			return fmt.Errorf("clickhouse.tree-query-settings can't override %#v", k)
+		}
+		if _, exists := cfg.ClickHouse.RequestSettings[k]; exists {
+			return fmt.Errorf("clickhouse.per-request-settings can't override %#v", k)
+		}
+	}
+
+	if cfg.ClickHouse.AsyncInsertWait {
+		for k := range uploader.AsyncInsertSettings {
+			if _, exists := cfg.ClickHouse.QuerySettings[k]; exists {
+				return fmt.Errorf("clickhouse.query-settings can't override %#v of async-insert-wait-end-of-query", k)
+			}
+			if _, exists := cfg.ClickHouse.TreeQuerySettings[k]; exists {
+				return fmt.Errorf("clickhouse.tree-query-settings can't override %#v of async-insert-wait-end-of-query", k)
+			}
+			if _, exists := cfg.ClickHouse.RequestSettings[k]; exists {
+				return fmt.Errorf("clickhouse.per-request-settings can't override %#v of async-insert-wait-end-of-query", k)
+			}
+		}
+	}
+
+	if cfg.ClickHouse.AsyncConfirm.Value() < 0 {
+		return fmt.Errorf("clickhouse.async-insert-confirm-interval should be positive or 0. %s is unsupported", cfg.ClickHouse.AsyncConfirm.Value())
+	}
+
+	for k := range cfg.ClickHouse.RequestSettings {
+		if !databaseName.MatchString(k) {
+			return fmt.Errorf("clickhouse.per-request-settings: invalid setting name %#v", k)
+		}
+		if _, exists := cfg.ClickHouse.QuerySettings[k]; exists {
+			return fmt.Errorf("clickhouse.per-request-settings can't override %#v of clickhouse.query-settings", k)
+		}
+		if _, exists := cfg.ClickHouse.TreeQuerySettings[k]; exists {
+			return fmt.Errorf("clickhouse.per-request-settings can't override %#v of clickhouse.tree-query-settings", k)
+		}
+	}
+
+	if cfg.Common.MaxMetricDepth < 0 {
+		return fmt.Errorf("common.max-metric-depth should be positive or 0. %d is unsupported", cfg.Common.MaxMetricDepth)
+	}
+
+	if cfg.Common.MaxOpenFiles < 0 {
+		return fmt.Errorf("common.max-open-files should be positive or 0. %d is unsupported", cfg.Common.MaxOpenFiles)
+	}
+
+	if cfg.Common.MaxMetricDepthWarn < 0 {
+		return fmt.Errorf("common.max-metric-depth-warn should be positive or 0. %d is unsupported", cfg.Common.MaxMetricDepthWarn)
+	}
+
+	for _, c := range cfg.Common.SanitizeReplacement {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return fmt.Errorf("common.sanitize-replacement should contain only [a-zA-Z0-9_-]. %#v is unsupported", cfg.Common.SanitizeReplacement)
+		}
+	}
+
+	if cfg.Prometheus.PushGatewayURL != "" {
+		if err := checkClickHouseURL(cfg.Prometheus.PushGatewayURL); err != nil {
+			return fmt.Errorf("prometheus.pushgateway-url: %s", err.Error())
+		}
+	}
+
+	if err := checkDatabases(cfg.ClickHouse); err != nil {
+		return err
+	}
+
+	if err := checkTenants(cfg.Tenants, cfg.ClickHouse); err != nil {
+		return err
+	}
+
+	if _, err := valueTransforms(cfg.Receiver.Transforms); err != nil {
+		return err
+	}
+
+	if cfg.Receiver.DedupWindow.Value() < 0 {
+		return fmt.Errorf("receiver.dedup-window should be positive or 0. %s is unsupported", cfg.Receiver.DedupWindow.Value())
+	}
+
+	if cfg.Receiver.DedupMaxSize <= 0 {
+		return fmt.Errorf("receiver.dedup-max-size should be positive. %d is unsupported", cfg.Receiver.DedupMaxSize)
+	}
+
+	if cfg.Receiver.WALEnabled {
+		if cfg.Data.Backend != DataBackendFile {
+			return fmt.Errorf("receiver.wal-enabled is supported only with data.backend %s", DataBackendFile)
+		}
+		if cfg.Receiver.WALPath == "" {
+			return fmt.Errorf("receiver.wal-path should be set")
+		}
+		if cfg.Receiver.WALSizeBytes < receiver.WALMinSize {
+			return fmt.Errorf("receiver.wal-size-bytes should be at least %d. %d is unsupported", receiver.WALMinSize, cfg.Receiver.WALSizeBytes)
+		}
+	}
+
+	if _, _, _, err := parseThreads(cfg.Common); err != nil {
+		return err
+	}
+
+	if err := checkCredentials(cfg.ClickHouse); err != nil {
+		return err
+	}
+
+	if cfg.ClickHouse.SessionIDEnabled && cfg.ClickHouse.Threads != 1 {
+		return fmt.Errorf("clickhouse.session-id-enabled requires 1 clickhouse.threads, concurrent queries of session are rejected. %d is unsupported", cfg.ClickHouse.Threads)
+	}
+
+	if cfg.Common.DrainTimeout.Value() <= 0 {
+		return fmt.Errorf("common.drain-timeout should be positive. %s is unsupported", cfg.Common.DrainTimeout.Value())
+	}
+
+	if cfg.Common.IngestTimeout.Value() < 0 {
+		return fmt.Errorf("common.ingest-timeout should be positive or 0. %s is unsupported", cfg.Common.IngestTimeout.Value())
+	}
+
+	if cfg.ClickHouse.RetryMinBackoff.Value() <= 0 {
+		return fmt.Errorf("clickhouse.retry-min-backoff should be positive. %s is unsupported", cfg.ClickHouse.RetryMinBackoff.Value())
+	}
+
+	if cfg.ClickHouse.RetryMaxBackoff.Value() < cfg.ClickHouse.RetryMinBackoff.Value() {
+		return fmt.Errorf("clickhouse.retry-max-backoff should be greater than or equal to clickhouse.retry-min-backoff. %s is unsupported",
+			cfg.ClickHouse.RetryMaxBackoff.Value())
+	}
+
+	for name, d := range map[string]*Duration{
+		"connect-timeout":     cfg.ClickHouse.ConnectTimeout,
+		"write-timeout":       cfg.ClickHouse.WriteTimeout,
+		"read-timeout":        cfg.ClickHouse.ReadTimeout,
+		"upload-retry-budget": cfg.ClickHouse.RetryBudget,
+	} {
+		if d.Value() < 0 {
+			return fmt.Errorf("clickhouse.%s should be positive or 0. %s is unsupported", name, d.Value())
+		}
+	}
+
+	if cfg.ClickHouse.RetryBudget.Value() > 0 && cfg.Data.DeadLetterPath == "" {
+		return fmt.Errorf("clickhouse.upload-retry-budget requires data.dead-letter-path")
+	}
+
+	if cfg.ClickHouse.AllowErrorsNum < 0 {
+		return fmt.Errorf("clickhouse.allow-insert-errors-num should be positive or 0. %d is unsupported", cfg.ClickHouse.AllowErrorsNum)
+	}
+
+	if cfg.ClickHouse.AllowErrorsRatio < 0 || cfg.ClickHouse.AllowErrorsRatio > 1 {
+		return fmt.Errorf("clickhouse.allow-insert-errors-ratio should be in range [0, 1]. %v is unsupported", cfg.ClickHouse.AllowErrorsRatio)
+	}
+
+	// input_format_allow_errors settings are applied by ClickHouse to text formats only
+	if (cfg.ClickHouse.AllowErrorsNum != 0 || cfg.ClickHouse.AllowErrorsRatio != 0) &&
+		strings.HasPrefix(cfg.ClickHouse.InsertFormat, RowBinary.FormatRowBinary) {
+		return fmt.Errorf("clickhouse.allow-insert-errors-num and clickhouse.allow-insert-errors-ratio are ignored by ClickHouse with %s clickhouse.insert-format. %d and %v are unsupported",
+			cfg.ClickHouse.InsertFormat, cfg.ClickHouse.AllowErrorsNum, cfg.ClickHouse.AllowErrorsRatio)
+	}
+
+	if cfg.ClickHouse.UploadChunkSize < 0 {
+		return fmt.Errorf("clickhouse.upload-chunk-size should be positive or 0. %d is unsupported", cfg.ClickHouse.UploadChunkSize)
+	}
+
+	if cfg.ClickHouse.TreeBatchSize < 0 {
+		return fmt.Errorf("clickhouse.tree-insert-batch-size should be positive or 0. %d is unsupported", cfg.ClickHouse.TreeBatchSize)
+	}
+
+	if cfg.ClickHouse.ReadAheadBuffers < 0 {
+		return fmt.Errorf("clickhouse.upload-read-ahead-buffers should be positive or 0. %d is unsupported", cfg.ClickHouse.ReadAheadBuffers)
+	}
+
+	if cfg.ClickHouse.MaxInsertBlock < 0 {
+		return fmt.Errorf("clickhouse.max-insert-block-size should be positive or 0. %d is unsupported", cfg.ClickHouse.MaxInsertBlock)
+	}
+
+	if cfg.ClickHouse.ZooKeeperPath != "" && !strings.Contains(cfg.ClickHouse.ZooKeeperPath, "{table}") {
+		return fmt.Errorf("clickhouse.zookeeper-path-template should contain {table}. %#v is unsupported", cfg.ClickHouse.ZooKeeperPath)
+	}
+
+	if cfg.ClickHouse.PipelineDepth < 1 || cfg.ClickHouse.PipelineDepth > uploader.MaxUploadPipelineDepth {
+		return fmt.Errorf("clickhouse.upload-pipeline-depth should be in range [1, %d]. %d is unsupported",
+			uploader.MaxUploadPipelineDepth, cfg.ClickHouse.PipelineDepth)
+	}
+
+	if cfg.ClickHouse.SessionIDEnabled && cfg.ClickHouse.PipelineDepth != 1 {
+		return fmt.Errorf("clickhouse.session-id-enabled requires 1 clickhouse.upload-pipeline-depth, concurrent queries of session are rejected. %d is unsupported", cfg.ClickHouse.PipelineDepth)
+	}
+
+	if cfg.ClickHouse.DryRunVerbose && cfg.ClickHouse.DryRunMaxRows <= 0 {
+		return fmt.Errorf("clickhouse.dry-run-max-rows should be positive. %d is unsupported", cfg.ClickHouse.DryRunMaxRows)
+	}
+
+	if cfg.ClickHouse.MaxResponseSize <= 0 {
+		return fmt.Errorf("clickhouse.max-response-size should be positive. %d is unsupported", cfg.ClickHouse.MaxResponseSize)
+	}
+
+	if cfg.ClickHouse.CheckMutations && cfg.ClickHouse.MutationInterval.Value() <= 0 {
+		return fmt.Errorf("clickhouse.mutation-check-interval should be positive. %s is unsupported", cfg.ClickHouse.MutationInterval.Value())
+	}
+
+	if cfg.ClickHouse.MutationWarn < 0 {
+		return fmt.Errorf("clickhouse.mutation-warn-threshold should be positive or 0. %d is unsupported", cfg.ClickHouse.MutationWarn)
+	}
+
+	if cfg.ClickHouse.ScanInterval.Value() <= 0 {
+		return fmt.Errorf("clickhouse.scan-interval should be positive. %s is unsupported", cfg.ClickHouse.ScanInterval.Value())
+	}
+
+	switch cfg.Pickle.Format {
+	case receiver.PickleFormatAuto, receiver.PickleFormatLegacy, receiver.PickleFormatModern:
+		// pass
+	default:
+		return fmt.Errorf("pickle.pickle-format supports only %s, %s and %s. %#v is unsupported",
+			receiver.PickleFormatAuto, receiver.PickleFormatLegacy, receiver.PickleFormatModern, cfg.Pickle.Format)
+	}
+
+	if cfg.Pickle.MaxBatchSize < 0 {
+		return fmt.Errorf("pickle.max-pickle-batch-size should be positive or 0. %d is unsupported", cfg.Pickle.MaxBatchSize)
+	}
+
+	if cfg.Tcp.MaxLineBufferBytes <= 0 {
+		return fmt.Errorf("tcp.max-line-buffer-bytes should be positive. %d is unsupported", cfg.Tcp.MaxLineBufferBytes)
+	}
+
+	if cfg.Stats.NamespaceDepth < 0 {
+		return fmt.Errorf("stats.namespace-depth should be positive or 0. %d is unsupported", cfg.Stats.NamespaceDepth)
+	}
+
+	if cfg.Stats.NamespaceDepth > 0 && cfg.Stats.MaxNamespaceEntries <= 0 {
+		return fmt.Errorf("stats.max-namespace-entries should be positive. %d is unsupported", cfg.Stats.MaxNamespaceEntries)
+	}
+
+	if cfg.RateLimit.Enabled {
+		if cfg.RateLimit.GlobalRate < 0 {
+			return fmt.Errorf("rate-limit.global-rate should be positive or 0. %d is unsupported", cfg.RateLimit.GlobalRate)
+		}
+		if cfg.RateLimit.NamespaceRate < 0 {
+			return fmt.Errorf("rate-limit.namespace-rate should be positive or 0. %d is unsupported", cfg.RateLimit.NamespaceRate)
+		}
+		if cfg.RateLimit.NamespaceDepth <= 0 {
+			return fmt.Errorf("rate-limit.namespace-depth should be positive. %d is unsupported", cfg.RateLimit.NamespaceDepth)
+		}
+		if cfg.RateLimit.MaxNamespaces < 0 {
+			return fmt.Errorf("rate-limit.max-namespaces should be positive or 0. %d is unsupported", cfg.RateLimit.MaxNamespaces)
+		}
+		if cfg.RateLimit.IdleTTL.Value() < 0 {
+			return fmt.Errorf("rate-limit.namespace-idle-ttl should be positive or 0. %s is unsupported", cfg.RateLimit.IdleTTL.Value())
+		}
+	}
+
+	switch cfg.Data.Backend {
+	case DataBackendFile, DataBackendMemory:
+		// pass
+	default:
+		return fmt.Errorf("data.backend supports only %s and %s. %#v is unsupported",
+			DataBackendFile, DataBackendMemory, cfg.Data.Backend)
+	}
+
+	if cfg.Data.WriterConcurrency < 1 {
+		return fmt.Errorf("data.writer-concurrency should be positive. %d is unsupported", cfg.Data.WriterConcurrency)
+	}
+
+	if cfg.Data.MaxPendingFiles < 0 {
+		return fmt.Errorf("data.max-pending-files should be positive or 0. %d is unsupported", cfg.Data.MaxPendingFiles)
+	}
+
+	if cfg.Data.MaxPendingFiles > 0 && cfg.Data.MaxFileInterval.Value() < cfg.Data.FileInterval.Value() {
+		return fmt.Errorf("data.max-file-interval should be greater than or equal to data.chunk-interval. %s is unsupported",
+			cfg.Data.MaxFileInterval.Value())
+	}
+
+	if cfg.Data.DeadLetterPath != "" && path.Clean(cfg.Data.DeadLetterPath) == path.Clean(cfg.Data.Path) {
+		return fmt.Errorf("data.dead-letter-path should differ from data.path")
+	}
+
+	switch cfg.Sharding.Mode {
+	case "":
+		// pass
+	case ShardingConsistentHash:
+		if err := checkSharding(cfg.Sharding); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("sharding.mode supports only %s or empty value. %#v is unsupported",
+			ShardingConsistentHash, cfg.Sharding.Mode)
+	}
+
+	switch cfg.ClickHouse.ServiceDiscovery.Backend {
+	case "":
+		// pass
+	case ServiceDiscoveryConsul:
+		sd := cfg.ClickHouse.ServiceDiscovery
+		if sd.ServiceName == "" {
+			return fmt.Errorf("clickhouse.service-discovery.service-name is required for consul backend")
+		}
+		if err := checkClickHouseURL(sd.ConsulAddr); err != nil {
+			return fmt.Errorf("clickhouse.service-discovery.consul-addr: %s", err.Error())
+		}
+		if sd.RefreshInterval.Value() <= 0 {
+			return fmt.Errorf("clickhouse.service-discovery.refresh-interval should be positive. %s is unsupported", sd.RefreshInterval.Value())
+		}
+	default:
+		return fmt.Errorf("clickhouse.service-discovery.backend supports only %s or empty value. %#v is unsupported",
+			ServiceDiscoveryConsul, cfg.ClickHouse.ServiceDiscovery.Backend)
+	}
+
+	switch cfg.TreeCache.Backend {
+	case TreeCacheLocal:
+		// pass
+	case TreeCacheRedis:
+		if len(cfg.TreeCache.RedisAddr) == 0 {
+			return fmt.Errorf("tree-cache.redis-addr is required for redis backend")
+		}
+		if cfg.TreeCache.CheckTimeout.Value() <= 0 {
+			return fmt.Errorf("tree-cache.check-timeout should be positive. %s is unsupported", cfg.TreeCache.CheckTimeout.Value())
+		}
+		if cfg.TreeCache.CheckMaxRetries < 0 {
+			return fmt.Errorf("tree-cache.check-max-retries should be positive or 0. %d is unsupported", cfg.TreeCache.CheckMaxRetries)
+		}
+	default:
+		return fmt.Errorf("tree-cache.backend supports only %s and %s. %#v is unsupported",
+			TreeCacheLocal, TreeCacheRedis, cfg.TreeCache.Backend)
+	}
+
+	switch cfg.Receiver.NameValidation {
+	case receiver.NameValidationOff, receiver.NameValidationWarn, receiver.NameValidationStrict:
+		// pass
+	default:
+		return fmt.Errorf("receiver.name-validation supports only %s, %s and %s. %#v is unsupported",
+			receiver.NameValidationOff, receiver.NameValidationWarn, receiver.NameValidationStrict, cfg.Receiver.NameValidation)
+	}
+
+	if app.Config != nil && cfg.Hash() == app.Config.Hash() && cfg.sameSecrets(app.Config) {
+		return ErrConfigUnchanged
+	}
+
+	// plugin can't be unloaded, it's loaded again only with new path
+	if cfg.ClickHouse.PreUploadPlugin != app.preUploadPath {
+		var transform RowBinary.TransformFunc
+		if cfg.ClickHouse.PreUploadPlugin != "" {
+			var err error
+			if transform, err = uploader.LoadPreUploadPlugin(cfg.ClickHouse.PreUploadPlugin); err != nil {
+				return fmt.Errorf("clickhouse.pre-upload-plugin %s load failed: %s", cfg.ClickHouse.PreUploadPlugin, err)
+			}
+		}
+		app.preUploadPath, app.preUpload = cfg.ClickHouse.PreUploadPlugin, transform
+	}
+
+	generation := ConfigGenerationDiff{Generation: 1, Changes: []ConfigChange{}}
+	if n := len(app.configHistory); n > 0 {
+		generation.Generation = app.configHistory[n-1].Generation + 1
+	}
+	if app.Config != nil {
+		if changes := Diff(*app.Config, *cfg); changes != nil {
+			generation.Changes = changes
+		}
+	}
+	app.configHistory = append(app.configHistory, generation)
+	if len(app.configHistory) > ConfigHistorySize {
+		app.configHistory = app.configHistory[len(app.configHistory)-ConfigHistorySize:]
+	}
+
 	app.Config = cfg
 
 	return nil
@@ -82,34 +782,72 @@ func (app *App) ParseConfig() error {
 	app.Lock()
 	defer app.Unlock()
 
-	return app.configure()
+	if err := app.configure(); err != ErrConfigUnchanged {
+		return err
+	}
+	return nil
 }
 
-// // ReloadConfig reloads some settings from config
-// func (app *App) ReloadConfig() error {
-// 	app.Lock()
-// 	defer app.Unlock()
+// ReloadConfig reloads some settings from config: clickhouse connection and tables, internal metrics.
+// Returns ErrConfigUnchanged without reload if config file is not changed
+func (app *App) ReloadConfig() error {
+	app.Lock()
+	defer app.Unlock()
+
+	var err error
+	if err = app.configure(); err != nil {
+		return err
+	}
+
+	logger := logging.Logger("app")
+	last := app.configHistory[len(app.configHistory)-1]
+	for _, c := range last.Changes {
+		logger.Info("config changed",
+			zap.Int("generation", last.Generation),
+			zap.String("field", c.Field),
+			zap.Any("old", c.OldValue),
+			zap.Any("new", c.NewValue),
+		)
+	}
 
-// 	var err error
-// 	if err = app.configure(); err != nil {
-// 		return err
-// 	}
+	if app.Uploader != nil {
+		app.Uploader.Reconfigure(app.uploaderOptions()...)
+	}
 
-// 	// TODO: reload something?
+	if app.Collector != nil {
+		app.Collector.Stop()
+		app.Collector = nil
+	}
 
-// 	if app.Collector != nil {
-// 		app.Collector.Stop()
-// 		app.Collector = nil
-// 	}
+	app.Collector = NewCollector(app.collectorConfig())
 
-// 	app.Collector = NewCollector(app)
+	return nil
+}
+
+// ConfigDiff returns changes of config generation against previous generation. Generation is incremented
+// by each successful parse and reload of config, changes of first generation are empty. 0 is current generation
+func (app *App) ConfigDiff(generation int) (*ConfigGenerationDiff, error) {
+	app.RLock()
+	defer app.RUnlock()
 
-// 	return nil
-// }
+	if len(app.configHistory) == 0 {
+		return nil, errors.New("config is not parsed")
+	}
+	if generation == 0 {
+		generation = app.configHistory[len(app.configHistory)-1].Generation
+	}
+
+	for _, g := range app.configHistory {
+		if g.Generation == generation {
+			return &g, nil
+		}
+	}
+	return nil, fmt.Errorf("config generation %d is not found", generation)
+}
 
 // Stop all socket listeners
 func (app *App) stopListeners() {
-	logger := zapwriter.Logger("app")
+	logger := logging.Logger("app")
 
 	if app.TCP != nil {
 		app.TCP.Stop()
@@ -128,31 +866,89 @@ func (app *App) stopListeners() {
 		app.UDP = nil
 		logger.Debug("finished", zap.String("module", "udp"))
 	}
+
+	if app.Ingest != nil {
+		app.Ingest.Stop()
+		app.Ingest = nil
+		logger.Debug("finished", zap.String("module", "ingest"))
+	}
 }
 
-func (app *App) stopAll() {
-	logger := zapwriter.Logger("app")
+// shutdownGraph returns stop functions of components with dependencies between them
+func (app *App) shutdownGraph() *shutdownGraph {
+	logger := logging.Logger("app")
+	g := newShutdownGraph()
 
-	app.stopListeners()
+	g.add("receivers", app.stopListeners)
 
-	if app.Collector != nil {
-		app.Collector.Stop()
-		app.Collector = nil
-		logger.Debug("finished", zap.String("module", "collector"))
-	}
+	// collector reads stat of all other modules
+	g.add("collector", func() {
+		if app.Collector != nil {
+			app.Collector.Stop()
+			app.Collector = nil
+			logger.Debug("finished", zap.String("module", "collector"))
+		}
+	})
 
-	if app.Writer != nil {
-		app.Writer.Stop()
-		app.Writer = nil
-		logger.Debug("finished", zap.String("module", "writer"))
+	// receivers push to writeChan and forward to sharding nodes
+	g.add("writer", func() {
+		if app.Writer != nil {
+			app.Writer.Stop()
+			app.Writer = nil
+			logger.Debug("finished", zap.String("module", "writer"))
+		}
+	}, "receivers", "collector")
+
+	// wal acknowledges buffers on close of files by writer
+	g.add("wal", func() {
+		if app.WAL != nil {
+			app.WAL.Stop()
+			app.WAL = nil
+			logger.Debug("finished", zap.String("module", "wal"))
+		}
+	}, "writer", "collector")
+
+	g.add("uploader", func() {
+		if app.Uploader != nil {
+			app.Uploader.Stop()
+			app.Uploader = nil
+			logger.Debug("finished", zap.String("module", "uploader"))
+		}
+	}, "writer", "collector")
+
+	g.add("sharding", func() {
+		if app.Sharding != nil {
+			app.Sharding.Stop()
+			app.Sharding = nil
+			logger.Debug("finished", zap.String("module", "sharding"))
+		}
+	}, "receivers", "collector")
+
+	return g
+}
+
+func (app *App) stopAll() {
+	logger := logging.Logger("app")
+
+	g := app.shutdownGraph()
+	order, err := g.order()
+	if err != nil {
+		// checked on start
+		logger.Error("shutdown order failed", zap.Error(err))
+		order = g.names
 	}
 
-	if app.Uploader != nil {
-		app.Uploader.Stop()
-		app.Uploader = nil
-		logger.Debug("finished", zap.String("module", "uploader"))
+	for _, name := range order {
+		g.stop[name]()
 	}
 
+	app.Namespaces = nil
+	app.Tenants = nil
+	app.RateLimits = nil
+	app.Dedup = nil
+	app.Newest = nil
+	app.startTime = time.Time{}
+
 	if app.exit != nil {
 		close(app.exit)
 		app.exit = nil
@@ -167,33 +963,23 @@ func (app *App) Stop() {
 	app.stopAll()
 }
 
-// Start starts
-func (app *App) Start() (err error) {
-	app.Lock()
-	defer app.Unlock()
-
-	defer func() {
-		if err != nil {
-			app.stopAll()
+// tablePaths returns cleaned data paths of tables by name
+func (app *App) tablePaths() map[string]string {
+	// app locked by caller
+	paths := make(map[string]string)
+	for table, o := range app.Config.ClickHouse.TableOptions {
+		if o.DataPath != "" {
+			paths[table] = path.Clean(o.DataPath)
 		}
-	}()
+	}
+	return paths
+}
 
+// uploaderOptions returns options which can be changed by Uploader.Reconfigure
+func (app *App) uploaderOptions() []uploader.Option {
+	// app locked by caller
 	conf := app.Config
 
-	runtime.GOMAXPROCS(conf.Common.MaxCPU)
-
-	app.writeChan = make(chan *RowBinary.WriteBuffer)
-
-	/* WRITER start */
-	app.Writer = writer.New(
-		app.writeChan,
-		conf.Data.Path,
-		conf.Data.FileInterval.Value(),
-	)
-	app.Writer.Start()
-	/* WRITER end */
-
-	/* UPLOADER start */
 	dataTables := conf.ClickHouse.DataTables
 	if dataTables == nil {
 		dataTables = make([]string, 0)
@@ -217,28 +1003,371 @@ func (app *App) Start() (err error) {
 		reverseDataTables = make([]string, 0)
 	}
 
-	app.Uploader = uploader.New(
-		uploader.Path(conf.Data.Path),
+	tenantTables := make(map[string][]string)
+	for _, t := range conf.Tenants {
+		tenantTables[t.DataTable] = append(tenantTables[t.DataTable], t.Prefix)
+	}
+
+	var mutationCheckInterval time.Duration
+	if conf.ClickHouse.CheckMutations {
+		mutationCheckInterval = conf.ClickHouse.MutationInterval.Value()
+	}
+
+	var dryRunRows int
+	if conf.ClickHouse.DryRunVerbose {
+		dryRunRows = conf.ClickHouse.DryRunMaxRows
+	}
+
+	// credentials of operation fall back to common user
+	ddlUser, ddlPassword := conf.ClickHouse.DDLUser, conf.ClickHouse.DDLPassword
+	if ddlUser == "" {
+		ddlUser, ddlPassword = conf.ClickHouse.User, conf.ClickHouse.Password
+	}
+	dmlUser, dmlPassword := conf.ClickHouse.DMLUser, conf.ClickHouse.DMLPassword
+	if dmlUser == "" {
+		dmlUser, dmlPassword = conf.ClickHouse.User, conf.ClickHouse.Password
+	}
+
+	tableOptions := make(map[string]uploader.TableOptions)
+	for table, o := range conf.ClickHouse.TableOptions {
+		tableOptions[table] = uploader.TableOptions{
+			DateColumn:     o.DateColumn,
+			DateColumnType: o.DateColumnType,
+			Engine:         o.TableEngine,
+			ValueFunction:  o.ValueFunction,
+			URL:            o.Url,
+			ShardKeyColumn: o.ShardKey,
+			Cluster:        o.Cluster,
+			FallbackTable:  o.FallbackTable,
+		}
+	}
+
+	return []uploader.Option{
 		uploader.ClickHouse(conf.ClickHouse.Url),
+		uploader.Database(conf.ClickHouse.Database),
+		uploader.DDLCredentials(ddlUser, ddlPassword),
+		uploader.DMLCredentials(dmlUser, dmlPassword),
+		uploader.SessionID(conf.ClickHouse.SessionIDEnabled),
+		uploader.PreUploadTransform(app.preUpload),
 		uploader.DataTables(dataTables),
 		uploader.ReverseDataTables(reverseDataTables),
+		uploader.TenantTables(tenantTables),
+		uploader.DataTableOptions(tableOptions),
 		uploader.DataTimeout(conf.ClickHouse.DataTimeout.Value()),
+		uploader.ConnectTimeout(conf.ClickHouse.ConnectTimeout.Value()),
+		uploader.WriteTimeout(conf.ClickHouse.WriteTimeout.Value()),
+		uploader.ReadTimeout(conf.ClickHouse.ReadTimeout.Value()),
 		uploader.TreeTable(conf.ClickHouse.TreeTable),
 		uploader.ReverseTreeTable(conf.ClickHouse.ReverseTreeTable),
+		uploader.TagsIndexTable(conf.ClickHouse.TagsIndexTable),
 		uploader.TreeDate(conf.ClickHouse.TreeDate),
+		uploader.TreeDateLocation(conf.ClickHouse.TreeDateLocation),
 		uploader.TreeTimeout(conf.ClickHouse.TreeTimeout.Value()),
-		uploader.InProgressCallback(app.Writer.IsInProgress),
-		uploader.Threads(app.Config.ClickHouse.Threads),
+		uploader.TreeInsertBatch(conf.ClickHouse.TreeBatchSize, conf.ClickHouse.TreeBatchDelay.Value()),
+		uploader.QuerySettings(conf.ClickHouse.QuerySettings),
+		uploader.TreeQuerySettings(conf.ClickHouse.TreeQuerySettings),
+		uploader.RequestSettings(conf.ClickHouse.RequestSettings),
+		uploader.InsertFormat(conf.ClickHouse.InsertFormat),
+		uploader.HTTP2(conf.ClickHouse.HTTP2),
+		uploader.UploadOrder(conf.ClickHouse.UploadOrder),
+		uploader.RetryBackoff(conf.ClickHouse.RetryMinBackoff.Value(), conf.ClickHouse.RetryMaxBackoff.Value()),
+		uploader.RetryBudget(conf.ClickHouse.RetryBudget.Value()),
+		uploader.DeadLetterPath(conf.Data.DeadLetterPath),
+		uploader.ScanInterval(conf.ClickHouse.ScanInterval.Value()),
+		uploader.UseInotify(conf.ClickHouse.UseInotify),
+		uploader.AllowInsertErrors(conf.ClickHouse.AllowErrorsNum, conf.ClickHouse.AllowErrorsRatio),
+		uploader.MutationCheck(mutationCheckInterval, conf.ClickHouse.MutationWarn),
+		uploader.AsyncInsertWaitEndOfQuery(conf.ClickHouse.AsyncInsertWait, conf.ClickHouse.AsyncConfirm.Value()),
+		uploader.UploadChunkSize(conf.ClickHouse.UploadChunkSize),
+		uploader.MaxInsertBlockSize(conf.ClickHouse.MaxInsertBlock),
+		uploader.MaxResponseSize(conf.ClickHouse.MaxResponseSize),
+		uploader.UploadPipelineDepth(conf.ClickHouse.PipelineDepth),
+		uploader.DDLCluster(conf.ClickHouse.DDLCluster),
+		uploader.ZooKeeperPathTemplate(conf.ClickHouse.ZooKeeperPath),
+		uploader.DryRun(dryRunRows),
+		uploader.ReadAheadBuffers(conf.ClickHouse.ReadAheadBuffers),
+		uploader.TreeCheckTimeout(conf.TreeCache.CheckTimeout.Value(), conf.TreeCache.CheckMaxRetries),
+	}
+}
+
+// collectorConfig returns snapshot of running modules for Collector
+func (app *App) collectorConfig() CollectorConfig {
+	// app locked by caller
+	config := CollectorConfig{
+		MetricPrefix:   app.Config.Common.MetricPrefix,
+		MetricInterval: app.Config.Common.MetricInterval.Value(),
+		MetricEndpoint: app.Config.Common.MetricEndpoint,
+		WriteChan:      app.writeChan,
+		PushGatewayURL: app.Config.Prometheus.PushGatewayURL,
+		Instance:       app.Config.Common.InstanceName,
+		Modules:        []CollectorModule{{"process", openFiles{}}},
+	}
+
+	if app.Uploader != nil {
+		config.Modules = append(config.Modules, CollectorModule{"uploader", app.Uploader})
+	}
+
+	if app.Writer != nil {
+		config.Modules = append(config.Modules, CollectorModule{"writer", app.Writer})
+	}
+
+	if app.TCP != nil {
+		config.Modules = append(config.Modules, CollectorModule{"tcp", app.TCP})
+	}
+
+	if app.Pickle != nil {
+		config.Modules = append(config.Modules, CollectorModule{"pickle", app.Pickle})
+	}
+
+	if app.UDP != nil {
+		config.Modules = append(config.Modules, CollectorModule{"udp", app.UDP})
+	}
+
+	if app.Ingest != nil {
+		config.Modules = append(config.Modules, CollectorModule{"ingest", app.Ingest})
+	}
+
+	for _, r := range []CollectorReceiver{{"tcp", app.TCP}, {"udp", app.UDP}, {"pickle", app.Pickle}, {"ingest", app.Ingest}} {
+		if r.Receiver != nil {
+			config.Receivers = append(config.Receivers, r)
+		}
+	}
+
+	if app.Namespaces != nil {
+		config.Modules = append(config.Modules, CollectorModule{"namespace", app.Namespaces})
+	}
+
+	if app.Tenants != nil {
+		config.Modules = append(config.Modules, CollectorModule{"tenant", app.Tenants})
+	}
+
+	if app.RateLimits != nil {
+		config.Modules = append(config.Modules, CollectorModule{"rateLimit", app.RateLimits})
+	}
+
+	if app.Dedup != nil {
+		config.Modules = append(config.Modules, CollectorModule{"dedup", app.Dedup})
+	}
+
+	if app.WAL != nil {
+		config.Modules = append(config.Modules, CollectorModule{"wal", app.WAL})
+	}
+
+	if app.Newest != nil {
+		config.Modules = append(config.Modules, CollectorModule{"receiver", app.Newest})
+	}
+
+	if app.Sharding != nil {
+		config.Modules = append(config.Modules, CollectorModule{"sharding", app.Sharding})
+	}
+
+	return config
+}
+
+// Start starts
+func (app *App) Start() (err error) {
+	app.Lock()
+	defer app.Unlock()
+
+	defer func() {
+		if err != nil {
+			app.stopAll()
+		}
+	}()
+
+	if _, err = app.shutdownGraph().order(); err != nil {
+		return err
+	}
+
+	conf := app.Config
+
+	runtime.GOMAXPROCS(conf.Common.MaxCPU)
+	logging.SetInstance(conf.Common.InstanceName)
+
+	if err = applyMaxOpenFiles(conf.Common.MaxOpenFiles); err != nil {
+		return err
+	}
+
+	app.startTime = time.Now()
+
+	app.writeChan = make(chan *RowBinary.WriteBuffer)
+
+	// received buffers are appended to wal before writer
+	writerChan := app.writeChan
+	if conf.Receiver.WALEnabled {
+		writerChan = make(chan *RowBinary.WriteBuffer)
+		app.WAL = receiver.NewWAL(conf.Receiver.WALPath, conf.Receiver.WALSizeBytes, app.writeChan, writerChan)
+	}
+
+	/* WRITER start */
+	var backend writer.Backend
+	var fb *writer.FileBackend
+	if conf.Data.Backend == DataBackendMemory {
+		backend = writer.NewMemoryBackend()
+	} else {
+		newFileBackend := func(p string) *writer.FileBackend {
+			b := writer.NewFileBackend(p, conf.Data.FileInterval.Value(), conf.Data.DatePartitionedFiles, conf.Data.WriterConcurrency)
+			b.SetFsync(!conf.Data.FsyncDisabled)
+			b.SetDeadLetterPath(uploader.DeadLetterDir(conf.Data.DeadLetterPath, p))
+			b.SetRowIndex(conf.Data.RowIndex)
+			return b
+		}
+
+		fb = newFileBackend(conf.Data.Path)
+		tablePaths := app.tablePaths()
+		if len(tablePaths) == 0 {
+			if app.WAL != nil {
+				fb.SetCloseCallback(app.WAL.Ack)
+			}
+			backend = fb
+		} else {
+			// tables with same path share backend
+			byPath := make(map[string]*writer.FileBackend)
+			tables := make(map[string]*writer.FileBackend)
+			for table, p := range tablePaths {
+				if byPath[p] == nil {
+					byPath[p] = newFileBackend(p)
+				}
+				tables[table] = byPath[p]
+			}
+
+			mb := writer.NewMultiBackend(fb, tables)
+			if app.WAL != nil {
+				mb.SetCloseCallback(app.WAL.Ack)
+			}
+			backend = mb
+		}
+	}
+
+	app.Writer = writer.NewWithBackend(writerChan, backend)
+	/* WRITER end */
+
+	/* UPLOADER start */
+	var treeCacheRedisAddr []string
+	if conf.TreeCache.Backend == TreeCacheRedis {
+		treeCacheRedisAddr = conf.TreeCache.RedisAddr
+	}
+
+	var consulService string
+	sd := conf.ClickHouse.ServiceDiscovery
+	if sd.Backend == ServiceDiscoveryConsul {
+		consulService = sd.ServiceName
+	}
+
+	app.Uploader = uploader.New(
+		append(app.uploaderOptions(),
+			uploader.Path(conf.Data.Path),
+			uploader.InProgressCallback(app.Writer.IsInProgress),
+			uploader.Threads(app.Config.ClickHouse.Threads),
+			uploader.MaxPendingFiles(conf.Data.MaxPendingFiles),
+			uploader.TablePaths(app.tablePaths()),
+			uploader.TreeCacheRedis(treeCacheRedisAddr, conf.TreeCache.RedisTTL.Value()),
+			uploader.ConsulDiscovery(sd.ConsulAddr, consulService, sd.Tag, sd.RefreshInterval.Value()),
+		)...,
 	)
+
+	if conf.ClickHouse.DDLScriptPath != "" {
+		var script []byte
+		if script, err = ioutil.ReadFile(conf.ClickHouse.DDLScriptPath); err != nil {
+			return
+		}
+		if err = app.Uploader.ExecDDLScript(string(script)); err != nil {
+			err = fmt.Errorf("ddl script %s failed: %s", conf.ClickHouse.DDLScriptPath, err)
+			return
+		}
+	}
+
+	// writer delays rotation of files while uploader has no slack
+	if fb != nil && conf.Data.MaxPendingFiles > 0 {
+		fb.SetFlowControl(app.Uploader.Slack, conf.Data.MaxFileInterval.Value())
+	}
+
+	app.Writer.Start()
+
+	/* WAL start */
+	if app.WAL != nil {
+		// not acknowledged buffers are replayed to writer before start of receivers
+		if err = app.WAL.Start(); err != nil {
+			return
+		}
+	}
+	/* WAL end */
+
 	app.Uploader.Start()
 	/* UPLOADER end */
 
 	/* RECEIVER start */
+	app.Newest = receiver.NewNewestTimestamp()
+
+	if conf.Stats.NamespaceDepth > 0 {
+		app.Namespaces = receiver.NewNamespaces(conf.Stats.NamespaceDepth, conf.Stats.MaxNamespaceEntries)
+	}
+
+	if len(conf.Tenants) > 0 {
+		tenants := make([]receiver.Tenant, 0, len(conf.Tenants))
+		for _, t := range conf.Tenants {
+			tenants = append(tenants, receiver.Tenant{
+				Name:                t.Name,
+				Prefix:              t.Prefix,
+				MaxSeries:           t.MaxSeries,
+				MaxMetricsPerSecond: t.MaxMetricsPerSecond,
+			})
+		}
+		app.Tenants = receiver.NewTenants(tenants)
+	}
+
+	if conf.RateLimit.Enabled {
+		app.RateLimits = receiver.NewRateLimits(float64(conf.RateLimit.GlobalRate), float64(conf.RateLimit.NamespaceRate),
+			conf.RateLimit.NamespaceDepth, conf.RateLimit.MaxNamespaces, conf.RateLimit.IdleTTL.Value())
+	}
+
+	if conf.Receiver.DedupWindow.Value() > 0 {
+		app.Dedup = receiver.NewDedup(conf.Receiver.DedupWindow.Value(), conf.Receiver.DedupMatchValue, conf.Receiver.DedupMaxSize)
+	}
+
+	var transforms *receiver.Transforms
+	if len(conf.Receiver.Transforms) > 0 {
+		t, err := valueTransforms(conf.Receiver.Transforms)
+		if err != nil {
+			return err
+		}
+		transforms = receiver.NewTransforms(t)
+	}
+
+	if conf.Sharding.Mode == ShardingConsistentHash {
+		app.Sharding = receiver.NewSharding(conf.Sharding.Nodes, conf.Sharding.ThisNode, conf.Sharding.PoolSize)
+		app.Sharding.Start()
+	}
+
+	threads, threadsMin, threadsMax, err := parseThreads(conf.Common)
+	if err != nil {
+		return
+	}
+
 	if conf.Tcp.Enabled {
 		app.TCP, err = receiver.New(
 			"tcp://"+conf.Tcp.Listen,
-			receiver.ParseThreads(runtime.GOMAXPROCS(-1)*2),
+			receiver.ParseThreads(threads),
+			receiver.ParseThreadsAuto(threadsMin, threadsMax),
 			receiver.WriteChan(app.writeChan),
+			receiver.ParseErrorLogRate(conf.Common.MaxParseErrorLogRate),
+			receiver.AllowUnicodeNames(conf.Common.AllowUnicodeNames),
+			receiver.MaxMetricDepth(conf.Common.MaxMetricDepth, conf.Common.MaxMetricDepthWarn),
+			receiver.NameValidation(conf.Receiver.NameValidation),
+			receiver.StripPrefix(conf.Common.StripPrefix),
+			receiver.SanitizeNames(conf.Common.SanitizeNames, conf.Common.SanitizeReplacement),
+			receiver.NamespaceStat(app.Namespaces),
+			receiver.TenantLimits(app.Tenants),
+			receiver.RateLimit(app.RateLimits),
+			receiver.NewestMetricTimestamp(app.Newest),
+			receiver.ValueTransforms(transforms),
+			receiver.Deduplicate(app.Dedup),
+			receiver.ShardingForward(app.Sharding),
+			receiver.IdleTimeout(conf.Tcp.IdleTimeout.Value()),
+			receiver.ReadTimeout(conf.Tcp.ReadTimeout.Value()),
+			receiver.BackpressureTimeout(conf.Tcp.BackpressureTimeout.Value()),
+			receiver.MaxLineBuffer(conf.Tcp.MaxLineBufferBytes),
+			receiver.ProxyProtocol(conf.Tcp.ProxyProtocol),
 		)
 
 		if err != nil {
@@ -249,8 +1378,22 @@ func (app *App) Start() (err error) {
 	if conf.Udp.Enabled {
 		app.UDP, err = receiver.New(
 			"udp://"+conf.Udp.Listen,
-			receiver.ParseThreads(runtime.GOMAXPROCS(-1)*2),
+			receiver.ParseThreads(threads),
+			receiver.ParseThreadsAuto(threadsMin, threadsMax),
 			receiver.WriteChan(app.writeChan),
+			receiver.ParseErrorLogRate(conf.Common.MaxParseErrorLogRate),
+			receiver.AllowUnicodeNames(conf.Common.AllowUnicodeNames),
+			receiver.MaxMetricDepth(conf.Common.MaxMetricDepth, conf.Common.MaxMetricDepthWarn),
+			receiver.NameValidation(conf.Receiver.NameValidation),
+			receiver.StripPrefix(conf.Common.StripPrefix),
+			receiver.SanitizeNames(conf.Common.SanitizeNames, conf.Common.SanitizeReplacement),
+			receiver.NamespaceStat(app.Namespaces),
+			receiver.TenantLimits(app.Tenants),
+			receiver.RateLimit(app.RateLimits),
+			receiver.NewestMetricTimestamp(app.Newest),
+			receiver.ValueTransforms(transforms),
+			receiver.Deduplicate(app.Dedup),
+			receiver.ShardingForward(app.Sharding),
 		)
 
 		if err != nil {
@@ -261,18 +1404,60 @@ func (app *App) Start() (err error) {
 	if conf.Pickle.Enabled {
 		app.Pickle, err = receiver.New(
 			"pickle://"+conf.Pickle.Listen,
-			receiver.ParseThreads(runtime.GOMAXPROCS(-1)*2),
+			receiver.ParseThreads(threads),
 			receiver.WriteChan(app.writeChan),
+			receiver.ParseErrorLogRate(conf.Common.MaxParseErrorLogRate),
+			receiver.AllowUnicodeNames(conf.Common.AllowUnicodeNames),
+			receiver.MaxMetricDepth(conf.Common.MaxMetricDepth, conf.Common.MaxMetricDepthWarn),
+			receiver.NameValidation(conf.Receiver.NameValidation),
+			receiver.StripPrefix(conf.Common.StripPrefix),
+			receiver.SanitizeNames(conf.Common.SanitizeNames, conf.Common.SanitizeReplacement),
+			receiver.NamespaceStat(app.Namespaces),
+			receiver.TenantLimits(app.Tenants),
+			receiver.RateLimit(app.RateLimits),
+			receiver.NewestMetricTimestamp(app.Newest),
+			receiver.ValueTransforms(transforms),
+			receiver.Deduplicate(app.Dedup),
+			receiver.ShardingForward(app.Sharding),
+			receiver.IdleTimeout(conf.Pickle.IdleTimeout.Value()),
+			receiver.ReadTimeout(conf.Pickle.ReadTimeout.Value()),
+			receiver.ProxyProtocol(conf.Pickle.ProxyProtocol),
+			receiver.MaxPickleBatchSize(conf.Pickle.MaxBatchSize),
+			receiver.PickleFormat(conf.Pickle.Format),
+			receiver.BackpressureTimeout(conf.Pickle.BackpressureTimeout.Value()),
 		)
 
 		if err != nil {
 			return
 		}
 	}
+
+	// metrics of IngestMetrics are filtered like metrics of tcp
+	app.Ingest, err = receiver.New(
+		"ingest://",
+		receiver.WriteChan(app.writeChan),
+		receiver.ParseErrorLogRate(conf.Common.MaxParseErrorLogRate),
+		receiver.AllowUnicodeNames(conf.Common.AllowUnicodeNames),
+		receiver.MaxMetricDepth(conf.Common.MaxMetricDepth, conf.Common.MaxMetricDepthWarn),
+		receiver.NameValidation(conf.Receiver.NameValidation),
+		receiver.StripPrefix(conf.Common.StripPrefix),
+		receiver.SanitizeNames(conf.Common.SanitizeNames, conf.Common.SanitizeReplacement),
+		receiver.NamespaceStat(app.Namespaces),
+		receiver.TenantLimits(app.Tenants),
+		receiver.RateLimit(app.RateLimits),
+		receiver.NewestMetricTimestamp(app.Newest),
+		receiver.ValueTransforms(transforms),
+		receiver.Deduplicate(app.Dedup),
+		receiver.ShardingForward(app.Sharding),
+		receiver.BackpressureTimeout(conf.Common.IngestTimeout.Value()),
+	)
+	if err != nil {
+		return
+	}
 	/* RECEIVER end */
 
 	/* COLLECTOR start */
-	app.Collector = NewCollector(app)
+	app.Collector = NewCollector(app.collectorConfig())
 	/* COLLECTOR end */
 
 	return
@@ -289,6 +1474,170 @@ func (app *App) ClearTreeExistsCache() {
 	}
 }
 
+// Flush closes current data file and starts its upload immediately
+func (app *App) Flush() error {
+	app.RLock()
+	defer app.RUnlock()
+
+	if app.Writer == nil || app.Uploader == nil {
+		return errors.New("app is not running")
+	}
+
+	if err := app.Writer.FlushNow(); err != nil {
+		return err
+	}
+
+	app.Uploader.ForceFlush()
+	return nil
+}
+
+// RequeueDeadLetters moves files of data.dead-letter-path back to data.path and data paths of tables for upload.
+// Returns count of moved files
+func (app *App) RequeueDeadLetters() (int, error) {
+	app.RLock()
+	defer app.RUnlock()
+
+	if app.Uploader == nil {
+		return 0, errors.New("app is not running")
+	}
+	if app.Config.Data.DeadLetterPath == "" {
+		return 0, errors.New("data.dead-letter-path is not configured")
+	}
+
+	return app.Uploader.RequeueDeadLetters()
+}
+
+// IngestMetrics passes metrics of embedding application to writer. Metrics are filtered, rewritten and validated
+// like metrics of tcp receiver, bad metrics are dropped. Returns receiver.ErrQueueFull if write queue is blocked
+// longer than common.ingest-timeout, part of metrics may be written already
+func (app *App) IngestMetrics(metrics []receiver.Metric) error {
+	app.RLock()
+	ingest, _ := app.Ingest.(*receiver.Ingest)
+	app.RUnlock()
+
+	if ingest == nil {
+		return errors.New("app is not running")
+	}
+
+	// not locked while blocked, so Stop interrupts call
+	return ingest.Ingest(metrics)
+}
+
+// ResetSession replaces session id of INSERT queries, next INSERT starts new ClickHouse session
+func (app *App) ResetSession() error {
+	app.RLock()
+	defer app.RUnlock()
+
+	if app.Uploader == nil {
+		return errors.New("app is not running")
+	}
+	if !app.Config.ClickHouse.SessionIDEnabled {
+		return errors.New("clickhouse.session-id-enabled is disabled")
+	}
+
+	app.Uploader.ResetSession()
+	return nil
+}
+
+// WaitReady waits until receive loops of all configured receivers are started. Returns error on timeout
+func (app *App) WaitReady(timeout time.Duration) error {
+	app.RLock()
+	if app.Writer == nil || app.Uploader == nil {
+		app.RUnlock()
+		return errors.New("app is not running")
+	}
+	receivers := []CollectorReceiver{{"tcp", app.TCP}, {"udp", app.UDP}, {"pickle", app.Pickle}}
+	app.RUnlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for _, r := range receivers {
+		if r.Receiver == nil {
+			continue
+		}
+		select {
+		case <-r.Receiver.Ready():
+			// pass
+		case <-deadline.C:
+			return fmt.Errorf("%s receiver is not ready in %s", r.Type, timeout)
+		}
+	}
+	return nil
+}
+
+// Drain stops receivers and waits until all received metrics are uploaded to ClickHouse.
+// Steps are: listeners stop accepting new connections and packets, accepted connections are served until closed
+// by clients and receivers become idle and are stopped, writer passes received data to current file,
+// current file is closed and uploaded with all other pending files. Returns error if steps are not finished
+// in common.drain-timeout. Writer and uploader are kept running, App should be stopped after Drain
+func (app *App) Drain() error {
+	// app is locked only for snapshot of modules, waits don't block Status and Reload
+	app.Lock()
+	if app.Writer == nil || app.Uploader == nil {
+		app.Unlock()
+		return errors.New("app is not running")
+	}
+	receivers := []receiver.Receiver{app.TCP, app.UDP, app.Pickle, app.Ingest}
+	wal, w, up := app.WAL, app.Writer, app.Uploader
+	deadline := time.Now().Add(app.Config.Common.DrainTimeout.Value())
+	app.Unlock()
+
+	wait := func(step string, done func() bool) error {
+		for !done() {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("drain timeout: %s", step)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+
+	for _, r := range receivers {
+		if l, ok := r.(interface {
+			CloseListener()
+		}); ok {
+			l.CloseListener()
+		}
+	}
+
+	err := wait("receivers are not idle", func() bool {
+		for _, r := range receivers {
+			if i, ok := r.(interface {
+				Idle() bool
+			}); ok && !i.Idle() {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	app.Lock()
+	app.stopListeners()
+	app.Unlock()
+
+	if wal != nil && !wal.Sync(deadline.Sub(time.Now())) {
+		return errors.New("drain timeout: wal queue is not empty")
+	}
+
+	if !w.Sync(deadline.Sub(time.Now())) {
+		return errors.New("drain timeout: writer queue is not empty")
+	}
+
+	if err = w.FlushNow(); err != nil {
+		return err
+	}
+
+	return wait("files are not uploaded", func() bool {
+		up.ForceFlush()
+		n, err := up.Pending()
+		return err == nil && n == 0
+	})
+}
+
 // Loop ...
 func (app *App) Loop() {
 	app.RLock()
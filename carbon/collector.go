@@ -11,8 +11,9 @@ import (
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
 	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
+	"github.com/lomik/carbon-clickhouse/receiver"
 	"github.com/lomik/stop"
-	"github.com/lomik/zapwriter"
 )
 
 type statFunc func()
@@ -27,6 +28,31 @@ type Point struct {
 	Timestamp uint32
 }
 
+// CollectorModule is named source of internal metrics
+type CollectorModule struct {
+	Name   string
+	Module statModule
+}
+
+// CollectorReceiver is receiver with counters exported as tagged metrics with receiver_type tag
+type CollectorReceiver struct {
+	Type     string
+	Receiver receiver.Receiver
+}
+
+// CollectorConfig is snapshot of App settings and modules required by Collector.
+// Collector doesn't access App, so it can be stopped and started while App is locked
+type CollectorConfig struct {
+	MetricPrefix   string
+	MetricInterval time.Duration
+	MetricEndpoint string
+	WriteChan      chan *RowBinary.WriteBuffer
+	Modules        []CollectorModule
+	Receivers      []CollectorReceiver
+	PushGatewayURL string // metrics are also pushed to Prometheus PushGateway if set
+	Instance       string // instance label of PushGateway metrics
+}
+
 type Collector struct {
 	stop.Struct
 	graphPrefix    string
@@ -36,39 +62,31 @@ type Collector struct {
 	logger         *zap.Logger
 	data           chan *Point
 	writeChan      chan *RowBinary.WriteBuffer
+	pushGateway    *pushGateway
+	pushChan       chan []byte
 }
 
-func NewCollector(app *App) *Collector {
-	// app locked by caller
-
+func NewCollector(config CollectorConfig) *Collector {
 	c := &Collector{
-		graphPrefix:    app.Config.Common.MetricPrefix,
-		metricInterval: app.Config.Common.MetricInterval.Value(),
-		endpoint:       app.Config.Common.MetricEndpoint,
+		graphPrefix:    config.MetricPrefix,
+		metricInterval: config.MetricInterval,
+		endpoint:       config.MetricEndpoint,
 		stats:          make([]statFunc, 0),
-		logger:         zapwriter.Logger("stat"),
+		logger:         logging.Logger("stat"),
 		data:           make(chan *Point, 4096),
-		writeChan:      app.writeChan,
+		writeChan:      config.WriteChan,
+	}
+
+	if config.PushGatewayURL != "" {
+		c.pushGateway = newPushGateway(config.PushGatewayURL, config.Instance, 5*time.Second)
+		c.pushChan = make(chan []byte, 1)
 	}
 
 	c.Start()
 
 	sendCallback := func(moduleName string) func(metric string, value float64) {
 		return func(metric string, value float64) {
-			key := fmt.Sprintf("%s.%s.%s", c.graphPrefix, moduleName, metric)
-
-			c.logger.Info("stat", zap.String("metric", key), zap.Float64("value", value))
-
-			select {
-			case c.data <- &Point{Metric: key, Value: value, Timestamp: uint32(time.Now().Unix())}:
-				// pass
-			default:
-				c.logger.Warn(
-					"send queue is full. metric dropped",
-					zap.String("metric", key),
-					zap.Float64("value", value),
-				)
-			}
+			c.send(fmt.Sprintf("%s.%s", moduleName, metric), value)
 		}
 	}
 
@@ -78,24 +96,12 @@ func NewCollector(app *App) *Collector {
 		}
 	}
 
-	if app.Uploader != nil {
-		c.stats = append(c.stats, moduleCallback("uploader", app.Uploader))
-	}
-
-	if app.Writer != nil {
-		c.stats = append(c.stats, moduleCallback("writer", app.Writer))
-	}
-
-	if app.TCP != nil {
-		c.stats = append(c.stats, moduleCallback("tcp", app.TCP))
-	}
-
-	if app.Pickle != nil {
-		c.stats = append(c.stats, moduleCallback("pickle", app.Pickle))
+	for _, m := range config.Modules {
+		c.stats = append(c.stats, moduleCallback(m.Name, m.Module))
 	}
 
-	if app.UDP != nil {
-		c.stats = append(c.stats, moduleCallback("udp", app.UDP))
+	for _, r := range config.Receivers {
+		c.stats = append(c.stats, c.receiverCallback(r.Type, r.Receiver))
 	}
 
 	var u *url.URL
@@ -142,9 +148,59 @@ func NewCollector(app *App) *Collector {
 		}
 	})
 
+	// pushgateway worker. Slow PushGateway doesn't delay collect of metrics
+	if c.pushGateway != nil {
+		c.Go(func(exit chan struct{}) {
+			for {
+				select {
+				case <-exit:
+					return
+				case body := <-c.pushChan:
+					c.pushGateway.push(c.logger, body)
+				}
+			}
+		})
+	}
+
 	return c
 }
 
+// send queues point of metric without prefix. Point is dropped if queue is full
+func (c *Collector) send(metric string, value float64) {
+	if c.pushGateway != nil {
+		c.pushGateway.add(metric, value)
+	}
+
+	key := fmt.Sprintf("%s.%s", c.graphPrefix, metric)
+	c.logger.Info("stat", zap.String("metric", key), zap.Float64("value", value))
+
+	select {
+	case c.data <- &Point{Metric: key, Value: value, Timestamp: uint32(time.Now().Unix())}:
+		// pass
+	default:
+		c.logger.Warn(
+			"send queue is full. metric dropped",
+			zap.String("metric", key),
+			zap.Float64("value", value),
+		)
+	}
+}
+
+// receiverCallback sends Stats of receiver as <prefix>.receiver.<metric>;receiver_type=<receiverType>.
+// Tag is receiver_type label of PushGateway metric
+func (c *Collector) receiverCallback(receiverType string, r receiver.Receiver) statFunc {
+	return func() {
+		s := r.Stats()
+		send := func(metric string, value float64) {
+			c.send(fmt.Sprintf("receiver.%s;receiver_type=%s", metric, receiverType), value)
+		}
+		send("receivedTotal", float64(s.ReceivedTotal))
+		send("parseErrors", float64(s.ParseErrors))
+		send("activeConnections", float64(s.ActiveConnections))
+		send("droppedTotal", float64(s.DroppedTotal))
+	}
+}
+
 func (c *Collector) readData(exit chan struct{}) []*Point {
 	result := make([]*Point, 0)
 
@@ -183,35 +239,31 @@ func (c *Collector) local(exit chan struct{}) {
 			return
 		}
 
-		b := RowBinary.GetWriteBuffer()
-
-		for _, p := range points {
-			if !b.CanWriteGraphitePoint(len(p.Metric)) {
-				// buffer is full
-				select {
-				case <-exit:
-					return
-				case c.writeChan <- b:
-					// pass
-				}
+		metrics := make([]RowBinary.Metric, len(points))
+		for i, p := range points {
+			metrics[i] = RowBinary.Metric{Name: p.Metric, Value: p.Value, Timestamp: p.Timestamp}
+		}
 
-				b = RowBinary.GetWriteBuffer()
+		version := uint32(time.Now().Unix())
+
+		for len(metrics) > 0 {
+			b := RowBinary.GetWriteBuffer()
+			n := b.AppendBatch(metrics, days, version)
+			if n == 0 {
+				// metric name is too long for buffer
+				b.Release()
+				c.logger.Warn("metric dropped", zap.String("metric", metrics[0].Name))
+				metrics = metrics[1:]
+				continue
 			}
+			metrics = metrics[n:]
 
-			b.WriteGraphitePoint(
-				[]byte(p.Metric),
-				p.Value,
-				p.Timestamp,
-				days.Timestamp(p.Timestamp),
-				uint32(time.Now().Unix()),
-			)
-		}
-
-		select {
-		case <-exit:
-			return
-		case c.writeChan <- b:
-			// pass
+			select {
+			case <-exit:
+				return
+			case c.writeChan <- b:
+				// pass
+			}
 		}
 	}
 }
@@ -308,4 +360,20 @@ func (c *Collector) collect() {
 	for _, stat := range c.stats {
 		stat()
 	}
+
+	if c.pushGateway == nil {
+		return
+	}
+
+	body := c.pushGateway.body()
+	if len(body) == 0 {
+		return
+	}
+
+	select {
+	case c.pushChan <- body:
+		// pass
+	default:
+		c.logger.Warn("previous push to pushgateway isn't finished. metrics push skipped")
+	}
 }
@@ -8,11 +8,30 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/receiver"
+	"github.com/lomik/carbon-clickhouse/uploader"
 	"github.com/lomik/zapwriter"
 )
 
 const MetricEndpointLocal = "local"
 
+const (
+	TreeCacheLocal = "local"
+	TreeCacheRedis = "redis"
+)
+
+const ServiceDiscoveryConsul = "consul"
+
+const (
+	DataBackendFile   = "file"
+	DataBackendMemory = "memory"
+)
+
+const ShardingConsistentHash = "consistent_hash"
+
+const ParseThreadsAuto = "auto"
+
 // Duration wrapper time.Duration for TOML
 type Duration struct {
 	time.Duration
@@ -38,24 +57,105 @@ func (d *Duration) Value() time.Duration {
 }
 
 type commonConfig struct {
-	MetricPrefix   string    `toml:"metric-prefix"`
-	MetricInterval *Duration `toml:"metric-interval"`
-	MetricEndpoint string    `toml:"metric-endpoint"`
-	MaxCPU         int       `toml:"max-cpu"`
+	InstanceName         string    `toml:"instance-name"`
+	MetricPrefix         string    `toml:"metric-prefix"`
+	MetricInterval       *Duration `toml:"metric-interval"`
+	MetricEndpoint       string    `toml:"metric-endpoint"`
+	MaxCPU               int       `toml:"max-cpu"`
+	MaxOpenFiles         int       `toml:"max-open-files"`
+	MaxParseErrorLogRate int       `toml:"max-parse-error-log-rate"`
+	AllowUnicodeNames    bool      `toml:"allow-unicode-names"`
+	MaxMetricDepth       int       `toml:"max-metric-depth"`
+	MaxMetricDepthWarn   int       `toml:"max-metric-depth-warn"`
+	StripPrefix          string    `toml:"strip-prefix"`
+	SanitizeNames        bool      `toml:"sanitize-metric-names"`
+	SanitizeReplacement  string    `toml:"sanitize-replacement"`
+	ParseThreads         string    `toml:"parse-threads"`
+	ParseThreadsMin      int       `toml:"parse-threads-min"`
+	ParseThreadsMax      int       `toml:"parse-threads-max"`
+	DrainTimeout         *Duration `toml:"drain-timeout"`
+	IngestTimeout        *Duration `toml:"ingest-timeout"`
+}
+
+type tableOptionsConfig struct {
+	DateColumn     string `toml:"date-column"`
+	DateColumnType string `toml:"date-column-type"`
+	TableEngine    string `toml:"table-engine"`
+	ValueFunction  string `toml:"value-function"`
+	Url            string `toml:"url"`
+	ShardKey       string `toml:"distributed-sharding-key"`
+	Cluster        string `toml:"distributed-cluster"`
+	FallbackTable  string `toml:"fallback-table"`
+	DataPath       string `toml:"data-path"`
 }
 
 type clickhouseConfig struct {
-	Url               string    `toml:"url"`
-	DataTable         string    `toml:"data-table"`
-	DataTables        []string  `toml:"data-tables"`
-	ReverseDataTables []string  `toml:"reverse-data-tables"`
-	DataTimeout       *Duration `toml:"data-timeout"`
-	TreeTable         string    `toml:"tree-table"`
-	ReverseTreeTable  string    `toml:"reverse-tree-table"`
-	TreeDateString    string    `toml:"tree-date"`
-	TreeDate          time.Time `toml:"-"`
-	TreeTimeout       *Duration `toml:"tree-timeout"`
-	Threads           int       `toml:"threads"`
+	Url               string                         `toml:"url"`
+	Database          string                         `toml:"database"`
+	User              string                         `toml:"user"`
+	Password          string                         `toml:"password"`
+	DDLUser           string                         `toml:"ddl-user"`
+	DDLPassword       string                         `toml:"ddl-password"`
+	DMLUser           string                         `toml:"dml-user"`
+	DMLPassword       string                         `toml:"dml-password"`
+	DDLScriptPath     string                         `toml:"ddl-script-path"`
+	DDLCluster        string                         `toml:"ddl-cluster"`
+	ZooKeeperPath     string                         `toml:"zookeeper-path-template"`
+	PreUploadPlugin   string                         `toml:"pre-upload-plugin"`
+	DataTable         string                         `toml:"data-table"`
+	DataTables        []string                       `toml:"data-tables"`
+	ReverseDataTables []string                       `toml:"reverse-data-tables"`
+	DataTimeout       *Duration                      `toml:"data-timeout"`
+	TreeTable         string                         `toml:"tree-table"`
+	ReverseTreeTable  string                         `toml:"reverse-tree-table"`
+	TagsIndexTable    string                         `toml:"tags-index-table"`
+	TreeDateString    string                         `toml:"tree-date"`
+	TreeDate          time.Time                      `toml:"-"`
+	TreeDateTimezone  string                         `toml:"tree-date-timezone"`
+	TreeDateLocation  *time.Location                 `toml:"-"`
+	TreeTimeout       *Duration                      `toml:"tree-timeout"`
+	TreeBatchSize     int                            `toml:"tree-insert-batch-size"`
+	TreeBatchDelay    *Duration                      `toml:"tree-insert-batch-delay"`
+	ConnectTimeout    *Duration                      `toml:"connect-timeout"`
+	WriteTimeout      *Duration                      `toml:"write-timeout"`
+	ReadTimeout       *Duration                      `toml:"read-timeout"`
+	RetryMinBackoff   *Duration                      `toml:"retry-min-backoff"`
+	RetryMaxBackoff   *Duration                      `toml:"retry-max-backoff"`
+	RetryBudget       *Duration                      `toml:"upload-retry-budget"`
+	ScanInterval      *Duration                      `toml:"scan-interval"`
+	UseInotify        bool                           `toml:"use-inotify"`
+	AllowErrorsNum    int                            `toml:"allow-insert-errors-num"`
+	AllowErrorsRatio  float64                        `toml:"allow-insert-errors-ratio"`
+	UploadChunkSize   int64                          `toml:"upload-chunk-size"`
+	MaxInsertBlock    int64                          `toml:"max-insert-block-size"`
+	ReadAheadBuffers  int                            `toml:"upload-read-ahead-buffers"`
+	MaxResponseSize   int64                          `toml:"max-response-size"`
+	PipelineDepth     int                            `toml:"upload-pipeline-depth"`
+	DryRunVerbose     bool                           `toml:"dry-run-verbose"`
+	DryRunMaxRows     int                            `toml:"dry-run-max-rows"`
+	CheckMutations    bool                           `toml:"check-mutations"`
+	MutationInterval  *Duration                      `toml:"mutation-check-interval"`
+	MutationWarn      int                            `toml:"mutation-warn-threshold"`
+	AsyncInsertWait   bool                           `toml:"async-insert-wait-end-of-query"`
+	AsyncConfirm      *Duration                      `toml:"async-insert-confirm-interval"`
+	Threads           int                            `toml:"threads"`
+	SessionIDEnabled  bool                           `toml:"session-id-enabled"`
+	InsertFormat      string                         `toml:"insert-format"`
+	HTTP2             bool                           `toml:"http2"`
+	UploadOrder       string                         `toml:"upload-order"`
+	TableOptions      map[string]*tableOptionsConfig `toml:"table-options"`
+	QuerySettings     map[string]string              `toml:"query-settings"`
+	TreeQuerySettings map[string]string              `toml:"tree-query-settings"`
+	RequestSettings   map[string]string              `toml:"per-request-settings"`
+	ServiceDiscovery  serviceDiscoveryConfig         `toml:"service-discovery"`
+}
+
+type serviceDiscoveryConfig struct {
+	Backend         string    `toml:"backend"`
+	ConsulAddr      string    `toml:"consul-addr"`
+	ServiceName     string    `toml:"service-name"`
+	Tag             string    `toml:"tag"`
+	RefreshInterval *Duration `toml:"refresh-interval"`
 }
 
 type udpConfig struct {
@@ -65,13 +165,28 @@ type udpConfig struct {
 }
 
 type tcpConfig struct {
-	Listen  string `toml:"listen"`
-	Enabled bool   `toml:"enabled"`
+	Listen              string    `toml:"listen"`
+	Enabled             bool      `toml:"enabled"`
+	IdleTimeout         *Duration `toml:"idle-timeout"`
+	ReadTimeout         *Duration `toml:"read-timeout"`
+	BackpressureTimeout *Duration `toml:"backpressure-timeout"`
+	MaxLineBufferBytes  int       `toml:"max-line-buffer-bytes"`
+	ProxyProtocol       bool      `toml:"proxy-protocol"`
 }
 
 type pickleConfig struct {
-	Listen  string `toml:"listen"`
-	Enabled bool   `toml:"enabled"`
+	Listen              string    `toml:"listen"`
+	Enabled             bool      `toml:"enabled"`
+	IdleTimeout         *Duration `toml:"idle-timeout"`
+	ReadTimeout         *Duration `toml:"read-timeout"`
+	BackpressureTimeout *Duration `toml:"backpressure-timeout"`
+	ProxyProtocol       bool      `toml:"proxy-protocol"`
+	MaxBatchSize        int       `toml:"max-pickle-batch-size"`
+	Format              string    `toml:"pickle-format"`
+}
+
+type prometheusConfig struct {
+	PushGatewayURL string `toml:"pushgateway-url"`
 }
 
 type pprofConfig struct {
@@ -79,9 +194,71 @@ type pprofConfig struct {
 	Enabled bool   `toml:"enabled"`
 }
 
+type treeCacheConfig struct {
+	Backend         string    `toml:"backend"`
+	RedisAddr       []string  `toml:"redis-addr"`
+	RedisTTL        *Duration `toml:"redis-ttl"`
+	CheckTimeout    *Duration `toml:"check-timeout"`
+	CheckMaxRetries int       `toml:"check-max-retries"`
+}
+
+type statsConfig struct {
+	NamespaceDepth      int `toml:"namespace-depth"`
+	MaxNamespaceEntries int `toml:"max-namespace-entries"`
+}
+
+type rateLimitConfig struct {
+	Enabled        bool      `toml:"enabled"`
+	GlobalRate     int       `toml:"global-rate"`
+	NamespaceRate  int       `toml:"namespace-rate"`
+	NamespaceDepth int       `toml:"namespace-depth"`
+	MaxNamespaces  int       `toml:"max-namespaces"`
+	IdleTTL        *Duration `toml:"namespace-idle-ttl"`
+}
+
+type shardingConfig struct {
+	Mode     string   `toml:"mode"`
+	Nodes    []string `toml:"nodes"`
+	ThisNode string   `toml:"this-node"`
+	PoolSize int      `toml:"pool-size"`
+}
+
+type tenantConfig struct {
+	Name                string `toml:"name"`
+	Prefix              string `toml:"prefix"`
+	DataTable           string `toml:"data-table"`
+	MaxSeries           int    `toml:"max-series"`
+	MaxMetricsPerSecond int    `toml:"max-metrics-per-second"`
+}
+
+type transformConfig struct {
+	Match      string   `toml:"match"`
+	MultiplyBy *float64 `toml:"multiply-by"`
+	DivideBy   *float64 `toml:"divide-by"`
+}
+
+type receiverConfig struct {
+	DedupWindow     *Duration          `toml:"dedup-window"`
+	DedupMatchValue bool               `toml:"dedup-match-value"`
+	DedupMaxSize    int                `toml:"dedup-max-size"`
+	WALEnabled      bool               `toml:"wal-enabled"`
+	WALPath         string             `toml:"wal-path"`
+	WALSizeBytes    int64              `toml:"wal-size-bytes"`
+	Transforms      []*transformConfig `toml:"transforms"`
+	NameValidation  string             `toml:"name-validation"`
+}
+
 type dataConfig struct {
-	Path         string    `toml:"path"`
-	FileInterval *Duration `toml:"chunk-interval"`
+	Backend              string    `toml:"backend"`
+	Path                 string    `toml:"path"`
+	FileInterval         *Duration `toml:"chunk-interval"`
+	DatePartitionedFiles bool      `toml:"date-partitioned-files"`
+	WriterConcurrency    int       `toml:"writer-concurrency"`
+	FsyncDisabled        bool      `toml:"fsync-disabled"`
+	DeadLetterPath       string    `toml:"dead-letter-path"`
+	MaxPendingFiles      int       `toml:"max-pending-files"`
+	MaxFileInterval      *Duration `toml:"max-file-interval"`
+	RowIndex             bool      `toml:"row-index"`
 }
 
 // Config ...
@@ -92,6 +269,13 @@ type Config struct {
 	Udp        udpConfig          `toml:"udp"`
 	Tcp        tcpConfig          `toml:"tcp"`
 	Pickle     pickleConfig       `toml:"pickle"`
+	TreeCache  treeCacheConfig    `toml:"tree-cache"`
+	Stats      statsConfig        `toml:"stats"`
+	Sharding   shardingConfig     `toml:"sharding"`
+	Tenants    []*tenantConfig    `toml:"tenants"`
+	Receiver   receiverConfig     `toml:"receiver"`
+	RateLimit  rateLimitConfig    `toml:"rate-limit"`
+	Prometheus prometheusConfig   `toml:"prometheus"`
 	Pprof      pprofConfig        `toml:"pprof"`
 	Logging    []zapwriter.Config `toml:"logging"`
 }
@@ -104,8 +288,18 @@ func NewConfig() *Config {
 			MetricInterval: &Duration{
 				Duration: time.Minute,
 			},
-			MetricEndpoint: MetricEndpointLocal,
-			MaxCPU:         1,
+			MetricEndpoint:       MetricEndpointLocal,
+			MaxCPU:               1,
+			MaxParseErrorLogRate: 100,
+			AllowUnicodeNames:    true,
+			SanitizeReplacement:  "_",
+			ParseThreadsMin:      1,
+			DrainTimeout: &Duration{
+				Duration: 30 * time.Second,
+			},
+			IngestTimeout: &Duration{
+				Duration: time.Second,
+			},
 		},
 		Logging: nil,
 		ClickHouse: clickhouseConfig{
@@ -115,19 +309,77 @@ func NewConfig() *Config {
 			ReverseDataTables: []string{},
 			TreeTable:         "graphite_tree",
 			TreeDateString:    "2016-11-01",
+			TreeDateTimezone:  "UTC",
 			DataTimeout: &Duration{
 				Duration: time.Minute,
 			},
 			TreeTimeout: &Duration{
 				Duration: time.Minute,
 			},
-			Threads: 1,
+			TreeBatchSize: 0,
+			TreeBatchDelay: &Duration{
+				Duration: 100 * time.Millisecond,
+			},
+			ConnectTimeout: &Duration{
+				Duration: 30 * time.Second,
+			},
+			WriteTimeout: &Duration{
+				Duration: 0,
+			},
+			ReadTimeout: &Duration{
+				Duration: 0,
+			},
+			RetryMinBackoff: &Duration{
+				Duration: time.Second,
+			},
+			RetryMaxBackoff: &Duration{
+				Duration: 5 * time.Minute,
+			},
+			RetryBudget: &Duration{
+				Duration: 0,
+			},
+			ScanInterval: &Duration{
+				Duration: time.Second,
+			},
+			MutationInterval: &Duration{
+				Duration: time.Minute,
+			},
+			AsyncConfirm: &Duration{
+				Duration: 0,
+			},
+			MutationWarn:      5,
+			Threads:           1,
+			InsertFormat:      RowBinary.FormatRowBinary,
+			HTTP2:             false,
+			UploadOrder:       uploader.UploadOrderOldestFirst,
+			ReadAheadBuffers:  2,
+			MaxResponseSize:   uploader.DefaultMaxResponseSize,
+			PipelineDepth:     1,
+			DryRunMaxRows:     10,
+			TableOptions:      map[string]*tableOptionsConfig{},
+			QuerySettings:     map[string]string{},
+			TreeQuerySettings: map[string]string{},
+			RequestSettings:   map[string]string{},
+			ServiceDiscovery: serviceDiscoveryConfig{
+				Backend:     "",
+				ConsulAddr:  "http://127.0.0.1:8500",
+				ServiceName: "clickhouse",
+				Tag:         "",
+				RefreshInterval: &Duration{
+					Duration: 30 * time.Second,
+				},
+			},
 		},
 		Data: dataConfig{
-			Path: "/data/carbon-clickhouse/",
+			Backend: DataBackendFile,
+			Path:    "/data/carbon-clickhouse/",
 			FileInterval: &Duration{
 				Duration: time.Second,
 			},
+			WriterConcurrency: 1,
+			MaxFileInterval: &Duration{
+				Duration: time.Minute,
+			},
 		},
 		Udp: udpConfig{
 			Listen:        ":2003",
@@ -137,10 +389,71 @@ func NewConfig() *Config {
 		Tcp: tcpConfig{
 			Listen:  ":2003",
 			Enabled: true,
+			IdleTimeout: &Duration{
+				Duration: 0,
+			},
+			ReadTimeout: &Duration{
+				Duration: time.Minute,
+			},
+			BackpressureTimeout: &Duration{
+				Duration: 0,
+			},
+			MaxLineBufferBytes: 1048576,
+			ProxyProtocol:      false,
 		},
 		Pickle: pickleConfig{
 			Listen:  ":2004",
 			Enabled: true,
+			IdleTimeout: &Duration{
+				Duration: 0,
+			},
+			ReadTimeout: &Duration{
+				Duration: time.Minute,
+			},
+			BackpressureTimeout: &Duration{
+				Duration: 0,
+			},
+			ProxyProtocol: false,
+			MaxBatchSize:  500000,
+			Format:        receiver.PickleFormatAuto,
+		},
+		TreeCache: treeCacheConfig{
+			Backend:   TreeCacheLocal,
+			RedisAddr: []string{},
+			RedisTTL: &Duration{
+				Duration: 24 * time.Hour,
+			},
+			CheckTimeout: &Duration{
+				Duration: 5 * time.Second,
+			},
+			CheckMaxRetries: 3,
+		},
+		Stats: statsConfig{
+			NamespaceDepth:      0,
+			MaxNamespaceEntries: 10000,
+		},
+		Sharding: shardingConfig{
+			Mode:     "",
+			Nodes:    []string{},
+			ThisNode: "",
+			PoolSize: 4,
+		},
+		Receiver: receiverConfig{
+			DedupWindow: &Duration{
+				Duration: 0,
+			},
+			DedupMatchValue: false,
+			DedupMaxSize:    receiver.DedupMaxSize,
+			WALPath:         "/data/carbon-clickhouse-wal/receiver.wal",
+			WALSizeBytes:    268435456,
+			NameValidation:  receiver.NameValidationWarn,
+		},
+		RateLimit: rateLimitConfig{
+			NamespaceDepth: 2,
+			MaxNamespaces:  100000,
+			IdleTTL: &Duration{
+				Duration: 10 * time.Minute,
+			},
 		},
 		Pprof: pprofConfig{
 			Listen:  "localhost:7007",
@@ -214,10 +527,18 @@ func ReadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	cfg.ClickHouse.TreeDate, err = time.ParseInLocation("2006-01-02", cfg.ClickHouse.TreeDateString, time.Local)
+	cfg.ClickHouse.TreeDateLocation, err = time.LoadLocation(cfg.ClickHouse.TreeDateTimezone)
 	if err != nil {
 		return nil, err
 	}
 
+	// empty tree-date means current date in tree-date-timezone
+	if cfg.ClickHouse.TreeDateString != "" {
+		cfg.ClickHouse.TreeDate, err = time.ParseInLocation("2006-01-02", cfg.ClickHouse.TreeDateString, cfg.ClickHouse.TreeDateLocation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return cfg, nil
 }
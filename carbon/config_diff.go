@@ -0,0 +1,228 @@
+package carbon
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/lomik/carbon-clickhouse/uploader"
+)
+
+// ConfigChange is changed field of config. Field is path of toml names like "clickhouse.data-timeout",
+// items of maps and lists are "clickhouse.table-options.graphite.url" and "tenants[0].prefix".
+// Nil value is missing field, passwords are redacted
+type ConfigChange struct {
+	Field    string      `json:"field"`
+	OldValue interface{} `json:"old_value"`
+	NewValue interface{} `json:"new_value"`
+}
+
+// ConfigHistorySize is count of last config generations kept by App for ConfigDiff
+const ConfigHistorySize = 100
+
+// ConfigGenerationDiff is changes of config generation against previous generation
+type ConfigGenerationDiff struct {
+	Generation int            `json:"generation"`
+	Changes    []ConfigChange `json:"changes"`
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// Diff returns changed fields of new config ordered as in config file
+func Diff(old, new Config) []ConfigChange {
+	var changes []ConfigChange
+	diffValue(&changes, "", reflect.ValueOf(old), reflect.ValueOf(new))
+	return changes
+}
+
+func diffValue(changes *[]ConfigChange, field string, old, new reflect.Value) {
+	if !old.IsValid() || !new.IsValid() {
+		diffLeaf(changes, field, old, new)
+		return
+	}
+
+	t := old.Type()
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		diffLeaf(changes, field, old, new)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if old.IsNil() || new.IsNil() {
+			diffLeaf(changes, field, old, new)
+			return
+		}
+		diffValue(changes, field, old.Elem(), new.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("toml"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				// unexported or derived from other fields
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if field != "" {
+				name = field + "." + name
+			}
+			diffValue(changes, name, old.Field(i), new.Field(i))
+		}
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range append(old.MapKeys(), new.MapKeys()...) {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			diffValue(changes, field+"."+name, old.MapIndex(keys[name]), new.MapIndex(keys[name]))
+		}
+	case reflect.Slice:
+		elem := t.Elem()
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			// lists of values are changed as whole
+			diffLeaf(changes, field, old, new)
+			return
+		}
+		n := old.Len()
+		if new.Len() > n {
+			n = new.Len()
+		}
+		for i := 0; i < n; i++ {
+			var o, v reflect.Value
+			if i < old.Len() {
+				o = old.Index(i)
+			}
+			if i < new.Len() {
+				v = new.Index(i)
+			}
+			diffValue(changes, fmt.Sprintf("%s[%d]", field, i), o, v)
+		}
+	default:
+		diffLeaf(changes, field, old, new)
+	}
+}
+
+func diffLeaf(changes *[]ConfigChange, field string, old, new reflect.Value) {
+	o, v := configValue(field, old), configValue(field, new)
+	if reflect.DeepEqual(o, v) {
+		return
+	}
+	*changes = append(*changes, ConfigChange{Field: field, OldValue: o, NewValue: v})
+}
+
+// configTree returns tables of config as maps by toml names and values as configValue. Passwords are not redacted
+// without redact
+func configTree(field string, v reflect.Value, redact bool) interface{} {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return nil
+	}
+
+	t := v.Type()
+	if t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType) {
+		return leafValue(field, v, redact)
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return configTree(field, v.Elem(), redact)
+	case reflect.Struct:
+		result := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("toml"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			path := name
+			if field != "" {
+				path = field + "." + name
+			}
+			result[name] = configTree(path, v.Field(i), redact)
+		}
+		return result
+	case reflect.Map:
+		result := make(map[string]interface{})
+		for _, k := range v.MapKeys() {
+			name := fmt.Sprint(k.Interface())
+			result[name] = configTree(field+"."+name, v.MapIndex(k), redact)
+		}
+		return result
+	case reflect.Slice:
+		elem := t.Elem()
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return leafValue(field, v, redact)
+		}
+		result := make([]interface{}, v.Len())
+		for i := range result {
+			result[i] = configTree(fmt.Sprintf("%s[%d]", field, i), v.Index(i), redact)
+		}
+		return result
+	default:
+		return leafValue(field, v, redact)
+	}
+}
+
+// leafValue returns configValue or rawConfigValue
+func leafValue(field string, v reflect.Value, redact bool) interface{} {
+	if redact {
+		return configValue(field, v)
+	}
+	return rawConfigValue(v)
+}
+
+// configValue returns value of field for log and json. Durations and other text values are strings
+func configValue(field string, v reflect.Value) interface{} {
+	value := rawConfigValue(v)
+	if s, ok := value.(string); ok {
+		if strings.HasSuffix(field, "password") && s != "" {
+			return "xxxxx"
+		}
+		if strings.HasSuffix(field, "url") {
+			return uploader.RedactURL(s)
+		}
+	}
+	return value
+}
+
+// rawConfigValue returns configValue without redacted passwords
+func rawConfigValue(v reflect.Value) interface{} {
+	if !v.IsValid() || (v.Kind() == reflect.Ptr && v.IsNil()) {
+		return nil
+	}
+
+	var value interface{}
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, _ := m.MarshalText()
+		value = string(text)
+	} else if v.CanAddr() {
+		if m, ok := v.Addr().Interface().(encoding.TextMarshaler); ok {
+			text, _ := m.MarshalText()
+			value = string(text)
+		}
+	}
+	if value == nil {
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		value = v.Interface()
+	}
+	return value
+}
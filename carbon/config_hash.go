@@ -0,0 +1,25 @@
+package carbon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// ErrConfigUnchanged is returned by ReloadConfig if config is equal to active one
+var ErrConfigUnchanged = errors.New("config unchanged")
+
+// Hash returns SHA256 in hex of config in JSON with sorted keys. Passwords are redacted, so hash can be
+// published and doesn't change with passwords only
+func (c *Config) Hash() string {
+	b, _ := json.Marshal(configTree("", reflect.ValueOf(c), true))
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// sameSecrets returns true if configs are equal with passwords. Complements Hash
+func (c *Config) sameSecrets(other *Config) bool {
+	return reflect.DeepEqual(configTree("", reflect.ValueOf(c), false), configTree("", reflect.ValueOf(other), false))
+}
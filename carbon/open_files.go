@@ -0,0 +1,61 @@
+package carbon
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/logging"
+)
+
+// openFiles sends count of open file descriptors of process
+type openFiles struct{}
+
+func (openFiles) Stat(send func(metric string, value float64)) {
+	if n, err := countOpenFiles(); err == nil {
+		send("openFilesCurrent", float64(n))
+	}
+}
+
+// applyMaxOpenFiles raises soft limit of file descriptors to common.max-open-files. Soft limit can't exceed hard limit,
+// hard limit is used for greater values. Limit is not lowered if it is already greater. 0 - limit is not changed
+func applyMaxOpenFiles(max int) error {
+	if max == 0 {
+		return nil
+	}
+
+	logger := logging.Logger("app")
+
+	cur, hard, err := getOpenFilesLimit()
+	if err != nil {
+		return fmt.Errorf("common.max-open-files: %s", err)
+	}
+
+	limit := uint64(max)
+	if limit > hard {
+		logger.Warn("common.max-open-files exceeds hard limit, hard limit is used",
+			zap.Int("max_open_files", max),
+			zap.Uint64("hard", hard),
+		)
+		limit = hard
+	}
+
+	if limit <= cur {
+		logger.Info("open files limit is not changed",
+			zap.Uint64("current", cur),
+			zap.Int("max_open_files", max),
+		)
+		return nil
+	}
+
+	if err = setOpenFilesLimit(limit, hard); err != nil {
+		return fmt.Errorf("common.max-open-files: %s", err)
+	}
+
+	logger.Info("open files limit",
+		zap.Uint64("current", cur),
+		zap.Uint64("new", limit),
+		zap.Uint64("hard", hard),
+	)
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package carbon
+
+import (
+	"errors"
+)
+
+var errOpenFilesUnsupported = errors.New("limit of open files is supported only on linux and darwin")
+
+func getOpenFilesLimit() (uint64, uint64, error) {
+	return 0, 0, errOpenFilesUnsupported
+}
+
+func setOpenFilesLimit(cur uint64, hard uint64) error {
+	return errOpenFilesUnsupported
+}
+
+func countOpenFiles() (int, error) {
+	return 0, errOpenFilesUnsupported
+}
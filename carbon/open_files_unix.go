@@ -0,0 +1,43 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package carbon
+
+import (
+	"io/ioutil"
+	"runtime"
+	"syscall"
+)
+
+// replaced by tests
+var (
+	getrlimit = syscall.Getrlimit
+	setrlimit = syscall.Setrlimit
+)
+
+// getOpenFilesLimit returns soft and hard limits of file descriptors
+func getOpenFilesLimit() (uint64, uint64, error) {
+	var l syscall.Rlimit
+	if err := getrlimit(syscall.RLIMIT_NOFILE, &l); err != nil {
+		return 0, 0, err
+	}
+	return l.Cur, l.Max, nil
+}
+
+func setOpenFilesLimit(cur uint64, hard uint64) error {
+	return setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: cur, Max: hard})
+}
+
+// countOpenFiles returns count of open file descriptors. Descriptor of listed directory is not counted
+func countOpenFiles() (int, error) {
+	dir := "/proc/self/fd"
+	if runtime.GOOS == "darwin" {
+		dir = "/dev/fd"
+	}
+
+	fds, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	return len(fds) - 1, nil
+}
@@ -0,0 +1,79 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package carbon
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestAppMaxOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := New("")
+	if err = app.ParseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	app.Config.Data.Path = dir
+	app.Config.Tcp.Listen = "127.0.0.1:0"
+	app.Config.Udp.Listen = "127.0.0.1:0"
+	app.Config.Pickle.Listen = "127.0.0.1:0"
+
+	// limits of process are not changed by test
+	limit := syscall.Rlimit{Cur: 1024, Max: 4096}
+	receiversStarted := false
+	getrlimit = func(resource int, rlim *syscall.Rlimit) error {
+		*rlim = limit
+		return nil
+	}
+	setrlimit = func(resource int, rlim *syscall.Rlimit) error {
+		if resource != syscall.RLIMIT_NOFILE {
+			t.Fatal(resource)
+		}
+		limit = *rlim
+		receiversStarted = app.TCP != nil || app.UDP != nil || app.Pickle != nil
+		return nil
+	}
+	defer func() {
+		getrlimit, setrlimit = syscall.Getrlimit, syscall.Setrlimit
+	}()
+
+	table := []struct {
+		maxOpenFiles int
+		expected     syscall.Rlimit
+	}{
+		{0, syscall.Rlimit{Cur: 1024, Max: 4096}},
+		{2048, syscall.Rlimit{Cur: 2048, Max: 4096}},
+		{10000, syscall.Rlimit{Cur: 4096, Max: 4096}}, // hard limit
+		{512, syscall.Rlimit{Cur: 4096, Max: 4096}},   // limit is not lowered
+	}
+
+	for _, c := range table {
+		app.Config.Common.MaxOpenFiles = c.maxOpenFiles
+		if err = app.Start(); err != nil {
+			t.Fatal(err)
+		}
+		app.Stop()
+
+		if limit != c.expected || receiversStarted {
+			t.Fatalf("%d: %#v, receivers started: %v", c.maxOpenFiles, limit, receiversStarted)
+		}
+	}
+
+	var current float64
+	openFiles{}.Stat(func(metric string, value float64) {
+		if metric == "openFilesCurrent" {
+			current = value
+		}
+	})
+	if current < 3 {
+		t.Fatal(current)
+	}
+}
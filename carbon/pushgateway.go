@@ -0,0 +1,138 @@
+package carbon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PushGatewayJob is job label of metrics pushed to Prometheus PushGateway
+const PushGatewayJob = "carbon_clickhouse"
+
+// pushGatewayMetricPrefix is prefix of Prometheus names of internal metrics
+const pushGatewayMetricPrefix = "carbon_clickhouse_"
+
+// labelValueEscaper escapes label value of text exposition format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type pushPoint struct {
+	name   string
+	labels string
+	value  float64
+}
+
+type byPushName []pushPoint
+
+func (p byPushName) Len() int           { return len(p) }
+func (p byPushName) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPushName) Less(i, j int) bool { return p[i].name < p[j].name }
+
+// pushGateway replaces metrics of group {job="carbon_clickhouse", instance=<instance>} in Prometheus PushGateway
+// by points of each collect. Points are added by collector worker and pushed by pushgateway worker
+type pushGateway struct {
+	url    string
+	client *http.Client
+	points []pushPoint
+}
+
+func newPushGateway(gatewayURL string, instance string, timeout time.Duration) *pushGateway {
+	if instance == "" {
+		instance = "localhost"
+	}
+	return &pushGateway{
+		url:    fmt.Sprintf("%s/metrics/job/%s/instance/%s", strings.TrimRight(gatewayURL, "/"), PushGatewayJob, instance),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// prometheusName replaces characters not valid in Prometheus metric and label names with "_"
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// add converts metric without prefix to Prometheus name. Tags of tagged metric are converted to labels:
+// receiver.receivedTotal;receiver_type=tcp is carbon_clickhouse_receiver_receivedTotal{receiver_type="tcp"}
+func (p *pushGateway) add(metric string, value float64) {
+	tags := strings.Split(metric, ";")
+
+	labels := make([]string, 0, len(tags)-1)
+	for _, tag := range tags[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		labels = append(labels, fmt.Sprintf("%s=\"%s\"", prometheusName(kv[0]), labelValueEscaper.Replace(kv[1])))
+	}
+
+	p.points = append(p.points, pushPoint{
+		name:   pushGatewayMetricPrefix + prometheusName(tags[0]),
+		labels: strings.Join(labels, ","),
+		value:  value,
+	})
+}
+
+// body returns added points in text exposition format and resets them
+func (p *pushGateway) body() []byte {
+	points := p.points
+	p.points = nil
+
+	// samples of metric family should be grouped
+	sort.Stable(byPushName(points))
+
+	var buf bytes.Buffer
+	for i, pt := range points {
+		if i == 0 || points[i-1].name != pt.name {
+			fmt.Fprintf(&buf, "# TYPE %s gauge\n", pt.name)
+		}
+		buf.WriteString(pt.name)
+		if pt.labels != "" {
+			buf.WriteString("{" + pt.labels + "}")
+		}
+		buf.WriteString(" " + strconv.FormatFloat(pt.value, 'g', -1, 64) + "\n")
+	}
+	return buf.Bytes()
+}
+
+// push sends body of points to PushGateway. Errors are logged, points of failed push are dropped
+func (p *pushGateway) push(logger *zap.Logger, body []byte) {
+	req, err := http.NewRequest("PUT", p.url, bytes.NewReader(body))
+	if err != nil {
+		logger.Error("pushgateway request failed", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		logger.Warn("push to pushgateway failed", zap.Error(err))
+		return
+	}
+	response, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// invalid names or labels, retry doesn't help
+		logger.Error("pushgateway rejected metrics",
+			zap.Int("status", resp.StatusCode),
+			zap.String("response", string(response)),
+		)
+	case resp.StatusCode/100 != 2:
+		logger.Warn("push to pushgateway failed",
+			zap.Int("status", resp.StatusCode),
+			zap.String("response", string(response)),
+		)
+	}
+}
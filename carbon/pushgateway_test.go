@@ -0,0 +1,137 @@
+package carbon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/receiver"
+)
+
+type testStatModule map[string]float64
+
+func (m testStatModule) Stat(send func(metric string, value float64)) {
+	for metric, value := range m {
+		send(metric, value)
+	}
+}
+
+type testReceiver struct {
+	testStatModule
+}
+
+func (r testReceiver) Stats() receiver.ReceiverStats {
+	return receiver.ReceiverStats{ReceivedTotal: 42, ActiveConnections: 2}
+}
+
+func (r testReceiver) Ready() <-chan struct{} {
+	return nil
+}
+
+func (r testReceiver) Stop() {}
+
+func TestCollectorPushGateway(t *testing.T) {
+	type push struct {
+		path string
+		body string
+	}
+	pushes := make(chan push, 100)
+	status := int32(http.StatusOK)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "PUT" || !strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+			http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+			return
+		}
+		pushes <- push{r.URL.Path, string(body)}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	// bad labels are rejected, collector keeps pushing
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+
+	c := NewCollector(CollectorConfig{
+		MetricPrefix:   "carbon.agents.test",
+		MetricInterval: 10 * time.Millisecond,
+		WriteChan:      make(chan *RowBinary.WriteBuffer, 1024),
+		Modules: []CollectorModule{
+			{"tcp", testStatModule{"metricsReceived": 10, "errors": 1}},
+			{"uploader", testStatModule{"graphite.inserts": 2}},
+		},
+		Receivers:      []CollectorReceiver{{"tcp", testReceiver{}}},
+		PushGatewayURL: srv.URL + "/",
+		Instance:       "web01",
+	})
+	defer c.Stop()
+
+	var p push
+	for i := 0; i < 2; i++ {
+		select {
+		case p = <-pushes:
+		case <-time.After(time.Second):
+			t.Fatalf("push %d timed out", i)
+		}
+	}
+
+	if p.path != "/metrics/job/carbon_clickhouse/instance/web01" {
+		t.Fatalf("path: %#v", p.path)
+	}
+
+	expected := []string{
+		"# TYPE carbon_clickhouse_receiver_activeConnections gauge",
+		`carbon_clickhouse_receiver_activeConnections{receiver_type="tcp"} 2`,
+		"# TYPE carbon_clickhouse_receiver_receivedTotal gauge",
+		`carbon_clickhouse_receiver_receivedTotal{receiver_type="tcp"} 42`,
+		"# TYPE carbon_clickhouse_tcp_errors gauge",
+		"carbon_clickhouse_tcp_errors 1",
+		"# TYPE carbon_clickhouse_tcp_metricsReceived gauge",
+		"carbon_clickhouse_tcp_metricsReceived 10",
+		"# TYPE carbon_clickhouse_uploader_graphite_inserts gauge",
+		"carbon_clickhouse_uploader_graphite_inserts 2",
+	}
+	for _, line := range expected {
+		if !strings.Contains(p.body, line+"\n") {
+			t.Fatalf("%#v not found in:\n%s", line, p.body)
+		}
+	}
+	if n := strings.Count(p.body, "# TYPE "); n != 7 {
+		t.Fatalf("metric families: %d\n%s", n, p.body)
+	}
+}
+
+func TestCollectorSlowPushGateway(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		<-release
+	}))
+	defer srv.Close()
+
+	writeChan := make(chan *RowBinary.WriteBuffer, 1024)
+	c := NewCollector(CollectorConfig{
+		MetricPrefix:   "carbon.agents.test",
+		MetricInterval: 10 * time.Millisecond,
+		WriteChan:      writeChan,
+		Modules:        []CollectorModule{{"tcp", testStatModule{"metricsReceived": 10}}},
+		PushGatewayURL: srv.URL,
+	})
+	defer c.Stop()
+	defer close(release)
+
+	// metrics are collected while push hangs
+	for i := 0; i < 3; i++ {
+		select {
+		case b := <-writeChan:
+			b.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("collect %d timed out", i)
+		}
+	}
+}
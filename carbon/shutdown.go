@@ -0,0 +1,85 @@
+package carbon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// shutdownGraph is order of components stop. Component is stopped after all its dependencies
+type shutdownGraph struct {
+	names []string            // registration order, used for components without dependency between them
+	stop  map[string]func()   // stop functions by name
+	after map[string][]string // name of component -> components stopped before it
+}
+
+func newShutdownGraph() *shutdownGraph {
+	return &shutdownGraph{
+		stop:  make(map[string]func()),
+		after: make(map[string][]string),
+	}
+}
+
+// add registers component which should be stopped after all of components in after
+func (g *shutdownGraph) add(name string, stop func(), after ...string) {
+	if _, exists := g.stop[name]; !exists {
+		g.names = append(g.names, name)
+	}
+	g.stop[name] = stop
+	g.after[name] = after
+}
+
+// order returns names of components in stop order. Returns error on unknown dependency or dependency cycle
+func (g *shutdownGraph) order() ([]string, error) {
+	index := make(map[string]int)
+	for i, name := range g.names {
+		index[name] = i
+	}
+
+	// count of not stopped dependencies and reverse edges
+	waiting := make(map[string]int)
+	next := make(map[string][]string)
+	for _, name := range g.names {
+		for _, dep := range g.after[name] {
+			if _, exists := g.stop[dep]; !exists {
+				return nil, fmt.Errorf("shutdown order: %s depends on unknown component %s", name, dep)
+			}
+			waiting[name]++
+			next[dep] = append(next[dep], name)
+		}
+	}
+
+	ready := make([]int, 0)
+	for i, name := range g.names {
+		if waiting[name] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	result := make([]string, 0, len(g.names))
+	for len(ready) > 0 {
+		sort.Ints(ready)
+		name := g.names[ready[0]]
+		ready = ready[1:]
+		result = append(result, name)
+
+		for _, n := range next[name] {
+			waiting[n]--
+			if waiting[n] == 0 {
+				ready = append(ready, index[n])
+			}
+		}
+	}
+
+	if len(result) != len(g.names) {
+		cycle := make([]string, 0)
+		for _, name := range g.names {
+			if waiting[name] > 0 {
+				cycle = append(cycle, name)
+			}
+		}
+		return nil, fmt.Errorf("shutdown order: dependency cycle between %s", strings.Join(cycle, ", "))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,80 @@
+package carbon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShutdownGraphOrder(t *testing.T) {
+	var stopped []string
+	g := newShutdownGraph()
+	add := func(name string, after ...string) {
+		g.add(name, func() { stopped = append(stopped, name) }, after...)
+	}
+
+	add("uploader", "writer")
+	add("writer", "tcp", "udp")
+	add("tcp")
+	add("udp")
+	add("collector")
+
+	order, err := g.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// independent components are stopped in registration order
+	expected := []string{"tcp", "udp", "writer", "uploader", "collector"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("%#v != %#v", order, expected)
+	}
+
+	// stop functions are registered by name
+	for _, name := range order {
+		g.stop[name]()
+	}
+	if !reflect.DeepEqual(stopped, expected) {
+		t.Fatalf("%#v != %#v", stopped, expected)
+	}
+
+	add("tcp", "uploader")
+	if _, err = g.order(); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("%#v", err)
+	}
+
+	add("tcp", "unknown")
+	if _, err = g.order(); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Fatalf("%#v", err)
+	}
+}
+
+func TestAppShutdownOrder(t *testing.T) {
+	app := New("")
+	if err := app.ParseConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := app.shutdownGraph().order()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	position := make(map[string]int)
+	for i, name := range order {
+		position[name] = i
+	}
+
+	for _, p := range [][2]string{
+		{"receivers", "writer"},
+		{"writer", "uploader"},
+		{"receivers", "sharding"},
+		{"collector", "writer"},
+		{"collector", "uploader"},
+		{"writer", "wal"},
+	} {
+		if position[p[0]] >= position[p[1]] {
+			t.Fatalf("%s should be stopped before %s: %#v", p[0], p[1], order)
+		}
+	}
+}
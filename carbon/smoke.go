@@ -0,0 +1,71 @@
+package carbon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// SmokeTestMetric is sent by SmokeTest
+const SmokeTestMetric = "carbon.clickhouse.test.metric"
+
+// SmokeTest sends test metric to started tcp receiver and waits until it appears in ClickHouse data table
+func (app *App) SmokeTest(timeout time.Duration) error {
+	app.RLock()
+	tcp := app.TCP
+	up := app.Uploader
+	conf := app.Config
+	app.RUnlock()
+
+	if tcp == nil || up == nil {
+		return errors.New("tcp receiver and uploader should be started")
+	}
+
+	rcv, ok := tcp.(interface {
+		Addr() net.Addr
+	})
+	if !ok || rcv.Addr() == nil {
+		return errors.New("tcp receiver address is unknown")
+	}
+
+	table := conf.ClickHouse.DataTable
+	if table == "" && len(conf.ClickHouse.DataTables) > 0 {
+		table = conf.ClickHouse.DataTables[0]
+	}
+	if table == "" {
+		return errors.New("data table is not configured")
+	}
+
+	deadline := time.Now().Add(timeout)
+	now := time.Now().Unix()
+
+	conn, err := net.DialTimeout("tcp", rcv.Addr().String(), timeout)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(conn, "%s 1.0 %d\n", SmokeTestMetric, now)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("SELECT count() FROM %s WHERE Path = '%s' AND Time = %d", table, SmokeTestMetric, now)
+
+	for {
+		body, err := up.Query(query, timeout)
+		if err == nil && strings.TrimSpace(string(body)) != "0" && strings.TrimSpace(string(body)) != "" {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("metric %s is not found in %s after %s", SmokeTestMetric, table, timeout)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
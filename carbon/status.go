@@ -0,0 +1,153 @@
+package carbon
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/uploader"
+)
+
+const (
+	ComponentRunning = "running"
+	ComponentStopped = "stopped"
+)
+
+// AppStatus is machine-readable state of App
+type AppStatus struct {
+	Uptime            float64           `json:"uptime"`             // seconds since Start
+	ReceivedTotal     uint64            `json:"received_total"`     // metrics received by all receivers
+	DroppedTotal      uint64            `json:"dropped_total"`      // bad lines and messages dropped by receivers
+	QueueDepth        int               `json:"queue_depth"`        // files waiting for upload
+	UploaderLag       float64           `json:"uploader_lag"`       // age of oldest file waiting for upload, seconds
+	RetryQueueDepth   int               `json:"retry_queue_depth"`  // failed files waiting for next attempt
+	ActiveConnections int               `json:"active_connections"` // open tcp and pickle connections
+	ClickHouseURL     string            `json:"clickhouse_url"`     // password is redacted
+	ComponentStatus   map[string]string `json:"component_status"`
+	// totals by receiver type: "tcp", "udp", "pickle". Only running receivers are listed
+	Receivers map[string]ReceiverStatus `json:"receivers"`
+}
+
+// ReceiverStatus is state of one receiver. Sums of all receivers are reported in AppStatus
+type ReceiverStatus struct {
+	ReceivedTotal     uint64 `json:"received_total"`
+	DroppedTotal      uint64 `json:"dropped_total"`
+	ActiveConnections int    `json:"active_connections"` // always 0 for udp
+}
+
+type receiverTotals interface {
+	MetricsReceivedTotal() uint64
+	ErrorsTotal() uint64
+}
+
+type receiverConnections interface {
+	ActiveConnections() int
+}
+
+// ConfigStatus is active config with toml names of fields. Passwords are redacted
+type ConfigStatus struct {
+	Generation int                    `json:"generation"`
+	Hash       string                 `json:"hash"`
+	Config     map[string]interface{} `json:"config"`
+}
+
+// ConfigStatus returns active config. Config is replaced by reload, so it is read without lock after snapshot
+func (app *App) ConfigStatus() (*ConfigStatus, error) {
+	app.RLock()
+	cfg := app.Config
+	generation := 0
+	if n := len(app.configHistory); n > 0 {
+		generation = app.configHistory[n-1].Generation
+	}
+	app.RUnlock()
+
+	if cfg == nil {
+		return nil, errors.New("config is not parsed")
+	}
+
+	tree, _ := configTree("", reflect.ValueOf(cfg), true).(map[string]interface{})
+	return &ConfigStatus{Generation: generation, Hash: cfg.Hash(), Config: tree}, nil
+}
+
+// UploaderStatus returns upload state of ClickHouse tables. Nil if uploader is not running
+func (app *App) UploaderStatus() map[string]uploader.TableUploadStatus {
+	app.RLock()
+	defer app.RUnlock()
+
+	if app.Uploader == nil {
+		return nil
+	}
+	return app.Uploader.TableStatus()
+}
+
+func componentStatus(running bool) string {
+	if running {
+		return ComponentRunning
+	}
+	return ComponentStopped
+}
+
+// Status returns current state of App. Safe for concurrent call with Start and Stop
+func (app *App) Status() AppStatus {
+	app.RLock()
+	defer app.RUnlock()
+
+	status := AppStatus{
+		ComponentStatus: map[string]string{
+			"writer":    componentStatus(app.Writer != nil),
+			"uploader":  componentStatus(app.Uploader != nil),
+			"tcp":       componentStatus(app.TCP != nil),
+			"udp":       componentStatus(app.UDP != nil),
+			"pickle":    componentStatus(app.Pickle != nil),
+			"ingest":    componentStatus(app.Ingest != nil),
+			"collector": componentStatus(app.Collector != nil),
+		},
+		Receivers: make(map[string]ReceiverStatus),
+	}
+
+	if app.Config != nil {
+		status.ClickHouseURL = uploader.RedactURL(app.Config.ClickHouse.Url)
+	}
+
+	if !app.startTime.IsZero() {
+		status.Uptime = time.Since(app.startTime).Seconds()
+	}
+
+	if app.Uploader != nil {
+		status.QueueDepth = app.Uploader.Unhandled()
+		status.UploaderLag = app.Uploader.Lag().Seconds()
+		status.RetryQueueDepth = app.Uploader.RetryQueueDepth()
+	}
+
+	receivers := []struct {
+		name     string
+		receiver interface{}
+	}{
+		{"tcp", app.TCP},
+		{"udp", app.UDP},
+		{"pickle", app.Pickle},
+		{"ingest", app.Ingest},
+	}
+
+	for _, r := range receivers {
+		if r.receiver == nil {
+			continue
+		}
+
+		var rs ReceiverStatus
+		if t, ok := r.receiver.(receiverTotals); ok {
+			rs.ReceivedTotal = t.MetricsReceivedTotal()
+			rs.DroppedTotal = t.ErrorsTotal()
+		}
+		if c, ok := r.receiver.(receiverConnections); ok {
+			rs.ActiveConnections = c.ActiveConnections()
+		}
+
+		status.Receivers[r.name] = rs
+		status.ReceivedTotal += rs.ReceivedTotal
+		status.DroppedTotal += rs.DroppedTotal
+		status.ActiveConnections += rs.ActiveConnections
+	}
+
+	return status
+}
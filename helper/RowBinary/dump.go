@@ -0,0 +1,110 @@
+package RowBinary
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Output formats of Dump
+const (
+	DumpFormatText = "text" // <timestamp>\t<name>\t<value>
+	DumpFormatJSON = "json" // {"timestamp":<timestamp>,"name":<name>,"value":<value>} per line, null for NaN and Inf
+)
+
+// DumpOptions select rows of Dump. Zero value prints all rows as text
+type DumpOptions struct {
+	Limit  int            // max printed rows. 0 - unlimited
+	Filter *regexp.Regexp // printed names. nil - all
+	Format string         // DumpFormatText or DumpFormatJSON. Empty is text
+	Offset int64          // first row (from 0), filter is applied after it. Row index of file is used if exists
+}
+
+// Dump prints rows of data file written by writer. Returns count of printed rows. Good rows before corrupted one are printed
+func Dump(out io.Writer, filename string, opts DumpOptions) (int, error) {
+	switch opts.Format {
+	case "", DumpFormatText, DumpFormatJSON:
+		// pass
+	default:
+		return 0, fmt.Errorf("unknown format %#v", opts.Format)
+	}
+
+	reader, err := NewReader(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	if opts.Offset > 0 {
+		err = reader.SeekRow(opts.Offset)
+		if os.IsNotExist(err) {
+			err = reader.SkipRows(opts.Offset)
+		}
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w := bufio.NewWriter(out)
+	count, err := dumpRows(w, reader, opts)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return count, err
+}
+
+func dumpRows(w *bufio.Writer, reader *Reader, opts DumpOptions) (int, error) {
+	var line []byte
+	count := 0
+	for opts.Limit <= 0 || count < opts.Limit {
+		name, err := reader.ReadRecord()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if opts.Filter != nil && !opts.Filter.Match(name) {
+			continue
+		}
+
+		line = line[:0]
+		if opts.Format == DumpFormatJSON {
+			n, _ := json.Marshal(string(name))
+			line = append(line, `{"timestamp":`...)
+			line = strconv.AppendUint(line, uint64(reader.Timestamp()), 10)
+			line = append(line, `,"name":`...)
+			line = append(line, n...)
+			line = append(line, `,"value":`...)
+			if v := reader.Value(); math.IsNaN(v) || math.IsInf(v, 0) {
+				line = append(line, "null"...)
+			} else {
+				line = strconv.AppendFloat(line, v, 'g', -1, 64)
+			}
+			line = append(line, "}\n"...)
+		} else {
+			line = strconv.AppendUint(line, uint64(reader.Timestamp()), 10)
+			line = append(line, '\t')
+			line = append(line, name...)
+			line = append(line, '\t')
+			line = strconv.AppendFloat(line, reader.Value(), 'g', -1, 64)
+			line = append(line, '\n')
+		}
+
+		if _, err = w.Write(line); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
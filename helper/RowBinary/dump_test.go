@@ -0,0 +1,101 @@
+package RowBinary_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"github.com/lomik/carbon-clickhouse/writer"
+)
+
+func TestDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// file of writer
+	in := make(chan *RowBinary.WriteBuffer)
+	w := writer.New(in, dir, time.Hour)
+	w.Start()
+
+	now := uint32(time.Now().Unix())
+	days := &days1970.Days{}
+	expected := make([]string, 1000)
+	for i := 0; i < 1000; i++ {
+		wb := RowBinary.GetWriteBuffer()
+		ts := now - uint32(i)
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%d", i)), float64(i)/4, ts, days.TimestampWithNow(ts, now), now)
+		in <- wb
+		expected[i] = fmt.Sprintf("%d\thello.world.%d\t%v", ts, i, float64(i)/4)
+	}
+	w.Stop()
+
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files: %#v, %#v", files, err)
+	}
+
+	dump := func(opts RowBinary.DumpOptions) []string {
+		var out bytes.Buffer
+		count, err := RowBinary.Dump(&out, files[0], opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if count != len(lines) {
+			t.Fatalf("count %d, lines %d", count, len(lines))
+		}
+		return lines
+	}
+
+	lines := dump(RowBinary.DumpOptions{})
+	if len(lines) != 1000 {
+		t.Fatalf("rows: %d", len(lines))
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Fatalf("%#v != %#v", line, expected[i])
+		}
+	}
+
+	lines = dump(RowBinary.DumpOptions{Limit: 10, Filter: regexp.MustCompile(`\.\d*7$`)})
+	if len(lines) != 10 || lines[0] != expected[7] || lines[9] != expected[97] {
+		t.Fatalf("%#v", lines)
+	}
+
+	// file without row index is read sequentially
+	lines = dump(RowBinary.DumpOptions{Offset: 990, Limit: 5})
+	if fmt.Sprintf("%#v", lines) != fmt.Sprintf("%#v", expected[990:995]) {
+		t.Fatalf("%#v", lines)
+	}
+
+	lines = dump(RowBinary.DumpOptions{Limit: 2, Format: RowBinary.DumpFormatJSON})
+	for i, line := range lines {
+		var row struct {
+			Timestamp uint32
+			Name      string
+			Value     float64
+		}
+		if err = json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatalf("%#v: %s", line, err)
+		}
+		if fmt.Sprintf("%d\t%s\t%v", row.Timestamp, row.Name, row.Value) != expected[i] {
+			t.Fatalf("%#v != %#v", line, expected[i])
+		}
+	}
+
+	if _, err = RowBinary.Dump(ioutil.Discard, files[0], RowBinary.DumpOptions{Format: "xml"}); err == nil {
+		t.Fatal("unknown format is accepted")
+	}
+}
@@ -0,0 +1,98 @@
+package RowBinary
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// IndexInterval is count of rows between entries of row index
+const IndexInterval = 1024
+
+// IndexFilename returns row index of data file: <unixnano>[.<date>].idx for default.<unixnano>[.<date>].
+// Index name doesn't start with "default.", so it is not uploaded
+func IndexFilename(filename string) string {
+	return path.Join(path.Dir(filename), strings.TrimPrefix(path.Base(filename), "default.")+".idx")
+}
+
+// AppendIndexEntry appends file offset of row to index. Index contains little endian UInt64 offsets
+// of rows 0, IndexInterval, 2*IndexInterval, ...
+func AppendIndexEntry(b []byte, offset int64) []byte {
+	var entry [8]byte
+	binary.LittleEndian.PutUint64(entry[:], uint64(offset))
+	return append(b, entry[:]...)
+}
+
+// indexEntry returns row and file offset of last entry of index before row n
+func indexEntry(filename string, n int64) (int64, int64, error) {
+	idx, err := os.Open(IndexFilename(filename))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer idx.Close()
+
+	st, err := idx.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	entry := n / IndexInterval
+	if last := st.Size()/8 - 1; entry > last {
+		// index of unfinished file
+		entry = last
+	}
+	if entry < 0 {
+		return 0, 0, nil
+	}
+
+	var b [8]byte
+	if _, err = idx.ReadAt(b[:], entry*8); err != nil {
+		return 0, 0, err
+	}
+	return entry * IndexInterval, int64(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+// SeekRow moves reader to row n (from 0) of file using row index written by writer. Rows before n are
+// not filtered and not counted by Records. Returns io.EOF if file contains less than n rows. Error of missing
+// index satisfies os.IsNotExist, such files can be read sequentially with SkipRows
+func (r *Reader) SeekRow(n int64) error {
+	row, offset, err := indexEntry(r.fd.Name(), n)
+	if err != nil {
+		return err
+	}
+
+	if _, err = r.fd.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.reader.Reset(r.fd)
+	r.consumed = offset
+	r.records = 0
+	r.eof = false
+	r.size = 0
+	r.offset = 0
+	r.out = nil
+
+	return r.SkipRows(n - row)
+}
+
+// SkipRows reads n rows without output. Rows are not filtered and not counted by Records
+func (r *Reader) SkipRows(n int64) error {
+	for ; n > 0; n-- {
+		if r.eof {
+			return io.EOF
+		}
+		if _, err := r.readRecord(); err != nil {
+			r.eof = true
+			r.size = 0
+			r.offset = 0
+			r.out = nil
+			return err
+		}
+		r.consumed += int64(r.size)
+	}
+	r.out = nil
+	r.offset = 0
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
 	"os"
@@ -16,15 +17,85 @@ import (
 
 // Read all good records from unfinished RowBinary file.
 type Reader struct {
-	now       uint32
-	fd        *os.File
-	reader    *bufio.Reader
-	offset    int
-	size      int
-	eof       bool
-	days      days1970.Days
-	line      [524288]byte
-	isReverse bool
+	now        uint32
+	fd         *os.File
+	reader     *bufio.Reader
+	offset     int
+	size       int
+	eof        bool
+	days       days1970.Days
+	line       [524288]byte
+	isReverse  bool
+	dateType   string // type of Date column in Read output
+	shards     uint32 // appends UInt32 CRC32(Path) % shards column to Read output if not 0
+	consumed   int64  // file bytes of read records
+	records    int64  // count of read records
+	limit      int64  // Read returns EOF after record ends at limit offset. 0 - unlimited
+	maxRecords int64  // Read returns EOF after maxRecords records are read. 0 - unlimited
+	out        []byte // current record in Read output format
+	prefixes   [][]byte
+	include    bool // read only names with prefixes. Names with prefixes are skipped if false
+	skipped    bool // current record is filtered
+	transform  TransformFunc
+	rows       []Row  // batch of transform
+	batch      []byte // transformed rows in Read output format
+}
+
+// SetDateType sets type of Date column in Read output. Records are stored with Date, other types are converted
+func (r *Reader) SetDateType(dateType string) {
+	r.dateType = dateType
+}
+
+// SetShards enables shard key column in Read output: CRC32 of Path modulo shards after Timestamp
+func (r *Reader) SetShards(shards uint32) {
+	r.shards = shards
+}
+
+// SetPrefixFilter filters records of ReadRecord and Read by name (not reversed) prefixes. If include is true only
+// names with one of prefixes are read, otherwise names with prefixes are skipped. Empty prefixes disable filter
+func (r *Reader) SetPrefixFilter(prefixes []string, include bool) {
+	r.prefixes = nil
+	for _, p := range prefixes {
+		r.prefixes = append(r.prefixes, []byte(p))
+	}
+	r.include = include
+}
+
+// Offset returns size of read records in file. Skipped records are counted too. Record in Read output is counted before it is read completely
+func (r *Reader) Offset() int64 {
+	return r.consumed
+}
+
+// Records returns count of read records, without skipped by prefix filter
+func (r *Reader) Records() int64 {
+	return r.records
+}
+
+// EOF returns true if end of file or bad record is reached
+func (r *Reader) EOF() bool {
+	return r.eof
+}
+
+// SetLimit sets file offset of Read end. Record crossing limit is read completely. 0 disables limit
+func (r *Reader) SetLimit(offset int64) {
+	r.limit = offset
+}
+
+// SetRecordsLimit sets count of read records (see Records) of Read end. 0 disables limit
+func (r *Reader) SetRecordsLimit(records int64) {
+	r.maxRecords = records
+}
+
+// Skip reads records up to file offset without output
+func (r *Reader) Skip(offset int64) error {
+	for r.consumed < offset {
+		if _, err := r.ReadRecord(); err != nil {
+			return err
+		}
+	}
+	r.out = nil
+	r.offset = 0
+	return nil
 }
 
 func (r *Reader) Timestamp() uint32 {
@@ -80,6 +151,17 @@ func (r *Reader) readRecord() ([]byte, error) {
 		return nil, errors.New("name truncated")
 	}
 
+	if len(r.prefixes) > 0 {
+		matched := false
+		for _, p := range r.prefixes {
+			if bytes.HasPrefix(r.line[r.size:r.size+n], p) {
+				matched = true
+				break
+			}
+		}
+		r.skipped = matched != r.include
+	}
+
 	if r.isReverse {
 		copy(r.line[r.size:], ReverseBytes(r.line[r.size:r.size+n]))
 	}
@@ -110,15 +192,49 @@ func (r *Reader) ReadRecord() ([]byte, error) {
 	}
 
 	p, err := r.readRecord()
+	for err == nil && r.skipped {
+		r.consumed += int64(r.size)
+		p, err = r.readRecord()
+	}
 	if err != nil {
 		r.eof = true
 		r.size = 0
 		r.offset = 0
+		r.out = nil
+		return p, err
+	}
+
+	r.consumed += int64(r.size)
+	r.records++
+
+	switch r.dateType {
+	case DateTypeDate32:
+		r.out = append(r.out[:0], r.line[:r.size-6]...)
+		r.out = appendUint32(r.out, uint32(int32(r.Days())))
+		r.out = append(r.out, r.line[r.size-4:r.size]...)
+	case DateTypeDateTime:
+		r.out = append(r.out[:0], r.line[:r.size-6]...)
+		r.out = appendUint32(r.out, r.Timestamp())
+		r.out = append(r.out, r.line[r.size-4:r.size]...)
+	default:
+		if r.shards > 0 {
+			r.out = append(r.out[:0], r.line[:r.size]...)
+		} else {
+			r.out = r.line[:r.size]
+		}
+	}
+
+	if r.shards > 0 {
+		r.out = appendUint32(r.out, crc32.ChecksumIEEE(p)%r.shards)
 	}
 
 	return p, err
 }
 
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
 func (r *Reader) Close() {
 	r.fd.Close()
 }
@@ -131,13 +247,23 @@ func (r *Reader) Read(p []byte) (int, error) {
 			return readed, nil
 		}
 
-		if r.size > r.offset {
-			n := copy(p, r.line[r.offset:r.size])
+		if len(r.out) > r.offset {
+			n := copy(p, r.out[r.offset:])
 			r.offset += n
 			p = p[n:]
 			readed += n
+		} else if r.limited() {
+			if readed > 0 {
+				return readed, nil
+			}
+			return 0, io.EOF
 		} else {
-			_, err := r.ReadRecord()
+			var err error
+			if r.transform != nil {
+				err = r.readTransformed()
+			} else {
+				_, err = r.ReadRecord()
+			}
 			if err != nil {
 				if readed > 0 {
 					return readed, nil
@@ -149,6 +275,11 @@ func (r *Reader) Read(p []byte) (int, error) {
 	}
 }
 
+// limited returns true if limit or records limit of Read is reached
+func (r *Reader) limited() bool {
+	return (r.limit > 0 && r.consumed >= r.limit) || (r.maxRecords > 0 && r.records >= r.maxRecords)
+}
+
 func NewReader(filename string) (*Reader, error) {
 	fd, err := os.Open(filename)
 	if err != nil {
@@ -0,0 +1,201 @@
+package RowBinary_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestReaderDateType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	days := &days1970.Days{}
+	now := uint32(1422642189)
+	timestamps := []uint32{now - 86400*3, now}
+
+	wb := RowBinary.GetWriteBuffer()
+	for _, ts := range timestamps {
+		wb.WriteGraphitePoint([]byte("hello.world"), 42, ts, days.TimestampWithNow(ts, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	for _, dateType := range []string{RowBinary.DateTypeDate, RowBinary.DateTypeDate32, RowBinary.DateTypeDateTime} {
+		expected := RowBinary.GetWriteBuffer()
+		for _, ts := range timestamps {
+			expected.WriteBytes([]byte("hello.world"))
+			expected.WriteFloat64(42)
+			expected.WriteUint32(ts)
+			expected.WriteDate(dateType, days.TimestampWithNow(ts, now), ts)
+			expected.WriteUint32(now)
+		}
+
+		reader, err := RowBinary.NewReader(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.SetDateType(dateType)
+
+		body, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(body, expected.Bytes()) {
+			t.Fatalf("%s: %#v != %#v", dateType, body, expected.Bytes())
+		}
+		expected.Release()
+	}
+}
+
+func TestReaderSeekRow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	days := &days1970.Days{}
+	now := uint32(time.Now().Unix())
+	wb := RowBinary.GetWriteBuffer()
+	for _, name := range []string{"a.b", "c.d", "e.f"} {
+		wb.WriteGraphitePoint([]byte(name), 42, now, days.TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	reader, err := RowBinary.NewReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err = reader.SeekRow(1); !os.IsNotExist(err) {
+		t.Fatalf("%#v", err)
+	}
+	if err = reader.SkipRows(1); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := reader.ReadRecord(); err != nil || string(name) != "c.d" {
+		t.Fatalf("%s, %#v", name, err)
+	}
+
+	if RowBinary.IndexFilename(filename) != path.Join(dir, "1.idx") {
+		t.Fatal(RowBinary.IndexFilename(filename))
+	}
+	if err = ioutil.WriteFile(RowBinary.IndexFilename(filename), RowBinary.AppendIndexEntry(nil, 0), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// rows after index entry are skipped
+	if err = reader.SeekRow(2); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := reader.ReadRecord(); err != nil || string(name) != "e.f" || reader.Records() != 1 {
+		t.Fatalf("%s, %#v, %d", name, err, reader.Records())
+	}
+	if err = reader.SeekRow(4); err != io.EOF {
+		t.Fatalf("%#v", err)
+	}
+	if err = reader.SeekRow(0); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := reader.ReadRecord(); err != nil || string(name) != "a.b" {
+		t.Fatalf("%s, %#v", name, err)
+	}
+}
+
+func TestReaderTransform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	days := &days1970.Days{}
+	now := uint32(time.Now().Unix())
+	wb := RowBinary.GetWriteBuffer()
+	for i := 0; i < 5000; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("a.b%d", i%3)), float64(i), now, days.TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	// rows of a.b0 are dropped, rows of a.b1 are doubled with new path
+	expected := RowBinary.GetWriteBuffer()
+	defer expected.Release()
+	for i := 0; i < 5000; i++ {
+		switch i % 3 {
+		case 1:
+			for _, name := range []string{"a.b1", "c.b1"} {
+				expected.WriteBytes([]byte(name))
+				expected.WriteFloat64(float64(i))
+				expected.WriteUint32(now)
+				expected.WriteDate(RowBinary.DateTypeDateTime, 0, now)
+				expected.WriteUint32(now)
+			}
+		case 2:
+			expected.WriteBytes([]byte("a.b2"))
+			expected.WriteFloat64(float64(i))
+			expected.WriteUint32(now)
+			expected.WriteDate(RowBinary.DateTypeDateTime, 0, now)
+			expected.WriteUint32(now)
+		}
+	}
+
+	reader, err := RowBinary.NewReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.SetDateType(RowBinary.DateTypeDateTime)
+
+	var out []RowBinary.Row
+	reader.SetTransform(func(rows []RowBinary.Row) []RowBinary.Row {
+		out = out[:0]
+		for _, row := range rows {
+			switch row.Path {
+			case "a.b0":
+				continue
+			case "a.b1":
+				out = append(out, row)
+				row.Path = "c.b1"
+			}
+			out = append(out, row)
+		}
+		return out
+	})
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, expected.Bytes()) {
+		t.Fatalf("body size %d, expected %d", len(body), expected.Used)
+	}
+	if reader.Records() != 5000 {
+		t.Fatal(reader.Records())
+	}
+}
@@ -0,0 +1,87 @@
+package RowBinary
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+)
+
+// count of records passed to transform at once
+const transformBatchSize = 4096
+
+// Row is decoded record of data file. Fields are named as columns of data table
+type Row struct {
+	Path      string // reversed for reverse tables
+	Value     float64
+	Time      uint32 // timestamp of point
+	Date      uint16 // days since 1970-01-01
+	Timestamp uint32 // version, receive time
+}
+
+// TransformFunc modifies, adds or drops rows before upload. Rows slice is reused after return.
+// Called concurrently from upload workers
+type TransformFunc func(rows []Row) []Row
+
+// SetTransform sets transform of records in Read output. Records are passed by batches of transformBatchSize.
+// Path of transformed rows is not filtered again. nil disables transform
+func (r *Reader) SetTransform(f TransformFunc) {
+	r.transform = f
+}
+
+// readTransformed reads batch of records and replaces Read output with transformed rows. Returns error of
+// first record only, batch ends at end of file, bad record, limit or records limit
+func (r *Reader) readTransformed() error {
+	r.rows = r.rows[:0]
+	for len(r.rows) < transformBatchSize && !r.limited() {
+		name, err := r.ReadRecord()
+		if err != nil {
+			if len(r.rows) == 0 {
+				return err
+			}
+			break
+		}
+		r.rows = append(r.rows, Row{
+			Path:      string(name),
+			Value:     r.Value(),
+			Time:      r.Timestamp(),
+			Date:      r.Days(),
+			Timestamp: r.Version(),
+		})
+	}
+
+	r.batch = r.batch[:0]
+	for _, row := range r.transform(r.rows) {
+		r.batch = r.appendRow(r.batch, row)
+	}
+	r.out = r.batch
+	r.offset = 0
+	return nil
+}
+
+// appendRow appends row in Read output format
+func (r *Reader) appendRow(b []byte, row Row) []byte {
+	var l [binary.MaxVarintLen64]byte
+	b = append(b, l[:binary.PutUvarint(l[:], uint64(len(row.Path)))]...)
+	b = append(b, row.Path...)
+
+	v := math.Float64bits(row.Value)
+	b = appendUint32(b, uint32(v))
+	b = appendUint32(b, uint32(v>>32))
+	b = appendUint32(b, row.Time)
+
+	switch r.dateType {
+	case DateTypeDate32:
+		b = appendUint32(b, uint32(int32(row.Date)))
+	case DateTypeDateTime:
+		b = appendUint32(b, row.Time)
+	default:
+		b = append(b, byte(row.Date), byte(row.Date>>8))
+	}
+
+	b = appendUint32(b, row.Timestamp)
+
+	if r.shards > 0 {
+		b = appendUint32(b, crc32.ChecksumIEEE([]byte(row.Path))%r.shards)
+	}
+	return b
+}
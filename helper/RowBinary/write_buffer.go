@@ -3,8 +3,13 @@ package RowBinary
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math"
 	"sync"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
 )
 
 var WriteBufferPool = sync.Pool{
@@ -15,6 +20,22 @@ var WriteBufferPool = sync.Pool{
 
 const WriteBufferSize = 524288
 
+// ErrBufferFull is returned by AppendRow if row doesn't fit in free space of buffer
+var ErrBufferFull = errors.New("write buffer is full")
+
+// Supported types of data table Date column
+const (
+	DateTypeDate     = "Date"     // UInt16 days since 1970-01-01
+	DateTypeDate32   = "Date32"   // Int32 days since 1970-01-01
+	DateTypeDateTime = "DateTime" // UInt32 unix timestamp
+)
+
+type Metric struct {
+	Name      string
+	Value     float64
+	Timestamp uint32
+}
+
 type WriteBuffer struct {
 	Used int
 	Body [WriteBufferSize]byte
@@ -47,6 +68,15 @@ func (wb *WriteBuffer) WriteBytes(p []byte) {
 	wb.Used += copy(wb.Body[wb.Used:], p)
 }
 
+func (wb *WriteBuffer) WriteString(s string) {
+	wb.Used += binary.PutUvarint(wb.Body[wb.Used:], uint64(len(s)))
+	wb.Used += copy(wb.Body[wb.Used:], s)
+}
+
+func (wb *WriteBuffer) WriteUVarint(v uint64) {
+	wb.Used += binary.PutUvarint(wb.Body[wb.Used:], v)
+}
+
 func (wb *WriteBuffer) WriteReversePath(p []byte) {
 	wb.Used += binary.PutUvarint(wb.Body[wb.Used:], uint64(len(p)))
 
@@ -70,6 +100,11 @@ func (wb *WriteBuffer) WriteFloat64(value float64) {
 	wb.Used += 8
 }
 
+func (wb *WriteBuffer) WriteUint8(value uint8) {
+	wb.Body[wb.Used] = value
+	wb.Used++
+}
+
 func (wb *WriteBuffer) WriteUint16(value uint16) {
 	binary.LittleEndian.PutUint16(wb.Body[wb.Used:], value)
 	wb.Used += 2
@@ -85,6 +120,22 @@ func (wb *WriteBuffer) WriteUint64(value uint64) {
 	wb.Used += 8
 }
 
+func (wb *WriteBuffer) WriteInt32(value int32) {
+	wb.WriteUint32(uint32(value))
+}
+
+// WriteDate writes Date column value in RowBinary encoding of dateType
+func (wb *WriteBuffer) WriteDate(dateType string, days uint16, timestamp uint32) {
+	switch dateType {
+	case DateTypeDate32:
+		wb.WriteInt32(int32(days))
+	case DateTypeDateTime:
+		wb.WriteUint32(timestamp)
+	default:
+		wb.WriteUint16(days)
+	}
+}
+
 func (wb *WriteBuffer) Write(p []byte) {
 	wb.Used += copy(wb.Body[wb.Used:], p)
 }
@@ -101,3 +152,107 @@ func (wb *WriteBuffer) CanWriteGraphitePoint(metricLen int) bool {
 	// required (maxvarint{5}, name{metricLen}, value{8}, timestamp{4}, days(date){2}, version{4})
 	return (WriteBufferSize - wb.Used) > (metricLen + 23)
 }
+
+// columnSize returns size of RowBinary encoded column value
+func columnSize(col interface{}) (int, error) {
+	switch v := col.(type) {
+	case string:
+		return uvarintLen(uint64(len(v))) + len(v), nil
+	case []byte:
+		return len(v), nil
+	case int8, uint8:
+		return 1, nil
+	case int16, uint16:
+		return 2, nil
+	case int32, uint32, float32, time.Time:
+		return 4, nil
+	case int64, uint64, float64:
+		return 8, nil
+	default:
+		return 0, fmt.Errorf("unsupported column type %T", col)
+	}
+}
+
+// AppendRow writes row of columns in RowBinary encoding: string as String, []byte as FixedString of its length,
+// time.Time as DateTime, integer and float types as ClickHouse types of same size.
+// Nothing is written if any column is unsupported or row doesn't fit in buffer
+func (wb *WriteBuffer) AppendRow(cols ...interface{}) error {
+	size := 0
+	for _, col := range cols {
+		n, err := columnSize(col)
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+
+	if size > WriteBufferSize-wb.Used {
+		return ErrBufferFull
+	}
+
+	for _, col := range cols {
+		switch v := col.(type) {
+		case string:
+			wb.WriteString(v)
+		case []byte:
+			wb.Write(v)
+		case int8:
+			wb.WriteUint8(uint8(v))
+		case uint8:
+			wb.WriteUint8(v)
+		case int16:
+			wb.WriteUint16(uint16(v))
+		case uint16:
+			wb.WriteUint16(v)
+		case int32:
+			wb.WriteInt32(v)
+		case uint32:
+			wb.WriteUint32(v)
+		case float32:
+			wb.WriteUint32(math.Float32bits(v))
+		case time.Time:
+			wb.WriteUint32(uint32(v.Unix()))
+		case int64:
+			wb.WriteUint64(uint64(v))
+		case uint64:
+			wb.WriteUint64(v)
+		case float64:
+			wb.WriteFloat64(v)
+		}
+	}
+
+	return nil
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// AppendBatch writes metrics while buffer has space. Returns count of written metrics
+func (wb *WriteBuffer) AppendBatch(metrics []Metric, days *days1970.Days, version uint32) int {
+	// calculate count of metrics fits in buffer
+	free := WriteBufferSize - wb.Used
+	count := 0
+	for ; count < len(metrics); count++ {
+		size := uvarintLen(uint64(len(metrics[count].Name))) + len(metrics[count].Name) + 18
+		if size >= free {
+			break
+		}
+		free -= size
+	}
+
+	for i := 0; i < count; i++ {
+		wb.WriteString(metrics[i].Name)
+		wb.WriteFloat64(metrics[i].Value)
+		wb.WriteUint32(metrics[i].Timestamp)
+		wb.WriteUint16(days.TimestampWithNow(metrics[i].Timestamp, version))
+		wb.WriteUint32(version)
+	}
+
+	return count
+}
@@ -1,10 +1,16 @@
-package RowBinary
+package RowBinary_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
 )
 
 func TestWriteBufferWriteReversePath(t *testing.T) {
@@ -15,3 +21,273 @@ func TestWriteBufferWriteReversePath(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func testBatch(n int) []RowBinary.Metric {
+	metrics := make([]RowBinary.Metric, n)
+	for i := 0; i < n; i++ {
+		metrics[i] = RowBinary.Metric{
+			Name:      fmt.Sprintf("carbon.agents.localhost.metric%d", i),
+			Value:     float64(i),
+			Timestamp: 1422642189,
+		}
+	}
+	return metrics
+}
+
+func TestWriteBufferAppendBatch(t *testing.T) {
+	metrics := testBatch(1000)
+	days := &days1970.Days{}
+
+	wb1 := RowBinary.GetWriteBuffer()
+	wb2 := RowBinary.GetWriteBuffer()
+
+	for _, m := range metrics {
+		wb1.WriteGraphitePoint([]byte(m.Name), m.Value, m.Timestamp, days.TimestampWithNow(m.Timestamp, 1422642189), 1422642189)
+	}
+
+	if n := wb2.AppendBatch(metrics, days, 1422642189); n != len(metrics) {
+		t.Fatalf("%d != %d", n, len(metrics))
+	}
+
+	if bytes.Compare(wb1.Bytes(), wb2.Bytes()) != 0 {
+		t.FailNow()
+	}
+
+	// buffer overflow
+	wb3 := RowBinary.GetWriteBuffer()
+	big := testBatch(100000)
+	n := wb3.AppendBatch(big, days, 1422642189)
+	if n == 0 || n == len(big) {
+		t.Fatalf("unexpected written count %d", n)
+	}
+	if wb3.AppendBatch(big[n:], days, 1422642189) != 0 {
+		t.FailNow()
+	}
+}
+
+func BenchmarkWriteBufferWriteGraphitePoint(b *testing.B) {
+	metrics := testBatch(1000)
+	days := &days1970.Days{}
+	wb := RowBinary.GetWriteBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		wb.Reset()
+		for _, m := range metrics {
+			wb.WriteGraphitePoint([]byte(m.Name), m.Value, m.Timestamp, days.TimestampWithNow(m.Timestamp, 1422642189), 1422642189)
+		}
+	}
+}
+
+func BenchmarkWriteBufferAppendBatch(b *testing.B) {
+	metrics := testBatch(1000)
+	days := &days1970.Days{}
+	wb := RowBinary.GetWriteBuffer()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		wb.Reset()
+		wb.AppendBatch(metrics, days, 1422642189)
+	}
+}
+
+func TestWriteBufferWriteDate(t *testing.T) {
+	table := []struct {
+		dateType string
+		expected []byte
+	}{
+		{RowBinary.DateTypeDate, []byte{0x51, 0x40}},
+		{RowBinary.DateTypeDate32, []byte{0x51, 0x40, 0, 0}},
+		{RowBinary.DateTypeDateTime, []byte{0x0d, 0xcc, 0xcb, 0x54}},
+	}
+
+	for _, c := range table {
+		wb := RowBinary.GetWriteBuffer()
+		// 2015-01-30
+		wb.WriteDate(c.dateType, 16465, 1422642189)
+
+		if !bytes.Equal(wb.Bytes(), c.expected) {
+			t.Fatalf("%s: %#v != %#v", c.dateType, wb.Bytes(), c.expected)
+		}
+		wb.Release()
+	}
+}
+
+func TestWriteBufferAppendRow(t *testing.T) {
+	ts := time.Unix(1422642189, 0)
+
+	table := [](struct {
+		col      interface{}
+		expected []byte
+	}){
+		{"hello", []byte("\x05hello")},
+		{"", []byte{0}},
+		{[]byte("abc"), []byte("abc")},
+		{int8(-2), []byte{0xFE}},
+		{uint8(200), []byte{200}},
+		{int16(-2), []byte{0xFE, 0xFF}},
+		{uint16(0x0102), []byte{0x02, 0x01}},
+		{int32(-2), []byte{0xFE, 0xFF, 0xFF, 0xFF}},
+		{uint32(0x01020304), []byte{0x04, 0x03, 0x02, 0x01}},
+		{int64(-2), []byte{0xFE, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{uint64(0x0102030405060708), []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}},
+		{float32(1.5), []byte{0x00, 0x00, 0xC0, 0x3F}},
+		{float64(1.5), []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xF8, 0x3F}},
+		{ts, []byte{0x0D, 0xCC, 0xCB, 0x54}},
+	}
+
+	for _, c := range table {
+		wb := RowBinary.GetWriteBuffer()
+		if err := wb.AppendRow(c.col); err != nil {
+			t.Fatalf("%T: %s", c.col, err)
+		}
+		if !bytes.Equal(wb.Bytes(), c.expected) {
+			t.Fatalf("%T %#v: %#v != %#v", c.col, c.col, wb.Bytes(), c.expected)
+		}
+		wb.Release()
+	}
+
+	wb := RowBinary.GetWriteBuffer()
+	defer wb.Release()
+
+	// unsupported column, nothing is written
+	if err := wb.AppendRow("hello", 42); err == nil || !wb.Empty() {
+		t.Fatalf("%#v, used %d", err, wb.Used)
+	}
+
+	// row doesn't fit
+	wb.Write(make([]byte, RowBinary.WriteBufferSize-10))
+	if err := wb.AppendRow(uint64(1), uint32(2)); err != RowBinary.ErrBufferFull || wb.Used != RowBinary.WriteBufferSize-10 {
+		t.Fatalf("%#v, used %d", err, wb.Used)
+	}
+	if err := wb.AppendRow(uint64(1), uint16(2)); err != nil || wb.Used != RowBinary.WriteBufferSize {
+		t.Fatalf("%#v, used %d", err, wb.Used)
+	}
+}
+
+// decodeRowBinary reads row of RowBinary encoding by ClickHouse types
+func decodeRowBinary(r *bytes.Reader, types []string) ([]interface{}, error) {
+	row := make([]interface{}, 0, len(types))
+	for _, typ := range types {
+		var v interface{}
+		switch typ {
+		case "String":
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			b := make([]byte, n)
+			if _, err = io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			v = string(b)
+		case "FixedString(4)":
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			v = b
+		case "Int8":
+			var x int8
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "UInt8":
+			var x uint8
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "Int16":
+			var x int16
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "UInt16":
+			var x uint16
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "Int32":
+			var x int32
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "UInt32":
+			var x uint32
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "Int64":
+			var x int64
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "UInt64":
+			var x uint64
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "Float32":
+			var x float32
+			binary.Read(r, binary.LittleEndian, &x)
+			v = x
+		case "Float64":
+			var x float64
+			if err := binary.Read(r, binary.LittleEndian, &x); err != nil {
+				return nil, err
+			}
+			v = x
+		case "DateTime":
+			var x uint32
+			if err := binary.Read(r, binary.LittleEndian, &x); err != nil {
+				return nil, err
+			}
+			v = time.Unix(int64(x), 0)
+		}
+		row = append(row, v)
+	}
+	return row, nil
+}
+
+func TestWriteBufferAppendRowRoundtrip(t *testing.T) {
+	types := []string{"String", "FixedString(4)", "Int8", "UInt8", "Int16", "UInt16", "Int32", "UInt32",
+		"Int64", "UInt64", "Float32", "Float64", "DateTime"}
+
+	rows := make([][]interface{}, 0)
+	for i := 0; i < 100; i++ {
+		rows = append(rows, []interface{}{
+			fmt.Sprintf("hello.world.%d", i), []byte(fmt.Sprintf("%04d", i)),
+			int8(-i), uint8(i), int16(-i * 100), uint16(i * 100), int32(-i * 100000), uint32(i * 100000),
+			int64(-i) << 40, uint64(i) << 40, float32(i) / 4, float64(i) / 3, time.Unix(1422642189+int64(i), 0),
+		})
+	}
+
+	wb := RowBinary.GetWriteBuffer()
+	defer wb.Release()
+	for _, row := range rows {
+		if err := wb.AppendRow(row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bytes.NewReader(wb.Bytes())
+	for i, expected := range rows {
+		row, err := decodeRowBinary(r, types)
+		if err != nil {
+			t.Fatalf("row %d: %s", i, err)
+		}
+		if !reflect.DeepEqual(row, expected) {
+			t.Fatalf("row %d: %#v != %#v", i, row, expected)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes left", r.Len())
+	}
+
+	// graphite point is readable by Reader of data files
+	graphite := RowBinary.GetWriteBuffer()
+	defer graphite.Release()
+	graphite.WriteGraphitePoint([]byte("hello.world"), 42, 1422642189, 16465, 1422642189)
+
+	wb.Reset()
+	if err := wb.AppendRow("hello.world", float64(42), uint32(1422642189), uint16(16465), uint32(1422642189)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wb.Bytes(), graphite.Bytes()) {
+		t.Fatalf("%#v != %#v", wb.Bytes(), graphite.Bytes())
+	}
+}
@@ -0,0 +1,31 @@
+package RowBinary
+
+const (
+	FormatRowBinary                  = "RowBinary"
+	FormatRowBinaryWithNamesAndTypes = "RowBinaryWithNamesAndTypes"
+)
+
+// WriteBufferWithNames is WriteBuffer prepended with RowBinaryWithNamesAndTypes header
+type WriteBufferWithNames struct {
+	WriteBuffer
+}
+
+func NewWriteBufferWithNames(names []string, types []string) *WriteBufferWithNames {
+	wb := &WriteBufferWithNames{}
+	wb.WriteHeader(names, types)
+	return wb
+}
+
+// WriteHeader resets buffer and writes header: columns count (varint), names, types
+func (wb *WriteBufferWithNames) WriteHeader(names []string, types []string) {
+	wb.Reset()
+	wb.WriteUVarint(uint64(len(names)))
+
+	for _, n := range names {
+		wb.WriteBytes([]byte(n))
+	}
+
+	for _, t := range types {
+		wb.WriteBytes([]byte(t))
+	}
+}
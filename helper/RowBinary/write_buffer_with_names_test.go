@@ -0,0 +1,70 @@
+package RowBinary
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func readString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, l)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func TestWriteBufferWithNames(t *testing.T) {
+	names := []string{"Path", "Value", "Time", "Date", "Timestamp"}
+	types := []string{"String", "Float64", "UInt32", "Date", "UInt32"}
+
+	wb := NewWriteBufferWithNames(names, types)
+	wb.WriteGraphitePoint([]byte("hello.world"), 42, 1422642189, 16465, 1422642189)
+
+	r := bufio.NewReader(bytes.NewReader(wb.Bytes()))
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int(count) != len(names) {
+		t.Fatalf("%d != %d", count, len(names))
+	}
+
+	for i := 0; i < len(names); i++ {
+		n, err := readString(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != names[i] {
+			t.Fatalf("%#v != %#v", n, names[i])
+		}
+	}
+
+	for i := 0; i < len(types); i++ {
+		n, err := readString(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != types[i] {
+			t.Fatalf("%#v != %#v", n, types[i])
+		}
+	}
+
+	name, err := readString(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "hello.world" {
+		t.Fatalf("%#v != %#v", name, "hello.world")
+	}
+}
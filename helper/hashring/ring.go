@@ -0,0 +1,98 @@
+package hashring
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Replicas is default count of virtual points of each node on ring
+const Replicas = 1024
+
+type point struct {
+	hash uint64
+	node int
+}
+
+type points []point
+
+func (p points) Len() int      { return len(p) }
+func (p points) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p points) Less(i, j int) bool {
+	if p[i].hash == p[j].hash {
+		return p[i].node < p[j].node
+	}
+	return p[i].hash < p[j].hash
+}
+
+// Ring is consistent hash ring of nodes. Result of Get depends only on set of nodes, not on their order.
+// Ring should be filled once (on config load). Get is read-only and safe for concurrent use without locks
+type Ring struct {
+	nodes  []string
+	points points
+}
+
+// hash is fnv-1a without allocation of hash.Hash64
+func hash(p []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range p {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return mix(h)
+}
+
+// mix is finalizer of murmur3. fnv of short similar keys is poorly distributed in high bits
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// New creates ring of nodes with replicas virtual points of each node
+func New(nodes []string, replicas int) *Ring {
+	r := &Ring{
+		nodes:  make([]string, len(nodes)),
+		points: make(points, 0, len(nodes)*replicas),
+	}
+
+	copy(r.nodes, nodes)
+	sort.Strings(r.nodes)
+
+	for i, node := range r.nodes {
+		for j := 0; j < replicas; j++ {
+			r.points = append(r.points, point{
+				hash: hash([]byte(node + "-" + strconv.Itoa(j))),
+				node: i,
+			})
+		}
+	}
+
+	sort.Sort(r.points)
+
+	return r
+}
+
+// Nodes returns sorted list of ring nodes
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// Get returns node of key. Empty string is returned for empty ring
+func (r *Ring) Get(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.nodes[r.points[i].node]
+}
@@ -0,0 +1,74 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingDistribution(t *testing.T) {
+	nodes := []string{"host1:2003", "host2:2003", "host3:2003"}
+
+	// each instance builds ring from own config. order of nodes should not matter
+	rings := []*Ring{
+		New([]string{"host1:2003", "host2:2003", "host3:2003"}, Replicas),
+		New([]string{"host2:2003", "host3:2003", "host1:2003"}, Replicas),
+		New([]string{"host3:2003", "host1:2003", "host2:2003"}, Replicas),
+	}
+
+	const count = 1000000
+	processed := make(map[string]int)
+
+	for i := 0; i < count; i++ {
+		name := []byte(fmt.Sprintf("servers.host%d.cpu.cpu%d.user", i/100, i%100))
+
+		// metric is processed locally only by instance of its node, others forward it
+		owners := 0
+		for j, r := range rings {
+			if r.Get(name) == nodes[j] {
+				processed[nodes[j]]++
+				owners++
+			}
+		}
+
+		if owners != 1 {
+			t.Fatalf("%s: processed %d times", name, owners)
+		}
+	}
+
+	for _, node := range nodes {
+		share := float64(processed[node]) / count
+		if share < 0.3 || share > 0.37 {
+			t.Fatalf("%s: %.4f of metrics", node, share)
+		}
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	r := New(nil, Replicas)
+	if r.Get([]byte("hello.world")) != "" {
+		t.FailNow()
+	}
+}
+
+func TestRingNodeRemoved(t *testing.T) {
+	r3 := New([]string{"host1:2003", "host2:2003", "host3:2003"}, Replicas)
+	r2 := New([]string{"host1:2003", "host2:2003"}, Replicas)
+
+	// only metrics of removed node are moved
+	for i := 0; i < 10000; i++ {
+		name := []byte(fmt.Sprintf("hello.world.%d", i))
+		if n := r3.Get(name); n != "host3:2003" && r2.Get(name) != n {
+			t.Fatalf("%s: %s -> %s", name, n, r2.Get(name))
+		}
+	}
+}
+
+func BenchmarkRingGet(b *testing.B) {
+	r := New([]string{"host1:2003", "host2:2003", "host3:2003"}, Replicas)
+	name := []byte("carbon.agents.localhost.cache.size")
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r.Get(name)
+	}
+}
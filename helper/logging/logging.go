@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/lomik/zapwriter"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// InstanceField is name of field with instance name added to every message
+const InstanceField = "instance"
+
+var (
+	instanceLock sync.RWMutex
+	instanceName string
+)
+
+// SetInstance sets instance name of loggers created by Logger after call. Empty name disables field
+func SetInstance(name string) {
+	instanceLock.Lock()
+	instanceName = name
+	instanceLock.Unlock()
+}
+
+// Instance returns current instance name
+func Instance() string {
+	instanceLock.RLock()
+	defer instanceLock.RUnlock()
+	return instanceName
+}
+
+// WithInstance wraps core of logger. All messages of result logger and its children have "instance" field
+func WithInstance(logger *zap.Logger, name string) *zap.Logger {
+	if name == "" {
+		return logger
+	}
+	fields := []zapcore.Field{zap.String(InstanceField, name)}
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return core.With(fields)
+	}))
+}
+
+// Logger returns named zapwriter logger with instance field
+func Logger(name string) *zap.Logger {
+	return WithInstance(zapwriter.Logger(name), Instance())
+}
@@ -0,0 +1,82 @@
+package receiver
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+var (
+	errBackpressure = errors.New("write queue is full, service unavailable")
+	errStopped      = errors.New("receiver stopped")
+)
+
+// Backpressure limits time of connection blocking on full write queue.
+// Zero timeout (and nil Backpressure) blocks until exit
+type Backpressure struct {
+	stat struct {
+		blocks uint32 // atomic
+		closed uint32 // atomic
+	}
+	timeout time.Duration
+}
+
+func NewBackpressure(timeout time.Duration) *Backpressure {
+	return &Backpressure{timeout: timeout}
+}
+
+// timer returns channel fired after timeout. Nil channel is returned for unlimited blocking
+func (bp *Backpressure) timer() (<-chan time.Time, func() bool) {
+	if bp == nil || bp.timeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(bp.timeout)
+	return t.C, t.Stop
+}
+
+func (bp *Backpressure) blocked() {
+	if bp != nil {
+		atomic.AddUint32(&bp.stat.blocks, 1)
+	}
+}
+
+func (bp *Backpressure) timedOut() {
+	if bp != nil {
+		atomic.AddUint32(&bp.stat.closed, 1)
+	}
+}
+
+// Send writes wb to out. Returns errBackpressure if out is blocked longer than timeout
+func (bp *Backpressure) Send(exit chan struct{}, out chan *RowBinary.WriteBuffer, wb *RowBinary.WriteBuffer) error {
+	select {
+	case out <- wb:
+		return nil
+	default:
+	}
+
+	bp.blocked()
+	timeout, stop := bp.timer()
+	defer stop()
+
+	select {
+	case out <- wb:
+		return nil
+	case <-exit:
+		return errStopped
+	case <-timeout:
+		bp.timedOut()
+		return errBackpressure
+	}
+}
+
+func (bp *Backpressure) Stat(send func(metric string, value float64)) {
+	blocks := atomic.LoadUint32(&bp.stat.blocks)
+	atomic.AddUint32(&bp.stat.blocks, -blocks)
+	send("backpressureBlocks", float64(blocks))
+
+	closed := atomic.LoadUint32(&bp.stat.closed)
+	atomic.AddUint32(&bp.stat.closed, -closed)
+	send("closedBackpressure", float64(closed))
+}
@@ -0,0 +1,79 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+func TestTCPBackpressureTimeout(t *testing.T) {
+	// no parse threads. connection is blocked on first line
+	r, err := New("tcp://127.0.0.1:0",
+		WriteChan(make(chan *RowBinary.WriteBuffer)),
+		BackpressureTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*TCP)
+
+	conn, err := net.Dial("tcp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("hello.world 42 1422642189\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitClosed(t, conn, time.Second)
+
+	if n := atomic.LoadUint32(&rcv.backpressure.stat.blocks); n != 1 {
+		t.Fatalf("blocks: %d", n)
+	}
+	if n := atomic.LoadUint32(&rcv.backpressure.stat.closed); n != 1 {
+		t.Fatalf("closed: %d", n)
+	}
+}
+
+func TestPickleBackpressureTimeout(t *testing.T) {
+	// nobody reads write queue
+	r, err := New("pickle://127.0.0.1:0",
+		WriteChan(make(chan *RowBinary.WriteBuffer)),
+		BackpressureTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Pickle)
+
+	conn, err := net.Dial("tcp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	message := pickleTestMessage(10, time.Now().Unix())
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(message)))
+
+	if _, err = conn.Write(append(size, message...)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitClosed(t, conn, time.Second)
+
+	if n := atomic.LoadUint32(&rcv.backpressure.stat.closed); n != 1 {
+		t.Fatalf("closed: %d", n)
+	}
+	if n := atomic.LoadUint32(&rcv.stat.errors); n != 0 {
+		t.Fatalf("errors: %d", n)
+	}
+}
@@ -2,16 +2,20 @@ package receiver
 
 import "sync"
 
+// BufferSize is initial size of Buffer. Buffer is grown for lines longer than BufferSize
+const BufferSize = 262144
+
 var BufferPool = sync.Pool{
 	New: func() interface{} {
-		return &Buffer{}
+		return &Buffer{Body: make([]byte, BufferSize)}
 	},
 }
 
 type Buffer struct {
 	Time uint32
 	Used int
-	Body [262144]byte
+	Body []byte
+	pool *sync.Pool // returned to own pool instead of BufferPool if set
 }
 
 func GetBuffer() *Buffer {
@@ -24,10 +28,34 @@ func (b *Buffer) Reset() *Buffer {
 }
 
 func (b *Buffer) Release() {
+	if b.pool != nil {
+		// received data is not kept in pool. Packets are read to start of Body, bytes after Used are zero
+		used := b.Body[:b.Used]
+		for i := range used {
+			used[i] = 0
+		}
+		b.Used = 0
+		b.pool.Put(b)
+		return
+	}
 	b.Used = 0
+	if len(b.Body) > BufferSize {
+		// don't keep grown buffers in pool
+		return
+	}
 	BufferPool.Put(b)
 }
 
+// Grow extends Body to size bytes keeping used data
+func (b *Buffer) Grow(size int) {
+	if size <= len(b.Body) {
+		return
+	}
+	body := make([]byte, size)
+	copy(body, b.Body[:b.Used])
+	b.Body = body
+}
+
 func (b *Buffer) Write(p []byte) {
 	b.Used += copy(b.Body[b.Used:], p)
 }
@@ -0,0 +1,69 @@
+package receiver
+
+import (
+	"net"
+	"time"
+)
+
+// deadlineReader sets read deadline around each read.
+// idleTimeout limits waiting of any data, readTimeout limits receiving of started line or message. Zero timeout is disabled.
+// Only time spent in reads is counted by readTimeout, so blocking of connection on full queues doesn't close it
+type deadlineReader struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+	readTimeout time.Duration
+	started     bool          // receiving of current line or message is started
+	reading     time.Duration // time of reads since start
+	timedOut    bool          // idle timeout exceeded
+	slowRead    bool          // read timeout exceeded
+}
+
+// Start marks start of line or message receiving
+func (r *deadlineReader) Start() {
+	r.started = true
+	r.reading = 0
+}
+
+// Finish marks that nothing is pending
+func (r *deadlineReader) Finish() {
+	r.started = false
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	var deadline time.Time
+	readLimited := false
+	now := time.Now()
+
+	if r.idleTimeout > 0 {
+		deadline = now.Add(r.idleTimeout)
+	}
+
+	if r.readTimeout > 0 && r.started {
+		if d := now.Add(r.readTimeout - r.reading); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+			readLimited = true
+		}
+	}
+
+	if !deadline.IsZero() {
+		r.conn.SetReadDeadline(deadline)
+	}
+
+	n, err := r.conn.Read(p)
+
+	if !deadline.IsZero() {
+		r.conn.SetReadDeadline(time.Time{})
+	}
+	if r.started {
+		r.reading += time.Since(now)
+	}
+
+	if err != nil && isTimeout(err) {
+		if readLimited {
+			r.slowRead = true
+		} else {
+			r.timedOut = true
+		}
+	}
+	return n, err
+}
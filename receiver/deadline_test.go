@@ -0,0 +1,152 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// slowSender writes prefix and then data by one byte with interval until write fails
+func slowSender(conn net.Conn, prefix []byte, data []byte, interval time.Duration) chan bool {
+	closed := make(chan bool)
+
+	go func() {
+		defer close(closed)
+		if _, err := conn.Write(prefix); err != nil {
+			return
+		}
+		for i := 0; ; i++ {
+			if _, err := conn.Write(data[i%len(data) : i%len(data)+1]); err != nil {
+				return
+			}
+			time.Sleep(interval)
+		}
+	}()
+
+	return closed
+}
+
+func TestTCPReadTimeout(t *testing.T) {
+	r, err := New("tcp://127.0.0.1:0",
+		WriteChan(make(chan *RowBinary.WriteBuffer, 16)),
+		IdleTimeout(200*time.Millisecond),
+		ReadTimeout(300*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*TCP)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go rcv.HandleConnection(nil, server)
+
+	// active sender, but line is never finished
+	closed := slowSender(client, nil, []byte("slow.metric"), 50*time.Millisecond)
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow connection is not closed")
+	}
+
+	if n := atomic.LoadUint32(&rcv.stat.closedSlowRead); n != 1 {
+		t.Fatalf("closedSlowRead: %d", n)
+	}
+	if n := atomic.LoadUint32(&rcv.stat.closedIdle); n != 0 {
+		t.Fatalf("closedIdle: %d", n)
+	}
+}
+
+func TestPickleReadTimeout(t *testing.T) {
+	r, err := New("pickle://127.0.0.1:0",
+		WriteChan(make(chan *RowBinary.WriteBuffer, 16)),
+		IdleTimeout(200*time.Millisecond),
+		ReadTimeout(300*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Pickle)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go rcv.HandleConnection(nil, server)
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, 1024*1024)
+
+	closed := slowSender(client, size, []byte("(lp0\n"), 50*time.Millisecond)
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow connection is not closed")
+	}
+
+	if n := atomic.LoadUint32(&rcv.stat.closedSlowRead); n != 1 {
+		t.Fatalf("closedSlowRead: %d", n)
+	}
+	if n := atomic.LoadUint32(&rcv.stat.closedIdle); n != 0 {
+		t.Fatalf("closedIdle: %d", n)
+	}
+}
+
+func TestPickleReadTimeoutBackpressure(t *testing.T) {
+	out := make(chan *RowBinary.WriteBuffer)
+	r, err := New("pickle://127.0.0.1:0",
+		WriteChan(out),
+		ReadTimeout(100*time.Millisecond),
+		BackpressureTimeout(0),
+		MaxPickleBatchSize(100),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Pickle)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go rcv.HandleConnection(nil, server)
+
+	// message is larger than read buffer, rest of message is read after blocking on write queue
+	message := pickleTestMessage(2000, time.Now().Unix())
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(message)))
+	go func() {
+		client.Write(size)
+		client.Write(message)
+	}()
+
+	wb := <-out
+	received := writeBufferCount(t, wb)
+	wb.Release()
+	time.Sleep(300 * time.Millisecond)
+
+	for received < 2000 {
+		select {
+		case wb = <-out:
+			received += writeBufferCount(t, wb)
+			wb.Release()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %d", received)
+		}
+	}
+
+	if n := atomic.LoadUint32(&rcv.stat.closedSlowRead); n != 0 {
+		t.Fatalf("closedSlowRead: %d", n)
+	}
+	if n := atomic.LoadInt32(&rcv.stat.active); n != 1 {
+		t.Fatalf("active: %d", n)
+	}
+}
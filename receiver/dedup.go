@@ -0,0 +1,159 @@
+package receiver
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupMaxSize is default count of points remembered by Dedup
+const DedupMaxSize = 1000000
+
+// limits of independently locked shards of Dedup. Each shard remembers at least dedupMinShardSize points
+const (
+	dedupMaxShards    = 64
+	dedupMinShardSize = 1024
+)
+
+// dedupKey is 64-bit FNV-1a hash of name with timestamp. Names aren't copied, point with colliding hash
+// of name is dropped as duplicate
+type dedupKey struct {
+	hash      uint64
+	timestamp uint32
+}
+
+type dedupPoint struct {
+	dedupKey
+	value    float64
+	received time.Time
+}
+
+// dedupShard is LRU of points with hash of name in shard
+type dedupShard struct {
+	sync.Mutex
+	lru    *list.List                 // *dedupPoint, recently received first
+	points map[dedupKey]*list.Element // keys of points from lru
+}
+
+// Dedup drops points with same name and timestamp received again within window. If matchValue is set
+// then only points with same value are duplicates, point with other value is correction and it is kept.
+// Points are kept in LRU with TTL of window, sharded by hash of name. The least recently received points
+// of shard are forgotten over shard part of maxSize
+type Dedup struct {
+	window       time.Duration
+	matchValue   bool
+	maxShardSize int
+	now          func() time.Time
+	stat         struct {
+		dropped uint32 // atomic
+	}
+	shards []dedupShard
+}
+
+func NewDedup(window time.Duration, matchValue bool, maxSize int) *Dedup {
+	if maxSize <= 0 {
+		maxSize = DedupMaxSize
+	}
+
+	count := maxSize / dedupMinShardSize
+	if count < 1 {
+		count = 1
+	}
+	if count > dedupMaxShards {
+		count = dedupMaxShards
+	}
+
+	d := &Dedup{
+		window:       window,
+		matchValue:   matchValue,
+		maxShardSize: (maxSize + count - 1) / count,
+		now:          time.Now,
+		shards:       make([]dedupShard, count),
+	}
+	for i := range d.shards {
+		d.shards[i].lru = list.New()
+		d.shards[i].points = make(map[dedupKey]*list.Element)
+	}
+	return d
+}
+
+// hashName returns 64-bit FNV-1a hash of name
+func hashName(name []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range name {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// duplicate returns true if point should be dropped. Safe for nil receiver
+func (d *Dedup) duplicate(name []byte, value float64, timestamp uint32) bool {
+	if d == nil {
+		return false
+	}
+
+	now := d.now()
+	key := dedupKey{hashName(name), timestamp}
+	s := &d.shards[key.hash%uint64(len(d.shards))]
+
+	s.Lock()
+	defer s.Unlock()
+
+	d.expire(s, now)
+
+	if e := s.points[key]; e != nil {
+		p := e.Value.(*dedupPoint)
+		if !d.matchValue || p.value == value {
+			atomic.AddUint32(&d.stat.dropped, 1)
+			return true
+		}
+		// correction of value starts new window
+		p.value = value
+		p.received = now
+		s.lru.MoveToFront(e)
+		return false
+	}
+
+	if s.lru.Len() >= d.maxShardSize {
+		p := s.lru.Remove(s.lru.Back()).(*dedupPoint)
+		delete(s.points, p.dedupKey)
+	}
+
+	p := &dedupPoint{dedupKey: key, value: value, received: now}
+	s.points[key] = s.lru.PushFront(p)
+	return false
+}
+
+// expire removes points of shard received longer than window ago. Shard is locked by caller
+func (d *Dedup) expire(s *dedupShard, now time.Time) {
+	for e := s.lru.Back(); e != nil; e = s.lru.Back() {
+		p := e.Value.(*dedupPoint)
+		if now.Sub(p.received) < d.window {
+			return
+		}
+		s.lru.Remove(e)
+		delete(s.points, p.dedupKey)
+	}
+}
+
+// Size returns count of remembered points
+func (d *Dedup) Size() int {
+	size := 0
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.Lock()
+		size += s.lru.Len()
+		s.Unlock()
+	}
+	return size
+}
+
+func (d *Dedup) Stat(send func(metric string, value float64)) {
+	dropped := atomic.LoadUint32(&d.stat.dropped)
+	atomic.AddUint32(&d.stat.dropped, -dropped)
+	send("dropped", float64(dropped))
+
+	send("size", float64(d.Size()))
+}
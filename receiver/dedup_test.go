@@ -0,0 +1,195 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestDedup(t *testing.T) {
+	type point struct {
+		name      string
+		value     float64
+		timestamp uint32
+		after     time.Duration // since previous point
+	}
+
+	first := point{"a.b.c", 42, 1422642189, 0}
+	tests := []struct {
+		name       string
+		matchValue bool
+		second     point
+		duplicate  bool
+	}{
+		{"same value", false, point{"a.b.c", 42, 1422642189, time.Second}, true},
+		{"same value, match value", true, point{"a.b.c", 42, 1422642189, time.Second}, true},
+		{"other value", false, point{"a.b.c", 43, 1422642189, time.Second}, true},
+		{"other value, match value", true, point{"a.b.c", 43, 1422642189, time.Second}, false},
+		{"other timestamp", false, point{"a.b.c", 42, 1422642190, time.Second}, false},
+		{"other timestamp, match value", true, point{"a.b.c", 42, 1422642190, time.Second}, false},
+		{"other name", false, point{"a.b.d", 42, 1422642189, time.Second}, false},
+		{"other name, match value", true, point{"a.b.d", 42, 1422642189, time.Second}, false},
+		{"after window", false, point{"a.b.c", 42, 1422642189, 10 * time.Second}, false},
+		{"after window, match value", true, point{"a.b.c", 42, 1422642189, 10 * time.Second}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(1422642189, 0)
+			d := NewDedup(10*time.Second, test.matchValue, 0)
+			d.now = func() time.Time { return now }
+
+			if d.duplicate([]byte(first.name), first.value, first.timestamp) {
+				t.Fatal("first point is duplicate")
+			}
+
+			now = now.Add(test.second.after)
+			if d.duplicate([]byte(test.second.name), test.second.value, test.second.timestamp) != test.duplicate {
+				t.Fatalf("duplicate is not %v", test.duplicate)
+			}
+
+			dropped := 0
+			if test.duplicate {
+				dropped = 1
+			}
+			stat := make(map[string]float64)
+			d.Stat(func(metric string, value float64) {
+				stat[metric] = value
+			})
+			if stat["dropped"] != float64(dropped) {
+				t.Fatalf("%#v", stat)
+			}
+		})
+	}
+
+	var nilDedup *Dedup
+	if nilDedup.duplicate([]byte("a.b.c"), 42, 1422642189) {
+		t.Fatal("nil dedup drops points")
+	}
+}
+
+func TestDedupCorrection(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	d := NewDedup(10*time.Second, true, 0)
+	d.now = func() time.Time { return now }
+
+	d.duplicate([]byte("a.b.c"), 42, 1422642189)
+
+	// corrected value replaces remembered one and starts new window
+	now = now.Add(5 * time.Second)
+	if d.duplicate([]byte("a.b.c"), 43, 1422642189) {
+		t.Fatal("correction is dropped")
+	}
+	now = now.Add(8 * time.Second)
+	if d.duplicate([]byte("a.b.c"), 42, 1422642189) {
+		t.Fatal("old value is dropped")
+	}
+	if !d.duplicate([]byte("a.b.c"), 42, 1422642189) {
+		t.Fatal("duplicate of old value is kept")
+	}
+}
+
+func TestDedupMaxSize(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	d := NewDedup(time.Minute, false, 3)
+	d.now = func() time.Time { return now }
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if d.duplicate([]byte(name), 1, 1422642189) {
+			t.Fatalf("%s is duplicate", name)
+		}
+		now = now.Add(time.Second)
+	}
+	if d.Size() != 3 {
+		t.Fatalf("size: %d", d.Size())
+	}
+
+	// least recently received is forgotten
+	if d.duplicate([]byte("a"), 1, 1422642189) {
+		t.Fatal("a is remembered")
+	}
+	if !d.duplicate([]byte("d"), 1, 1422642189) {
+		t.Fatal("d is forgotten")
+	}
+
+	// expired points are removed
+	now = now.Add(time.Minute)
+	d.duplicate([]byte("e"), 1, 1422642189)
+	if d.Size() != 1 {
+		t.Fatalf("size: %d", d.Size())
+	}
+}
+
+func TestDedupParse(t *testing.T) {
+	d := NewDedup(time.Minute, false, 0)
+
+	buf := GetBuffer()
+	buf.Used = copy(buf.Body, "a.b.c 1 1422642189\na.b.c 1 1422642189\na.b.c 2 1422642189\na.b.c 1 1422642190\n")
+	buf.Time = 1422642189
+
+	out := make(chan *RowBinary.WriteBuffer, 2)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{Dedup: d})
+
+	// dropped duplicate is not error
+	if received != 2 || errors != 0 {
+		t.Fatalf("received: %d, errors: %d", received, errors)
+	}
+	(<-out).Release()
+
+	// pickle points of same name and timestamp are dropped too
+	received = 0
+	err := PickleParseStream(nil, bufio.NewReader(bytes.NewReader(pickleTestMessage(3, 1422642189))), 1422642189, out, &days1970.Days{},
+		&received, &errors, nil, &ParseOptions{Dedup: d}, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PickleParseStream(nil, bufio.NewReader(bytes.NewReader(pickleTestMessage(3, 1422642189))), 1422642189, out, &days1970.Days{},
+		&received, &errors, nil, &ParseOptions{Dedup: d}, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != 3 || errors != 0 {
+		t.Fatalf("received: %d, errors: %d", received, errors)
+	}
+}
+
+func TestDedupShards(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	d := NewDedup(time.Minute, false, DedupMaxSize)
+	d.now = func() time.Time { return now }
+	if len(d.shards) != dedupMaxShards || d.maxShardSize != (DedupMaxSize+dedupMaxShards-1)/dedupMaxShards {
+		t.Fatalf("shards: %d, size: %d", len(d.shards), d.maxShardSize)
+	}
+
+	// points are spread over shards, each of them is remembered
+	for i := 0; i < 10000; i++ {
+		if d.duplicate([]byte(fmt.Sprintf("a.b.c%d", i)), 1, 1422642189) {
+			t.Fatalf("%d is duplicate", i)
+		}
+	}
+	used := 0
+	for i := range d.shards {
+		if d.shards[i].lru.Len() > 0 {
+			used++
+		}
+	}
+	if used != dedupMaxShards || d.Size() != 10000 {
+		t.Fatalf("used shards: %d, size: %d", used, d.Size())
+	}
+	for i := 0; i < 10000; i++ {
+		if !d.duplicate([]byte(fmt.Sprintf("a.b.c%d", i)), 1, 1422642189) {
+			t.Fatalf("%d is not duplicate", i)
+		}
+	}
+
+	// small limit is kept by one shard
+	if d = NewDedup(time.Minute, false, 3); len(d.shards) != 1 || d.maxShardSize != 3 {
+		t.Fatalf("shards: %d, size: %d", len(d.shards), d.maxShardSize)
+	}
+}
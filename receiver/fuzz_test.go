@@ -0,0 +1,160 @@
+//go:build go1.18
+// +build go1.18
+
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+// Fuzz targets of parsers. Run one target with
+//   go test -run XXX -fuzz FuzzPlainParseBuffer -fuzztime 10m ./receiver
+// Failing inputs are saved to testdata/fuzz/<target> and replayed by go test
+
+var fuzzPlainSeeds = []string{
+	"carbon.agents.localhost.cache.size 1412351 1422642189\n",
+	"a.b.c 42 1422642189\nd.e.f 43.5 1422642190\n",
+	"  a.b.c   42   1422642189  \n",
+	"a.b.c\t42\t1422642189\n",
+	"a.b.c -42.5 1422642189\n",
+	"a.b.c -1e308 -1\n",
+	"a..b...c 1 1422642189\n",
+	"a.b.c NaN 1422642189\n",
+	"a.b.c +Inf 1422642189\n",
+	"a.b.c 1 1422642189.5\n",
+	"a.b.c 1\n",
+	"\n\n\n",
+	strings.Repeat("long.", 2000) + "name 1 1422642189\n",
+	"a.b\x00c 1 1422642189\n\x00\x00\x00\n",
+	"\xff\xfe\x80\x01 \x02 \x03\n",
+	"a.b.c 1 1422642189",
+}
+
+// decodeGraphitePoints returns names of points written by WriteGraphitePoint
+func decodeGraphitePoints(b []byte) ([]string, error) {
+	var names []string
+	for len(b) > 0 {
+		size, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < size+18 {
+			return names, errors.New("truncated point")
+		}
+		names = append(names, string(b[n:n+int(size)]))
+		b = b[n+int(size)+18:]
+	}
+	return names, nil
+}
+
+// checkWriteBuffers checks that buffers sent to out are valid and contain count points
+func checkWriteBuffers(t *testing.T, out chan *RowBinary.WriteBuffer, count uint32) {
+	var received uint32
+	for {
+		select {
+		case wb := <-out:
+			names, err := decodeGraphitePoints(wb.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range names {
+				if name == "" {
+					t.Fatal("empty name")
+				}
+			}
+			received += uint32(len(names))
+			wb.Release()
+		default:
+			if received != count {
+				t.Fatalf("points: %d, metrics received: %d", received, count)
+			}
+			return
+		}
+	}
+}
+
+// withTimeout fails test if f is not finished in second
+func withTimeout(t *testing.T, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("parser is blocked")
+	}
+}
+
+func FuzzPlainParseLine(f *testing.F) {
+	for _, s := range fuzzPlainSeeds {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		input := string(line)
+		name, _, _, err := PlainParseLine(line)
+		if err != nil {
+			return
+		}
+		if len(name) == 0 {
+			t.Fatalf("empty name of %#v", input)
+		}
+		if bytes.Contains(name, []byte("..")) {
+			t.Fatalf("double dot in name %#v", string(name))
+		}
+		if string(line) != input {
+			t.Fatalf("line modified: %#v", string(line))
+		}
+	})
+}
+
+// FuzzPlainParseBuffer parses buffers of tcp receiver and udp packets
+func FuzzPlainParseBuffer(f *testing.F) {
+	for _, s := range fuzzPlainSeeds {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buf := GetBuffer()
+		defer buf.Release()
+		buf.Used = copy(buf.Body, data)
+		buf.Time = 1422642189
+
+		out := make(chan *RowBinary.WriteBuffer, len(data)/8+1)
+		var received, errors uint32
+		withTimeout(t, func() {
+			PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, nil)
+		})
+		checkWriteBuffers(t, out, received)
+	})
+}
+
+// FuzzPickleParseStream parses payload of pickle frame
+func FuzzPickleParseStream(f *testing.F) {
+	f.Add(pickleTestMessage(1, 1422642189))
+	f.Add(pickleTestMessage(3, -1))
+	f.Add([]byte("(lp0\n(S'a.b.c'\np1\n(I1422642189\nF42.0\ntp2\ntp3\na."))
+	f.Add([]byte("\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cJ\x15\x1e\xcbTG@E\x00\x00\x00\x00\x00\x00\x86\x86e."))
+	f.Add([]byte("\x80\x02]q\x00(X\x05\x00\x00\x00a\x00b.cJ\x15\x1e\xcbTG\xc0E\x00\x00\x00\x00\x00\x00\x87e."))
+	f.Add([]byte("\x80\x02]q\x00(X\xff\xff\xff\x7fa"))
+	f.Add([]byte("\x00\x00\x00\x00\xff\xfe"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out := make(chan *RowBinary.WriteBuffer, len(data)/8+1)
+		var received, errors uint32
+		withTimeout(t, func() {
+			PickleParseStream(nil, bufio.NewReader(bytes.NewReader(data)), 1422642189, out, &days1970.Days{},
+				&received, &errors, nil, nil, PickleFormatAuto, 0, nil)
+		})
+		checkWriteBuffers(t, out, received)
+	})
+}
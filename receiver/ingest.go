@@ -0,0 +1,213 @@
+package receiver
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"go.uber.org/zap"
+)
+
+// ErrQueueFull is returned by Ingest if write queue is blocked longer than backpressure timeout
+var ErrQueueFull = errBackpressure
+
+// Metric is point passed to Ingest by embedding application
+type Metric struct {
+	Name      string
+	Value     float64
+	Timestamp int64
+}
+
+// Ingest receives metrics from function calls. Metrics are formatted as plain lines and parsed
+// by PlainParseBuffer, so they are filtered, rewritten and validated like metrics of TCP receiver
+type Ingest struct {
+	stat struct {
+		metricsReceivedTotal uint64 // atomic. since start, updated by Stat
+		errorsTotal          uint64 // atomic. since start, updated by Stat
+		metricsReceived      uint32 // atomic
+		errors               uint32 // atomic
+		pending              int32  // atomic. running Ingest calls
+	}
+	writeChan    chan *RowBinary.WriteBuffer
+	parseErrors  *ParseErrors
+	namespaces   *Namespaces
+	sharding     *Sharding
+	stripPrefix  *PrefixStripper
+	sanitizer    *Sanitizer
+	tenants      *Tenants
+	rateLimits   *RateLimits
+	newest       *NewestTimestamp
+	transforms   *Transforms
+	dedup        *Dedup
+	ready        readiness
+	backpressure *Backpressure
+	exit         chan struct{}
+	stopOnce     sync.Once
+	logger       *zap.Logger
+}
+
+// MetricsReceivedTotal returns count of received metrics since start
+func (rcv *Ingest) MetricsReceivedTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.metricsReceivedTotal) + uint64(atomic.LoadUint32(&rcv.stat.metricsReceived))
+}
+
+// ErrorsTotal returns count of dropped bad metrics since start
+func (rcv *Ingest) ErrorsTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.errorsTotal) + uint64(atomic.LoadUint32(&rcv.stat.errors))
+}
+
+// Stats returns counters since start
+func (rcv *Ingest) Stats() ReceiverStats {
+	return ReceiverStats{
+		ReceivedTotal: rcv.MetricsReceivedTotal(),
+		ParseErrors:   rcv.ErrorsTotal(),
+	}
+}
+
+// Ready is closed on creation, there is no receive loop
+func (rcv *Ingest) Ready() <-chan struct{} {
+	return rcv.ready.ch
+}
+
+// Idle returns true if there are no running Ingest calls
+func (rcv *Ingest) Idle() bool {
+	return atomic.LoadInt32(&rcv.stat.pending) == 0
+}
+
+func (rcv *Ingest) Stat(send func(metric string, value float64)) {
+	metricsReceived := atomic.LoadUint32(&rcv.stat.metricsReceived)
+	atomic.AddUint32(&rcv.stat.metricsReceived, -metricsReceived)
+	atomic.AddUint64(&rcv.stat.metricsReceivedTotal, uint64(metricsReceived))
+	send("metricsReceived", float64(metricsReceived))
+
+	errors := atomic.LoadUint32(&rcv.stat.errors)
+	atomic.AddUint32(&rcv.stat.errors, -errors)
+	atomic.AddUint64(&rcv.stat.errorsTotal, uint64(errors))
+	send("errors", float64(errors))
+
+	rcv.parseErrors.Stat(send)
+	rcv.stripPrefix.Stat(send)
+	rcv.sanitizer.Stat(send)
+	rcv.backpressure.Stat(send)
+}
+
+// Stop interrupts blocked Ingest calls, they return errStopped. Next calls fail immediately
+func (rcv *Ingest) Stop() {
+	rcv.stopOnce.Do(func() {
+		close(rcv.exit)
+	})
+}
+
+// buffers formats metrics as plain lines. Names with line breaks are dropped as bad lines
+func (rcv *Ingest) buffers(metrics []Metric) []*Buffer {
+	now := uint32(time.Now().Unix())
+	b := GetBuffer()
+	b.Time = now
+	result := []*Buffer{b}
+
+	var line []byte
+	for _, m := range metrics {
+		line = append(line[:0], m.Name...)
+		line = append(line, ' ')
+		line = strconv.AppendFloat(line, m.Value, 'g', -1, 64)
+		line = append(line, ' ')
+		line = strconv.AppendInt(line, m.Timestamp, 10)
+
+		if strings.IndexAny(m.Name, "\r\n") >= 0 {
+			atomic.AddUint32(&rcv.stat.errors, 1)
+			rcv.parseErrors.Add(errFieldCount, line)
+			continue
+		}
+		line = append(line, '\n')
+
+		if b.Used+len(line) > len(b.Body) {
+			if b.Used > 0 {
+				b = GetBuffer()
+				b.Time = now
+				result = append(result, b)
+			}
+			b.Grow(len(line))
+		}
+		b.Write(line)
+	}
+
+	return result
+}
+
+// Ingest parses metrics and sends them to write channel. Bad metrics are dropped and counted in errors.
+// Returns ErrQueueFull if write channel is blocked longer than backpressure timeout, metrics before blocked
+// buffer are written already
+func (rcv *Ingest) Ingest(metrics []Metric) error {
+	atomic.AddInt32(&rcv.stat.pending, 1)
+	defer atomic.AddInt32(&rcv.stat.pending, -1)
+
+	select {
+	case <-rcv.exit:
+		return errStopped
+	default:
+	}
+
+	buffers := rcv.buffers(metrics)
+	parsed := make(chan *RowBinary.WriteBuffer)
+	cancel := make(chan struct{})
+
+	go func() {
+		defer close(parsed)
+		days := &days1970.Days{}
+		parseOptions := rcv.parseOptions()
+		for i, b := range buffers {
+			select {
+			case <-cancel:
+				for _, rest := range buffers[i:] {
+					rest.Release()
+				}
+				return
+			default:
+			}
+
+			PlainParseBuffer(
+				cancel,
+				b,
+				parsed,
+				days,
+				&rcv.stat.metricsReceived,
+				&rcv.stat.errors,
+				parseOptions,
+			)
+			b.Release()
+		}
+	}()
+
+	var err error
+	for wb := range parsed {
+		if err == nil {
+			if err = rcv.backpressure.Send(rcv.exit, rcv.writeChan, wb); err == nil {
+				continue
+			}
+			close(cancel)
+		}
+		wb.Release()
+	}
+
+	return err
+}
+
+// parseOptions returns stages of parsed metrics set by options
+func (rcv *Ingest) parseOptions() *ParseOptions {
+	return &ParseOptions{
+		ParseErrors: rcv.parseErrors,
+		Namespaces:  rcv.namespaces,
+		Sharding:    rcv.sharding,
+		StripPrefix: rcv.stripPrefix,
+		Sanitizer:   rcv.sanitizer,
+		Tenants:     rcv.tenants,
+		Newest:      rcv.newest,
+		Transforms:  rcv.transforms,
+		Dedup:       rcv.dedup,
+		RateLimits:  rcv.rateLimits,
+	}
+}
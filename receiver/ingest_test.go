@@ -0,0 +1,118 @@
+package receiver
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+func TestIngest(t *testing.T) {
+	out := make(chan *RowBinary.WriteBuffer, 1024)
+
+	r, err := New("ingest://",
+		WriteChan(out),
+		StripPrefix("dc1."),
+		SanitizeNames(true, "_"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Ingest)
+
+	select {
+	case <-rcv.Ready():
+	default:
+		t.Fatal("ingest is not ready")
+	}
+
+	now := time.Now().Unix()
+	err = rcv.Ingest([]Metric{
+		{Name: "dc1.servers.web01.cpu", Value: 42, Timestamp: now},
+		{Name: "servers.web 02.cpu", Value: 0.5, Timestamp: now},
+		{Name: "servers.web03.cpu", Value: math.NaN(), Timestamp: now},
+		{Name: "servers.web04.cpu", Value: 1, Timestamp: -1},
+		{Name: "servers.web05.cpu\nservers.injected 1", Value: 1, Timestamp: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// name with space is parsed as line with wrong field count, like in tcp
+	names := readNames(t, out, 1, time.Second)
+	if !names["servers.web01.cpu"] || len(names) != 1 {
+		t.Fatalf("%#v", names)
+	}
+	if s := rcv.Stats(); s.ReceivedTotal != 1 || s.ParseErrors != 4 {
+		t.Fatalf("%#v", s)
+	}
+
+	// metrics are split to several buffers by size
+	metrics := make([]Metric, 100000)
+	for i := range metrics {
+		metrics[i] = Metric{Name: fmt.Sprintf("servers.web%06d.cpu", i), Value: float64(i), Timestamp: now}
+	}
+	done := make(chan error)
+	go func() {
+		done <- rcv.Ingest(metrics)
+	}()
+	if names = readNames(t, out, len(metrics), 5*time.Second); len(names) != len(metrics) {
+		t.Fatalf("received %d of %d", len(names), len(metrics))
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !rcv.Idle() {
+		t.Fatal("ingest is not idle")
+	}
+}
+
+func TestIngestQueueFull(t *testing.T) {
+	// nobody reads write queue
+	r, err := New("ingest://",
+		WriteChan(make(chan *RowBinary.WriteBuffer)),
+		BackpressureTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := r.(*Ingest)
+
+	metrics := []Metric{{Name: "hello.world", Value: 42, Timestamp: time.Now().Unix()}}
+	if err = rcv.Ingest(metrics); err != ErrQueueFull {
+		t.Fatalf("%#v", err)
+	}
+
+	stat := make(map[string]float64)
+	rcv.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["closedBackpressure"] != 1 || stat["metricsReceived"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// stop interrupts blocked call
+	rcv.backpressure = NewBackpressure(0)
+	done := make(chan error)
+	go func() {
+		done <- rcv.Ingest(metrics)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Stop()
+
+	select {
+	case err = <-done:
+		if err != errStopped {
+			t.Fatalf("%#v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ingest is not stopped")
+	}
+
+	if err = rcv.Ingest(metrics); err != errStopped {
+		t.Fatalf("%#v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// Modes of name validation
+const (
+	NameValidationOff    = "off"
+	NameValidationWarn   = "warn"   // names are logged and passed
+	NameValidationStrict = "strict" // names are dropped
+)
+
+var errInvalidName = errors.New("invalid name")
+
+// ValidationError is pathological pattern of metric name causing problems in ClickHouse or graphite-web
+type ValidationError struct {
+	Rule        string // name of counter
+	Description string
+}
+
+func (e ValidationError) Error() string {
+	return e.Description
+}
+
+// Catalog of checked patterns. Tags after first ';' are not checked
+var (
+	NameLeadingDot  = ValidationError{"leadingDot", "leading dot creates empty path component"}
+	NameTrailingDot = ValidationError{"trailingDot", "trailing dot creates empty path component"}
+	NameDoubleDot   = ValidationError{"doubleDot", "double dot creates ambiguous tree entries"}
+	NameNumeric     = ValidationError{"numeric", "number is parsed as constant by graphite-web"}
+	NameWildcard    = ValidationError{"wildcard", "wildcard characters *?[]{} can't be queried literally"}
+)
+
+// nameRules is catalog in order of bits of nameViolations
+var nameRules = [...]ValidationError{NameLeadingDot, NameTrailingDot, NameDoubleDot, NameNumeric, NameWildcard}
+
+// nameViolations returns bit mask of violated rules by index in nameRules
+func nameViolations(name []byte) uint32 {
+	if end := bytes.IndexByte(name, ';'); end >= 0 {
+		name = name[:end]
+	}
+	if len(name) == 0 {
+		return 0
+	}
+
+	var mask uint32
+	if name[0] == '.' {
+		mask |= 1 << 0
+	}
+	if name[len(name)-1] == '.' {
+		mask |= 1 << 1
+	}
+	if bytes.Contains(name, []byte("..")) {
+		mask |= 1 << 2
+	}
+	if numeric(name) {
+		mask |= 1 << 3
+	}
+	if bytes.IndexAny(name, "*?[]{}") >= 0 {
+		mask |= 1 << 4
+	}
+	return mask
+}
+
+// numeric returns true if name is float number
+func numeric(name []byte) bool {
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c == '.' || c == '-' || c == '+' || c == 'e' || c == 'E') {
+			return false
+		}
+	}
+	_, err := strconv.ParseFloat(string(name), 64)
+	return err == nil
+}
+
+// ValidateMetricName returns violated patterns of catalog. Nil for good name
+func ValidateMetricName(name string) []ValidationError {
+	mask := nameViolations([]byte(name))
+	if mask == 0 {
+		return nil
+	}
+
+	var violations []ValidationError
+	for i, rule := range nameRules {
+		if mask&(1<<uint(i)) != 0 {
+			violations = append(violations, rule)
+		}
+	}
+	return violations
+}
+
+// validateName counts violations of name. Returns errInvalidName in strict mode. Violations are logged in warn mode
+func (pe *ParseErrors) validateName(name []byte) error {
+	mask := nameViolations(name)
+	if mask == 0 {
+		return nil
+	}
+
+	var rules []string
+	for i, rule := range nameRules {
+		if mask&(1<<uint(i)) != 0 {
+			atomic.AddUint32(&pe.stat.invalidNames[i], 1)
+			rules = append(rules, rule.Rule)
+		}
+	}
+
+	if pe.nameValidation == NameValidationStrict {
+		return errInvalidName
+	}
+
+	if pe.allowLog() {
+		pe.logger.Warn("invalid metric name", zap.String("rules", strings.Join(rules, ",")), zap.String("name", truncate(name)))
+	}
+	return nil
+}
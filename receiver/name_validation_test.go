@@ -0,0 +1,131 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestValidateMetricName(t *testing.T) {
+	table := []struct {
+		name     string
+		expected []ValidationError
+	}{
+		{"hello.world", nil},
+		{"hello.world-2.p99", nil},
+		{"", nil},
+		{".hello.world", []ValidationError{NameLeadingDot}},
+		{"hello.world.", []ValidationError{NameTrailingDot}},
+		{"hello..world", []ValidationError{NameDoubleDot}},
+		{".hello..", []ValidationError{NameLeadingDot, NameTrailingDot, NameDoubleDot}},
+		{"42", []ValidationError{NameNumeric}},
+		{"1.5e3", []ValidationError{NameNumeric}},
+		{"1.5.3", nil},
+		{"e", nil},
+		{"hello.*.world", []ValidationError{NameWildcard}},
+		{"hello.{a,b}", []ValidationError{NameWildcard}},
+		{"hello.world;tag=.a..b*", nil},
+		{"42;tag=value", []ValidationError{NameNumeric}},
+	}
+
+	for _, c := range table {
+		v := ValidateMetricName(c.name)
+		if fmt.Sprintf("%#v", v) != fmt.Sprintf("%#v", c.expected) {
+			t.Fatalf("%#v: %#v != %#v", c.name, v, c.expected)
+		}
+	}
+}
+
+func TestParseErrorsNameValidation(t *testing.T) {
+	names := []string{"hello.world", "hello..world", "..hello", "42", "hello.world*"}
+
+	for _, mode := range []string{"", NameValidationOff, NameValidationWarn, NameValidationStrict} {
+		pe := NewParseErrors(zap.NewNop())
+		pe.nameValidation = mode
+
+		dropped := 0
+		for _, name := range names {
+			err := pe.CheckName([]byte(name))
+			if err == errInvalidName {
+				dropped++
+			} else if err != nil {
+				t.Fatalf("%s %#v: %#v", mode, name, err)
+			}
+		}
+
+		stat := make(map[string]float64)
+		pe.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+
+		switch mode {
+		case NameValidationWarn, NameValidationStrict:
+			expected := map[string]float64{
+				"invalidNames.leadingDot":  1,
+				"invalidNames.trailingDot": 0,
+				"invalidNames.doubleDot":   2,
+				"invalidNames.numeric":     1,
+				"invalidNames.wildcard":    1,
+			}
+			for k, v := range expected {
+				if stat[k] != v {
+					t.Fatalf("%s %s: %#v != %#v", mode, k, stat[k], v)
+				}
+			}
+		default:
+			if _, exists := stat["invalidNames.doubleDot"]; exists {
+				t.Fatalf("%s: %#v", mode, stat)
+			}
+		}
+
+		expectedDropped := 0
+		if mode == NameValidationStrict {
+			expectedDropped = 4
+		}
+		if dropped != expectedDropped {
+			t.Fatalf("%s: dropped %d", mode, dropped)
+		}
+	}
+}
+
+func TestPlainNameValidation(t *testing.T) {
+	// double dots are removed from names of plain lines after validation
+	for _, mode := range []string{NameValidationWarn, NameValidationStrict} {
+		pe := NewParseErrors(zap.NewNop())
+		pe.nameValidation = mode
+
+		out := make(chan *RowBinary.WriteBuffer, 1)
+		buf := GetBuffer()
+		buf.Time = 1422642189
+		buf.Write([]byte("hello..world 42 1422642189\nhello.world 43 1422642189\n"))
+
+		var received, errors uint32
+		PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{ParseErrors: pe})
+		buf.Release()
+
+		wb := <-out
+		count := bytes.Count(wb.Bytes(), []byte("hello.world"))
+		wb.Release()
+
+		stat := make(map[string]float64)
+		pe.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+		if stat["invalidNames.doubleDot"] != 1 {
+			t.Fatalf("%s: %#v", mode, stat)
+		}
+
+		expected := 2
+		if mode == NameValidationStrict {
+			expected = 1
+		}
+		if count != expected || received != uint32(expected) {
+			t.Fatalf("%s: written %d, received %d", mode, count, received)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package receiver
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// Namespaces counts received metrics by first components of metric path.
+// Each tree level up to depth is counted: metric servers.web01.cpu with depth 2 is counted in servers and servers.web01
+type Namespaces struct {
+	depth      int
+	maxEntries int32
+	entries    int32  // atomic. count of tree nodes
+	overflow   uint32 // atomic. metrics not counted due to maxEntries
+	root       *namespaceNode
+}
+
+type namespaceNode struct {
+	sync.RWMutex
+	count    uint32 // atomic
+	children map[string]*namespaceNode
+}
+
+func NewNamespaces(depth int, maxEntries int) *Namespaces {
+	return &Namespaces{
+		depth:      depth,
+		maxEntries: int32(maxEntries),
+		root:       &namespaceNode{children: make(map[string]*namespaceNode)},
+	}
+}
+
+// child returns existing or created node. Nil is returned if limit of entries reached
+func (ns *Namespaces) child(node *namespaceNode, name []byte) *namespaceNode {
+	node.RLock()
+	c := node.children[unsafeString(name)]
+	node.RUnlock()
+
+	if c != nil {
+		return c
+	}
+
+	node.Lock()
+	defer node.Unlock()
+
+	if c = node.children[unsafeString(name)]; c != nil {
+		return c
+	}
+
+	if atomic.AddInt32(&ns.entries, 1) > ns.maxEntries {
+		atomic.AddInt32(&ns.entries, -1)
+		return nil
+	}
+
+	c = &namespaceNode{children: make(map[string]*namespaceNode)}
+	node.children[string(name)] = c
+	return c
+}
+
+// Add counts metric name. Safe for nil receiver
+func (ns *Namespaces) Add(name []byte) {
+	if ns == nil {
+		return
+	}
+
+	node := ns.root
+	p := name
+	var c []byte
+
+	for level := 0; level < ns.depth && len(p) > 0; level++ {
+		if index := bytes.IndexByte(p, '.'); index >= 0 {
+			c, p = p[:index], p[index+1:]
+		} else {
+			c, p = p, nil
+		}
+
+		if len(c) == 0 {
+			return
+		}
+
+		if node = ns.child(node, c); node == nil {
+			atomic.AddUint32(&ns.overflow, 1)
+			return
+		}
+
+		atomic.AddUint32(&node.count, 1)
+	}
+}
+
+func (ns *Namespaces) stat(node *namespaceNode, prefix string, send func(metric string, value float64)) {
+	node.RLock()
+	defer node.RUnlock()
+
+	for name, c := range node.children {
+		count := atomic.LoadUint32(&c.count)
+		atomic.AddUint32(&c.count, -count)
+		send(prefix+name+".count", float64(count))
+
+		ns.stat(c, prefix+name+".", send)
+	}
+}
+
+func (ns *Namespaces) Stat(send func(metric string, value float64)) {
+	ns.stat(ns.root, "", send)
+
+	overflow := atomic.LoadUint32(&ns.overflow)
+	atomic.AddUint32(&ns.overflow, -overflow)
+	send("entriesOverflow", float64(overflow))
+}
@@ -0,0 +1,53 @@
+package receiver
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestNamespacesStat(t *testing.T) {
+	ns := NewNamespaces(2, 3)
+
+	// servers, servers.web01 and servers.web02 entries
+	ns.Add([]byte("servers.web01.cpu"))
+	ns.Add([]byte("servers.web02.cpu"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ns.Add([]byte("servers.web01.cpu"))
+			ns.Add([]byte("servers.web01.mem"))
+			ns.Add([]byte("servers.web02.cpu"))
+			// entries limit reached
+			ns.Add([]byte("hello"))
+			ns.Add([]byte("world.cpu"))
+		}()
+	}
+	wg.Wait()
+
+	expected := map[string]float64{
+		"servers.count":       14,
+		"servers.web01.count": 9,
+		"servers.web02.count": 5,
+		"entriesOverflow":     8,
+	}
+
+	for i := 0; i < 2; i++ {
+		stat := make(map[string]float64)
+		ns.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+
+		if !reflect.DeepEqual(stat, expected) {
+			t.Fatalf("%#v != %#v", stat, expected)
+		}
+
+		// counters are reset, entries are kept
+		for k := range expected {
+			expected[k] = 0
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package receiver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// NewestTimestamp tracks max timestamp of metrics received by all receivers since last Stat
+type NewestTimestamp struct {
+	value int64 // atomic. unix timestamp, 0 - no metrics
+	now   func() time.Time
+}
+
+func NewNewestTimestamp() *NewestTimestamp {
+	return &NewestTimestamp{now: time.Now}
+}
+
+// observe updates max timestamp. Safe for nil receiver
+func (n *NewestTimestamp) observe(timestamp uint32) {
+	if n == nil || timestamp == 0 {
+		return
+	}
+	for {
+		v := atomic.LoadInt64(&n.value)
+		if int64(timestamp) <= v || atomic.CompareAndSwapInt64(&n.value, v, int64(timestamp)) {
+			return
+		}
+	}
+}
+
+// Stat sends difference between now and newest timestamp received in interval. Nothing is sent if no metrics
+// were received. Negative age means timestamps in future
+func (n *NewestTimestamp) Stat(send func(metric string, value float64)) {
+	v := atomic.SwapInt64(&n.value, 0)
+	if v == 0 {
+		return
+	}
+	send("newestMetricTimestampAgeSeconds", n.now().Sub(time.Unix(v, 0)).Seconds())
+}
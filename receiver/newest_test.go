@@ -0,0 +1,59 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestNewestTimestamp(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	newest := NewNewestTimestamp()
+	newest.now = func() time.Time { return now }
+
+	stat := func() map[string]float64 {
+		m := make(map[string]float64)
+		newest.Stat(func(metric string, value float64) {
+			m[metric] = value
+		})
+		return m
+	}
+
+	buf := GetBuffer()
+	buf.Used = copy(buf.Body, "a.b 1 1422642069\na.c 2 1422642129\nbad\na.d 3 1422641589\n")
+	buf.Time = uint32(now.Unix())
+
+	out := make(chan *RowBinary.WriteBuffer, 2)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{Newest: newest})
+	if received != 3 {
+		t.Fatalf("received: %d", received)
+	}
+
+	// pickle timestamps are older
+	message := pickleTestMessage(10, now.Unix()-600)
+	err := PickleParseStream(nil, bufio.NewReader(bytes.NewReader(message)), uint32(now.Unix()), out, &days1970.Days{},
+		&received, &errors, nil, &ParseOptions{Newest: newest}, "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := stat(); m["newestMetricTimestampAgeSeconds"] != 60 {
+		t.Fatalf("%#v", m)
+	}
+
+	// nothing received in interval
+	if m := stat(); len(m) != 0 {
+		t.Fatalf("%#v", m)
+	}
+
+	// timestamp in future
+	newest.observe(uint32(now.Unix() + 30))
+	if m := stat(); m["newestMetricTimestampAgeSeconds"] != -30 {
+		t.Fatalf("%#v", m)
+	}
+}
@@ -0,0 +1,208 @@
+package receiver
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errFieldCount   = errors.New("wrong field count")
+	errBadValue     = errors.New("bad value")
+	errBadTimestamp = errors.New("bad timestamp")
+	errNameTooLong  = errors.New("name too long")
+	errNonASCII     = errors.New("non-ascii name")
+	errInvalidUTF8  = errors.New("invalid utf-8 name")
+	errTooDeep      = errors.New("name too deep")
+	errEmptyName    = errors.New("empty name")
+)
+
+const maxRawLineLog = 256
+
+// ParseErrors counts parse errors by type and logs it with rate limit
+type ParseErrors struct {
+	stat struct {
+		fieldCount   uint32                 // atomic
+		badValue     uint32                 // atomic
+		badTimestamp uint32                 // atomic
+		nameTooLong  uint32                 // atomic
+		nonASCII     uint32                 // atomic
+		invalidUTF8  uint32                 // atomic
+		tooDeep      uint32                 // atomic
+		emptyName    uint32                 // atomic
+		logDropped   uint32                 // atomic. messages not logged because of logRate
+		invalidNames [len(nameRules)]uint32 // atomic. by rules of catalog
+	}
+	allowUnicode   bool   // pass valid utf-8 names, otherwise only ascii names are allowed
+	maxDepth       int    // max count of dot-separated name components. 0 - unlimited
+	warnDepth      int    // log names with more components, but pass it. 0 - disabled
+	nameValidation string // mode of check of names by catalog of pathological patterns. Empty is off
+	logRate        uint32 // max logged errors per minute
+	logged         uint32 // atomic. logged errors in current minute
+	logMinute      int64  // atomic
+	logger         *zap.Logger
+}
+
+func NewParseErrors(logger *zap.Logger) *ParseErrors {
+	return &ParseErrors{
+		allowUnicode: true,
+		logRate:      100,
+		logger:       logger,
+	}
+}
+
+// CheckName returns error if metric name is not allowed: name deeper than maxDepth, non-ascii name
+// if unicode is disabled, invalid utf-8 otherwise or name with pathological pattern in strict mode of validation.
+// Nil receiver allows any name
+func (pe *ParseErrors) CheckName(name []byte) error {
+	return pe.checkName(name, true)
+}
+
+// checkPatterns validates name by catalog of pathological patterns if validation is enabled. Safe for nil receiver
+func (pe *ParseErrors) checkPatterns(name []byte) error {
+	if pe == nil || (pe.nameValidation != NameValidationWarn && pe.nameValidation != NameValidationStrict) {
+		return nil
+	}
+	return pe.validateName(name)
+}
+
+// checkName is CheckName with optional check of patterns. Plain receivers check patterns before removal of double dots
+func (pe *ParseErrors) checkName(name []byte, patterns bool) error {
+	if pe == nil {
+		return nil
+	}
+
+	if pe.maxDepth > 0 || pe.warnDepth > 0 {
+		depth := bytes.Count(name, []byte{'.'}) + 1
+		if pe.maxDepth > 0 && depth > pe.maxDepth {
+			return errTooDeep
+		}
+		if pe.warnDepth > 0 && depth > pe.warnDepth && pe.allowLog() {
+			pe.logger.Warn("deep metric name", zap.Int("depth", depth), zap.String("name", truncate(name)))
+		}
+	}
+
+	if patterns {
+		if err := pe.checkPatterns(name); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range name {
+		if c >= utf8.RuneSelf {
+			if !pe.allowUnicode {
+				return errNonASCII
+			}
+			if !utf8.Valid(name) {
+				return errInvalidUTF8
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Add counts error and logs it with raw line. Safe for nil receiver
+func (pe *ParseErrors) Add(err error, line []byte) {
+	if pe == nil {
+		return
+	}
+
+	switch err {
+	case errFieldCount:
+		atomic.AddUint32(&pe.stat.fieldCount, 1)
+	case errBadValue:
+		atomic.AddUint32(&pe.stat.badValue, 1)
+	case errBadTimestamp:
+		atomic.AddUint32(&pe.stat.badTimestamp, 1)
+	case errNameTooLong:
+		atomic.AddUint32(&pe.stat.nameTooLong, 1)
+	case errNonASCII:
+		atomic.AddUint32(&pe.stat.nonASCII, 1)
+	case errInvalidUTF8:
+		atomic.AddUint32(&pe.stat.invalidUTF8, 1)
+	case errTooDeep:
+		atomic.AddUint32(&pe.stat.tooDeep, 1)
+	case errEmptyName:
+		atomic.AddUint32(&pe.stat.emptyName, 1)
+	}
+
+	if !pe.allowLog() {
+		return
+	}
+
+	pe.logger.Warn("parse failed", zap.Error(err), zap.String("raw_line", truncate(line)))
+}
+
+// allowLog returns false if logRate messages are already logged in current minute
+func (pe *ParseErrors) allowLog() bool {
+	minute := time.Now().Unix() / 60
+	if atomic.LoadInt64(&pe.logMinute) != minute {
+		atomic.StoreInt64(&pe.logMinute, minute)
+		atomic.StoreUint32(&pe.logged, 0)
+	}
+
+	if atomic.AddUint32(&pe.logged, 1) > atomic.LoadUint32(&pe.logRate) {
+		atomic.AddUint32(&pe.stat.logDropped, 1)
+		return false
+	}
+	return true
+}
+
+func truncate(line []byte) string {
+	if len(line) > maxRawLineLog {
+		line = line[:maxRawLineLog]
+	}
+	return string(line)
+}
+
+func (pe *ParseErrors) Stat(send func(metric string, value float64)) {
+	fieldCount := atomic.LoadUint32(&pe.stat.fieldCount)
+	atomic.AddUint32(&pe.stat.fieldCount, -fieldCount)
+	send("parseErrors.fieldCount", float64(fieldCount))
+
+	badValue := atomic.LoadUint32(&pe.stat.badValue)
+	atomic.AddUint32(&pe.stat.badValue, -badValue)
+	send("parseErrors.badValue", float64(badValue))
+
+	badTimestamp := atomic.LoadUint32(&pe.stat.badTimestamp)
+	atomic.AddUint32(&pe.stat.badTimestamp, -badTimestamp)
+	send("parseErrors.badTimestamp", float64(badTimestamp))
+
+	nameTooLong := atomic.LoadUint32(&pe.stat.nameTooLong)
+	atomic.AddUint32(&pe.stat.nameTooLong, -nameTooLong)
+	send("parseErrors.nameTooLong", float64(nameTooLong))
+
+	nonASCII := atomic.LoadUint32(&pe.stat.nonASCII)
+	atomic.AddUint32(&pe.stat.nonASCII, -nonASCII)
+	send("parseErrors.nonASCII", float64(nonASCII))
+
+	invalidUTF8 := atomic.LoadUint32(&pe.stat.invalidUTF8)
+	atomic.AddUint32(&pe.stat.invalidUTF8, -invalidUTF8)
+	send("parseErrors.invalidUTF8", float64(invalidUTF8))
+
+	tooDeep := atomic.LoadUint32(&pe.stat.tooDeep)
+	atomic.AddUint32(&pe.stat.tooDeep, -tooDeep)
+	send("parseErrors.tooDeep", float64(tooDeep))
+
+	emptyName := atomic.LoadUint32(&pe.stat.emptyName)
+	atomic.AddUint32(&pe.stat.emptyName, -emptyName)
+	send("parseErrors.emptyName", float64(emptyName))
+
+	logDropped := atomic.LoadUint32(&pe.stat.logDropped)
+	atomic.AddUint32(&pe.stat.logDropped, -logDropped)
+	send("parseErrors.logDropped", float64(logDropped))
+
+	if pe.nameValidation == NameValidationWarn || pe.nameValidation == NameValidationStrict {
+		for i, rule := range nameRules {
+			invalid := atomic.LoadUint32(&pe.stat.invalidNames[i])
+			atomic.AddUint32(&pe.stat.invalidNames[i], -invalid)
+			send("invalidNames."+rule.Rule, float64(invalid))
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package receiver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"go.uber.org/zap"
+)
+
+func TestPlainParseLineErrors(t *testing.T) {
+	table := [](struct {
+		b   string
+		err error
+	}){
+		{"42\n", errFieldCount},
+		{"metric.name 42\n", errFieldCount},
+		{"metric.name 42 1422642189 1\n", errFieldCount},
+		{"metric.name 42a 1422642189\n", errBadValue},
+		{"metric.name NaN 1422642189\n", errBadValue},
+		{"metric.name 42 a1422642189\n", errBadTimestamp},
+		{"metric.name 42 NaN\n", errBadTimestamp},
+	}
+
+	for _, p := range table {
+		_, _, _, err := PlainParseLine([]byte(p.b))
+		if err != p.err {
+			t.Fatalf("%#v: %#v != %#v", p.b, err, p.err)
+		}
+	}
+}
+
+func TestParseErrorsStat(t *testing.T) {
+	pe := NewParseErrors(zap.NewNop())
+
+	pe.Add(errFieldCount, []byte("42\n"))
+	pe.Add(errBadValue, []byte("metric.name 42a 1422642189\n"))
+	pe.Add(errBadValue, []byte("metric.name NaN 1422642189\n"))
+	pe.Add(errBadTimestamp, []byte("metric.name 42 NaN\n"))
+	pe.Add(errNameTooLong, []byte(strings.Repeat("a", 1024)))
+
+	expected := map[string]float64{
+		"parseErrors.fieldCount":   1,
+		"parseErrors.badValue":     2,
+		"parseErrors.badTimestamp": 1,
+		"parseErrors.nameTooLong":  1,
+	}
+
+	stat := make(map[string]float64)
+	pe.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+
+	for k, v := range expected {
+		if stat[k] != v {
+			t.Fatalf("%s: %#v != %#v", k, stat[k], v)
+		}
+	}
+
+	// counters are reset after Stat
+	pe.Stat(func(metric string, value float64) {
+		if value != 0 {
+			t.Fatalf("%s: %#v != 0", metric, value)
+		}
+	})
+}
+
+func TestParseErrorsLogRate(t *testing.T) {
+	pe := NewParseErrors(zap.NewNop())
+	pe.logRate = 10
+
+	for i := 0; i < 100; i++ {
+		pe.Add(errFieldCount, []byte("42\n"))
+	}
+
+	if pe.logged != 100 {
+		t.Fatalf("%d != 100", pe.logged)
+	}
+
+	if pe.stat.fieldCount != 100 {
+		t.Fatalf("%d != 100", pe.stat.fieldCount)
+	}
+
+	// messages above limit are not logged
+	if pe.stat.logDropped != 90 {
+		t.Fatalf("dropped %d != 90", pe.stat.logDropped)
+	}
+}
+
+func TestParseErrorsCheckName(t *testing.T) {
+	table := [](struct {
+		name         string
+		allowUnicode bool
+		err          error
+	}){
+		{"hello.world", false, nil},
+		{"hello.world", true, nil},
+		{"\u4f60\u597d.\u4e16\u754c", false, errNonASCII},
+		{"\u4f60\u597d.\u4e16\u754c", true, nil},
+		{"hello.\u4e16\u754c.count", false, errNonASCII},
+		{"hello.\u4e16\u754c.count", true, nil},
+		{"hello.\xff\xfe.count", false, errNonASCII},
+		{"hello.\xff\xfe.count", true, errInvalidUTF8},
+		{"hello.\u4e16\xe7.count", true, errInvalidUTF8},
+	}
+
+	pe := NewParseErrors(zap.NewNop())
+	for _, p := range table {
+		pe.allowUnicode = p.allowUnicode
+		if err := pe.CheckName([]byte(p.name)); err != p.err {
+			t.Fatalf("%#v (unicode %v): %#v != %#v", p.name, p.allowUnicode, err, p.err)
+		}
+	}
+
+	// nil ParseErrors allows all names
+	if err := (*ParseErrors)(nil).CheckName([]byte("hello.\xff")); err != nil {
+		t.Fatalf("%#v", err)
+	}
+}
+
+func TestPlainParseBufferUnicode(t *testing.T) {
+	days := &days1970.Days{}
+
+	parse := func(allowUnicode bool, body string) ([]byte, map[string]float64) {
+		pe := NewParseErrors(zap.NewNop())
+		pe.allowUnicode = allowUnicode
+
+		out := make(chan *RowBinary.WriteBuffer, 1)
+		buf := GetBuffer()
+		buf.Time = 1422642189
+		buf.Write([]byte(body))
+
+		var received, errors uint32
+		PlainParseBuffer(nil, buf, out, days, &received, &errors, &ParseOptions{ParseErrors: pe})
+		buf.Release()
+
+		var result []byte
+		select {
+		case wb := <-out:
+			result = append(result, wb.Bytes()...)
+			wb.Release()
+		default:
+		}
+
+		stat := make(map[string]float64)
+		pe.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+		return result, stat
+	}
+
+	body := "hello.world 42 1422642189\n" +
+		"\u4f60\u597d.\u4e16\u754c 43 1422642189\n" +
+		"hello.\xff\xfe 44 1422642189\n"
+
+	point := func(name string, value float64) []byte {
+		wb := RowBinary.GetWriteBuffer()
+		defer wb.Release()
+		wb.WriteGraphitePoint([]byte(name), value, 1422642189, days.TimestampWithNow(1422642189, 1422642189), 1422642189)
+		return append([]byte(nil), wb.Bytes()...)
+	}
+
+	// name length is encoded in bytes, not runes
+	expected := append(point("hello.world", 42), point("\u4f60\u597d.\u4e16\u754c", 43)...)
+	result, stat := parse(true, body)
+	if !bytes.Equal(result, expected) {
+		t.Fatalf("%#v != %#v", result, expected)
+	}
+	if stat["parseErrors.invalidUTF8"] != 1 || stat["parseErrors.nonASCII"] != 0 {
+		t.Fatalf("%#v", stat)
+	}
+
+	expected = point("hello.world", 42)
+	result, stat = parse(false, body)
+	if !bytes.Equal(result, expected) {
+		t.Fatalf("%#v != %#v", result, expected)
+	}
+	if stat["parseErrors.invalidUTF8"] != 0 || stat["parseErrors.nonASCII"] != 2 {
+		t.Fatalf("%#v", stat)
+	}
+}
+
+func TestParseErrorsMaxDepth(t *testing.T) {
+	name := func(depth int) string {
+		return strings.TrimSuffix(strings.Repeat("a.", depth), ".")
+	}
+
+	table := [](struct {
+		depth    int
+		maxDepth int
+		err      error
+	}){
+		{1, 0, nil},
+		{10, 0, nil},
+		{100, 0, nil},
+		{1000, 0, nil},
+		{1, 100, nil},
+		{10, 100, nil},
+		{100, 100, nil},
+		{101, 100, errTooDeep},
+		{10, 1, errTooDeep},
+		{1, 1, nil},
+	}
+
+	pe := NewParseErrors(zap.NewNop())
+	for _, p := range table {
+		pe.maxDepth = p.maxDepth
+		if err := pe.CheckName([]byte(name(p.depth))); err != p.err {
+			t.Fatalf("depth %d (max %d): %#v != %#v", p.depth, p.maxDepth, err, p.err)
+		}
+	}
+
+	// deep names are logged, but passed
+	pe = NewParseErrors(zap.NewNop())
+	pe.warnDepth = 10
+	for _, depth := range []int{1, 10, 11, 100} {
+		if err := pe.CheckName([]byte(name(depth))); err != nil {
+			t.Fatalf("depth %d: %#v", depth, err)
+		}
+	}
+	if pe.logged != 2 {
+		t.Fatalf("logged %d != 2", pe.logged)
+	}
+
+	// dropped names are counted
+	pe.maxDepth = 100
+	buf := GetBuffer()
+	buf.Time = 1422642189
+	buf.Write([]byte(name(100) + " 42 1422642189\n" + name(101) + " 43 1422642189\n"))
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{ParseErrors: pe})
+	buf.Release()
+	(<-out).Release()
+
+	stat := make(map[string]float64)
+	pe.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if received != 1 || errors != 1 || stat["parseErrors.tooDeep"] != 1 {
+		t.Fatalf("received: %d, errors: %d, stat: %#v", received, errors, stat)
+	}
+}
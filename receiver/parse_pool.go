@@ -0,0 +1,176 @@
+package receiver
+
+import (
+	"fmt"
+	"math"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Auto scaling of ParsePool. Load is count of buffers queued and in parsing per goroutine,
+// averaged over window of scaleSamples intervals
+const (
+	scaleUpLoad   = 0.8
+	scaleDownLoad = 0.2
+	scaleSamples  = 10
+)
+
+type goGroup interface {
+	Go(func(exit chan struct{}))
+}
+
+// ParsePool runs parse goroutines. Panicked goroutine is logged and restarted,
+// so count of running goroutines is always equal to started threads
+type ParsePool struct {
+	stat struct {
+		panics  uint32 // atomic
+		grows   uint32 // atomic
+		shrinks uint32 // atomic
+	}
+	running       int32 // atomic
+	scaleMin      int   // 0 - fixed count of goroutines
+	scaleMax      int
+	scaleInterval time.Duration
+	logger        *zap.Logger
+}
+
+func NewParsePool(logger *zap.Logger) *ParsePool {
+	return &ParsePool{scaleInterval: 100 * time.Millisecond, logger: logger}
+}
+
+// AutoScale enables resizing of pool by Scale between min and max goroutines. 0 min disables resizing
+func (p *ParsePool) AutoScale(min, max int) {
+	p.scaleMin = min
+	p.scaleMax = max
+}
+
+// Go starts threads goroutines with g.Go. Each goroutine calls parse until exit is closed or parse returns
+func (p *ParsePool) Go(g goGroup, threads int, parse func(exit chan struct{})) {
+	for i := 0; i < threads; i++ {
+		g.Go(func(exit chan struct{}) {
+			atomic.AddInt32(&p.running, 1)
+			defer atomic.AddInt32(&p.running, -1)
+
+			for p.run(exit, parse) {
+				select {
+				case <-exit:
+					return
+				default:
+				}
+			}
+		})
+	}
+}
+
+// run calls parse and returns true if it panicked
+func (p *ParsePool) run(exit chan struct{}, parse func(exit chan struct{})) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			atomic.AddUint32(&p.stat.panics, 1)
+			p.logger.Error("parse panic recovered, restarting",
+				zap.String("error", fmt.Sprint(r)),
+				zap.String("traceback", string(debug.Stack())),
+			)
+		}
+	}()
+
+	parse(exit)
+	return false
+}
+
+// Scale resizes auto scaled pool of threads goroutines started by Go, no-op for fixed pool. Pool is grown to
+// peak load of window / 80% goroutines, at least doubled, if load of window is above 80% and write queue was not
+// full in window: parsers blocked on full write queue are not helped by new ones. Peak is used because window
+// started before spike of load averages it down. Half of goroutines is stopped if load of window is below 20%. stop makes one idle goroutine to return from parse
+func (p *ParsePool) Scale(g goGroup, threads int, load func() int, writeQueueFull func() bool, stop func(exit chan struct{}), parse func(exit chan struct{})) {
+	if p.scaleMin <= 0 {
+		return
+	}
+
+	g.Go(func(exit chan struct{}) {
+		t := time.NewTicker(p.scaleInterval)
+		defer t.Stop()
+
+		var sum, peak float64 // load of samples in window
+		var samples int
+		var full bool // write queue was full in window
+		for {
+			select {
+			case <-exit:
+				return
+			case <-t.C:
+			}
+
+			s := float64(load()) / float64(threads)
+			sum += s
+			if s > peak {
+				peak = s
+			}
+			full = full || writeQueueFull()
+			if samples++; samples < scaleSamples {
+				continue
+			}
+
+			l, m := sum/float64(samples), peak
+			grow := l > scaleUpLoad && !full
+			sum, peak, samples, full = 0, 0, 0, false
+
+			if grow && threads < p.scaleMax {
+				n := int(math.Ceil(float64(threads)*m/scaleUpLoad)) - threads
+				if n < threads {
+					n = threads
+				}
+				if threads+n > p.scaleMax {
+					n = p.scaleMax - threads
+				}
+				p.Go(g, n, parse)
+				p.logger.Info("parse threads added", zap.Int("threads", threads+n), zap.Float64("load", l))
+				threads += n
+				atomic.AddUint32(&p.stat.grows, 1)
+			}
+
+			if l < scaleDownLoad && threads > p.scaleMin {
+				n := threads / 2
+				if n < 1 {
+					n = 1
+				}
+				if threads-n < p.scaleMin {
+					n = threads - p.scaleMin
+				}
+				for i := 0; i < n; i++ {
+					stop(exit)
+				}
+				p.logger.Info("parse threads stopped", zap.Int("threads", threads-n), zap.Float64("load", l))
+				threads -= n
+				atomic.AddUint32(&p.stat.shrinks, 1)
+			}
+		}
+	})
+}
+
+// Running returns count of running parse goroutines
+func (p *ParsePool) Running() int {
+	return int(atomic.LoadInt32(&p.running))
+}
+
+func (p *ParsePool) Stat(send func(metric string, value float64)) {
+	panics := atomic.LoadUint32(&p.stat.panics)
+	atomic.AddUint32(&p.stat.panics, -panics)
+	send("parsePanics", float64(panics))
+
+	send("parseThreads", float64(p.Running()))
+
+	if p.scaleMin > 0 {
+		grows := atomic.LoadUint32(&p.stat.grows)
+		atomic.AddUint32(&p.stat.grows, -grows)
+		send("parseThreadsGrows", float64(grows))
+
+		shrinks := atomic.LoadUint32(&p.stat.shrinks)
+		atomic.AddUint32(&p.stat.shrinks, -shrinks)
+		send("parseThreadsShrinks", float64(shrinks))
+	}
+}
@@ -0,0 +1,200 @@
+package receiver
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/stop"
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+func TestParsePoolRestart(t *testing.T) {
+	var s stop.Struct
+	s.StartFunc(func() error { return nil })
+
+	in := make(chan string)
+	out := make(chan string)
+
+	pool := NewParsePool(zap.NewNop())
+	pool.Go(&s, 2, func(exit chan struct{}) {
+		for {
+			select {
+			case <-exit:
+				return
+			case p := <-in:
+				if p == "panic" {
+					panic("bad payload")
+				}
+				out <- p
+			}
+		}
+	})
+
+	// wait for start of goroutines
+	for deadline := time.Now().Add(time.Second); pool.Running() != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("running: %d", pool.Running())
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		in <- "panic"
+	}
+
+	// both goroutines restarted and parse new payload
+	for i := 0; i < 2; i++ {
+		in <- "hello"
+		select {
+		case p := <-out:
+			if p != "hello" {
+				t.Fatalf("%#v", p)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("parse goroutine is not restarted")
+		}
+	}
+
+	// last panic can be counted after parsing of new payload by other goroutine
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&pool.stat.panics) != 4; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			break
+		}
+	}
+
+	if n := pool.Running(); n != 2 {
+		t.Fatalf("running: %d", n)
+	}
+
+	stat := make(map[string]float64)
+	pool.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["parsePanics"] != 4 {
+		t.Fatalf("%#v", stat)
+	}
+
+	s.Stop()
+
+	if n := pool.Running(); n != 0 {
+		t.Fatalf("running after stop: %d", n)
+	}
+}
+
+func TestParsePoolPlainParserPanic(t *testing.T) {
+	var s stop.Struct
+	s.StartFunc(func() error { return nil })
+	defer s.Stop()
+
+	in := make(chan *Buffer, 3)
+	// send to closed write channel panics
+	out := make(chan *RowBinary.WriteBuffer)
+	close(out)
+
+	var received, errors uint32
+	var pending int32
+	pool := NewParsePool(zap.NewNop())
+	pool.Go(&s, 1, func(exit chan struct{}) {
+		PlainParser(exit, in, out, &received, &errors, &pending, &ParseOptions{})
+	})
+
+	buffers := make([]*Buffer, 3)
+	for i := range buffers {
+		buffers[i] = GetBuffer()
+		buffers[i].Write([]byte("hello.world 42 1422642189\n"))
+		atomic.AddInt32(&pending, 1)
+		in <- buffers[i]
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&pool.stat.panics) != 3; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("panics: %d", atomic.LoadUint32(&pool.stat.panics))
+		}
+	}
+	if n := atomic.LoadInt32(&pending); n != 0 {
+		t.Fatalf("pending: %d", n)
+	}
+	for i, b := range buffers {
+		if b.Used != 0 {
+			t.Fatalf("buffer %d isn't released", i)
+		}
+	}
+}
+
+func TestParsePoolScale(t *testing.T) {
+	var s stop.Struct
+	s.StartFunc(func() error { return nil })
+	defer s.Stop()
+
+	in := make(chan string)
+	var load int32
+	var queueFull int32
+
+	pool := NewParsePool(zap.NewNop())
+	pool.scaleInterval = 5 * time.Millisecond
+	pool.AutoScale(2, 8)
+
+	parse := func(exit chan struct{}) {
+		for {
+			select {
+			case <-exit:
+				return
+			case p := <-in:
+				if p == "stop" {
+					return
+				}
+			}
+		}
+	}
+	pool.Go(&s, 3, parse)
+	pool.Scale(&s, 3,
+		func() int { return int(atomic.LoadInt32(&load)) },
+		func() bool { return atomic.LoadInt32(&queueFull) != 0 },
+		func(exit chan struct{}) {
+			select {
+			case in <- "stop":
+			case <-exit:
+			}
+		},
+		parse,
+	)
+
+	waitRunning := func(n int) {
+		for deadline := time.Now().Add(time.Second); pool.Running() != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("running: %d, expected %d", pool.Running(), n)
+			}
+		}
+	}
+
+	// moderate load doesn't resize pool
+	atomic.StoreInt32(&load, 1)
+	time.Sleep(50 * time.Millisecond)
+	waitRunning(3)
+
+	// parsers are blocked on full write queue
+	atomic.StoreInt32(&queueFull, 1)
+	atomic.StoreInt32(&load, 100)
+	time.Sleep(50 * time.Millisecond)
+	waitRunning(3)
+
+	// 3 => 8 by load
+	atomic.StoreInt32(&queueFull, 0)
+	waitRunning(8)
+
+	// 8 => 4 => 2
+	atomic.StoreInt32(&load, 0)
+	waitRunning(2)
+	time.Sleep(50 * time.Millisecond)
+	waitRunning(2)
+
+	stat := make(map[string]float64)
+	pool.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["parseThreads"] != 2 || stat["parseThreadsGrows"] != 1 || stat["parseThreadsShrinks"] != 2 {
+		t.Fatalf("%#v", stat)
+	}
+}
@@ -1,36 +1,61 @@
 package receiver
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
-	"github.com/lomik/graphite-pickle/framing"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
 	"github.com/lomik/stop"
 	"go.uber.org/zap"
 )
 
+// max size of pickle message. Connection with bigger message is closed
 const maxPickleMessageSize = 67108864
 
 // Pickle receive metrics from TCP connections
 type Pickle struct {
 	stop.Struct
 	stat struct {
-		messagesReceived uint32 // atomic
-		metricsReceived  uint32 // atomic
-		errors           uint32 // atomic
-		active           int32  // atomic
+		metricsReceivedTotal uint64 // atomic. since start, updated by Stat
+		errorsTotal          uint64 // atomic. since start, updated by Stat
+		droppedTotal         uint64 // atomic. since start, metrics of batches rejected by backpressure
+		messagesReceived     uint32 // atomic
+		metricsReceived      uint32 // atomic
+		errors               uint32 // atomic
+		active               int32  // atomic
+		closedIdle           uint32 // atomic
+		closedSlowRead       uint32 // atomic
+		proxyErrors          uint32 // atomic
 	}
-	listener     *net.TCPListener
-	parseThreads int
-	parseChan    chan []byte
-	writeChan    chan *RowBinary.WriteBuffer
-	logger       *zap.Logger
+	listener      *net.TCPListener
+	idleTimeout   time.Duration
+	readTimeout   time.Duration
+	proxyProtocol bool // connections start with PROXY protocol header
+	maxBatchSize  int  // max metrics in one WriteBuffer. 0 is unlimited
+	parseThreads  int
+	writeChan     chan *RowBinary.WriteBuffer
+	parseErrors   *ParseErrors
+	namespaces    *Namespaces
+	sharding      *Sharding
+	stripPrefix   *PrefixStripper
+	sanitizer     *Sanitizer
+	tenants       *Tenants
+	rateLimits    *RateLimits
+	newest        *NewestTimestamp
+	transforms    *Transforms
+	dedup         *Dedup
+	ready         readiness
+	format        string
+	backpressure  *Backpressure
+	logger        *zap.Logger
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -41,9 +66,52 @@ func (rcv *Pickle) Addr() net.Addr {
 	return rcv.listener.Addr()
 }
 
+// MetricsReceivedTotal returns count of received metrics since start
+func (rcv *Pickle) MetricsReceivedTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.metricsReceivedTotal) + uint64(atomic.LoadUint32(&rcv.stat.metricsReceived))
+}
+
+// ErrorsTotal returns count of dropped bad lines and messages since start
+func (rcv *Pickle) ErrorsTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.errorsTotal) + uint64(atomic.LoadUint32(&rcv.stat.errors))
+}
+
+// ActiveConnections returns count of open connections
+func (rcv *Pickle) ActiveConnections() int {
+	return int(atomic.LoadInt32(&rcv.stat.active))
+}
+
+// Stats returns counters since start
+func (rcv *Pickle) Stats() ReceiverStats {
+	return ReceiverStats{
+		ReceivedTotal:     rcv.MetricsReceivedTotal(),
+		ParseErrors:       rcv.ErrorsTotal(),
+		ActiveConnections: rcv.ActiveConnections(),
+		DroppedTotal:      atomic.LoadUint64(&rcv.stat.droppedTotal),
+	}
+}
+
+// Ready is closed after receive loop is started
+func (rcv *Pickle) Ready() <-chan struct{} {
+	return rcv.ready.ch
+}
+
+// CloseListener stops accepting of new connections. Accepted connections are served until closed by clients
+func (rcv *Pickle) CloseListener() {
+	if rcv.listener != nil {
+		rcv.listener.Close()
+	}
+}
+
+// Idle returns true if there are no open connections. Messages are parsed and sent to write channel by connection handler
+func (rcv *Pickle) Idle() bool {
+	return atomic.LoadInt32(&rcv.stat.active) == 0
+}
+
 func (rcv *Pickle) Stat(send func(metric string, value float64)) {
 	metricsReceived := atomic.LoadUint32(&rcv.stat.metricsReceived)
 	atomic.AddUint32(&rcv.stat.metricsReceived, -metricsReceived)
+	atomic.AddUint64(&rcv.stat.metricsReceivedTotal, uint64(metricsReceived))
 	send("metricsReceived", float64(metricsReceived))
 
 	messagesReceived := atomic.LoadUint32(&rcv.stat.messagesReceived)
@@ -52,13 +120,30 @@ func (rcv *Pickle) Stat(send func(metric string, value float64)) {
 
 	errors := atomic.LoadUint32(&rcv.stat.errors)
 	atomic.AddUint32(&rcv.stat.errors, -errors)
+	atomic.AddUint64(&rcv.stat.errorsTotal, uint64(errors))
 	send("errors", float64(errors))
 
 	send("active", float64(atomic.LoadInt32(&rcv.stat.active)))
+
+	closedIdle := atomic.LoadUint32(&rcv.stat.closedIdle)
+	atomic.AddUint32(&rcv.stat.closedIdle, -closedIdle)
+	send("closedIdleTimeout", float64(closedIdle))
+
+	closedSlowRead := atomic.LoadUint32(&rcv.stat.closedSlowRead)
+	atomic.AddUint32(&rcv.stat.closedSlowRead, -closedSlowRead)
+	send("closedReadTimeout", float64(closedSlowRead))
+
+	proxyErrors := atomic.LoadUint32(&rcv.stat.proxyErrors)
+	atomic.AddUint32(&rcv.stat.proxyErrors, -proxyErrors)
+	send("proxyProtocolErrors", float64(proxyErrors))
+
+	rcv.parseErrors.Stat(send)
+	rcv.stripPrefix.Stat(send)
+	rcv.sanitizer.Stat(send)
+	rcv.backpressure.Stat(send)
 }
 
-func (rcv *Pickle) HandleConnection(conn net.Conn) {
-	framedConn, _ := framing.NewConn(conn, byte(4), binary.BigEndian)
+func (rcv *Pickle) HandleConnection(exit chan struct{}, conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
 			rcv.logger.Error("panic recovered", zap.String("traceback", fmt.Sprint(r)))
@@ -83,24 +168,93 @@ func (rcv *Pickle) HandleConnection(conn net.Conn) {
 		}
 	})
 
-	framedConn.MaxFrameSize = uint(maxPickleMessageSize)
+	client := conn
+	if rcv.proxyProtocol {
+		c, err := readProxyHeader(conn)
+		if err != nil {
+			atomic.AddUint32(&rcv.stat.proxyErrors, 1)
+			rcv.logger.Warn("can't read PROXY protocol header", zap.String("proxy", conn.RemoteAddr().String()), zap.Error(err))
+			return
+		}
+		client = c
+	}
+
+	logger := rcv.logger.With(zap.String("peer", client.RemoteAddr().String()))
+
+	connReader := &deadlineReader{conn: client, idleTimeout: rcv.idleTimeout, readTimeout: rcv.readTimeout}
+	defer func() {
+		if connReader.slowRead {
+			atomic.AddUint32(&rcv.stat.closedSlowRead, 1)
+			logger.Warn("slow connection closed", zap.Duration("read_timeout", rcv.readTimeout))
+		} else if connReader.timedOut {
+			atomic.AddUint32(&rcv.stat.closedIdle, 1)
+			logger.Debug("idle connection closed")
+		}
+	}()
 
+	reader := bufio.NewReader(connReader)
+	frameReader := bufio.NewReader(nil)
+	days := &days1970.Days{}
+	parseOptions := rcv.parseOptions()
+
+	var size uint32
 	for {
-		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
-		data, err := framedConn.ReadFrame()
-		if err == framing.ErrPrefixLength {
-			atomic.AddUint32(&rcv.stat.errors, 1)
-			rcv.logger.Warn("bad message size")
-			return
-		} else if err != nil {
-			if err != io.EOF {
+		err := binary.Read(reader, binary.BigEndian, &size)
+		if err != nil {
+			if err != io.EOF && !connReader.timedOut && !connReader.slowRead {
 				atomic.AddUint32(&rcv.stat.errors, 1)
-				rcv.logger.Warn("can't read message body", zap.Error(err))
+				rcv.logger.Warn("can't read message size", zap.Error(err))
 			}
 			return
 		}
 
-		rcv.parseChan <- data
+		if size > maxPickleMessageSize {
+			atomic.AddUint32(&rcv.stat.errors, 1)
+			logger.Warn("message is too big, connection closed", zap.Uint32("size", size), zap.Int("max_size", maxPickleMessageSize))
+			return
+		}
+
+		// whole message should be received in read timeout
+		connReader.Start()
+
+		// message is parsed while arriving, without buffering of whole frame
+		frame := &io.LimitedReader{R: reader, N: int64(size)}
+		frameReader.Reset(frame)
+
+		err = PickleParseStream(
+			exit,
+			frameReader,
+			uint32(time.Now().Unix()),
+			rcv.writeChan,
+			days,
+			&rcv.stat.metricsReceived,
+			&rcv.stat.errors,
+			&rcv.stat.droppedTotal,
+			parseOptions,
+			rcv.format,
+			rcv.maxBatchSize,
+			rcv.backpressure,
+		)
+		atomic.AddUint32(&rcv.stat.messagesReceived, 1)
+
+		if err == errBackpressure {
+			logger.Warn("connection closed", zap.Error(err))
+			return
+		}
+		if err == errStopped {
+			return
+		}
+
+		if err != nil {
+			rcv.logger.Warn("can't parse message", zap.Error(err))
+		}
+
+		// skip unparsed tail of frame
+		if _, err = io.Copy(ioutil.Discard, frame); err != nil || frame.N > 0 {
+			return
+		}
+
+		connReader.Finish()
 	}
 }
 
@@ -120,10 +274,13 @@ func (rcv *Pickle) Listen(addr *net.TCPAddr) error {
 
 		handler := rcv.HandleConnection
 
+		rcv.ready.reset()
+
 		rcv.Go(func(exit chan struct{}) {
 			defer tcpListener.Close()
 
 			for {
+				rcv.ready.done()
 
 				conn, err := tcpListener.Accept()
 				if err != nil {
@@ -135,26 +292,30 @@ func (rcv *Pickle) Listen(addr *net.TCPAddr) error {
 				}
 
 				rcv.Go(func(exit chan struct{}) {
-					handler(conn)
+					handler(exit, conn)
 				})
 			}
 
 		})
 
-		for i := 0; i < rcv.parseThreads; i++ {
-			rcv.Go(func(exit chan struct{}) {
-				PickleParser(
-					exit,
-					rcv.parseChan,
-					rcv.writeChan,
-					&rcv.stat.metricsReceived,
-					&rcv.stat.errors,
-				)
-			})
-		}
-
 		rcv.listener = tcpListener
 
 		return nil
 	})
 }
+
+// parseOptions returns stages of parsed metrics set by options
+func (rcv *Pickle) parseOptions() *ParseOptions {
+	return &ParseOptions{
+		ParseErrors: rcv.parseErrors,
+		Namespaces:  rcv.namespaces,
+		Sharding:    rcv.sharding,
+		StripPrefix: rcv.stripPrefix,
+		Sanitizer:   rcv.sanitizer,
+		Tenants:     rcv.tenants,
+		Newest:      rcv.newest,
+		Transforms:  rcv.transforms,
+		Dedup:       rcv.dedup,
+		RateLimits:  rcv.rateLimits,
+	}
+}
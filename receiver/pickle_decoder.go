@@ -0,0 +1,564 @@
+package receiver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// pickle opcodes used by graphite senders (protocols 0-4)
+const (
+	opMark            = '('
+	opStop            = '.'
+	opPop             = '0'
+	opPopMark         = '1'
+	opDup             = '2'
+	opFloat           = 'F'
+	opInt             = 'I'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opLong            = 'L'
+	opBinInt2         = 'M'
+	opNone            = 'N'
+	opString          = 'S'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opUnicode         = 'V'
+	opBinUnicode      = 'X'
+	opAppend          = 'a'
+	opGet             = 'g'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opList            = 'l'
+	opPut             = 'p'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opTuple           = 't'
+	opEmptyTuple      = ')'
+	opEmptyList       = ']'
+	opAppends         = 'e'
+	opBinFloat        = 'G'
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opProto           = '\x80'
+	opTuple1          = '\x85'
+	opTuple2          = '\x86'
+	opTuple3          = '\x87'
+	opNewTrue         = '\x88'
+	opNewFalse        = '\x89'
+	opLong1           = '\x8a'
+	opLong4           = '\x8b'
+	opShortBinUnicode = '\x8c'
+	opBinUnicode8     = '\x8d'
+	opBinBytes8       = '\x8e'
+	opMemoize         = '\x94'
+	opFrame           = '\x95'
+)
+
+// max length of single string in pickle stream. Longer names can't be written to WriteBuffer
+const maxPickleStringLen = RowBinary.WriteBufferSize
+
+// max count of memoized objects of pickle message. Memo keeps objects of root list, which are not stored otherwise
+const maxPickleMemoSize = 1 << 20
+
+var (
+	errPickleStackUnderflow = errors.New("pickle: stack underflow")
+	errPickleMemoTooBig     = errors.New("pickle: memo is too big")
+)
+
+// pickleList is list object on decoder stack. Items of root list are not stored, they are passed to callback
+type pickleList struct {
+	root  bool
+	items []interface{}
+}
+
+// pickleDecoder decodes pickle stream incrementally. Memory usage doesn't depend on count of items in root list
+type pickleDecoder struct {
+	r        *bufio.Reader
+	stack    []interface{}
+	marks    []int
+	memo     map[int]interface{}
+	buf      [8]byte
+	callback func(item interface{}) error
+}
+
+// pickleDecode reads pickle object from r. Each item appended to top level list is passed to callback.
+// Decoding is aborted on callback error
+func pickleDecode(r *bufio.Reader, callback func(item interface{}) error) error {
+	d := &pickleDecoder{
+		r:        r,
+		stack:    make([]interface{}, 0, 16),
+		memo:     make(map[int]interface{}),
+		callback: callback,
+	}
+	return d.decode()
+}
+
+func (d *pickleDecoder) push(v interface{}) {
+	d.stack = append(d.stack, v)
+}
+
+func (d *pickleDecoder) pop() (interface{}, error) {
+	if len(d.stack) == 0 {
+		return nil, errPickleStackUnderflow
+	}
+	v := d.stack[len(d.stack)-1]
+	d.stack = d.stack[:len(d.stack)-1]
+	return v, nil
+}
+
+func (d *pickleDecoder) top() (interface{}, error) {
+	if len(d.stack) == 0 {
+		return nil, errPickleStackUnderflow
+	}
+	return d.stack[len(d.stack)-1], nil
+}
+
+// popMark returns items pushed after last mark
+func (d *pickleDecoder) popMark() ([]interface{}, error) {
+	if len(d.marks) == 0 {
+		return nil, errors.New("pickle: mark not found")
+	}
+	m := d.marks[len(d.marks)-1]
+	d.marks = d.marks[:len(d.marks)-1]
+	if m > len(d.stack) {
+		// items below mark are popped by other opcodes
+		return nil, errPickleStackUnderflow
+	}
+
+	items := make([]interface{}, len(d.stack)-m)
+	copy(items, d.stack[m:])
+	d.stack = d.stack[:m]
+	return items, nil
+}
+
+func (d *pickleDecoder) appendItems(target interface{}, items ...interface{}) error {
+	l, ok := target.(*pickleList)
+	if !ok {
+		return fmt.Errorf("pickle: append to %T", target)
+	}
+
+	if !l.root {
+		l.items = append(l.items, items...)
+		return nil
+	}
+
+	for _, item := range items {
+		if err := d.callback(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *pickleDecoder) readN(n int) ([]byte, error) {
+	if n < 0 || n > maxPickleStringLen {
+		return nil, errNameTooLong
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+func (d *pickleDecoder) readFixed(n int) ([]byte, error) {
+	_, err := io.ReadFull(d.r, d.buf[:n])
+	return d.buf[:n], err
+}
+
+func (d *pickleDecoder) readLine() ([]byte, error) {
+	line, err := d.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+func (d *pickleDecoder) readLength(n int) (int, error) {
+	b, err := d.readFixed(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 4:
+		return int(binary.LittleEndian.Uint32(b)), nil
+	}
+	return int(binary.LittleEndian.Uint64(b)), nil
+}
+
+func (d *pickleDecoder) put(index int) error {
+	v, err := d.top()
+	if err != nil {
+		return err
+	}
+	if _, exists := d.memo[index]; !exists && len(d.memo) >= maxPickleMemoSize {
+		return errPickleMemoTooBig
+	}
+	d.memo[index] = v
+	return nil
+}
+
+func (d *pickleDecoder) get(index int) error {
+	v, exists := d.memo[index]
+	if !exists {
+		return fmt.Errorf("pickle: memo %d not found", index)
+	}
+	d.push(v)
+	return nil
+}
+
+// decodeLong decodes little-endian two's complement integer
+func decodeLong(b []byte) (int64, error) {
+	if len(b) > 8 {
+		return 0, errors.New("pickle: long is too big")
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	// sign extension
+	if b[len(b)-1]&0x80 != 0 && len(b) < 8 {
+		v |= math.MaxUint64 << (uint(len(b)) * 8)
+	}
+	return int64(v), nil
+}
+
+// unquoteString decodes python repr of string
+func unquoteString(s string) (string, error) {
+	if len(s) < 2 || s[0] != s[len(s)-1] || (s[0] != '\'' && s[0] != '"') {
+		return "", fmt.Errorf("pickle: bad string %#v", s)
+	}
+	quote := s[0]
+	s = s[1 : len(s)-1]
+
+	buf := make([]byte, 0, len(s))
+	for len(s) > 0 {
+		c, multibyte, tail, err := strconv.UnquoteChar(s, quote)
+		if err != nil {
+			return "", err
+		}
+		if c < utf8.RuneSelf || !multibyte {
+			buf = append(buf, byte(c))
+		} else {
+			var rb [utf8.UTFMax]byte
+			n := utf8.EncodeRune(rb[:], c)
+			buf = append(buf, rb[:n]...)
+		}
+		s = tail
+	}
+	return string(buf), nil
+}
+
+// decodeRawUnicodeEscape decodes python raw-unicode-escape encoding
+func decodeRawUnicodeEscape(b []byte) (string, error) {
+	buf := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '\\' && i+1 < len(b) && (b[i+1] == 'u' || b[i+1] == 'U') {
+			size := 4
+			if b[i+1] == 'U' {
+				size = 8
+			}
+			if i+2+size > len(b) {
+				return "", errors.New("pickle: truncated unicode escape")
+			}
+			r, err := strconv.ParseUint(string(b[i+2:i+2+size]), 16, 32)
+			if err != nil {
+				return "", err
+			}
+			var rb [utf8.UTFMax]byte
+			n := utf8.EncodeRune(rb[:], rune(r))
+			buf = append(buf, rb[:n]...)
+			i += 1 + size
+			continue
+		}
+		if b[i] >= utf8.RuneSelf {
+			// latin-1 byte
+			var rb [utf8.UTFMax]byte
+			n := utf8.EncodeRune(rb[:], rune(b[i]))
+			buf = append(buf, rb[:n]...)
+			continue
+		}
+		buf = append(buf, b[i])
+	}
+	return string(buf), nil
+}
+
+func (d *pickleDecoder) decode() error {
+	for {
+		op, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if err = d.decodeOp(op); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		if op == opStop {
+			return nil
+		}
+	}
+}
+
+func (d *pickleDecoder) decodeOp(op byte) error {
+	switch op {
+	case opProto:
+		_, err := d.r.ReadByte()
+		return err
+	case opStop:
+		return nil
+	case opMark:
+		d.marks = append(d.marks, len(d.stack))
+	case opPop:
+		_, err := d.pop()
+		return err
+	case opPopMark:
+		_, err := d.popMark()
+		return err
+	case opDup:
+		v, err := d.top()
+		if err != nil {
+			return err
+		}
+		d.push(v)
+	case opNone:
+		d.push(nil)
+	case opNewTrue:
+		d.push(int64(1))
+	case opNewFalse:
+		d.push(int64(0))
+	case opInt:
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		// I01 and I00 are bool in protocol 0
+		v, err := strconv.ParseInt(string(line), 10, 64)
+		if err != nil {
+			return err
+		}
+		d.push(v)
+	case opLong:
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		if len(line) > 0 && line[len(line)-1] == 'L' {
+			line = line[:len(line)-1]
+		}
+		v, err := strconv.ParseInt(string(line), 10, 64)
+		if err != nil {
+			return err
+		}
+		d.push(v)
+	case opBinInt:
+		b, err := d.readFixed(4)
+		if err != nil {
+			return err
+		}
+		d.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	case opBinInt1:
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		d.push(int64(b))
+	case opBinInt2:
+		b, err := d.readFixed(2)
+		if err != nil {
+			return err
+		}
+		d.push(int64(binary.LittleEndian.Uint16(b)))
+	case opLong1, opLong4:
+		size := 1
+		if op == opLong4 {
+			size = 4
+		}
+		n, err := d.readLength(size)
+		if err != nil {
+			return err
+		}
+		if n > 8 {
+			return errors.New("pickle: long is too big")
+		}
+		b, err := d.readFixed(n)
+		if err != nil {
+			return err
+		}
+		v, err := decodeLong(b)
+		if err != nil {
+			return err
+		}
+		d.push(v)
+	case opFloat:
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		v, err := strconv.ParseFloat(string(line), 64)
+		if err != nil {
+			return err
+		}
+		d.push(v)
+	case opBinFloat:
+		b, err := d.readFixed(8)
+		if err != nil {
+			return err
+		}
+		d.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case opString:
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		s, err := unquoteString(string(line))
+		if err != nil {
+			return err
+		}
+		d.push(s)
+	case opUnicode:
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		s, err := decodeRawUnicodeEscape(line)
+		if err != nil {
+			return err
+		}
+		d.push(s)
+	case opBinString, opBinUnicode, opBinBytes:
+		n, err := d.readLength(4)
+		if err != nil {
+			return err
+		}
+		b, err := d.readN(n)
+		if err != nil {
+			return err
+		}
+		d.push(string(b))
+	case opBinUnicode8, opBinBytes8:
+		n, err := d.readLength(8)
+		if err != nil {
+			return err
+		}
+		b, err := d.readN(n)
+		if err != nil {
+			return err
+		}
+		d.push(string(b))
+	case opShortBinString, opShortBinBytes, opShortBinUnicode:
+		n, err := d.readLength(1)
+		if err != nil {
+			return err
+		}
+		b, err := d.readN(n)
+		if err != nil {
+			return err
+		}
+		d.push(string(b))
+	case opEmptyTuple:
+		d.push([]interface{}{})
+	case opTuple:
+		items, err := d.popMark()
+		if err != nil {
+			return err
+		}
+		d.push(items)
+	case opTuple1, opTuple2, opTuple3:
+		n := int(op-opTuple1) + 1
+		if len(d.stack) < n {
+			return errPickleStackUnderflow
+		}
+		items := make([]interface{}, n)
+		copy(items, d.stack[len(d.stack)-n:])
+		d.stack = d.stack[:len(d.stack)-n]
+		d.push(items)
+	case opEmptyList:
+		d.push(&pickleList{root: len(d.stack) == 0})
+	case opList:
+		items, err := d.popMark()
+		if err != nil {
+			return err
+		}
+		l := &pickleList{root: len(d.stack) == 0}
+		if err = d.appendItems(l, items...); err != nil {
+			return err
+		}
+		d.push(l)
+	case opAppend:
+		v, err := d.pop()
+		if err != nil {
+			return err
+		}
+		l, err := d.top()
+		if err != nil {
+			return err
+		}
+		return d.appendItems(l, v)
+	case opAppends:
+		items, err := d.popMark()
+		if err != nil {
+			return err
+		}
+		l, err := d.top()
+		if err != nil {
+			return err
+		}
+		return d.appendItems(l, items...)
+	case opPut, opGet:
+		line, err := d.readLine()
+		if err != nil {
+			return err
+		}
+		index, err := strconv.Atoi(string(line))
+		if err != nil {
+			return err
+		}
+		if op == opPut {
+			return d.put(index)
+		}
+		return d.get(index)
+	case opMemoize:
+		return d.put(len(d.memo))
+	case opFrame:
+		// size of frame is only hint for buffering
+		if _, err := d.readFixed(8); err != nil {
+			return err
+		}
+	case opBinPut, opLongBinPut, opBinGet, opLongBinGet:
+		size := 1
+		if op == opLongBinPut || op == opLongBinGet {
+			size = 4
+		}
+		index, err := d.readLength(size)
+		if err != nil {
+			return err
+		}
+		if op == opBinPut || op == opLongBinPut {
+			return d.put(index)
+		}
+		return d.get(index)
+	default:
+		return fmt.Errorf("pickle: unsupported opcode %#x", op)
+	}
+
+	return nil
+}
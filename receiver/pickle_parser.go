@@ -1,76 +1,190 @@
 package receiver
 
 import (
+	"bufio"
+	"bytes"
 	"sync/atomic"
-	"time"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
 	"github.com/lomik/carbon-clickhouse/helper/days1970"
-	pickle "github.com/lomik/graphite-pickle"
 )
 
-func PickleParser(exit chan struct{}, in chan []byte, out chan *RowBinary.WriteBuffer, metricsReceived *uint32, errors *uint32) {
-	days := &days1970.Days{}
+func pickleNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// Formats of items of pickled list
+const (
+	PickleFormatAuto   = "auto"   // both formats, detected by size of item
+	PickleFormatLegacy = "legacy" // (name, (timestamp, value))
+	PickleFormatModern = "modern" // (name, timestamp, value)
+)
+
+// pickleMetric converts item of pickled list to metric. Empty format is PickleFormatAuto
+func pickleMetric(item interface{}, format string) (string, float64, int64, error) {
+	t, ok := item.([]interface{})
+	if !ok {
+		return "", 0, 0, errFieldCount
+	}
 
-	for {
-		select {
-		case <-exit:
-			return
-		case b := <-in:
-			PickeParseBytes(exit, b, uint32(time.Now().Unix()), out, days, metricsReceived, errors)
+	var point []interface{}
+	switch {
+	case len(t) == 2 && format != PickleFormatModern:
+		point, ok = t[1].([]interface{})
+		if !ok || len(point) != 2 {
+			return "", 0, 0, errFieldCount
 		}
+	case len(t) == 3 && format != PickleFormatLegacy:
+		point = t[1:]
+	default:
+		return "", 0, 0, errFieldCount
 	}
+
+	name, ok := t[0].(string)
+	if !ok {
+		return "", 0, 0, errFieldCount
+	}
+
+	timestamp, ok := pickleNumber(point[0])
+	if !ok {
+		return "", 0, 0, errBadTimestamp
+	}
+
+	value, ok := pickleNumber(point[1])
+	if !ok {
+		return "", 0, 0, errBadValue
+	}
+
+	return name, value, int64(timestamp), nil
 }
 
-func PickeParseBytes(exit chan struct{}, b []byte, now uint32, out chan *RowBinary.WriteBuffer, days *days1970.Days, metricsReceived *uint32, errors *uint32) {
+// PickleParseStream reads one pickled message from r and writes metrics to out while message is arriving.
+// WriteBuffer is sent if it is full or contains maxBatch metrics (0 is unlimited).
+// Returns errBackpressure if out is blocked longer than bp.timeout
+func PickleParseStream(exit chan struct{}, r *bufio.Reader, now uint32, out chan *RowBinary.WriteBuffer, days *days1970.Days, metricsReceived *uint32, errors *uint32, dropped *uint64, o *ParseOptions, format string, maxBatch int, bp *Backpressure) error {
+	if o == nil {
+		o = &ParseOptions{}
+	}
+	clock := o.RateLimits.clock()
+
 	metricCount := uint32(0)
+	newestTimestamp := uint32(0)
+	batchCount := 0 // metrics in wb
 	wb := RowBinary.GetWriteBuffer()
 
-	flush := func() {
-		if wb != nil {
-			if wb.Empty() {
-				wb.Release()
-			} else {
-				select {
-				case out <- wb:
-					// pass
-				case <-exit:
-					// pass
-				}
+	flush := func() error {
+		if wb.Empty() {
+			return nil
+		}
+		count := batchCount
+		batchCount = 0
+		if err := bp.Send(exit, out, wb); err != nil {
+			wb.Reset()
+			// dropped metrics are not received
+			metricCount -= uint32(count)
+			if dropped != nil {
+				atomic.AddUint64(dropped, uint64(count))
 			}
-			wb = nil
+			return err
 		}
+		wb = RowBinary.GetWriteBuffer()
+		return nil
 	}
 
-	fail := func() {
-		// @TODO: log
-		flush()
-		atomic.AddUint32(errors, 1)
-	}
+	err := pickleDecode(r, func(item interface{}) error {
+		name, value, timestamp, err := pickleMetric(item, format)
+		if err == nil {
+			var b []byte
+			if b, err = o.StripPrefix.strip([]byte(name)); err == nil {
+				b, err = o.Sanitizer.sanitize(b)
+			}
+			if err == nil {
+				name = string(b)
+			}
+		}
+		if err == nil {
+			err = o.ParseErrors.CheckName([]byte(name))
+		}
+		if err != nil {
+			atomic.AddUint32(errors, 1)
+			o.ParseErrors.Add(err, nil)
+			return nil
+		}
+
+		if o.Sharding.forwardPoint([]byte(name), value, timestamp) {
+			return nil
+		}
+
+		if o.Dedup.duplicate([]byte(name), value, uint32(timestamp)) {
+			return nil
+		}
+
+		if !o.Tenants.allow([]byte(name)) {
+			return nil
+		}
+
+		if !o.RateLimits.allow([]byte(name), clock) {
+			return nil
+		}
 
-	pickle.ParseMessage(b, func(name string, value float64, timestamp int64) {
 		if !wb.CanWriteGraphitePoint(len(name)) {
-			flush()
 			if len(name) > RowBinary.WriteBufferSize-50 {
-				fail()
-				return
+				atomic.AddUint32(errors, 1)
+				o.ParseErrors.Add(errNameTooLong, []byte(name))
+				return nil
+			}
+			if err = flush(); err != nil {
+				return err
+			}
+		} else if maxBatch > 0 && batchCount >= maxBatch {
+			if err = flush(); err != nil {
+				return err
 			}
-			wb = RowBinary.GetWriteBuffer()
 		}
 
 		wb.WriteGraphitePoint(
 			[]byte(name),
-			value,
+			o.Transforms.apply([]byte(name), value),
 			uint32(timestamp),
 			days.TimestampWithNow(uint32(timestamp), now),
 			now,
 		)
 
+		o.Namespaces.Add([]byte(name))
 		metricCount++
+		batchCount++
+		if uint32(timestamp) > newestTimestamp {
+			newestTimestamp = uint32(timestamp)
+		}
+		return nil
 	})
 
-	flush()
+	if err == nil {
+		err = flush()
+	} else {
+		// points of broken message tail are not sent
+		metricCount -= uint32(batchCount)
+	}
+	wb.Release()
+
 	if metricCount > 0 {
 		atomic.AddUint32(metricsReceived, metricCount)
+		o.Newest.observe(newestTimestamp)
+	}
+
+	if err != nil && err != errBackpressure && err != errStopped {
+		atomic.AddUint32(errors, 1)
 	}
+
+	return err
+}
+
+func PickeParseBytes(exit chan struct{}, b []byte, now uint32, out chan *RowBinary.WriteBuffer, days *days1970.Days, metricsReceived *uint32, errors *uint32, parseErrors *ParseErrors) {
+	PickleParseStream(exit, bufio.NewReader(bytes.NewReader(b)), now, out, days, metricsReceived, errors, nil, &ParseOptions{ParseErrors: parseErrors}, "", 0, nil)
 }
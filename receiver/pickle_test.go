@@ -0,0 +1,388 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+type pickleTestMetric struct {
+	name      string
+	value     float64
+	timestamp int64
+}
+
+func pickleDecodeMetrics(t *testing.T, b []byte) []pickleTestMetric {
+	result := make([]pickleTestMetric, 0)
+
+	err := pickleDecode(bufio.NewReader(bytes.NewReader(b)), func(item interface{}) error {
+		name, value, timestamp, err := pickleMetric(item, PickleFormatAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, pickleTestMetric{name, value, timestamp})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestPickleDecode(t *testing.T) {
+	// pickle.dumps([('carbon.agents.a', (1422642189, 42.5)), ('carbon.agents.b', (1422642190.0, -1)), ('carbon.agents.a', (1422642191, 2**40))], protocol=N)
+	table := []string{
+		"(lp0\n(Vcarbon.agents.a\np1\n(I1422642189\nF42.5\ntp2\ntp3\na(Vcarbon.agents.b\np4\n(F1422642190.0\nI-1\ntp5\ntp6\na(g1\n(I1422642191\nL1099511627776L\ntp7\ntp8\na.",
+		"(lp0\n(S'carbon.agents.a'\np1\n(I1422642189\nF42.5\ntp2\ntp3\na(S'carbon.agents.b'\np4\n(F1422642190.0\nI-1\ntp5\ntp6\na(g1\n(I1422642191\nL1099511627776L\ntp7\ntp8\na.",
+		"]q\x00((X\x0f\x00\x00\x00carbon.agents.aq\x01(J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00tq\x02tq\x03(X\x0f\x00\x00\x00carbon.agents.bq\x04(GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xfftq\x05tq\x06(h\x01(J\x0f\xcc\xcbTL1099511627776L\ntq\x07tq\x08e.",
+		"\x80\x02]q\x00(X\x0f\x00\x00\x00carbon.agents.aq\x01J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x0f\x00\x00\x00carbon.agents.bq\x04GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x86q\x05\x86q\x06h\x01J\x0f\xcc\xcbT\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x07\x86q\x08e.",
+		"\x80\x03]q\x00(X\x0f\x00\x00\x00carbon.agents.aq\x01J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x0f\x00\x00\x00carbon.agents.bq\x04GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x86q\x05\x86q\x06h\x01J\x0f\xcc\xcbT\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x07\x86q\x08e.",
+	}
+
+	expected := []pickleTestMetric{
+		{"carbon.agents.a", 42.5, 1422642189},
+		{"carbon.agents.b", -1, 1422642190},
+		{"carbon.agents.a", math.Pow(2, 40), 1422642191},
+	}
+
+	for i, p := range table {
+		m := pickleDecodeMetrics(t, []byte(p))
+		if len(m) != len(expected) {
+			t.Fatalf("%d: %#v != %#v", i, m, expected)
+		}
+		for j := 0; j < len(m); j++ {
+			if m[j] != expected[j] {
+				t.Fatalf("%d: %#v != %#v", i, m[j], expected[j])
+			}
+		}
+	}
+}
+
+func TestPickleFormats(t *testing.T) {
+	table := []struct {
+		format  string
+		pickle  string
+		metrics int // -1 is error
+	}{
+		// Python 2.7: pickle.dumps([('carbon.agents.a', 1422642189, 42.5), ('carbon.agents.b', 1422642190.0, -1)], protocol=N)
+		{PickleFormatModern, "(lp0\n(S'carbon.agents.a'\np1\nI1422642189\nF42.5\ntp2\na(S'carbon.agents.b'\np3\nF1422642190.0\nI-1\ntp4\na.", 2},
+		{PickleFormatModern, "\x80\x02]q\x00(U\x0fcarbon.agents.aq\x01J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x87q\x02U\x0fcarbon.agents.bq\x03GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x87q\x04e.", 2},
+		// Python 3, same list
+		{PickleFormatModern, "\x80\x03]q\x00(X\x0f\x00\x00\x00carbon.agents.aq\x01J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x87q\x02X\x0f\x00\x00\x00carbon.agents.bq\x03GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x87q\x04e.", 2},
+		{PickleFormatModern, "\x80\x04\x95I\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0fcarbon.agents.a\x94J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x87\x94\x8c\x0fcarbon.agents.b\x94GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x87\x94e.", 2},
+		{PickleFormatAuto, "\x80\x04\x95I\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0fcarbon.agents.a\x94J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x87\x94\x8c\x0fcarbon.agents.b\x94GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x87\x94e.", 2},
+		{PickleFormatLegacy, "\x80\x04\x95I\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0fcarbon.agents.a\x94J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x87\x94\x8c\x0fcarbon.agents.b\x94GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x87\x94e.", -1},
+		// Python 3: pickle.dumps([('carbon.agents.a', (1422642189, 42.5)), ('carbon.agents.b', (1422642190.0, -1))], protocol=4)
+		{PickleFormatLegacy, "\x80\x04\x95M\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0fcarbon.agents.a\x94J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x0fcarbon.agents.b\x94GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x86\x94\x86\x94e.", 2},
+		{PickleFormatModern, "\x80\x04\x95M\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0fcarbon.agents.a\x94J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x0fcarbon.agents.b\x94GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x86\x94\x86\x94e.", -1},
+		// Python 3: pickle.dumps([('carbon.agents.a', (1422642189, 42.5)), ('carbon.agents.b', 1422642190.0, -1)], protocol=4)
+		{PickleFormatAuto, "\x80\x04\x95K\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x0fcarbon.agents.a\x94J\r\xcc\xcbTG@E@\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x0fcarbon.agents.b\x94GA\xd52\xf3\x03\x80\x00\x00J\xff\xff\xff\xff\x87\x94e.", 2},
+	}
+
+	expected := []pickleTestMetric{
+		{"carbon.agents.a", 42.5, 1422642189},
+		{"carbon.agents.b", -1, 1422642190},
+	}
+
+	for i, c := range table {
+		var m []pickleTestMetric
+		err := pickleDecode(bufio.NewReader(strings.NewReader(c.pickle)), func(item interface{}) error {
+			name, value, timestamp, err := pickleMetric(item, c.format)
+			if err != nil {
+				return err
+			}
+			m = append(m, pickleTestMetric{name, value, timestamp})
+			return nil
+		})
+
+		if c.metrics < 0 {
+			if err != errFieldCount {
+				t.Fatalf("%d: %#v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: %s", i, err.Error())
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Fatalf("%d: %#v != %#v", i, m, expected)
+		}
+	}
+}
+
+func TestPickleDecodeErrors(t *testing.T) {
+	table := []string{
+		"",
+		"\x80\x02]q\x00(X\x0f\x00\x00\x00carbon",
+		"\x80\x02e.",
+		"\x80\x02h\x01.",
+		"\x80\x02\xff.",
+		"\x80\x02]X\xff\xff\xff\xff",
+	}
+
+	for _, p := range table {
+		err := pickleDecode(bufio.NewReader(bytes.NewReader([]byte(p))), func(item interface{}) error { return nil })
+		if err == nil {
+			t.Fatalf("%#v: error expected", p)
+		}
+	}
+
+	// each MEMOIZE of root list adds memo entry
+	p := "\x80\x04]" + strings.Repeat("\x94", maxPickleMemoSize+1) + "."
+	err := pickleDecode(bufio.NewReader(strings.NewReader(p)), func(item interface{}) error { return nil })
+	if err != errPickleMemoTooBig {
+		t.Fatalf("memo: %v", err)
+	}
+}
+
+// pickleTestMessage generates protocol 2 pickled list like python pickler makes (APPENDS by 1000 items)
+func pickleTestMessage(count int, now int64) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("\x80\x02]q\x00")
+
+	b := make([]byte, 8)
+	for i := 0; i < count; i++ {
+		if i%1000 == 0 {
+			if i > 0 {
+				buf.WriteByte(opAppends)
+			}
+			buf.WriteByte(opMark)
+		}
+
+		name := fmt.Sprintf("carbon.agents.host%d.metric", i)
+		buf.WriteByte(opBinUnicode)
+		binary.LittleEndian.PutUint32(b, uint32(len(name)))
+		buf.Write(b[:4])
+		buf.WriteString(name)
+
+		buf.WriteByte(opBinInt)
+		binary.LittleEndian.PutUint32(b, uint32(now))
+		buf.Write(b[:4])
+
+		buf.WriteByte(opBinFloat)
+		binary.BigEndian.PutUint64(b, math.Float64bits(float64(i)))
+		buf.Write(b)
+
+		buf.WriteByte(opTuple2)
+		buf.WriteByte(opTuple2)
+	}
+	if count > 0 {
+		buf.WriteByte(opAppends)
+	}
+	buf.WriteByte(opStop)
+
+	return buf.Bytes()
+}
+
+func TestPickleStreamLargeMessage(t *testing.T) {
+	out := make(chan *RowBinary.WriteBuffer, 16)
+
+	r, err := New("pickle://127.0.0.1:0", WriteChan(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Pickle)
+
+	now := time.Now().Unix()
+	count := 1024 * 1024
+	message := pickleTestMessage(count, now) // ~50Mb
+
+	conn, err := net.Dial("tcp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(message)))
+		conn.Write(size)
+
+		for p := message; len(p) > 0; {
+			n := 1024
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := conn.Write(p[:n]); err != nil {
+				return
+			}
+			p = p[n:]
+		}
+	}()
+
+	deadline := time.After(time.Minute)
+	for atomic.LoadUint32(&rcv.stat.metricsReceived) < uint32(count) {
+		select {
+		case wb := <-out:
+			wb.Release()
+		case <-time.After(10 * time.Millisecond):
+			// recheck counter
+		case <-deadline:
+			t.Fatalf("received %d of %d metrics", atomic.LoadUint32(&rcv.stat.metricsReceived), count)
+		}
+	}
+
+	if atomic.LoadUint32(&rcv.stat.errors) != 0 {
+		t.Fatalf("errors: %d", rcv.stat.errors)
+	}
+}
+
+func TestPickleMaxMessageSize(t *testing.T) {
+	r, err := New("pickle://127.0.0.1:0", WriteChan(make(chan *RowBinary.WriteBuffer, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Pickle)
+
+	conn, err := net.Dial("tcp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, maxPickleMessageSize+1)
+	conn.Write(size)
+
+	// message isn't read
+	waitClosed(t, conn, time.Second)
+
+	if n := atomic.LoadUint32(&rcv.stat.errors); n != 1 {
+		t.Fatalf("errors: %d", n)
+	}
+}
+
+func TestPickleIdleTimeout(t *testing.T) {
+	idleTimeout := 100 * time.Millisecond
+
+	r, err := New("pickle://127.0.0.1:0", WriteChan(make(chan *RowBinary.WriteBuffer, 16)), IdleTimeout(idleTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*Pickle)
+
+	conn, err := net.Dial("tcp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitClosed(t, conn, idleTimeout+time.Second)
+
+	if n := atomic.LoadUint32(&rcv.stat.closedIdle); n != 1 {
+		t.Fatalf("closedIdle: %d", n)
+	}
+}
+
+func TestPickleMaxBatchSize(t *testing.T) {
+	now := time.Now().Unix()
+	message := pickleTestMessage(2000, now)
+
+	parse := func(maxBatch int) []int {
+		out := make(chan *RowBinary.WriteBuffer, 1024)
+		var received, errors uint32
+		err := PickleParseStream(nil, bufio.NewReader(bytes.NewReader(message)), uint32(now), out, &days1970.Days{},
+			&received, &errors, nil, nil, "", maxBatch, nil)
+		if err != nil || received != 2000 || errors != 0 {
+			t.Fatalf("err: %#v, received: %d, errors: %d", err, received, errors)
+		}
+		close(out)
+
+		var sizes []int
+		for wb := range out {
+			sizes = append(sizes, writeBufferCount(t, wb))
+			wb.Release()
+		}
+		return sizes
+	}
+
+	sizes := parse(100)
+	if len(sizes) != 20 {
+		t.Fatalf("%d buffers: %#v", len(sizes), sizes)
+	}
+	for _, s := range sizes {
+		if s != 100 {
+			t.Fatalf("%#v", sizes)
+		}
+	}
+
+	// without limit all metrics fit into one buffer
+	if sizes = parse(0); len(sizes) != 1 || sizes[0] != 2000 {
+		t.Fatalf("%#v", sizes)
+	}
+}
+
+// writeBufferCount returns count of points in WriteBuffer
+func writeBufferCount(t *testing.T, wb *RowBinary.WriteBuffer) int {
+	count := 0
+	for p := wb.Bytes(); len(p) > 0; count++ {
+		namelen, n := binary.Uvarint(p)
+		if n <= 0 || len(p) < n+int(namelen)+18 {
+			t.Fatalf("bad buffer")
+		}
+		p = p[n+int(namelen)+18:]
+	}
+	return count
+}
+
+func TestPickleStats(t *testing.T) {
+	ch := make(chan *RowBinary.WriteBuffer)
+
+	r, err := New("pickle://127.0.0.1:0", WriteChan(ch), BackpressureTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	conn, err := net.Dial("tcp", r.(*Pickle).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeFrame := func(message []byte) {
+		binary.Write(conn, binary.BigEndian, uint32(len(message)))
+		conn.Write(message)
+	}
+
+	writeFrame(pickleTestMessage(10, time.Now().Unix()))
+	readNames(t, ch, 10, time.Second)
+	writeFrame([]byte("\x80\x02garbage"))
+
+	for deadline := time.Now().Add(time.Second); r.Stats().ParseErrors == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("parse error is not counted")
+		}
+	}
+	if s := r.Stats(); s != (ReceiverStats{ReceivedTotal: 10, ParseErrors: 1, ActiveConnections: 1}) {
+		t.Fatalf("%#v", s)
+	}
+
+	// write queue is not read, batch is dropped
+	writeFrame(pickleTestMessage(5, time.Now().Unix()))
+	waitClosed(t, conn, time.Second)
+
+	for deadline := time.Now().Add(time.Second); r.Stats().ActiveConnections > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is active")
+		}
+	}
+	if s := r.Stats(); s != (ReceiverStats{ReceivedTotal: 10, ParseErrors: 1, DroppedTotal: 5}) {
+		t.Fatalf("%#v", s)
+	}
+}
@@ -3,7 +3,6 @@ package receiver
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
 	"math"
 	"strconv"
 	"sync/atomic"
@@ -49,43 +48,93 @@ func RemoveDoubleDot(p []byte) []byte {
 	return p[:len(p)-shift]
 }
 
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// skipSpaces returns index of first non-space byte in p starting from offset
+func skipSpaces(p []byte, offset int) int {
+	for offset < len(p) && p[offset] == ' ' {
+		offset++
+	}
+	return offset
+}
+
+func parseTimestamp(p []byte) (uint32, error) {
+	ts, err := strconv.ParseUint(unsafeString(p), 10, 32)
+	if err == nil {
+		return uint32(ts), nil
+	}
+
+	// slow path for fractional timestamps
+	tsf, err := strconv.ParseFloat(unsafeString(p), 64)
+	if err != nil || math.IsNaN(tsf) || tsf < 0 || tsf > math.MaxUint32 {
+		return 0, errBadTimestamp
+	}
+
+	return uint32(tsf), nil
+}
+
+// PlainParseLine parses "name value timestamp" line without allocations.
+// Fields can be separated by several spaces, line can end with \n, \r\n or other trailing whitespace
 func PlainParseLine(p []byte) ([]byte, float64, uint32, error) {
+	name, value, timestamp, err := plainParseLine(p)
+	if err == nil && HasDoubleDot(name) {
+		// line is forwarded by sharding and logged on errors as received
+		name = RemoveDoubleDot(append([]byte(nil), name...))
+	}
+	return name, value, timestamp, err
+}
+
+// plainParseLine is PlainParseLine without removal of double dots. Name is part of p
+func plainParseLine(p []byte) ([]byte, float64, uint32, error) {
+	end := len(p)
+	for end > 0 && isSpace(p[end-1]) {
+		end--
+	}
+	p = p[:end]
+
 	i1 := bytes.IndexByte(p, ' ')
 	if i1 < 1 {
-		return nil, 0, 0, fmt.Errorf("bad message: %#v", string(p))
+		return nil, 0, 0, errFieldCount
 	}
 
-	i2 := bytes.IndexByte(p[i1+1:], ' ')
-	if i2 < 1 {
-		return nil, 0, 0, fmt.Errorf("bad message: %#v", string(p))
+	s2 := skipSpaces(p, i1+1)
+	i2 := bytes.IndexByte(p[s2:], ' ')
+	if i2 < 0 {
+		return nil, 0, 0, errFieldCount
 	}
-	i2 += i1 + 1
+	i2 += s2
 
-	i3 := len(p)
-	if p[i3-1] == '\n' {
-		i3--
-	}
-	if p[i3-1] == '\r' {
-		i3--
+	s3 := skipSpaces(p, i2+1)
+	if bytes.IndexByte(p[s3:], ' ') >= 0 {
+		return nil, 0, 0, errFieldCount
 	}
 
-	value, err := strconv.ParseFloat(unsafeString(p[i1+1:i2]), 64)
+	value, err := strconv.ParseFloat(unsafeString(p[s2:i2]), 64)
 	if err != nil || math.IsNaN(value) {
-		return nil, 0, 0, fmt.Errorf("bad message: %#v", string(p))
+		return nil, 0, 0, errBadValue
 	}
 
-	tsf, err := strconv.ParseFloat(unsafeString(p[i2+1:i3]), 64)
-	if err != nil || math.IsNaN(tsf) {
-		return nil, 0, 0, fmt.Errorf("bad message: %#v", string(p))
+	timestamp, err := parseTimestamp(p[s3:])
+	if err != nil {
+		return nil, 0, 0, err
 	}
 
-	return RemoveDoubleDot(p[:i1]), value, uint32(tsf), nil
+	return p[:i1], value, timestamp, nil
 }
 
-func PlainParseBuffer(exit chan struct{}, b *Buffer, out chan *RowBinary.WriteBuffer, days *days1970.Days, metricsReceived *uint32, errors *uint32) {
+// PlainParseBuffer parses lines of b and sends metrics to out. o is nil if all stages are disabled
+func PlainParseBuffer(exit chan struct{}, b *Buffer, out chan *RowBinary.WriteBuffer, days *days1970.Days, metricsReceived *uint32, errors *uint32, o *ParseOptions) {
+	if o == nil {
+		o = &ParseOptions{}
+	}
+	now := o.RateLimits.clock()
+
 	offset := 0
 	metricCount := uint32(0)
 	errorCount := uint32(0)
+	newestTimestamp := uint32(0)
 
 	version := make([]byte, 4)
 	binary.LittleEndian.PutUint32(version, b.Time)
@@ -105,28 +154,82 @@ MainLoop:
 			continue MainLoop
 		}
 
-		name, value, timestamp, err := PlainParseLine(b.Body[offset : offset+lineEnd+1])
+		line := b.Body[offset : offset+lineEnd+1]
+		name, value, timestamp, err := plainParseLine(line)
 		offset += lineEnd + 1
 
-		// @TODO: check required buffer size, get new
+		// patterns are checked in received name, double dots are removed below
+		if err == nil {
+			err = o.ParseErrors.checkPatterns(name)
+		}
+		if err == nil && HasDoubleDot(name) {
+			name = RemoveDoubleDot(append([]byte(nil), name...))
+		}
+		if err == nil {
+			name, err = o.StripPrefix.strip(name)
+		}
+		if err == nil {
+			name, err = o.Sanitizer.sanitize(name)
+		}
+		if err == nil {
+			err = o.ParseErrors.checkName(name, false)
+		}
 
 		if err != nil {
 			errorCount++
-			// @TODO: log error
+			o.ParseErrors.Add(err, line)
+			continue MainLoop
+		}
+
+		if o.Sharding.forwardLine(name, line) {
+			continue MainLoop
+		}
+
+		if o.Dedup.duplicate(name, value, timestamp) {
+			continue MainLoop
+		}
+
+		if !o.Tenants.allow(name) {
+			continue MainLoop
+		}
+
+		if !o.RateLimits.allow(name, now) {
 			continue MainLoop
 		}
 
+		if !wb.CanWriteGraphitePoint(len(name)) {
+			if len(name) > RowBinary.WriteBufferSize-50 {
+				errorCount++
+				o.ParseErrors.Add(errNameTooLong, line)
+				continue MainLoop
+			}
+
+			// buffer is full
+			select {
+			case out <- wb:
+				// pass
+			case <-exit:
+				return
+			}
+			wb = RowBinary.GetWriteBuffer()
+		}
+
 		// write result to buffer for clickhouse
 		wb.WriteBytes(name)
-		wb.WriteFloat64(value)
+		wb.WriteFloat64(o.Transforms.apply(name, value))
 		wb.WriteUint32(timestamp)
 		wb.WriteUint16(days.TimestampWithNow(timestamp, b.Time))
 		wb.Write(version)
+		o.Namespaces.Add(name)
 		metricCount++
+		if timestamp > newestTimestamp {
+			newestTimestamp = timestamp
+		}
 	}
 
 	if metricCount > 0 {
 		atomic.AddUint32(metricsReceived, metricCount)
+		o.Newest.observe(newestTimestamp)
 	}
 	if errorCount > 0 {
 		atomic.AddUint32(errors, errorCount)
@@ -145,7 +248,9 @@ MainLoop:
 	}
 }
 
-func PlainParser(exit chan struct{}, in chan *Buffer, out chan *RowBinary.WriteBuffer, metricsReceived *uint32, errors *uint32) {
+// PlainParser parses buffers from in. pending is decremented after buffer is parsed and sent to out or parse is panicked.
+// Nil buffer stops parser, it is sent by ParsePool.Scale
+func PlainParser(exit chan struct{}, in chan *Buffer, out chan *RowBinary.WriteBuffer, metricsReceived *uint32, errors *uint32, pending *int32, o *ParseOptions) {
 	days := &days1970.Days{}
 
 	for {
@@ -153,8 +258,19 @@ func PlainParser(exit chan struct{}, in chan *Buffer, out chan *RowBinary.WriteB
 		case <-exit:
 			return
 		case b := <-in:
-			PlainParseBuffer(exit, b, out, days, metricsReceived, errors)
-			b.Release()
+			if b == nil {
+				return
+			}
+			plainParse(exit, b, out, days, metricsReceived, errors, pending, o)
 		}
 	}
 }
+
+// plainParse parses b. b is released and pending is decremented on panic too: panic is recovered by ParsePool
+func plainParse(exit chan struct{}, b *Buffer, out chan *RowBinary.WriteBuffer, days *days1970.Days, metricsReceived *uint32, errors *uint32, pending *int32, o *ParseOptions) {
+	defer func() {
+		b.Release()
+		atomic.AddInt32(pending, -1)
+	}()
+	PlainParseBuffer(exit, b, out, days, metricsReceived, errors, o)
+}
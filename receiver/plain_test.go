@@ -36,16 +36,25 @@ func BenchmarkPlainParseBuffer(b *testing.B) {
 
 	var wb *RowBinary.WriteBuffer
 	for i := 0; i < b.N; i += 100 {
-		PlainParseBuffer(nil, buf, out, days, &c1, &c2)
+		PlainParseBuffer(nil, buf, out, days, &c1, &c2, nil)
 		wb = <-out
 		wb.Release()
 
-		PlainParseBuffer(nil, buf2, out, days, &c1, &c2)
+		PlainParseBuffer(nil, buf2, out, days, &c1, &c2, nil)
 		wb = <-out
 		wb.Release()
 	}
 }
 
+func BenchmarkPlainParseLine(b *testing.B) {
+	line := []byte("carbon.agents.localhost.cache.size 1412351 1422642189\n")
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		PlainParseLine(line)
+	}
+}
+
 func TestRemoveDoubleDot(t *testing.T) {
 	table := [](struct {
 		input    string
@@ -87,6 +96,14 @@ func TestPlainParseLine(t *testing.T) {
 		{"metric..name 42.15 1422642189\n", "metric.name", 42.15, 1422642189},
 		{"metric...name 42.15 1422642189\n", "metric.name", 42.15, 1422642189},
 		{"metric.name 42.15 1422642189\r\n", "metric.name", 42.15, 1422642189},
+		{"metric.name   42.15  1422642189\n", "metric.name", 42.15, 1422642189},
+		{"metric.name 42.15 1422642189 \t\r\n", "metric.name", 42.15, 1422642189},
+		{"metric.name 42.15 1422642189", "metric.name", 42.15, 1422642189},
+		{"metric.name 42.15 1422642189.7\n", "metric.name", 42.15, 1422642189},
+		{b: "metric.name 42.15 1422642189 1\n"},
+		{b: "metric.name 42.15 -1422642189\n"},
+		{b: "metric.name 42.15 14226421890\n"},
+		{b: " metric.name 42.15 1422642189\n"},
 	}
 
 	for _, p := range table {
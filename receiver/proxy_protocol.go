@@ -0,0 +1,162 @@
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// max time of PROXY header receiving
+const proxyHeaderTimeout = 10 * time.Second
+
+// max length of v1 header including CRLF
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\x0D\x0A\x0D\x0A\x00\x0D\x0A\x51\x55\x49\x54\x0A")
+
+var errProxyHeader = errors.New("bad PROXY protocol header")
+
+// proxyConn is connection with client address from PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader // contains data received after header
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads PROXY protocol v1 or v2 header from start of connection.
+// Returned connection reports client address as RemoteAddr. Address of proxy is kept for LOCAL and UNKNOWN connections
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var addr net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		addr, err = readProxyV2(r)
+	} else {
+		addr, err = readProxyV1(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+
+	return &proxyConn{Conn: conn, reader: r, remoteAddr: addr}, nil
+}
+
+// readProxyV1 parses text header "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		// pass
+	default:
+		return nil, errProxyHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, errProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses binary header: signature{12}, version and command{1}, family{1}, length{2}, addresses and TLVs{length}
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0F {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+		// pass
+	default:
+		return nil, errProxyHeader
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		// UNSPEC, UDP and unix sockets
+		return nil, nil
+	}
+}
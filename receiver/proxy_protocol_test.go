@@ -0,0 +1,138 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// proxyV2Header builds binary header of TCP connection from src:port
+func proxyV2Header(src net.IP, port int) []byte {
+	var body []byte
+	var family byte
+
+	if ip4 := src.To4(); ip4 != nil {
+		family = 0x11
+		body = append(body, ip4...)
+		body = append(body, net.IPv4(127, 0, 0, 1).To4()...)
+	} else {
+		family = 0x21
+		body = append(body, src.To16()...)
+		body = append(body, net.IPv6loopback...)
+	}
+	body = append(body, byte(port>>8), byte(port), 0x07, 0xD3)
+
+	// unknown TLV is skipped
+	body = append(body, 0xEE, 0x00, 0x01, 0x00)
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	local := append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+
+	table := []struct {
+		header string
+		addr   string // empty for address of proxy
+		valid  bool
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 2003\r\n", "192.168.0.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 2003\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY UNKNOWN 192.168.0.1 192.168.0.11 56324 2003\r\n", "", true},
+		{string(proxyV2Header(net.ParseIP("10.0.0.1"), 40000)), "10.0.0.1:40000", true},
+		{string(proxyV2Header(net.ParseIP("2001:db8::1"), 40000)), "[2001:db8::1]:40000", true},
+		{string(local), "", true},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 2003\n", "", false},
+		{"PROXY TCP4 2001:db8::1 192.168.0.11 56324 2003\r\n", "", false},
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 65536 2003\r\n", "", false},
+		{"PROXY UDP4 192.168.0.1 192.168.0.11 56324 2003\r\n", "", false},
+		{"hello.world 42 1422642189\n", "", false},
+	}
+
+	for _, c := range table {
+		client, server := net.Pipe()
+
+		go func() {
+			client.Write([]byte(c.header))
+			client.Write([]byte("hello.world 42 1422642189\n"))
+			client.Close()
+		}()
+
+		conn, err := readProxyHeader(server)
+		if (err == nil) != c.valid {
+			t.Fatalf("%#v: %#v", c.header, err)
+		}
+
+		if err == nil {
+			addr := conn.RemoteAddr().String()
+			if c.addr == "" && addr != server.RemoteAddr().String() || c.addr != "" && addr != c.addr {
+				t.Fatalf("%#v: addr %s", c.header, addr)
+			}
+
+			// data after header is not lost
+			body := make([]byte, 26)
+			if _, err = io.ReadFull(conn, body); err != nil || string(body) != "hello.world 42 1422642189\n" {
+				t.Fatalf("%#v: %#v %#v", c.header, string(body), err)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func TestTCPProxyProtocol(t *testing.T) {
+	ch := make(chan *RowBinary.WriteBuffer, 16)
+
+	r, err := New("tcp://127.0.0.1:0",
+		WriteChan(ch),
+		ParseThreads(1),
+		MaxLineBuffer(1048576),
+		ProxyProtocol(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*TCP)
+
+	send := func(header []byte, line string) {
+		conn, err := net.Dial("tcp", rcv.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(header)
+		conn.Write([]byte(line))
+		conn.Close()
+	}
+
+	send([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 2003\r\n"), "hello.v1 42 1422642189\n")
+	send(proxyV2Header(net.ParseIP("10.0.0.1"), 40000), "hello.v2 42 1422642189\n")
+
+	names := readNames(t, ch, 2, time.Second)
+	if !names["hello.v1"] || !names["hello.v2"] {
+		t.Fatalf("%#v", names)
+	}
+
+	// connection without header is closed
+	send(nil, "hello.world 42 1422642189\n")
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&rcv.stat.proxyErrors) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("proxyErrors: %d", atomic.LoadUint32(&rcv.stat.proxyErrors))
+		}
+	}
+
+	select {
+	case <-ch:
+		t.Fatal("metric without PROXY header is received")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
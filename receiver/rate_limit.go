@@ -0,0 +1,246 @@
+package receiver
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// count of independently locked maps of namespace buckets
+const rateLimitShards = 64
+
+// bucketBurst is capacity of bucket: tokens of one second
+const bucketBurst = int64(time.Second)
+
+// tokenBucket refills rate tokens per second up to rate. Implemented as generic cell rate algorithm:
+// each token moves theoretical arrival time by interval, bucket is empty if it is more than one second ahead
+// of now. Tokens are taken by compare and swap without lock
+type tokenBucket struct {
+	interval int64 // nanoseconds per token. 0 is unlimited
+	tat      int64 // atomic. unixnano of theoretical arrival, bucket is full if it is before now
+}
+
+func newTokenBucket(rate float64, now int64) *tokenBucket {
+	b := &tokenBucket{tat: now}
+	if rate > 0 {
+		b.interval = int64(float64(time.Second) / rate)
+	}
+	return b
+}
+
+// take returns false if bucket is empty
+func (b *tokenBucket) take(now int64) bool {
+	if b.interval == 0 {
+		return true
+	}
+
+	for {
+		tat := atomic.LoadInt64(&b.tat)
+		next := tat
+		if next < now {
+			next = now
+		}
+		next += b.interval
+		if next-now > bucketBurst {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, tat, next) {
+			return true
+		}
+	}
+}
+
+// refund returns token taken for metric dropped by parent bucket
+func (b *tokenBucket) refund() {
+	if b.interval == 0 {
+		return
+	}
+	atomic.AddInt64(&b.tat, -b.interval)
+}
+
+// tokens returns count of tokens available at now
+func (b *tokenBucket) tokens(now int64) float64 {
+	tat := atomic.LoadInt64(&b.tat)
+	if tat < now {
+		tat = now
+	}
+	return float64(bucketBurst-(tat-now)) / float64(b.interval)
+}
+
+// idle returns true if bucket is full for ttl at now
+func (b *tokenBucket) idle(now int64, ttl int64) bool {
+	return atomic.LoadInt64(&b.tat)+ttl < now
+}
+
+type rateLimitShard struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// RateLimits is hierarchical token bucket of received metrics. Root bucket limits total rate, bucket of each
+// namespace (first depth components of name) limits rate of namespace. Metrics dropped by bucket of namespace
+// don't take tokens of root, so exhausted namespace doesn't throttle other ones
+type RateLimits struct {
+	stat struct {
+		droppedGlobal    uint32 // atomic
+		droppedNamespace uint32 // atomic
+		overflow         uint32 // atomic. metrics of namespaces not tracked due to maxNamespaces
+		expired          uint32 // atomic. removed idle buckets of namespaces
+	}
+	root          *tokenBucket
+	namespaceRate float64
+	depth         int
+	maxNamespaces int32
+	idleTTL       int64 // nanoseconds. Buckets of namespaces full for idleTTL are removed. 0 - never removed
+	namespaces    int32 // atomic. count of buckets of namespaces
+	swept         int64 // atomic. unixnano of last removal of idle buckets
+	shards        [rateLimitShards]rateLimitShard
+	now           func() time.Time
+}
+
+// NewRateLimits creates limits of metrics per second. Buckets of namespaces are created on first metric of namespace,
+// metrics of namespaces above maxNamespaces are limited by globalRate only. Buckets of namespaces without metrics
+// for idleTTL are removed, so they don't take place of new namespaces. 0 rate is unlimited, 0 idleTTL is disabled
+func NewRateLimits(globalRate float64, namespaceRate float64, depth int, maxNamespaces int, idleTTL time.Duration) *RateLimits {
+	rl := &RateLimits{
+		namespaceRate: namespaceRate,
+		depth:         depth,
+		maxNamespaces: int32(maxNamespaces),
+		idleTTL:       int64(idleTTL),
+		now:           time.Now,
+	}
+	rl.swept = rl.now().UnixNano()
+	rl.root = newTokenBucket(globalRate, rl.swept)
+	for i := range rl.shards {
+		rl.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return rl
+}
+
+// clock returns current time for allow. Parsers read it once per buffer of metrics. Safe for nil receiver
+func (rl *RateLimits) clock() int64 {
+	if rl == nil {
+		return 0
+	}
+	return rl.now().UnixNano()
+}
+
+// namespace returns first depth components of name without tags
+func (rl *RateLimits) namespace(name []byte) []byte {
+	if end := bytes.IndexByte(name, ';'); end >= 0 {
+		name = name[:end]
+	}
+
+	offset := 0
+	for i := 0; i < rl.depth; i++ {
+		next := bytes.IndexByte(name[offset:], '.')
+		if next < 0 {
+			return name
+		}
+		offset += next + 1
+	}
+	return name[:offset-1]
+}
+
+// bucket returns existing or created bucket of namespace. Nil is returned if limit of namespaces reached
+func (rl *RateLimits) bucket(ns []byte, now int64) *tokenBucket {
+	if rl.idleTTL > 0 {
+		// one of parsers removes idle buckets of all shards once per idleTTL
+		if swept := atomic.LoadInt64(&rl.swept); now-swept > rl.idleTTL && atomic.CompareAndSwapInt64(&rl.swept, swept, now) {
+			rl.sweep(now)
+		}
+	}
+
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, c := range ns {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	shard := &rl.shards[h%rateLimitShards]
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	if b := shard.buckets[unsafeString(ns)]; b != nil {
+		return b
+	}
+
+	if atomic.AddInt32(&rl.namespaces, 1) > rl.maxNamespaces && rl.maxNamespaces > 0 {
+		atomic.AddInt32(&rl.namespaces, -1)
+		return nil
+	}
+
+	b := newTokenBucket(rl.namespaceRate, now)
+	shard.buckets[string(ns)] = b
+	return b
+}
+
+// sweep removes buckets full for idleTTL
+func (rl *RateLimits) sweep(now int64) {
+	for i := range rl.shards {
+		shard := &rl.shards[i]
+		shard.Lock()
+		for ns, b := range shard.buckets {
+			if b.idle(now, rl.idleTTL) {
+				delete(shard.buckets, ns)
+				atomic.AddInt32(&rl.namespaces, -1)
+				atomic.AddUint32(&rl.stat.expired, 1)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+// allow returns false if metric should be dropped. now is value of clock. Safe for nil receiver
+func (rl *RateLimits) allow(name []byte, now int64) bool {
+	if rl == nil {
+		return true
+	}
+
+	var b *tokenBucket
+	if rl.namespaceRate > 0 {
+		if b = rl.bucket(rl.namespace(name), now); b == nil {
+			atomic.AddUint32(&rl.stat.overflow, 1)
+		} else if !b.take(now) {
+			atomic.AddUint32(&rl.stat.droppedNamespace, 1)
+			return false
+		}
+	}
+
+	if !rl.root.take(now) {
+		if b != nil {
+			b.refund()
+		}
+		atomic.AddUint32(&rl.stat.droppedGlobal, 1)
+		return false
+	}
+
+	return true
+}
+
+// Namespaces returns count of buckets of namespaces
+func (rl *RateLimits) Namespaces() int {
+	return int(atomic.LoadInt32(&rl.namespaces))
+}
+
+func (rl *RateLimits) Stat(send func(metric string, value float64)) {
+	droppedGlobal := atomic.LoadUint32(&rl.stat.droppedGlobal)
+	atomic.AddUint32(&rl.stat.droppedGlobal, -droppedGlobal)
+	send("droppedGlobal", float64(droppedGlobal))
+
+	droppedNamespace := atomic.LoadUint32(&rl.stat.droppedNamespace)
+	atomic.AddUint32(&rl.stat.droppedNamespace, -droppedNamespace)
+	send("droppedNamespace", float64(droppedNamespace))
+
+	overflow := atomic.LoadUint32(&rl.stat.overflow)
+	atomic.AddUint32(&rl.stat.overflow, -overflow)
+	send("namespaceOverflow", float64(overflow))
+
+	expired := atomic.LoadUint32(&rl.stat.expired)
+	atomic.AddUint32(&rl.stat.expired, -expired)
+	send("namespaceExpired", float64(expired))
+
+	send("namespaces", float64(rl.Namespaces()))
+}
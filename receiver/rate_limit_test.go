@@ -0,0 +1,215 @@
+package receiver
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestRateLimitsNamespace(t *testing.T) {
+	tests := []struct {
+		depth    int
+		name     string
+		expected string
+	}{
+		{2, "a.b.c.d", "a.b"},
+		{2, "a.b", "a.b"},
+		{2, "a", "a"},
+		{1, "a.b.c", "a"},
+		{2, "a.b.c;tag=x.y", "a.b"},
+		{3, "a.b;tag=x.y.z", "a.b"},
+	}
+
+	for _, test := range tests {
+		rl := NewRateLimits(0, 1, test.depth, 0, 0)
+		if ns := string(rl.namespace([]byte(test.name))); ns != test.expected {
+			t.Errorf("%d %s: %s, expected %s", test.depth, test.name, ns, test.expected)
+		}
+	}
+}
+
+// setClock replaces clock of rl by *now. Root bucket is full at *now
+func setClock(rl *RateLimits, now *time.Time) {
+	rl.now = func() time.Time { return *now }
+	atomic.StoreInt64(&rl.root.tat, now.UnixNano())
+	atomic.StoreInt64(&rl.swept, now.UnixNano())
+}
+
+func TestRateLimits(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	rl := NewRateLimits(50, 30, 2, 3, 0)
+	setClock(rl, &now)
+
+	send := func(namespaces ...string) map[string]int {
+		allowed := make(map[string]int)
+		for i := 0; i < 50; i++ {
+			for _, ns := range namespaces {
+				if rl.allow([]byte(fmt.Sprintf("%s.host%d.cpu", ns, i)), rl.clock()) {
+					allowed[ns]++
+				}
+			}
+		}
+		return allowed
+	}
+
+	// exhausted namespace doesn't take tokens of other ones
+	allowed := send("prod.noisy")
+	if allowed["prod.noisy"] != 30 {
+		t.Fatalf("%#v", allowed)
+	}
+	allowed = send("prod.noisy", "prod.quiet")
+	if allowed["prod.noisy"] != 0 || allowed["prod.quiet"] != 20 {
+		t.Fatalf("%#v", allowed)
+	}
+	// metrics dropped by global limit don't take tokens of namespace
+	if tokens := int(rl.bucket([]byte("prod.quiet"), now.UnixNano()).tokens(now.UnixNano())); tokens != 10 {
+		t.Fatalf("tokens: %v", tokens)
+	}
+
+	allowed = send("dev.a")
+	if allowed["dev.a"] != 0 {
+		t.Fatalf("%#v", allowed)
+	}
+	// metrics of namespaces over max-namespaces are limited by global rate only
+	allowed = send("dev.b")
+	if allowed["dev.b"] != 0 || rl.Namespaces() != 3 {
+		t.Fatalf("%#v, namespaces: %d", allowed, rl.Namespaces())
+	}
+
+	// buckets are refilled, burst is limited by one second
+	now = now.Add(100 * time.Millisecond)
+	allowed = send("dev.a")
+	if allowed["dev.a"] != 5 {
+		t.Fatalf("%#v", allowed)
+	}
+	now = now.Add(time.Minute)
+	allowed = send("dev.b")
+	if allowed["dev.b"] != 50 {
+		t.Fatalf("%#v", allowed)
+	}
+
+	stat := make(map[string]float64)
+	rl.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	expected := map[string]float64{
+		"droppedGlobal":     30 + 50 + 50 + 45,
+		"droppedNamespace":  20 + 50,
+		"namespaceOverflow": 100,
+		"namespaceExpired":  0,
+		"namespaces":        3,
+	}
+	for metric, value := range expected {
+		if stat[metric] != value {
+			t.Fatalf("%s: %v, %#v", metric, stat[metric], stat)
+		}
+	}
+
+	// counters are reset by Stat
+	rl.Stat(func(metric string, value float64) {
+		if metric != "namespaces" && value != 0 {
+			t.Fatalf("%s: %v", metric, value)
+		}
+	})
+}
+
+func TestRateLimitsUnlimitedNamespaces(t *testing.T) {
+	rl := NewRateLimits(10, 0, 2, 100, 0)
+	now := time.Unix(1422642189, 0)
+	setClock(rl, &now)
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if rl.allow([]byte(fmt.Sprintf("ns%d.host.cpu", i)), rl.clock()) {
+			allowed++
+		}
+	}
+	// buckets of namespaces are not created
+	if allowed != 10 || rl.Namespaces() != 0 {
+		t.Fatalf("allowed: %d, namespaces: %d", allowed, rl.Namespaces())
+	}
+}
+
+func TestRateLimitsIdleTTL(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	rl := NewRateLimits(0, 1, 1, 2, time.Minute)
+	setClock(rl, &now)
+
+	// namespace c over max-namespaces isn't limited
+	for _, name := range []string{"a.cpu", "b.cpu", "c.cpu", "c.cpu"} {
+		rl.allow([]byte(name), rl.clock())
+	}
+	if rl.Namespaces() != 2 {
+		t.Fatalf("namespaces: %d", rl.Namespaces())
+	}
+
+	// namespace a is active, idle bucket of b is removed and replaced by c
+	now = now.Add(50 * time.Second)
+	rl.allow([]byte("a.cpu"), rl.clock())
+	now = now.Add(20 * time.Second)
+	if !rl.allow([]byte("c.cpu"), rl.clock()) || rl.allow([]byte("c.cpu"), rl.clock()) {
+		t.Fatal("bucket of c isn't created")
+	}
+	if rl.Namespaces() != 2 {
+		t.Fatalf("namespaces: %d", rl.Namespaces())
+	}
+
+	stat := make(map[string]float64)
+	rl.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["namespaceExpired"] != 1 || stat["namespaceOverflow"] != 2 {
+		t.Fatalf("%#v", stat)
+	}
+}
+
+func TestRateLimitsConcurrent(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	rl := NewRateLimits(1000, 0, 1, 0, 0)
+	setClock(rl, &now)
+
+	// tokens of root are taken without lock, exactly rate of metrics is allowed
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clock := rl.clock()
+			for j := 0; j < 500; j++ {
+				if rl.allow([]byte("a.cpu"), clock) {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1000 {
+		t.Fatalf("allowed: %d", allowed)
+	}
+}
+
+func TestRateLimitsPlainParse(t *testing.T) {
+	rl := NewRateLimits(0, 1, 1, 0, 0)
+
+	buf := GetBuffer()
+	buf.Used = copy(buf.Body, "acme.cpu 1 1422642189\nacme.mem 2 1422642189\nhello.world 3 1422642189\n")
+	buf.Time = 1422642189
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{RateLimits: rl})
+
+	// dropped metric is not error
+	if received != 2 || errors != 0 {
+		t.Fatalf("received: %d, errors: %d", received, errors)
+	}
+	if names := readNames(t, out, 2, time.Second); !names["acme.cpu"] || !names["hello.world"] {
+		t.Fatalf("%#v", names)
+	}
+}
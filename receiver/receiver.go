@@ -4,18 +4,62 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
-	"github.com/lomik/zapwriter"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
 )
 
 type Receiver interface {
 	Stat(func(metric string, value float64))
+	Stats() ReceiverStats
+	// Ready is closed after receive loop is started: first accept of tcp and pickle, first read of udp.
+	// Ingest is ready on creation
+	Ready() <-chan struct{}
 	Stop()
 }
 
+// readiness is Ready channel of receiver closed once by receive loops
+type readiness struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+// reset is called by Listen before start of receive loops
+func (r *readiness) reset() {
+	r.once = sync.Once{}
+	r.ch = make(chan struct{})
+}
+
+func (r *readiness) done() {
+	r.once.Do(func() { close(r.ch) })
+}
+
+// ReceiverStats is snapshot of receiver counters since start. Unlike Stat it doesn't reset counters
+type ReceiverStats struct {
+	ReceivedTotal     uint64 // parsed metrics
+	ParseErrors       uint64 // dropped bad lines and messages
+	ActiveConnections int    // open connections. Always 0 for UDP
+	DroppedTotal      uint64 // received metrics dropped on backpressure or stop. Always 0 for UDP, it blocks on full parse queue, and for Ingest, it returns error to caller
+}
+
 type Option func(Receiver) error
 
+// ParseOptions are stages of parsed metrics shared by parsers of all protocols. Nil stage is disabled
+type ParseOptions struct {
+	ParseErrors *ParseErrors
+	Namespaces  *Namespaces
+	Sharding    *Sharding
+	StripPrefix *PrefixStripper
+	Sanitizer   *Sanitizer
+	Tenants     *Tenants
+	Newest      *NewestTimestamp
+	Transforms  *Transforms
+	Dedup       *Dedup
+	RateLimits  *RateLimits
+}
+
 // WriteChan creates option for New contructor
 func WriteChan(ch chan *RowBinary.WriteBuffer) Option {
 	return func(r Receiver) error {
@@ -28,6 +72,9 @@ func WriteChan(ch chan *RowBinary.WriteBuffer) Option {
 		if t, ok := r.(*UDP); ok {
 			t.writeChan = ch
 		}
+		if t, ok := r.(*Ingest); ok {
+			t.writeChan = ch
+		}
 		return nil
 	}
 }
@@ -48,7 +95,366 @@ func ParseThreads(threads int) Option {
 	}
 }
 
-// New creates udp, tcp, pickle receiver
+// ParseErrorLogRate creates option for New contructor. Max logged parse errors per minute
+func ParseErrorLogRate(rate int) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.parseErrors.logRate = uint32(rate)
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.parseErrors.logRate = uint32(rate)
+		}
+		if t, ok := r.(*UDP); ok {
+			t.parseErrors.logRate = uint32(rate)
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.parseErrors.logRate = uint32(rate)
+		}
+		return nil
+	}
+}
+
+// AllowUnicodeNames creates option for New contructor. Valid utf-8 names are passed if enabled,
+// otherwise names with non-ascii bytes are dropped
+func AllowUnicodeNames(enabled bool) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.parseErrors.allowUnicode = enabled
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.parseErrors.allowUnicode = enabled
+		}
+		if t, ok := r.(*UDP); ok {
+			t.parseErrors.allowUnicode = enabled
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.parseErrors.allowUnicode = enabled
+		}
+		return nil
+	}
+}
+
+// MaxMetricDepth creates option for New contructor. Names with more than maxDepth dot-separated components
+// are dropped, names with more than warnDepth components are logged. 0 disables check
+func MaxMetricDepth(maxDepth, warnDepth int) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.parseErrors.maxDepth, t.parseErrors.warnDepth = maxDepth, warnDepth
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.parseErrors.maxDepth, t.parseErrors.warnDepth = maxDepth, warnDepth
+		}
+		if t, ok := r.(*UDP); ok {
+			t.parseErrors.maxDepth, t.parseErrors.warnDepth = maxDepth, warnDepth
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.parseErrors.maxDepth, t.parseErrors.warnDepth = maxDepth, warnDepth
+		}
+		return nil
+	}
+}
+
+// NameValidation creates option for New contructor. Names matching catalog of pathological patterns are counted
+// by pattern, logged in NameValidationWarn mode and dropped in NameValidationStrict mode
+func NameValidation(mode string) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.parseErrors.nameValidation = mode
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.parseErrors.nameValidation = mode
+		}
+		if t, ok := r.(*UDP); ok {
+			t.parseErrors.nameValidation = mode
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.parseErrors.nameValidation = mode
+		}
+		return nil
+	}
+}
+
+// StripPrefix creates option for New contructor. Prefix is removed from metric names, names without prefix are not changed
+func StripPrefix(prefix string) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.stripPrefix = NewPrefixStripper(prefix)
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.stripPrefix = NewPrefixStripper(prefix)
+		}
+		if t, ok := r.(*UDP); ok {
+			t.stripPrefix = NewPrefixStripper(prefix)
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.stripPrefix = NewPrefixStripper(prefix)
+		}
+		return nil
+	}
+}
+
+// SanitizeNames creates option for New contructor. Characters of metric names not matching [a-zA-Z0-9._-]
+// are replaced if enabled
+func SanitizeNames(enabled bool, replacement string) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok && enabled {
+			t.sanitizer = NewSanitizer(replacement, t.logger)
+		}
+		if t, ok := r.(*Pickle); ok && enabled {
+			t.sanitizer = NewSanitizer(replacement, t.logger)
+		}
+		if t, ok := r.(*UDP); ok && enabled {
+			t.sanitizer = NewSanitizer(replacement, t.logger)
+		}
+		if t, ok := r.(*Ingest); ok && enabled {
+			t.sanitizer = NewSanitizer(replacement, t.logger)
+		}
+		return nil
+	}
+}
+
+// ShardingForward creates option for New contructor. Metrics owned by other nodes are forwarded to them
+func ShardingForward(s *Sharding) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.sharding = s
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.sharding = s
+		}
+		if t, ok := r.(*UDP); ok {
+			t.sharding = s
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.sharding = s
+		}
+		return nil
+	}
+}
+
+// ProxyProtocol creates option for New contructor. Client address is read from PROXY protocol v1 or v2 header
+// at start of each connection. Connections without header are closed
+func ProxyProtocol(enabled bool) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.proxyProtocol = enabled
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.proxyProtocol = enabled
+		}
+		return nil
+	}
+}
+
+// MaxPickleBatchSize creates option for New contructor. Metrics of pickle message are sent to writer
+// by batches of at most size metrics. 0 is limited only by size of WriteBuffer
+func MaxPickleBatchSize(size int) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*Pickle); ok {
+			t.maxBatchSize = size
+		}
+		return nil
+	}
+}
+
+// PickleFormat creates option for New contructor. Format of items of pickled list, one of PickleFormat* constants
+func PickleFormat(format string) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*Pickle); ok {
+			t.format = format
+		}
+		return nil
+	}
+}
+
+// IdleTimeout creates option for New contructor. Connection without received data is closed after timeout. 0 is disabled
+func IdleTimeout(timeout time.Duration) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.idleTimeout = timeout
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.idleTimeout = timeout
+		}
+		return nil
+	}
+}
+
+// ParseThreadsAuto creates option for New contructor. Count of tcp and udp parse goroutines started
+// with ParseThreads is changed between min and max by load. 0 min is fixed count
+func ParseThreadsAuto(min, max int) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.parsePool.AutoScale(min, max)
+		}
+		if t, ok := r.(*UDP); ok {
+			t.parsePool.AutoScale(min, max)
+		}
+		return nil
+	}
+}
+
+// ReadTimeout creates option for New contructor. Connection is closed if line (tcp) or message (pickle)
+// is not received in timeout after first byte. Protects from slow senders. 0 is disabled
+func ReadTimeout(timeout time.Duration) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.readTimeout = timeout
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.readTimeout = timeout
+		}
+		return nil
+	}
+}
+
+// BackpressureTimeout creates option for New contructor. Connection is closed if it blocked on full
+// write queue longer than timeout. 0 is unlimited blocking
+func BackpressureTimeout(timeout time.Duration) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.backpressure = NewBackpressure(timeout)
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.backpressure = NewBackpressure(timeout)
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.backpressure = NewBackpressure(timeout)
+		}
+		return nil
+	}
+}
+
+// MaxLineBuffer creates option for New contructor. Longer tcp lines are dropped
+func MaxLineBuffer(bytes int) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.maxLineBuffer = bytes
+		}
+		return nil
+	}
+}
+
+// NewestMetricTimestamp creates option for New contructor. Received timestamps are tracked by n
+func NewestMetricTimestamp(n *NewestTimestamp) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.newest = n
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.newest = n
+		}
+		if t, ok := r.(*UDP); ok {
+			t.newest = n
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.newest = n
+		}
+		return nil
+	}
+}
+
+// ValueTransforms creates option for New contructor. Values of received metrics are changed by transforms
+func ValueTransforms(t *Transforms) Option {
+	return func(r Receiver) error {
+		if t2, ok := r.(*TCP); ok {
+			t2.transforms = t
+		}
+		if t2, ok := r.(*Pickle); ok {
+			t2.transforms = t
+		}
+		if t2, ok := r.(*UDP); ok {
+			t2.transforms = t
+		}
+		if t2, ok := r.(*Ingest); ok {
+			t2.transforms = t
+		}
+		return nil
+	}
+}
+
+// Deduplicate creates option for New contructor. Points received again within window of Dedup are dropped
+func Deduplicate(d *Dedup) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.dedup = d
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.dedup = d
+		}
+		if t, ok := r.(*UDP); ok {
+			t.dedup = d
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.dedup = d
+		}
+		return nil
+	}
+}
+
+// TenantLimits creates option for New contructor. Metrics of tenants over limits are dropped
+func TenantLimits(t *Tenants) Option {
+	return func(r Receiver) error {
+		if t2, ok := r.(*TCP); ok {
+			t2.tenants = t
+		}
+		if t2, ok := r.(*Pickle); ok {
+			t2.tenants = t
+		}
+		if t2, ok := r.(*UDP); ok {
+			t2.tenants = t
+		}
+		if t2, ok := r.(*Ingest); ok {
+			t2.tenants = t
+		}
+		return nil
+	}
+}
+
+// RateLimit creates option for New contructor. Metrics over global rate or rate of namespace are dropped
+func RateLimit(rl *RateLimits) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.rateLimits = rl
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.rateLimits = rl
+		}
+		if t, ok := r.(*UDP); ok {
+			t.rateLimits = rl
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.rateLimits = rl
+		}
+		return nil
+	}
+}
+
+// NamespaceStat creates option for New contructor. Received metrics are counted in ns
+func NamespaceStat(ns *Namespaces) Option {
+	return func(r Receiver) error {
+		if t, ok := r.(*TCP); ok {
+			t.namespaces = ns
+		}
+		if t, ok := r.(*Pickle); ok {
+			t.namespaces = ns
+		}
+		if t, ok := r.(*UDP); ok {
+			t.namespaces = ns
+		}
+		if t, ok := r.(*Ingest); ok {
+			t.namespaces = ns
+		}
+		return nil
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// New creates udp, tcp, pickle receiver or ingest receiver of function calls by "ingest://" dsn
 func New(dsn string, opts ...Option) (Receiver, error) {
 	u, err := url.Parse(dsn)
 	if err != nil {
@@ -62,9 +468,13 @@ func New(dsn string, opts ...Option) (Receiver, error) {
 		}
 
 		r := &TCP{
-			parseChan: make(chan *Buffer),
-			logger:    zapwriter.Logger("tcp"),
+			parseChan:     make(chan *Buffer),
+			maxLineBuffer: 1048576,
+			backpressure:  NewBackpressure(0),
+			logger:        logging.Logger("tcp"),
 		}
+		r.parseErrors = NewParseErrors(r.logger)
+		r.parsePool = NewParsePool(r.logger)
 
 		for _, optApply := range opts {
 			optApply(r)
@@ -84,9 +494,10 @@ func New(dsn string, opts ...Option) (Receiver, error) {
 		}
 
 		r := &Pickle{
-			parseChan: make(chan []byte),
-			logger:    zapwriter.Logger("pickle"),
+			backpressure: NewBackpressure(0),
+			logger:       logging.Logger("pickle"),
 		}
+		r.parseErrors = NewParseErrors(r.logger)
 
 		for _, optApply := range opts {
 			optApply(r)
@@ -107,8 +518,11 @@ func New(dsn string, opts ...Option) (Receiver, error) {
 
 		r := &UDP{
 			parseChan: make(chan *Buffer),
-			logger:    zapwriter.Logger("udp"),
+			logger:    logging.Logger("udp"),
 		}
+		r.parseErrors = NewParseErrors(r.logger)
+		r.parsePool = NewParsePool(r.logger)
+		r.bufferPool.New = r.newBuffer
 
 		for _, optApply := range opts {
 			optApply(r)
@@ -121,5 +535,22 @@ func New(dsn string, opts ...Option) (Receiver, error) {
 		return r, err
 	}
 
+	if u.Scheme == "ingest" {
+		r := &Ingest{
+			backpressure: NewBackpressure(0),
+			exit:         make(chan struct{}),
+			logger:       logging.Logger("ingest"),
+		}
+		r.parseErrors = NewParseErrors(r.logger)
+		r.ready.reset()
+		r.ready.done()
+
+		for _, optApply := range opts {
+			optApply(r)
+		}
+
+		return r, nil
+	}
+
 	return nil, fmt.Errorf("unknown proto %#v", u.Scheme)
 }
@@ -0,0 +1,105 @@
+package receiver
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// one of sanitizeLogSample sanitized names is logged
+const sanitizeLogSample = 100
+
+// Sanitizer replaces characters of metric names unsupported by graphite-web and ClickHouse queries.
+// Tags after first ';' are passed unchanged
+type Sanitizer struct {
+	stat struct {
+		sanitized uint32 // atomic
+	}
+	replacement []byte
+	double      []byte // collapsed to single replacement
+	logger      *zap.Logger
+}
+
+// NewSanitizer creates sanitizer with replacement of bad characters. Replacement should consist of
+// allowed characters except dot
+func NewSanitizer(replacement string, logger *zap.Logger) *Sanitizer {
+	return &Sanitizer{
+		replacement: []byte(replacement),
+		double:      []byte(replacement + replacement),
+		logger:      logger,
+	}
+}
+
+// sanitizeAllowed returns true for characters matching [a-zA-Z0-9._-]
+func sanitizeAllowed(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-'
+}
+
+// clean returns true if name is not changed by sanitize
+func (s *Sanitizer) clean(name []byte) bool {
+	if len(name) == 0 || name[0] == '.' || name[len(name)-1] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if !sanitizeAllowed(c) {
+			return false
+		}
+	}
+	return len(s.replacement) == 0 || !bytes.Contains(name, s.double)
+}
+
+// sanitize replaces not allowed characters with replacement, collapses consecutive replacements
+// and strips leading and trailing dots. Returns errEmptyName if nothing is left. Nil receiver returns name as is
+func (s *Sanitizer) sanitize(name []byte) ([]byte, error) {
+	if s == nil {
+		return name, nil
+	}
+
+	end := bytes.IndexByte(name, ';')
+	if end < 0 {
+		end = len(name)
+	}
+
+	if s.clean(name[:end]) {
+		return name, nil
+	}
+
+	out := make([]byte, 0, len(name))
+	for _, c := range name[:end] {
+		if sanitizeAllowed(c) {
+			out = append(out, c)
+		} else {
+			out = append(out, s.replacement...)
+		}
+	}
+
+	if len(s.replacement) > 0 {
+		for bytes.Contains(out, s.double) {
+			out = bytes.Replace(out, s.double, s.replacement, -1)
+		}
+	}
+
+	out = bytes.Trim(out, ".")
+	if len(out) == 0 {
+		return nil, errEmptyName
+	}
+	out = append(out, name[end:]...)
+
+	if atomic.AddUint32(&s.stat.sanitized, 1)%sanitizeLogSample == 1 {
+		s.logger.Debug("metric name sanitized", zap.String("name", truncate(out)), zap.String("original", truncate(name)))
+	}
+
+	return out, nil
+}
+
+// Stat sends count of sanitized names. Safe for nil receiver
+func (s *Sanitizer) Stat(send func(metric string, value float64)) {
+	if s == nil {
+		return
+	}
+
+	sanitized := atomic.LoadUint32(&s.stat.sanitized)
+	atomic.AddUint32(&s.stat.sanitized, -sanitized)
+	send("sanitizedMetrics", float64(sanitized))
+}
@@ -0,0 +1,119 @@
+package receiver
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"go.uber.org/zap"
+)
+
+func TestSanitizer(t *testing.T) {
+	table := [](struct {
+		replacement string
+		name        string
+		expected    string
+		err         error
+	}){
+		{"_", "servers.web01.cpu", "servers.web01.cpu", nil},
+		{"_", "servers.web-01.cpu_user", "servers.web-01.cpu_user", nil},
+		{"_", "servers.web01:8080.cpu", "servers.web01_8080.cpu", nil},
+		{"_", "servers.web01.cpu/%user", "servers.web01.cpu_user", nil},
+		{"_", "servers.web__01.cpu", "servers.web_01.cpu", nil},
+		{"_", ".servers.web01.cpu.", "servers.web01.cpu", nil},
+		{"_", "серверы.cpu", "_.cpu", nil},
+		{"_", "cpu;host=web01;dc=1", "cpu;host=web01;dc=1", nil},
+		{"_", "cpu@user;host=web:01", "cpu_user;host=web:01", nil},
+		{"_", "..", "", errEmptyName},
+		{"_", ".;host=web01", "", errEmptyName},
+		{"-", "servers.web01:8080.cpu", "servers.web01-8080.cpu", nil},
+		{"", "servers.web01:8080.cpu", "servers.web018080.cpu", nil},
+		{"", "$$$", "", errEmptyName},
+	}
+
+	for _, c := range table {
+		name, err := NewSanitizer(c.replacement, zap.NewNop()).sanitize([]byte(c.name))
+		if err != c.err || string(name) != c.expected {
+			t.Fatalf("%#v, %#v: %#v, %#v", c.replacement, c.name, string(name), err)
+		}
+	}
+
+	s := NewSanitizer("_", zap.NewNop())
+	s.sanitize([]byte("a:b"))
+	s.sanitize([]byte("a.b"))
+
+	stat := make(map[string]float64)
+	s.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["sanitizedMetrics"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// nil sanitizer is disabled
+	s = nil
+	if name, err := s.sanitize([]byte("a:b")); err != nil || string(name) != "a:b" {
+		t.Fatalf("%#v, %#v", string(name), err)
+	}
+}
+
+func TestSanitizerFuzz(t *testing.T) {
+	alphabet := []byte("aZ09._-_:;= /\x00\xff")
+
+	for _, replacement := range []string{"_", "-", "", "xy"} {
+		s := NewSanitizer(replacement, zap.NewNop())
+
+		check := func(seed int64, length uint8) bool {
+			rnd := rand.New(rand.NewSource(seed))
+			name := make([]byte, length)
+			for i := range name {
+				name[i] = alphabet[rnd.Intn(len(alphabet))]
+			}
+
+			result, err := s.sanitize(name)
+			if err != nil {
+				return err == errEmptyName && result == nil
+			}
+			if len(result) == 0 {
+				return false
+			}
+
+			// result is stable
+			again, err := s.sanitize(result)
+			return err == nil && string(again) == string(result)
+		}
+
+		if err := quick.Check(check, &quick.Config{MaxCount: 10000}); err != nil {
+			t.Fatalf("replacement %#v: %s", replacement, err)
+		}
+	}
+}
+
+func TestPlainParseBufferSanitize(t *testing.T) {
+	buf := GetBuffer()
+	buf.Time = 1422642189
+	buf.Write([]byte("servers.web01:8080.cpu 42 1422642189\nservers.web02.cpu 43 1422642189\n. 44 1422642189\n"))
+
+	pe := NewParseErrors(zap.NewNop())
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{ParseErrors: pe, Sanitizer: NewSanitizer("-", zap.NewNop())})
+	buf.Release()
+
+	names := readNames(t, out, 2, time.Second)
+	if !names["servers.web01-8080.cpu"] || !names["servers.web02.cpu"] {
+		t.Fatalf("%#v", names)
+	}
+
+	stat := make(map[string]float64)
+	pe.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if received != 2 || errors != 1 || stat["parseErrors.emptyName"] != 1 {
+		t.Fatalf("received: %d, errors: %d, stat: %#v", received, errors, stat)
+	}
+}
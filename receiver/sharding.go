@@ -0,0 +1,204 @@
+package receiver
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/hashring"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
+	"github.com/lomik/stop"
+	"go.uber.org/zap"
+)
+
+// max count of lines waiting for send to one node. Lines are dropped if queue is full
+const shardQueueSize = 65536
+
+const shardTimeout = 10 * time.Second
+
+type shardNode struct {
+	addr  string
+	queue chan []byte
+}
+
+// Sharding forwards metrics owned by other nodes of consistent hash ring to them by plain tcp protocol.
+// Each node keeps poolSize connections to every other node
+type Sharding struct {
+	stop.Struct
+	stat struct {
+		forwarded  uint32 // atomic
+		dropped    uint32 // atomic
+		sendErrors uint32 // atomic
+	}
+	ring     *hashring.Ring
+	thisNode string
+	nodes    map[string]*shardNode
+	poolSize int
+	logger   *zap.Logger
+}
+
+func NewSharding(nodes []string, thisNode string, poolSize int) *Sharding {
+	s := &Sharding{
+		ring:     hashring.New(nodes, hashring.Replicas),
+		thisNode: thisNode,
+		nodes:    make(map[string]*shardNode),
+		poolSize: poolSize,
+		logger:   logging.Logger("sharding"),
+	}
+
+	for _, addr := range nodes {
+		if addr == thisNode {
+			continue
+		}
+		s.nodes[addr] = &shardNode{
+			addr:  addr,
+			queue: make(chan []byte, shardQueueSize),
+		}
+	}
+
+	return s
+}
+
+func (s *Sharding) Start() error {
+	return s.StartFunc(func() error {
+		for _, node := range s.nodes {
+			for i := 0; i < s.poolSize; i++ {
+				n := node
+				s.Go(func(exit chan struct{}) {
+					s.worker(exit, n)
+				})
+			}
+		}
+		return nil
+	})
+}
+
+// Stop closes connections. Queued lines are lost
+func (s *Sharding) Stop() {
+	s.StopFunc(func() {})
+}
+
+func (s *Sharding) Stat(send func(metric string, value float64)) {
+	forwarded := atomic.LoadUint32(&s.stat.forwarded)
+	atomic.AddUint32(&s.stat.forwarded, -forwarded)
+	send("forwarded", float64(forwarded))
+
+	dropped := atomic.LoadUint32(&s.stat.dropped)
+	atomic.AddUint32(&s.stat.dropped, -dropped)
+	send("dropped", float64(dropped))
+
+	sendErrors := atomic.LoadUint32(&s.stat.sendErrors)
+	atomic.AddUint32(&s.stat.sendErrors, -sendErrors)
+	send("sendErrors", float64(sendErrors))
+}
+
+// remote returns node of metric if it is not this node. Safe for nil receiver
+func (s *Sharding) remote(name []byte) *shardNode {
+	if s == nil {
+		return nil
+	}
+
+	addr := s.ring.Get(name)
+	if addr == s.thisNode {
+		return nil
+	}
+
+	return s.nodes[addr]
+}
+
+func (s *Sharding) enqueue(node *shardNode, line []byte) {
+	select {
+	case node.queue <- line:
+		atomic.AddUint32(&s.stat.forwarded, 1)
+	default:
+		atomic.AddUint32(&s.stat.dropped, 1)
+	}
+}
+
+// forwardLine sends plain line if metric is owned by other node. Returns false if metric should be processed locally
+func (s *Sharding) forwardLine(name []byte, line []byte) bool {
+	node := s.remote(name)
+	if node == nil {
+		return false
+	}
+
+	s.enqueue(node, append([]byte(nil), line...))
+	return true
+}
+
+// forwardPoint sends point as plain line if metric is owned by other node. Returns false if metric should be processed locally
+func (s *Sharding) forwardPoint(name []byte, value float64, timestamp int64) bool {
+	node := s.remote(name)
+	if node == nil {
+		return false
+	}
+
+	line := make([]byte, 0, len(name)+32)
+	line = append(line, name...)
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, value, 'f', -1, 64)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, timestamp, 10)
+	line = append(line, '\n')
+
+	s.enqueue(node, line)
+	return true
+}
+
+func (s *Sharding) worker(exit chan struct{}, node *shardNode) {
+	var conn net.Conn
+	var w *bufio.Writer
+
+	disconnect := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	defer disconnect()
+
+	for {
+		var line []byte
+
+		select {
+		case <-exit:
+			return
+		case line = <-node.queue:
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout("tcp", node.addr, shardTimeout)
+			if err != nil {
+				conn = nil
+				atomic.AddUint32(&s.stat.sendErrors, 1)
+				atomic.AddUint32(&s.stat.dropped, 1)
+				s.logger.Error("connect failed", zap.String("node", node.addr), zap.Error(err))
+
+				// retry after second. queued lines are dropped on overflow meanwhile
+				select {
+				case <-exit:
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			w = bufio.NewWriterSize(conn, 65536)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(shardTimeout))
+
+		_, err := w.Write(line)
+		if err == nil && len(node.queue) == 0 {
+			err = w.Flush()
+		}
+
+		if err != nil {
+			atomic.AddUint32(&s.stat.sendErrors, 1)
+			s.logger.Error("send failed", zap.String("node", node.addr), zap.Error(err))
+			disconnect()
+		}
+	}
+}
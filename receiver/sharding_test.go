@@ -0,0 +1,109 @@
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestShardingForward(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	thisNode := "127.0.0.1:1"
+	otherNode := listener.Addr().String()
+
+	s := NewSharding([]string{thisNode, otherNode}, thisNode, 2)
+	s.Start()
+	defer s.Stop()
+
+	// split names between nodes
+	var local, remote []string
+	for i := 0; len(local) < 10 || len(remote) < 10; i++ {
+		name := fmt.Sprintf("hello.world.%d", i)
+		if s.ring.Get([]byte(name)) == thisNode {
+			local = append(local, name)
+		} else {
+			remote = append(remote, name)
+		}
+	}
+
+	buf := GetBuffer()
+	buf.Time = 1422642189
+	for i := 0; i < 10; i++ {
+		buf.Write([]byte(fmt.Sprintf("%s 42 1422642189\n", local[i])))
+		buf.Write([]byte(fmt.Sprintf("%s 43 1422642189\n", remote[i])))
+	}
+	remote = remote[:10]
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{Sharding: s})
+	buf.Release()
+
+	wb := <-out
+	wb.Release()
+	if received != 10 || errors != 0 {
+		t.Fatalf("received: %d, errors: %d", received, errors)
+	}
+
+	// pickle points are forwarded as plain lines
+	if !s.forwardPoint([]byte(remote[0]), 0.5, 1422642190) {
+		t.Fatalf("%s is not forwarded", remote[0])
+	}
+
+	lines := make(chan string, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					lines <- line
+				}
+			}(conn)
+		}
+	}()
+
+	expected := make(map[string]bool)
+	for _, name := range remote {
+		expected[fmt.Sprintf("%s 43 1422642189\n", name)] = true
+	}
+	expected[fmt.Sprintf("%s 0.5 1422642190\n", remote[0])] = true
+
+	for count := len(expected); count > 0; count-- {
+		select {
+		case line := <-lines:
+			if !expected[line] {
+				t.Fatalf("unexpected line %#v", line)
+			}
+			delete(expected, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("not received: %#v", expected)
+		}
+	}
+
+	stat := make(map[string]float64)
+	s.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["forwarded"] != 11 || stat["dropped"] != 0 || stat["sendErrors"] != 0 {
+		t.Fatalf("%#v", stat)
+	}
+}
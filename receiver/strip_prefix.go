@@ -0,0 +1,57 @@
+package receiver
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// PrefixStripper removes static prefix from metric names. Names without prefix are passed unchanged
+type PrefixStripper struct {
+	stat struct {
+		stripped uint32 // atomic
+		noPrefix uint32 // atomic
+	}
+	prefix []byte
+}
+
+// NewPrefixStripper returns nil for empty prefix
+func NewPrefixStripper(prefix string) *PrefixStripper {
+	if prefix == "" {
+		return nil
+	}
+	return &PrefixStripper{prefix: []byte(prefix)}
+}
+
+// strip returns name without prefix. Returns errEmptyName if nothing is left. Nil receiver returns name as is
+func (p *PrefixStripper) strip(name []byte) ([]byte, error) {
+	if p == nil {
+		return name, nil
+	}
+
+	if !bytes.HasPrefix(name, p.prefix) {
+		atomic.AddUint32(&p.stat.noPrefix, 1)
+		return name, nil
+	}
+
+	if len(name) == len(p.prefix) {
+		return nil, errEmptyName
+	}
+
+	atomic.AddUint32(&p.stat.stripped, 1)
+	return name[len(p.prefix):], nil
+}
+
+// Stat sends counters of stripped and passed names. Safe for nil receiver
+func (p *PrefixStripper) Stat(send func(metric string, value float64)) {
+	if p == nil {
+		return
+	}
+
+	stripped := atomic.LoadUint32(&p.stat.stripped)
+	atomic.AddUint32(&p.stat.stripped, -stripped)
+	send("strippedMetrics", float64(stripped))
+
+	noPrefix := atomic.LoadUint32(&p.stat.noPrefix)
+	atomic.AddUint32(&p.stat.noPrefix, -noPrefix)
+	send("noPrefixMetrics", float64(noPrefix))
+}
@@ -0,0 +1,76 @@
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"go.uber.org/zap"
+)
+
+func TestPrefixStripper(t *testing.T) {
+	table := [](struct {
+		name     string
+		expected string
+		err      error
+	}){
+		{"dc1.servers.web01.cpu", "servers.web01.cpu", nil},
+		{"dc1.cpu", "cpu", nil},
+		{"dc10.servers.web01.cpu", "dc10.servers.web01.cpu", nil}, // partial match
+		{"dc1", "dc1", nil},
+		{"servers.web01.cpu", "servers.web01.cpu", nil},
+		{"servers.dc1.cpu", "servers.dc1.cpu", nil},
+		{"dc1.", "", errEmptyName},
+	}
+
+	p := NewPrefixStripper("dc1.")
+	for _, c := range table {
+		name, err := p.strip([]byte(c.name))
+		if err != c.err || string(name) != c.expected {
+			t.Fatalf("%#v: %#v, %#v", c.name, string(name), err)
+		}
+	}
+
+	stat := make(map[string]float64)
+	p.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["strippedMetrics"] != 2 || stat["noPrefixMetrics"] != 4 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// empty prefix is disabled
+	if p = NewPrefixStripper(""); p != nil {
+		t.Fatalf("%#v", p)
+	}
+	if name, err := p.strip([]byte("dc1.cpu")); err != nil || string(name) != "dc1.cpu" {
+		t.Fatalf("%#v, %#v", string(name), err)
+	}
+}
+
+func TestPlainParseBufferStripPrefix(t *testing.T) {
+	buf := GetBuffer()
+	buf.Time = 1422642189
+	buf.Write([]byte("dc1.servers.web01.cpu 42 1422642189\nservers.web02.cpu 43 1422642189\ndc1. 44 1422642189\n"))
+
+	pe := NewParseErrors(zap.NewNop())
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{ParseErrors: pe, StripPrefix: NewPrefixStripper("dc1.")})
+	buf.Release()
+
+	names := readNames(t, out, 2, time.Second)
+	if !names["servers.web01.cpu"] || !names["servers.web02.cpu"] {
+		t.Fatalf("%#v", names)
+	}
+
+	stat := make(map[string]float64)
+	pe.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if received != 2 || errors != 1 || stat["parseErrors.emptyName"] != 1 {
+		t.Fatalf("received: %d, errors: %d, stat: %#v", received, errors, stat)
+	}
+}
@@ -17,15 +17,39 @@ import (
 type TCP struct {
 	stop.Struct
 	stat struct {
-		metricsReceived uint32 // atomic
-		errors          uint32 // atomic
-		active          int32  // atomic
+		metricsReceivedTotal uint64 // atomic. since start, updated by Stat
+		errorsTotal          uint64 // atomic. since start, updated by Stat
+		droppedTotal         uint64 // atomic. since start, lines of buffers rejected by push
+		metricsReceived      uint32 // atomic
+		errors               uint32 // atomic
+		active               int32  // atomic
+		closedIdle           uint32 // atomic
+		closedSlowRead       uint32 // atomic
+		proxyErrors          uint32 // atomic
+		pending              int32  // atomic. buffers in parse queue and parsing
 	}
-	listener     *net.TCPListener
-	parseThreads int
-	parseChan    chan *Buffer
-	writeChan    chan *RowBinary.WriteBuffer
-	logger       *zap.Logger
+	listener      *net.TCPListener
+	idleTimeout   time.Duration
+	readTimeout   time.Duration
+	proxyProtocol bool // connections start with PROXY protocol header
+	maxLineBuffer int  // max size of unfinished line
+	parseThreads  int
+	parseChan     chan *Buffer
+	writeChan     chan *RowBinary.WriteBuffer
+	parseErrors   *ParseErrors
+	namespaces    *Namespaces
+	sharding      *Sharding
+	stripPrefix   *PrefixStripper
+	sanitizer     *Sanitizer
+	tenants       *Tenants
+	rateLimits    *RateLimits
+	newest        *NewestTimestamp
+	transforms    *Transforms
+	dedup         *Dedup
+	ready         readiness
+	parsePool     *ParsePool
+	backpressure  *Backpressure
+	logger        *zap.Logger
 }
 
 // Addr returns binded socket address. For bind port 0 in tests
@@ -36,26 +60,116 @@ func (rcv *TCP) Addr() net.Addr {
 	return rcv.listener.Addr()
 }
 
+// MetricsReceivedTotal returns count of received metrics since start
+func (rcv *TCP) MetricsReceivedTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.metricsReceivedTotal) + uint64(atomic.LoadUint32(&rcv.stat.metricsReceived))
+}
+
+// ErrorsTotal returns count of dropped bad lines and messages since start
+func (rcv *TCP) ErrorsTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.errorsTotal) + uint64(atomic.LoadUint32(&rcv.stat.errors))
+}
+
+// ActiveConnections returns count of open connections
+func (rcv *TCP) ActiveConnections() int {
+	return int(atomic.LoadInt32(&rcv.stat.active))
+}
+
+// Stats returns counters since start
+func (rcv *TCP) Stats() ReceiverStats {
+	return ReceiverStats{
+		ReceivedTotal:     rcv.MetricsReceivedTotal(),
+		ParseErrors:       rcv.ErrorsTotal(),
+		ActiveConnections: rcv.ActiveConnections(),
+		DroppedTotal:      atomic.LoadUint64(&rcv.stat.droppedTotal),
+	}
+}
+
+// Ready is closed after receive loop is started
+func (rcv *TCP) Ready() <-chan struct{} {
+	return rcv.ready.ch
+}
+
+// CloseListener stops accepting of new connections. Accepted connections are served until closed by clients
+func (rcv *TCP) CloseListener() {
+	if rcv.listener != nil {
+		rcv.listener.Close()
+	}
+}
+
+// Idle returns true if there are no open connections and all received data is parsed and sent to write channel
+func (rcv *TCP) Idle() bool {
+	return atomic.LoadInt32(&rcv.stat.active) == 0 && atomic.LoadInt32(&rcv.stat.pending) == 0
+}
+
 func (rcv *TCP) Stat(send func(metric string, value float64)) {
 	metricsReceived := atomic.LoadUint32(&rcv.stat.metricsReceived)
 	atomic.AddUint32(&rcv.stat.metricsReceived, -metricsReceived)
+	atomic.AddUint64(&rcv.stat.metricsReceivedTotal, uint64(metricsReceived))
 	send("metricsReceived", float64(metricsReceived))
 
 	errors := atomic.LoadUint32(&rcv.stat.errors)
 	atomic.AddUint32(&rcv.stat.errors, -errors)
+	atomic.AddUint64(&rcv.stat.errorsTotal, uint64(errors))
 	send("errors", float64(errors))
 
 	send("active", float64(atomic.LoadInt32(&rcv.stat.active)))
+
+	closedIdle := atomic.LoadUint32(&rcv.stat.closedIdle)
+	atomic.AddUint32(&rcv.stat.closedIdle, -closedIdle)
+	send("closedIdleTimeout", float64(closedIdle))
+
+	closedSlowRead := atomic.LoadUint32(&rcv.stat.closedSlowRead)
+	atomic.AddUint32(&rcv.stat.closedSlowRead, -closedSlowRead)
+	send("closedReadTimeout", float64(closedSlowRead))
+
+	proxyErrors := atomic.LoadUint32(&rcv.stat.proxyErrors)
+	atomic.AddUint32(&rcv.stat.proxyErrors, -proxyErrors)
+	send("proxyProtocolErrors", float64(proxyErrors))
+
+	rcv.parseErrors.Stat(send)
+	rcv.stripPrefix.Stat(send)
+	rcv.sanitizer.Stat(send)
+	rcv.parsePool.Stat(send)
+	rcv.backpressure.Stat(send)
+}
+
+// push sends buffer to parse threads. Returns errBackpressure if parsers are blocked longer than backpressure timeout
+func (rcv *TCP) push(exit chan struct{}, buffer *Buffer) (err error) {
+	atomic.AddInt32(&rcv.stat.pending, 1)
+	defer func() {
+		if err != nil {
+			atomic.AddInt32(&rcv.stat.pending, -1)
+		}
+	}()
+
+	select {
+	case rcv.parseChan <- buffer:
+		return nil
+	default:
+	}
+
+	rcv.backpressure.blocked()
+	timeout, stop := rcv.backpressure.timer()
+	defer stop()
+
+	select {
+	case rcv.parseChan <- buffer:
+		return nil
+	case <-exit:
+		return errStopped
+	case <-timeout:
+		rcv.backpressure.timedOut()
+		return errBackpressure
+	}
 }
 
-func (rcv *TCP) HandleConnection(conn net.Conn) {
+func (rcv *TCP) HandleConnection(exit chan struct{}, conn net.Conn) {
 	atomic.AddInt32(&rcv.stat.active, 1)
 	defer atomic.AddInt32(&rcv.stat.active, -1)
 
 	defer conn.Close()
 
-	logger := rcv.logger.With(zap.String("peer", conn.RemoteAddr().String()))
-
 	finished := make(chan bool)
 	defer close(finished)
 
@@ -69,15 +183,45 @@ func (rcv *TCP) HandleConnection(conn net.Conn) {
 		}
 	})
 
+	client := conn
+	if rcv.proxyProtocol {
+		c, err := readProxyHeader(conn)
+		if err != nil {
+			atomic.AddUint32(&rcv.stat.proxyErrors, 1)
+			rcv.logger.Warn("can't read PROXY protocol header", zap.String("proxy", conn.RemoteAddr().String()), zap.Error(err))
+			return
+		}
+		client = c
+	}
+
+	logger := rcv.logger.With(zap.String("peer", client.RemoteAddr().String()))
+
 	buffer := GetBuffer()
+	connReader := &deadlineReader{conn: client, idleTimeout: rcv.idleTimeout, readTimeout: rcv.readTimeout}
 
 	var n int
 	var err error
+	skipLine := false // rest of too long line is dropped
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
-		n, err = conn.Read(buffer.Body[buffer.Used:])
-		conn.SetDeadline(time.Time{})
+		n, err = connReader.Read(buffer.Body[buffer.Used:])
+
+		if skipLine && n > 0 {
+			// buffer is empty while line is skipped
+			if index := bytes.IndexByte(buffer.Body[:n], '\n'); index >= 0 {
+				n = copy(buffer.Body, buffer.Body[index+1:n])
+				skipLine = false
+				if n == 0 {
+					connReader.Finish()
+				}
+			} else {
+				n = 0
+			}
+		}
+
+		if buffer.Used == 0 && n > 0 {
+			connReader.Start()
+		}
 		buffer.Used += n
 		buffer.Time = uint32(time.Now().Unix())
 
@@ -86,6 +230,12 @@ func (rcv *TCP) HandleConnection(conn net.Conn) {
 				if buffer.Used > 0 {
 					logger.Warn("unfinished line", zap.String("line", string(buffer.Body[:buffer.Used])))
 				}
+			} else if connReader.slowRead {
+				atomic.AddUint32(&rcv.stat.closedSlowRead, 1)
+				logger.Warn("slow connection closed", zap.Duration("read_timeout", rcv.readTimeout))
+			} else if connReader.timedOut {
+				atomic.AddUint32(&rcv.stat.closedIdle, 1)
+				logger.Debug("idle connection closed")
 			} else {
 				atomic.AddUint32(&rcv.stat.errors, 1)
 				logger.Error("read failed", zap.Error(err))
@@ -99,14 +249,57 @@ func (rcv *TCP) HandleConnection(conn net.Conn) {
 			newBuffer := GetBuffer()
 
 			if chunkSize < buffer.Used { // has unfinished data
-				copy(newBuffer.Body[:], buffer.Body[chunkSize:buffer.Used])
+				newBuffer.Grow(buffer.Used - chunkSize)
+				copy(newBuffer.Body, buffer.Body[chunkSize:buffer.Used])
 				newBuffer.Used = buffer.Used - chunkSize
 				buffer.Used = chunkSize
+				connReader.Start()
+			} else {
+				connReader.Finish()
 			}
 
-			rcv.parseChan <- buffer
+			if err = rcv.push(exit, buffer); err != nil {
+				if err == errBackpressure {
+					logger.Warn("connection closed", zap.Error(err))
+				}
+				atomic.AddUint64(&rcv.stat.droppedTotal, uint64(bytes.Count(buffer.Body[:buffer.Used], []byte{'\n'})))
+				newBuffer.Release()
+				break
+			}
 			buffer = newBuffer
 		}
+
+		if buffer.Used >= rcv.maxLineBuffer {
+			// unfinished line is too long
+			atomic.AddUint32(&rcv.stat.errors, 1)
+			rcv.parseErrors.Add(errNameTooLong, buffer.Body[:buffer.Used])
+			buffer.Used = 0
+			skipLine = true
+		} else if buffer.Used == len(buffer.Body) {
+			size := 2 * len(buffer.Body)
+			if size > rcv.maxLineBuffer {
+				size = rcv.maxLineBuffer
+			}
+			buffer.Grow(size)
+		}
+	}
+}
+
+// parseLoad returns count of buffers in parse queue and parsing
+func (rcv *TCP) parseLoad() int {
+	return int(atomic.LoadInt32(&rcv.stat.pending))
+}
+
+// writeQueueFull returns true if write channel is filled more than 80%
+func (rcv *TCP) writeQueueFull() bool {
+	return len(rcv.writeChan) > cap(rcv.writeChan)*8/10
+}
+
+// stopParser stops one parse goroutine after it finishes current buffer
+func (rcv *TCP) stopParser(exit chan struct{}) {
+	select {
+	case rcv.parseChan <- nil:
+	case <-exit:
 	}
 }
 
@@ -126,10 +319,13 @@ func (rcv *TCP) Listen(addr *net.TCPAddr) error {
 
 		handler := rcv.HandleConnection
 
+		rcv.ready.reset()
+
 		rcv.Go(func(exit chan struct{}) {
 			defer tcpListener.Close()
 
 			for {
+				rcv.ready.done()
 
 				conn, err := tcpListener.Accept()
 				if err != nil {
@@ -141,26 +337,44 @@ func (rcv *TCP) Listen(addr *net.TCPAddr) error {
 				}
 
 				rcv.Go(func(exit chan struct{}) {
-					handler(conn)
+					handler(exit, conn)
 				})
 			}
 
 		})
 
-		for i := 0; i < rcv.parseThreads; i++ {
-			rcv.Go(func(exit chan struct{}) {
-				PlainParser(
-					exit,
-					rcv.parseChan,
-					rcv.writeChan,
-					&rcv.stat.metricsReceived,
-					&rcv.stat.errors,
-				)
-			})
+		parse := func(exit chan struct{}) {
+			PlainParser(
+				exit,
+				rcv.parseChan,
+				rcv.writeChan,
+				&rcv.stat.metricsReceived,
+				&rcv.stat.errors,
+				&rcv.stat.pending,
+				rcv.parseOptions(),
+			)
 		}
+		rcv.parsePool.Go(rcv, rcv.parseThreads, parse)
+		rcv.parsePool.Scale(rcv, rcv.parseThreads, rcv.parseLoad, rcv.writeQueueFull, rcv.stopParser, parse)
 
 		rcv.listener = tcpListener
 
 		return nil
 	})
 }
+
+// parseOptions returns stages of parsed metrics set by options
+func (rcv *TCP) parseOptions() *ParseOptions {
+	return &ParseOptions{
+		ParseErrors: rcv.parseErrors,
+		Namespaces:  rcv.namespaces,
+		Sharding:    rcv.sharding,
+		StripPrefix: rcv.stripPrefix,
+		Sanitizer:   rcv.sanitizer,
+		Tenants:     rcv.tenants,
+		Newest:      rcv.newest,
+		Transforms:  rcv.transforms,
+		Dedup:       rcv.dedup,
+		RateLimits:  rcv.rateLimits,
+	}
+}
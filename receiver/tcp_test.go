@@ -0,0 +1,274 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// waitClosed waits server side close of connection
+func waitClosed(t *testing.T, conn net.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("connection is not closed: %v", err)
+	}
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	idleTimeout := 100 * time.Millisecond
+
+	r, err := New("tcp://127.0.0.1:0", WriteChan(make(chan *RowBinary.WriteBuffer, 16)), IdleTimeout(idleTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*TCP)
+
+	conn, err := net.Dial("tcp", rcv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitClosed(t, conn, idleTimeout+time.Second)
+
+	if n := atomic.LoadUint32(&rcv.stat.closedIdle); n != 1 {
+		t.Fatalf("closedIdle: %d", n)
+	}
+	if n := atomic.LoadUint32(&rcv.stat.errors); n != 0 {
+		t.Fatalf("errors: %d", n)
+	}
+}
+
+// readNames returns names of metrics in RowBinary buffers from ch until count names received or timeout
+func readNames(t *testing.T, ch chan *RowBinary.WriteBuffer, count int, timeout time.Duration) map[string]bool {
+	names := make(map[string]bool)
+	deadline := time.After(timeout)
+
+	for len(names) < count {
+		select {
+		case wb := <-ch:
+			p := wb.Bytes()
+			for len(p) > 0 {
+				l, n := binary.Uvarint(p)
+				names[string(p[n:n+int(l)])] = true
+				// value{8}, timestamp{4}, days(date){2}, version{4}
+				p = p[n+int(l)+18:]
+			}
+			wb.Release()
+		case <-deadline:
+			t.Fatalf("received %d of %d metrics", len(names), count)
+		}
+	}
+
+	return names
+}
+
+func TestTCPRandomChunks(t *testing.T) {
+	ch := make(chan *RowBinary.WriteBuffer, 1024)
+
+	r, err := New("tcp://127.0.0.1:0",
+		WriteChan(ch),
+		ParseThreads(2),
+		MaxLineBuffer(1048576),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*TCP)
+
+	longName := strings.Repeat("a", 300000)
+	expected := map[string]bool{longName: true}
+
+	var data bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("fuzz.metric.%d", i)
+		expected[name] = true
+		fmt.Fprintf(&data, "%s %d 1422642189\n", name, i)
+
+		switch i {
+		case 300:
+			// longer than initial buffer
+			fmt.Fprintf(&data, "%s 42 1422642189\n", longName)
+		case 600:
+			// longer than max line buffer, dropped
+			fmt.Fprintf(&data, "%s 42 1422642189\n", strings.Repeat("b", 2000000))
+		}
+	}
+
+	for seed := int64(1); seed <= 3; seed++ {
+		rnd := rand.New(rand.NewSource(seed))
+
+		client, server := net.Pipe()
+		rcv.Go(func(exit chan struct{}) {
+			rcv.HandleConnection(exit, server)
+		})
+
+		go func() {
+			defer client.Close()
+			for p := data.Bytes(); len(p) > 0; {
+				size := 1 + rnd.Intn(4096)
+				if rnd.Intn(100) == 0 {
+					size = rnd.Intn(1000000)
+				}
+				if size > len(p) {
+					size = len(p)
+				}
+				if _, err := client.Write(p[:size]); err != nil {
+					return
+				}
+				p = p[size:]
+			}
+		}()
+
+		names := readNames(t, ch, len(expected), 10*time.Second)
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("seed %d: received %d metrics, expected %d", seed, len(names), len(expected))
+		}
+	}
+
+	if n := atomic.LoadUint32(&rcv.stat.errors); n != 3 {
+		t.Fatalf("errors: %d", n)
+	}
+}
+
+func TestTCPStats(t *testing.T) {
+	ch := make(chan *RowBinary.WriteBuffer)
+
+	r, err := New("tcp://127.0.0.1:0", WriteChan(ch), ParseThreads(1), BackpressureTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	conn, err := net.Dial("tcp", r.(*TCP).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "hello.world 42 1422642189\nbad line\n")
+	readNames(t, ch, 1, time.Second)
+
+	if s := r.Stats(); s != (ReceiverStats{ReceivedTotal: 1, ParseErrors: 1, ActiveConnections: 1}) {
+		t.Fatalf("%#v", s)
+	}
+
+	// parser is blocked on write queue by first buffer, second one is dropped
+	fmt.Fprint(conn, "hello.world 43 1422642189\n")
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprint(conn, "hello.world 44 1422642189\nhello.world 45 1422642189\n")
+	waitClosed(t, conn, time.Second)
+
+	for deadline := time.Now().Add(time.Second); r.Stats().ActiveConnections > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is active")
+		}
+	}
+	if s := r.Stats(); s != (ReceiverStats{ReceivedTotal: 2, ParseErrors: 1, DroppedTotal: 2}) {
+		t.Fatalf("%#v", s)
+	}
+
+	// Stat doesn't reset totals
+	r.Stat(func(metric string, value float64) {})
+	if s := r.Stats(); s.ReceivedTotal != 2 || s.ParseErrors != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestTCPParseThreadsAutoScale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+
+	ch := make(chan *RowBinary.WriteBuffer, 1024)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case wb := <-ch:
+				wb.Release()
+			}
+		}
+	}()
+
+	r, err := New("tcp://127.0.0.1:0", WriteChan(ch), ParseThreads(1), ParseThreadsAuto(1, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	rcv := r.(*TCP)
+
+	var chunk bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&chunk, "load.test.metric.%d %d 1422642189\n", i, i)
+	}
+
+	// sends chunk each pause until stop is closed
+	send := func(stop chan struct{}, pause time.Duration) {
+		conn, err := net.Dial("tcp", rcv.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(pause):
+			}
+			if _, err := conn.Write(chunk.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+
+	baseline := make(chan struct{})
+	defer close(baseline)
+	go send(baseline, 200*time.Millisecond)
+
+	time.Sleep(2 * time.Second)
+	if n := rcv.parsePool.Running(); n != 1 {
+		t.Fatalf("parse threads at baseline: %d", n)
+	}
+
+	// 10 connections without pauses
+	spike := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go send(spike, 0)
+	}
+
+	start := time.Now()
+	for rcv.parsePool.Running() < 4 {
+		if time.Since(start) > 5*time.Second {
+			close(spike)
+			t.Fatalf("parse threads after spike: %d", rcv.parsePool.Running())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Logf("%d parse threads in %s", rcv.parsePool.Running(), time.Since(start))
+	close(spike)
+
+	start = time.Now()
+	for rcv.parsePool.Running() > 1 {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("parse threads after spike end: %d", rcv.parsePool.Running())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
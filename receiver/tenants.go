@@ -0,0 +1,170 @@
+package receiver
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantSeriesTTL is time after last point of series when it is not counted in tenant MaxSeries
+const TenantSeriesTTL = time.Hour
+
+// Tenant limits metrics with name prefix. 0 limit is unlimited
+type Tenant struct {
+	Name                string
+	Prefix              string
+	MaxSeries           int
+	MaxMetricsPerSecond int
+}
+
+// tenantState is token bucket and LRU of series of Tenant
+type tenantState struct {
+	Tenant
+	prefix []byte
+	stat   struct {
+		received      uint32 // atomic
+		droppedRate   uint32 // atomic
+		droppedSeries uint32 // atomic
+	}
+	sync.Mutex
+	tokens  float64
+	updated time.Time                // last refill of tokens
+	lru     *list.List               // *tenantSeries, recently received first
+	series  map[string]*list.Element // only if MaxSeries > 0
+}
+
+type tenantSeries struct {
+	name     string
+	received time.Time
+}
+
+// Tenants applies limits of tenants to received metrics. Prefixes of tenants don't overlap
+type Tenants struct {
+	tenants   []*tenantState
+	seriesTTL time.Duration
+	now       func() time.Time
+}
+
+func NewTenants(tenants []Tenant) *Tenants {
+	t := &Tenants{seriesTTL: TenantSeriesTTL, now: time.Now}
+	for _, c := range tenants {
+		s := &tenantState{
+			Tenant:  c,
+			prefix:  []byte(c.Prefix),
+			tokens:  float64(c.MaxMetricsPerSecond),
+			updated: t.now(),
+			lru:     list.New(),
+		}
+		if c.MaxSeries > 0 {
+			s.series = make(map[string]*list.Element)
+		}
+		t.tenants = append(t.tenants, s)
+	}
+	return t
+}
+
+// allow returns false if metric of tenant should be dropped. Safe for nil receiver
+func (t *Tenants) allow(name []byte) bool {
+	if t == nil {
+		return true
+	}
+
+	var s *tenantState
+	for _, c := range t.tenants {
+		if bytes.HasPrefix(name, c.prefix) {
+			s = c
+			break
+		}
+	}
+	if s == nil {
+		return true
+	}
+
+	now := t.now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	var known *list.Element
+	if s.series != nil {
+		known = s.series[unsafeString(name)]
+		if known == nil && len(s.series) >= s.MaxSeries {
+			t.expire(s, now)
+			if len(s.series) >= s.MaxSeries {
+				atomic.AddUint32(&s.stat.droppedSeries, 1)
+				return false
+			}
+		}
+	}
+
+	if s.MaxMetricsPerSecond > 0 {
+		if elapsed := now.Sub(s.updated); elapsed > 0 {
+			s.tokens += elapsed.Seconds() * float64(s.MaxMetricsPerSecond)
+			if s.tokens > float64(s.MaxMetricsPerSecond) {
+				s.tokens = float64(s.MaxMetricsPerSecond)
+			}
+		}
+		s.updated = now
+		if s.tokens < 1 {
+			atomic.AddUint32(&s.stat.droppedRate, 1)
+			return false
+		}
+		s.tokens--
+	}
+
+	if known != nil {
+		known.Value.(*tenantSeries).received = now
+		s.lru.MoveToFront(known)
+	} else if s.series != nil {
+		s.series[string(name)] = s.lru.PushFront(&tenantSeries{name: string(name), received: now})
+	}
+
+	atomic.AddUint32(&s.stat.received, 1)
+	return true
+}
+
+// expire removes series not received longer than seriesTTL. Tenant is locked by caller
+func (t *Tenants) expire(s *tenantState, now time.Time) {
+	for e := s.lru.Back(); e != nil; e = s.lru.Back() {
+		series := e.Value.(*tenantSeries)
+		if now.Sub(series.received) < t.seriesTTL {
+			return
+		}
+		s.lru.Remove(e)
+		delete(s.series, series.name)
+	}
+}
+
+// Series returns count of tracked series of tenant. 0 if tenant doesn't limit series
+func (t *Tenants) Series(name string) int {
+	for _, s := range t.tenants {
+		if s.Name == name {
+			s.Lock()
+			defer s.Unlock()
+			return len(s.series)
+		}
+	}
+	return 0
+}
+
+func (t *Tenants) Stat(send func(metric string, value float64)) {
+	for _, s := range t.tenants {
+		received := atomic.LoadUint32(&s.stat.received)
+		atomic.AddUint32(&s.stat.received, -received)
+		send(s.Name+".metricsReceived", float64(received))
+
+		droppedRate := atomic.LoadUint32(&s.stat.droppedRate)
+		atomic.AddUint32(&s.stat.droppedRate, -droppedRate)
+		send(s.Name+".droppedRateLimit", float64(droppedRate))
+
+		droppedSeries := atomic.LoadUint32(&s.stat.droppedSeries)
+		atomic.AddUint32(&s.stat.droppedSeries, -droppedSeries)
+		send(s.Name+".droppedMaxSeries", float64(droppedSeries))
+
+		if s.MaxSeries > 0 {
+			send(s.Name+".series", float64(t.Series(s.Name)))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package receiver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestTenantsLimits(t *testing.T) {
+	now := time.Unix(1422642189, 0)
+	tenants := NewTenants([]Tenant{
+		{Name: "slow", Prefix: "slow.", MaxMetricsPerSecond: 10},
+		{Name: "fast", Prefix: "fast.", MaxMetricsPerSecond: 100},
+		{Name: "limited", Prefix: "limited.", MaxMetricsPerSecond: 1000, MaxSeries: 5},
+	})
+	tenants.now = func() time.Time { return now }
+
+	// 200 points of 20 series for each tenant and metric without tenant
+	send := func() map[string]int {
+		allowed := make(map[string]int)
+		for i := 0; i < 200; i++ {
+			for _, prefix := range []string{"slow.", "fast.", "limited.", "other."} {
+				if tenants.allow([]byte(fmt.Sprintf("%shost%d.cpu", prefix, i%20))) {
+					allowed[prefix]++
+				}
+			}
+		}
+		return allowed
+	}
+
+	allowed := send()
+	if allowed["slow."] != 10 || allowed["fast."] != 100 || allowed["limited."] != 50 || allowed["other."] != 200 {
+		t.Fatalf("%#v", allowed)
+	}
+
+	// buckets are refilled, burst is limited by one second
+	now = now.Add(500 * time.Millisecond)
+	if allowed = send(); allowed["slow."] != 5 || allowed["fast."] != 50 || allowed["limited."] != 50 {
+		t.Fatalf("%#v", allowed)
+	}
+	now = now.Add(time.Minute)
+	if allowed = send(); allowed["slow."] != 10 || allowed["fast."] != 100 || allowed["limited."] != 50 {
+		t.Fatalf("%#v", allowed)
+	}
+
+	stat := make(map[string]float64)
+	tenants.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	expected := map[string]float64{
+		"slow.metricsReceived":     25,
+		"slow.droppedRateLimit":    575,
+		"slow.droppedMaxSeries":    0,
+		"fast.metricsReceived":     250,
+		"fast.droppedRateLimit":    350,
+		"fast.droppedMaxSeries":    0,
+		"limited.metricsReceived":  150,
+		"limited.droppedRateLimit": 0,
+		"limited.droppedMaxSeries": 450,
+		"limited.series":           5,
+	}
+	for metric, value := range expected {
+		if stat[metric] != value {
+			t.Fatalf("%s: %v, %#v", metric, stat[metric], stat)
+		}
+	}
+
+	// series not received during TTL are replaced with new ones
+	now = now.Add(TenantSeriesTTL)
+	for i := 0; i < 5; i++ {
+		if !tenants.allow([]byte(fmt.Sprintf("limited.new%d.cpu", i))) {
+			t.Fatalf("new series %d is dropped", i)
+		}
+	}
+	if tenants.allow([]byte("limited.host0.cpu")) || tenants.Series("limited") != 5 {
+		t.Fatalf("series: %d", tenants.Series("limited"))
+	}
+}
+
+func TestTenantsPlainParse(t *testing.T) {
+	tenants := NewTenants([]Tenant{{Name: "acme", Prefix: "acme.", MaxSeries: 1}})
+
+	buf := GetBuffer()
+	buf.Used = copy(buf.Body, "acme.cpu 1 1422642189\nacme.mem 2 1422642189\nhello.world 3 1422642189\n")
+	buf.Time = 1422642189
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{Tenants: tenants})
+
+	// dropped metric of tenant is not error
+	if received != 2 || errors != 0 {
+		t.Fatalf("received: %d, errors: %d", received, errors)
+	}
+	if names := readNames(t, out, 2, time.Second); !names["acme.cpu"] || !names["hello.world"] {
+		t.Fatalf("%#v", names)
+	}
+}
@@ -0,0 +1,72 @@
+package receiver
+
+import (
+	"bytes"
+	"regexp"
+	"regexp/syntax"
+)
+
+// Transform multiplies values of metrics with names matching Match by Factor
+type Transform struct {
+	Match  *regexp.Regexp
+	Factor float64
+}
+
+type transform struct {
+	Transform
+	prefix   []byte // literal part of every matched name
+	anchored bool   // matched names start with prefix
+}
+
+// Transforms applies chain of transforms to received values. Transforms are applied in order,
+// value of metric matching several transforms is multiplied by all factors
+type Transforms struct {
+	transforms []transform
+}
+
+func NewTransforms(transforms []Transform) *Transforms {
+	t := &Transforms{}
+	for _, c := range transforms {
+		prefix, anchored := transformPrefix(c.Match)
+		t.transforms = append(t.transforms, transform{Transform: c, prefix: []byte(prefix), anchored: anchored})
+	}
+	return t
+}
+
+// transformPrefix returns literal which is contained in every name matched by re. Name starts with it if re begins with ^.
+// Names without literal are skipped without regexp match
+func transformPrefix(re *regexp.Regexp) (string, bool) {
+	s, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	s = s.Simplify()
+	if s.Op == syntax.OpConcat && len(s.Sub) > 1 && s.Sub[0].Op == syntax.OpBeginText &&
+		s.Sub[1].Op == syntax.OpLiteral && s.Sub[1].Flags&syntax.FoldCase == 0 {
+		return string(s.Sub[1].Rune), true
+	}
+
+	prefix, _ := re.LiteralPrefix()
+	return prefix, false
+}
+
+// apply returns value transformed by matching transforms. Nil receiver returns value as is
+func (t *Transforms) apply(name []byte, value float64) float64 {
+	if t == nil {
+		return value
+	}
+	for i := range t.transforms {
+		c := &t.transforms[i]
+		if c.anchored {
+			if !bytes.HasPrefix(name, c.prefix) {
+				continue
+			}
+		} else if len(c.prefix) > 0 && !bytes.Contains(name, c.prefix) {
+			continue
+		}
+		if c.Match.Match(name) {
+			value *= c.Factor
+		}
+	}
+	return value
+}
@@ -0,0 +1,92 @@
+package receiver
+
+import (
+	"encoding/binary"
+	"math"
+	"regexp"
+	"testing"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestTransforms(t *testing.T) {
+	transforms := NewTransforms([]Transform{
+		{Match: regexp.MustCompile(`^servers\.[^.]+\.cpu$`), Factor: 100},
+		{Match: regexp.MustCompile(`\.bits$`), Factor: 0.125},
+		{Match: regexp.MustCompile(`(?i)^SERVERS\.`), Factor: 2},
+		{Match: regexp.MustCompile(`^a\.b|net\.`), Factor: 10},
+	})
+
+	table := []struct {
+		name     string
+		expected float64
+	}{
+		{"servers.web01.cpu", 200},
+		{"servers.web01.cpu.user", 2},
+		{"dc1.servers.web01.cpu", 1},
+		{"servers.web01.eth0.bits", 0.25},
+		{"Servers.web01.disk", 2},
+		{"a.b.c", 10},
+		{"x.net.bits", 1.25},
+		{"hello.world", 1},
+	}
+
+	for _, c := range table {
+		if v := transforms.apply([]byte(c.name), 1); v != c.expected {
+			t.Fatalf("%s: %v != %v", c.name, v, c.expected)
+		}
+	}
+
+	var nilTransforms *Transforms
+	if v := nilTransforms.apply([]byte("servers.web01.cpu"), 0.5); v != 0.5 {
+		t.Fatalf("%v", v)
+	}
+}
+
+func TestTransformsPlainParse(t *testing.T) {
+	transforms := NewTransforms([]Transform{{Match: regexp.MustCompile(`^servers\..*\.cpu$`), Factor: 100}})
+
+	buf := GetBuffer()
+	buf.Used = copy(buf.Body, "servers.web01.cpu 0.42 1422642189\nservers.web01.mem 0.5 1422642189\n")
+	buf.Time = 1422642189
+
+	out := make(chan *RowBinary.WriteBuffer, 1)
+	var received, errors uint32
+	PlainParseBuffer(nil, buf, out, &days1970.Days{}, &received, &errors, &ParseOptions{Transforms: transforms})
+
+	values := make(map[string]float64)
+	p := (<-out).Bytes()
+	for len(p) > 0 {
+		l, n := binary.Uvarint(p)
+		values[string(p[n:n+int(l)])] = math.Float64frombits(binary.LittleEndian.Uint64(p[n+int(l):]))
+		// value{8}, timestamp{4}, days(date){2}, version{4}
+		p = p[n+int(l)+18:]
+	}
+	if values["servers.web01.cpu"] != 42 || values["servers.web01.mem"] != 0.5 {
+		t.Fatalf("%#v", values)
+	}
+}
+
+func benchmarkTransforms(b *testing.B, transforms *Transforms, name string) {
+	n := []byte(name)
+	v := 0.0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v += transforms.apply(n, 0.5)
+	}
+}
+
+func BenchmarkTransformsDisabled(b *testing.B) {
+	benchmarkTransforms(b, nil, "servers.web01.cpu")
+}
+
+func BenchmarkTransformsNotMatched(b *testing.B) {
+	t := NewTransforms([]Transform{{Match: regexp.MustCompile(`^servers\.[^.]+\.cpu$`), Factor: 100}})
+	benchmarkTransforms(b, t, "carbon.agents.host1.tcp.metricsReceived")
+}
+
+func BenchmarkTransformsMatched(b *testing.B) {
+	t := NewTransforms([]Transform{{Match: regexp.MustCompile(`^servers\.[^.]+\.cpu$`), Factor: 100}})
+	benchmarkTransforms(b, t, "servers.web01.cpu")
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
@@ -11,22 +12,55 @@ import (
 	"go.uber.org/zap"
 )
 
+// UDPBufferSize is size of packet buffer. Max payload of UDP datagram is 65507 bytes
+const UDPBufferSize = 65536
+
 // UDP receive metrics from UDP messages
 type UDP struct {
 	stop.Struct
 	stat struct {
-		metricsReceived    uint32 // atomic
-		errors             uint32 // atomic
-		incompleteReceived uint32 // atomic
+		metricsReceivedTotal uint64 // atomic. since start, updated by Stat
+		errorsTotal          uint64 // atomic. since start, updated by Stat
+		metricsReceived      uint32 // atomic
+		errors               uint32 // atomic
+		incompleteReceived   uint32 // atomic
+		pending              int32  // atomic. buffers in parse queue and parsing
+		bufferGets           uint32 // atomic
+		bufferAllocs         uint32 // atomic. pool misses
 	}
 	name         string // name for store metrics
 	conn         *net.UDPConn
+	received     chan struct{} // closed after exit of receive loop
 	parseThreads int
 	parseChan    chan *Buffer
 	writeChan    chan *RowBinary.WriteBuffer
+	parseErrors  *ParseErrors
+	namespaces   *Namespaces
+	sharding     *Sharding
+	stripPrefix  *PrefixStripper
+	sanitizer    *Sanitizer
+	tenants      *Tenants
+	rateLimits   *RateLimits
+	newest       *NewestTimestamp
+	transforms   *Transforms
+	dedup        *Dedup
+	ready        readiness
+	parsePool    *ParsePool
+	bufferPool   sync.Pool // packet buffers of UDPBufferSize
 	logger       *zap.Logger
 }
 
+// getBuffer returns packet buffer from pool
+func (rcv *UDP) getBuffer() *Buffer {
+	atomic.AddUint32(&rcv.stat.bufferGets, 1)
+	return rcv.bufferPool.Get().(*Buffer)
+}
+
+func (rcv *UDP) newBuffer() interface{} {
+	atomic.AddUint32(&rcv.stat.bufferAllocs, 1)
+	return &Buffer{Body: make([]byte, UDPBufferSize), pool: &rcv.bufferPool}
+}
+
 // Addr returns binded socket address. For bind port 0 in tests
 func (rcv *UDP) Addr() net.Addr {
 	if rcv.conn == nil {
@@ -35,27 +69,86 @@ func (rcv *UDP) Addr() net.Addr {
 	return rcv.conn.LocalAddr()
 }
 
+// MetricsReceivedTotal returns count of received metrics since start
+func (rcv *UDP) MetricsReceivedTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.metricsReceivedTotal) + uint64(atomic.LoadUint32(&rcv.stat.metricsReceived))
+}
+
+// ErrorsTotal returns count of dropped bad lines and messages since start
+func (rcv *UDP) ErrorsTotal() uint64 {
+	return atomic.LoadUint64(&rcv.stat.errorsTotal) + uint64(atomic.LoadUint32(&rcv.stat.errors))
+}
+
+// CloseListener stops reading of packets and waits until last read packet is sent to parse queue
+func (rcv *UDP) CloseListener() {
+	if rcv.conn != nil {
+		rcv.conn.Close()
+		<-rcv.received
+	}
+}
+
+// Idle returns true if all read packets are parsed and sent to write channel.
+// Packets in socket buffer are not taken into account
+func (rcv *UDP) Idle() bool {
+	return atomic.LoadInt32(&rcv.stat.pending) == 0
+}
+
+// Stats returns counters since start
+func (rcv *UDP) Stats() ReceiverStats {
+	return ReceiverStats{
+		ReceivedTotal: rcv.MetricsReceivedTotal(),
+		ParseErrors:   rcv.ErrorsTotal(),
+	}
+}
+
+// Ready is closed after receive loop is started
+func (rcv *UDP) Ready() <-chan struct{} {
+	return rcv.ready.ch
+}
+
 func (rcv *UDP) Stat(send func(metric string, value float64)) {
 	metricsReceived := atomic.LoadUint32(&rcv.stat.metricsReceived)
 	atomic.AddUint32(&rcv.stat.metricsReceived, -metricsReceived)
+	atomic.AddUint64(&rcv.stat.metricsReceivedTotal, uint64(metricsReceived))
 	send("metricsReceived", float64(metricsReceived))
 
 	errors := atomic.LoadUint32(&rcv.stat.errors)
 	atomic.AddUint32(&rcv.stat.errors, -errors)
+	atomic.AddUint64(&rcv.stat.errorsTotal, uint64(errors))
 	send("errors", float64(errors))
 
 	incompleteReceived := atomic.LoadUint32(&rcv.stat.incompleteReceived)
 	atomic.AddUint32(&rcv.stat.incompleteReceived, -incompleteReceived)
 	send("incompleteReceived", float64(incompleteReceived))
+
+	bufferGets := atomic.LoadUint32(&rcv.stat.bufferGets)
+	atomic.AddUint32(&rcv.stat.bufferGets, -bufferGets)
+	bufferAllocs := atomic.LoadUint32(&rcv.stat.bufferAllocs)
+	atomic.AddUint32(&rcv.stat.bufferAllocs, -bufferAllocs)
+	hitRate := 1.0
+	if bufferGets > 0 {
+		hitRate = 1 - float64(bufferAllocs)/float64(bufferGets)
+		if hitRate < 0 {
+			hitRate = 0
+		}
+	}
+	send("bufferPoolHitRate", hitRate)
+
+	rcv.parseErrors.Stat(send)
+	rcv.stripPrefix.Stat(send)
+	rcv.sanitizer.Stat(send)
+	rcv.parsePool.Stat(send)
 }
 
 func (rcv *UDP) receiveWorker(exit chan struct{}) {
+	defer close(rcv.received)
 	defer rcv.conn.Close()
 
-	buffer := GetBuffer()
+	buffer := rcv.getBuffer()
 
 ReceiveLoop:
 	for {
+		rcv.ready.done()
 
 		n, peer, err := rcv.conn.ReadFromUDP(buffer.Body[:])
 		if err != nil {
@@ -76,14 +169,33 @@ ReceiveLoop:
 
 			if chunkSize > 0 {
 				buffer.Used = chunkSize
+				atomic.AddInt32(&rcv.stat.pending, 1)
 				rcv.parseChan <- buffer
-				buffer = GetBuffer()
+				buffer = rcv.getBuffer()
 			}
 
 		}
 	}
 }
 
+// parseLoad returns count of buffers in parse queue and parsing
+func (rcv *UDP) parseLoad() int {
+	return int(atomic.LoadInt32(&rcv.stat.pending))
+}
+
+// writeQueueFull returns true if write channel is filled more than 80%
+func (rcv *UDP) writeQueueFull() bool {
+	return len(rcv.writeChan) > cap(rcv.writeChan)*8/10
+}
+
+// stopParser stops one parse goroutine after it finishes current buffer
+func (rcv *UDP) stopParser(exit chan struct{}) {
+	select {
+	case rcv.parseChan <- nil:
+	case <-exit:
+	}
+}
+
 // Listen bind port. Receive messages and send to out channel
 func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 	return rcv.StartFunc(func() error {
@@ -94,25 +206,46 @@ func (rcv *UDP) Listen(addr *net.UDPAddr) error {
 			return err
 		}
 
+		rcv.ready.reset()
+
 		rcv.Go(func(exit chan struct{}) {
 			<-exit
 			rcv.conn.Close()
 		})
 
-		for i := 0; i < rcv.parseThreads; i++ {
-			rcv.Go(func(exit chan struct{}) {
-				PlainParser(
-					exit,
-					rcv.parseChan,
-					rcv.writeChan,
-					&rcv.stat.metricsReceived,
-					&rcv.stat.errors,
-				)
-			})
+		parse := func(exit chan struct{}) {
+			PlainParser(
+				exit,
+				rcv.parseChan,
+				rcv.writeChan,
+				&rcv.stat.metricsReceived,
+				&rcv.stat.errors,
+				&rcv.stat.pending,
+				rcv.parseOptions(),
+			)
 		}
+		rcv.parsePool.Go(rcv, rcv.parseThreads, parse)
+		rcv.parsePool.Scale(rcv, rcv.parseThreads, rcv.parseLoad, rcv.writeQueueFull, rcv.stopParser, parse)
 
+		rcv.received = make(chan struct{})
 		rcv.Go(rcv.receiveWorker)
 
 		return nil
 	})
 }
+
+// parseOptions returns stages of parsed metrics set by options
+func (rcv *UDP) parseOptions() *ParseOptions {
+	return &ParseOptions{
+		ParseErrors: rcv.parseErrors,
+		Namespaces:  rcv.namespaces,
+		Sharding:    rcv.sharding,
+		StripPrefix: rcv.stripPrefix,
+		Sanitizer:   rcv.sanitizer,
+		Tenants:     rcv.tenants,
+		Newest:      rcv.newest,
+		Transforms:  rcv.transforms,
+		Dedup:       rcv.dedup,
+		RateLimits:  rcv.rateLimits,
+	}
+}
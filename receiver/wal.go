@@ -0,0 +1,396 @@
+package receiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
+	"github.com/lomik/stop"
+	"go.uber.org/zap"
+)
+
+// header: magic{8}, capacity{8}, head{8}, tail{8}. Circular buffer of records follows header
+const walHeaderSize = 64
+
+// record: length{4}, crc32 of payload{4}, payload
+const walRecordHeaderSize = 8
+
+// WALMinSize is minimal size of WAL file. It fits several write buffers
+const WALMinSize = walHeaderSize + 4*(walRecordHeaderSize+RowBinary.WriteBufferSize)
+
+var walMagic = []byte("CCHWAL01")
+
+// WAL is write-ahead log of received data in memory-mapped file of fixed size. Buffers of input channel are appended
+// to circular buffer of file before they are sent to output channel of writer. Writer acknowledges buffers after
+// they are stored in closed data files. Head (acknowledged) and tail (appended) positions are stored in header,
+// file offset of position is header size + position modulo capacity. Not acknowledged buffers are replayed
+// to output channel on start. Append waits for acknowledgment while WAL is full
+type WAL struct {
+	stop.Struct
+	stat struct {
+		appended uint32 // atomic
+		replayed uint32 // atomic
+		waits    uint32 // atomic. appends waited for acknowledgment
+	}
+	sync.Mutex // guards positions in header and pending
+	filename   string
+	size       int64
+	file       *os.File
+	data       []byte        // mapped file
+	ring       []byte        // circular buffer after header
+	pending    []uint64      // end positions of not acknowledged records in order of output
+	acked      uint64        // acknowledged buffers since start
+	space      chan struct{} // signaled on acknowledgment
+	inputChan  chan *RowBinary.WriteBuffer
+	outputChan chan *RowBinary.WriteBuffer
+	syncChan   chan chan struct{}
+	logger     *zap.Logger
+}
+
+// NewWAL creates WAL of filename with size bytes between in and out channels
+func NewWAL(filename string, size int64, in chan *RowBinary.WriteBuffer, out chan *RowBinary.WriteBuffer) *WAL {
+	return &WAL{
+		filename:   filename,
+		size:       size,
+		space:      make(chan struct{}, 1),
+		inputChan:  in,
+		outputChan: out,
+		syncChan:   make(chan chan struct{}),
+		logger:     logging.Logger("wal"),
+	}
+}
+
+// Start opens WAL file and replays not acknowledged buffers to output channel before input
+func (w *WAL) Start() error {
+	return w.StartFunc(func() error {
+		if err := w.open(); err != nil {
+			return err
+		}
+
+		w.Lock()
+		replay := len(w.pending)
+		w.Unlock()
+		if replay > 0 {
+			w.logger.Info("replay of not acknowledged buffers", zap.Int("buffers", replay))
+		}
+
+		w.Go(func(exit chan struct{}) {
+			w.worker(exit, replay)
+		})
+		return nil
+	})
+}
+
+// Stop stops worker, syncs and unmaps file. Buffer received from input channel, but not sent to output is replayed
+// on next start. Should be called after stop of writer, so last files are acknowledged
+func (w *WAL) Stop() {
+	w.StopFunc(func() {})
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.file == nil {
+		return
+	}
+	if err := w.file.Sync(); err != nil {
+		w.logger.Error("sync failed", zap.Error(err))
+	}
+	w.close()
+}
+
+// close unmaps and closes file. WAL is locked by caller
+func (w *WAL) close() {
+	if err := munmap(w.data); err != nil {
+		w.logger.Error("munmap failed", zap.Error(err))
+	}
+	w.file.Close()
+	w.file, w.data, w.ring = nil, nil, nil
+}
+
+func (w *WAL) open() error {
+	if w.size < WALMinSize {
+		return fmt.Errorf("wal size should be at least %d. %d is unsupported", WALMinSize, w.size)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(w.filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(w.filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() == 0 {
+		err = f.Truncate(w.size)
+	} else if info.Size() != w.size {
+		err = fmt.Errorf("size of wal %s is %d, expected %d", w.filename, info.Size(), w.size)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	data, err := mmap(f, int(w.size))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.file, w.data, w.ring = f, data, data[walHeaderSize:]
+	w.pending, w.acked = nil, 0
+
+	if !bytes.Equal(data[:len(walMagic)], walMagic) {
+		// new file
+		copy(data, walMagic)
+		binary.LittleEndian.PutUint64(data[8:], uint64(len(w.ring)))
+		w.setHead(0)
+		w.setTail(0)
+		return nil
+	}
+
+	if binary.LittleEndian.Uint64(data[8:]) != uint64(len(w.ring)) || w.head() > w.tail() || w.tail()-w.head() > uint64(len(w.ring)) {
+		w.close()
+		return fmt.Errorf("wal %s is corrupted", w.filename)
+	}
+
+	w.scan()
+	return nil
+}
+
+func (w *WAL) head() uint64 {
+	return binary.LittleEndian.Uint64(w.data[16:])
+}
+
+func (w *WAL) tail() uint64 {
+	return binary.LittleEndian.Uint64(w.data[24:])
+}
+
+func (w *WAL) setHead(pos uint64) {
+	binary.LittleEndian.PutUint64(w.data[16:], pos)
+}
+
+func (w *WAL) setTail(pos uint64) {
+	binary.LittleEndian.PutUint64(w.data[24:], pos)
+}
+
+// used returns bytes of not acknowledged records
+func (w *WAL) used() uint64 {
+	return w.tail() - w.head()
+}
+
+// read copies bytes of circular buffer from position to p
+func (w *WAL) read(pos uint64, p []byte) {
+	offset := int(pos % uint64(len(w.ring)))
+	n := copy(p, w.ring[offset:])
+	copy(p[n:], w.ring)
+}
+
+// write copies p to circular buffer from position
+func (w *WAL) write(pos uint64, p []byte) {
+	offset := int(pos % uint64(len(w.ring)))
+	n := copy(w.ring[offset:], p)
+	copy(w.ring, p[n:])
+}
+
+// scan finds records between head and tail. Tail is moved to first broken record
+func (w *WAL) scan() {
+	var header [walRecordHeaderSize]byte
+	payload := make([]byte, RowBinary.WriteBufferSize)
+
+	head, tail := w.head(), w.tail()
+	for pos := head; pos < tail; {
+		err := errors.New("incomplete record")
+		if tail-pos >= walRecordHeaderSize {
+			w.read(pos, header[:])
+			length := uint64(binary.LittleEndian.Uint32(header[:]))
+			if length == 0 || length > RowBinary.WriteBufferSize || tail-pos-walRecordHeaderSize < length {
+				err = fmt.Errorf("invalid record length %d", length)
+			} else {
+				w.read(pos+walRecordHeaderSize, payload[:length])
+				if crc32.ChecksumIEEE(payload[:length]) == binary.LittleEndian.Uint32(header[4:]) {
+					pos += walRecordHeaderSize + length
+					w.pending = append(w.pending, pos)
+					continue
+				}
+				err = errors.New("checksum mismatch")
+			}
+		}
+
+		w.logger.Error("broken record, rest of wal is dropped",
+			zap.Uint64("position", pos),
+			zap.Uint64("dropped_bytes", tail-pos),
+			zap.Error(err),
+		)
+		w.setTail(pos)
+		return
+	}
+}
+
+// record returns copy of i-th record sent to output since start. Record should not be acknowledged
+func (w *WAL) record(i int) *RowBinary.WriteBuffer {
+	w.Lock()
+	defer w.Unlock()
+
+	// records before i may be acknowledged already
+	i -= int(w.acked)
+	pos := w.head()
+	if i > 0 {
+		pos = w.pending[i-1]
+	}
+
+	b := RowBinary.GetWriteBuffer()
+	b.Used = int(w.pending[i] - pos - walRecordHeaderSize)
+	w.read(pos+walRecordHeaderSize, b.Body[:b.Used])
+	return b
+}
+
+// append writes record of p to tail. Returns false if WAL is full. Tail in header is updated
+// after record, so record broken by crash is not replayed
+func (w *WAL) append(p []byte) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	size := uint64(walRecordHeaderSize + len(p))
+	if w.used()+size > uint64(len(w.ring)) {
+		return false
+	}
+
+	var header [walRecordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(p)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(p))
+
+	tail := w.tail()
+	w.write(tail, header[:])
+	w.write(tail+walRecordHeaderSize, p)
+	w.setTail(tail + size)
+	w.pending = append(w.pending, tail+size)
+	return true
+}
+
+// Ack acknowledges first count buffers sent to output channel since start, including replayed.
+// FileBackend passes count of appended buffers after close of files
+func (w *WAL) Ack(count uint64) {
+	w.Lock()
+	if w.data == nil {
+		w.Unlock()
+		return
+	}
+	n := 0
+	for w.acked < count && n < len(w.pending) {
+		w.acked++
+		n++
+	}
+	if n > 0 {
+		w.setHead(w.pending[n-1])
+		w.pending = w.pending[n:]
+	}
+	w.Unlock()
+
+	if n > 0 {
+		select {
+		case w.space <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Sync waits until all buffers received from input channel before call are sent to output channel.
+// Returns false on timeout
+func (w *WAL) Sync(timeout time.Duration) bool {
+	done := make(chan struct{})
+	deadline := time.After(timeout)
+
+	select {
+	case w.syncChan <- done:
+	case <-deadline:
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// worker sends replay records to output, then appends and sends buffers of input
+func (w *WAL) worker(exit chan struct{}, replay int) {
+	for i := 0; i < replay; i++ {
+		b := w.record(i)
+		select {
+		case w.outputChan <- b:
+			atomic.AddUint32(&w.stat.replayed, 1)
+		case <-exit:
+			b.Release()
+			return
+		}
+	}
+
+	for {
+		select {
+		case b := <-w.inputChan:
+			for !w.append(b.Bytes()) {
+				atomic.AddUint32(&w.stat.waits, 1)
+				select {
+				case <-w.space:
+				case <-exit:
+					b.Release()
+					return
+				}
+			}
+			atomic.AddUint32(&w.stat.appended, 1)
+
+			select {
+			case w.outputChan <- b:
+			case <-exit:
+				b.Release()
+				return
+			}
+		case done := <-w.syncChan:
+			close(done)
+		case <-exit:
+			return
+		}
+	}
+}
+
+func (w *WAL) Stat(send func(metric string, value float64)) {
+	appended := atomic.LoadUint32(&w.stat.appended)
+	atomic.AddUint32(&w.stat.appended, -appended)
+	send("appended", float64(appended))
+
+	replayed := atomic.LoadUint32(&w.stat.replayed)
+	atomic.AddUint32(&w.stat.replayed, -replayed)
+	send("replayed", float64(replayed))
+
+	waits := atomic.LoadUint32(&w.stat.waits)
+	atomic.AddUint32(&w.stat.waits, -waits)
+	send("waits", float64(waits))
+
+	w.Lock()
+	var used uint64
+	if w.data != nil {
+		used = w.used()
+	}
+	pending := len(w.pending)
+	w.Unlock()
+
+	send("usedBytes", float64(used))
+	send("pending", float64(pending))
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package receiver
+
+import (
+	"errors"
+	"os"
+)
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("wal is not supported on windows")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
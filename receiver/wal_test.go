@@ -0,0 +1,211 @@
+package receiver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+func walTestBuffer(i int) *RowBinary.WriteBuffer {
+	b := RowBinary.GetWriteBuffer()
+	b.WriteGraphitePoint([]byte(fmt.Sprintf("wal.metric%d", i)), float64(i), 1422642189, 16466, 1422642189)
+	return b
+}
+
+func walTestReceive(t *testing.T, out chan *RowBinary.WriteBuffer, i int) {
+	select {
+	case b := <-out:
+		expected := walTestBuffer(i)
+		if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+			t.Fatalf("%d: %#v != %#v", i, b.Bytes(), expected.Bytes())
+		}
+		expected.Release()
+		b.Release()
+	case <-time.After(time.Second):
+		t.Fatalf("%d is not received", i)
+	}
+}
+
+func walTestNothing(t *testing.T, out chan *RowBinary.WriteBuffer) {
+	select {
+	case b := <-out:
+		t.Fatalf("unexpected buffer %#v", b.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// walCrash stops WAL without sync of file, like crash of process after write to memory of mapped file
+func walCrash(w *WAL) {
+	w.StopFunc(func() {})
+	w.Lock()
+	w.close()
+	w.Unlock()
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "wal", "receiver.wal")
+
+	in := make(chan *RowBinary.WriteBuffer)
+	out := make(chan *RowBinary.WriteBuffer)
+
+	w := NewWAL(filename, WALMinSize, in, out)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		in <- walTestBuffer(i)
+		walTestReceive(t, out, i)
+	}
+	// first two buffers are stored in closed file
+	w.Ack(2)
+
+	// crash in the middle of append: record is written partially, tail is not updated
+	b := walTestBuffer(4)
+	w.Lock()
+	w.write(w.tail(), []byte{byte(b.Used), 0, 0, 0, 0, 0, 0, 0})
+	w.write(w.tail()+walRecordHeaderSize, b.Bytes()[:b.Used/2])
+	w.Unlock()
+	walCrash(w)
+
+	// not acknowledged buffers are replayed on start
+	w = NewWAL(filename, WALMinSize, in, out)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	walTestReceive(t, out, 2)
+	walTestReceive(t, out, 3)
+	walTestNothing(t, out)
+
+	// replayed buffers are acknowledged with new ones
+	in <- walTestBuffer(4)
+	walTestReceive(t, out, 4)
+	w.Ack(2)
+
+	stat := make(map[string]float64)
+	w.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["replayed"] != 2 || stat["appended"] != 1 || stat["pending"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+	w.Stop()
+
+	w = NewWAL(filename, WALMinSize, in, out)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	walTestReceive(t, out, 4)
+	walTestNothing(t, out)
+	w.Stop()
+
+	// size of existing file can't be changed
+	w = NewWAL(filename, 2*WALMinSize, in, out)
+	if err = w.Start(); err == nil {
+		w.Stop()
+		t.Fatal("wal of other size is opened")
+	}
+}
+
+func TestWALBrokenRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "receiver.wal")
+
+	in := make(chan *RowBinary.WriteBuffer)
+	out := make(chan *RowBinary.WriteBuffer)
+
+	w := NewWAL(filename, WALMinSize, in, out)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		in <- walTestBuffer(i)
+		walTestReceive(t, out, i)
+	}
+
+	// payload of second record is damaged
+	w.Lock()
+	w.ring[w.pending[0]+walRecordHeaderSize] ^= 0xff
+	w.Unlock()
+	walCrash(w)
+
+	// records from broken one are dropped
+	w = NewWAL(filename, WALMinSize, in, out)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	walTestReceive(t, out, 0)
+	walTestNothing(t, out)
+
+	in <- walTestBuffer(3)
+	walTestReceive(t, out, 3)
+	w.Stop()
+}
+
+func TestWALFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "receiver.wal")
+
+	in := make(chan *RowBinary.WriteBuffer)
+	out := make(chan *RowBinary.WriteBuffer)
+
+	w := NewWAL(filename, WALMinSize, in, out)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	full := func(i int) *RowBinary.WriteBuffer {
+		b := RowBinary.GetWriteBuffer()
+		b.Used = RowBinary.WriteBufferSize
+		for j := range b.Body {
+			b.Body[j] = byte(i)
+		}
+		return b
+	}
+
+	// wal fits 4 full buffers, next append waits for acknowledgment. Records are wrapped around end of file
+	for i := 0; i < 10; i++ {
+		in <- full(i)
+		if i >= 4 {
+			walTestNothing(t, out)
+			w.Ack(uint64(i - 3))
+		}
+
+		select {
+		case b := <-out:
+			if b.Used != RowBinary.WriteBufferSize || b.Body[0] != byte(i) || b.Body[b.Used-1] != byte(i) {
+				t.Fatalf("%d: unexpected buffer", i)
+			}
+			b.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("%d is not received", i)
+		}
+	}
+
+	stat := make(map[string]float64)
+	w.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["waits"] != 6 || stat["pending"] != 4 {
+		t.Fatalf("%#v", stat)
+	}
+}
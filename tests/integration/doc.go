@@ -0,0 +1,3 @@
+// Package integration runs carbon-clickhouse pipeline against ClickHouse started in docker container.
+// Tests are skipped unless RUN_INTEGRATION=1. Image is CLICKHOUSE_IMAGE or clickhouse/clickhouse-server:23.8
+package integration
@@ -0,0 +1,341 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/carbon"
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+const defaultImage = "clickhouse/clickhouse-server:23.8"
+
+// clickhouseURL is url of started container. Empty if integration tests are disabled
+var clickhouseURL string
+
+var tables = []string{
+	"CREATE TABLE %s (Path String, Value Float64, Time UInt32, Date Date, Timestamp UInt32) " +
+		"ENGINE = MergeTree PARTITION BY toYYYYMM(Date) ORDER BY (Path, Time)",
+	"CREATE TABLE %s (Date Date, Level UInt32, Path String, Deleted UInt8, Version UInt32) " +
+		"ENGINE = ReplacingMergeTree(Version) PARTITION BY toYYYYMM(Date) ORDER BY (Level, Path)",
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("RUN_INTEGRATION") != "1" {
+		fmt.Println("integration tests are skipped, set RUN_INTEGRATION=1 to run")
+		os.Exit(0)
+	}
+
+	image := os.Getenv("CLICKHOUSE_IMAGE")
+	if image == "" {
+		image = defaultImage
+	}
+
+	id, err := docker("run", "-d", "--rm", "-p", "127.0.0.1::8123", image)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code := 1
+	func() {
+		defer docker("stop", id)
+
+		addr, err := docker("port", id, "8123/tcp")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		// first line if both ipv4 and ipv6 are published
+		clickhouseURL = "http://" + strings.Fields(addr)[0] + "/"
+
+		if err = waitClickHouse(time.Minute); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+
+		code = m.Run()
+	}()
+
+	os.Exit(code)
+}
+
+// docker executes docker command and returns trimmed stdout
+func docker(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %s: %s", strings.Join(args, " "), err.Error(), stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func waitClickHouse(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := http.Get(clickhouseURL + "ping")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("clickhouse is not started in %s", timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// query executes query in ClickHouse and returns trimmed response body
+func query(t *testing.T, q string) string {
+	resp, err := http.Post(clickhouseURL+"?query="+url.QueryEscape(q), "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s", q, string(body))
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// createTables creates data and reverse data tables <prefix> and <prefix>_reverse,
+// tree and reverse tree tables <prefix>_tree and <prefix>_reverse_tree
+func createTables(t *testing.T, prefix string) {
+	query(t, fmt.Sprintf(tables[0], prefix))
+	query(t, fmt.Sprintf(tables[0], prefix+"_reverse"))
+	query(t, fmt.Sprintf(tables[1], prefix+"_tree"))
+	query(t, fmt.Sprintf(tables[1], prefix+"_reverse_tree"))
+}
+
+func dropTables(t *testing.T, prefix string) {
+	for _, table := range []string{prefix, prefix + "_reverse", prefix + "_tree", prefix + "_reverse_tree"} {
+		query(t, "DROP TABLE IF EXISTS "+table)
+	}
+}
+
+// waitCount waits until count of rows matching where in table is expected
+func waitCount(t *testing.T, table string, where string, expected int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	q := fmt.Sprintf("SELECT count() FROM %s WHERE %s", table, where)
+	for {
+		count := query(t, q)
+		if count == fmt.Sprintf("%d", expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %s, expected %d", q, count, expected)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// startApp starts app with tables of createTables. configure changes config before start
+func startApp(t *testing.T, prefix string, configure ...func(cfg *carbon.Config)) *carbon.App {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := carbon.New("")
+	if err = app.ParseConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Config.Common.MaxCPU = runtime.NumCPU()
+	app.Config.ClickHouse.Url = clickhouseURL
+	app.Config.ClickHouse.DataTables = []string{prefix}
+	app.Config.ClickHouse.ReverseDataTables = []string{prefix + "_reverse"}
+	app.Config.ClickHouse.TreeTable = prefix + "_tree"
+	app.Config.ClickHouse.ReverseTreeTable = prefix + "_reverse_tree"
+	app.Config.ClickHouse.RetryMinBackoff.Duration = 100 * time.Millisecond
+	app.Config.ClickHouse.RetryMaxBackoff.Duration = time.Second
+	app.Config.Data.Path = dir
+	app.Config.Data.FileInterval.Duration = 100 * time.Millisecond
+	app.Config.Tcp.Listen = "127.0.0.1:0"
+	app.Config.Udp.Listen = "127.0.0.1:0"
+	app.Config.Pickle.Listen = "127.0.0.1:0"
+	for _, f := range configure {
+		f(app.Config)
+	}
+
+	if err = app.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err = app.WaitReady(5 * time.Second); err != nil {
+		app.Stop()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+func stopApp(app *carbon.App) {
+	app.Stop()
+	os.RemoveAll(app.Config.Data.Path)
+}
+
+type addrReceiver interface {
+	Addr() net.Addr
+}
+
+// pickleMessage returns framed pickle message with one metric
+func pickleMessage(name string, value float64, timestamp int64) []byte {
+	var msg bytes.Buffer
+	b := make([]byte, 8)
+
+	msg.WriteString("\x80\x02]q\x00(X")
+	binary.LittleEndian.PutUint32(b, uint32(len(name)))
+	msg.Write(b[:4])
+	msg.WriteString(name)
+	msg.WriteByte('J')
+	binary.LittleEndian.PutUint32(b, uint32(timestamp))
+	msg.Write(b[:4])
+	msg.WriteByte('G')
+	binary.BigEndian.PutUint64(b, math.Float64bits(value))
+	msg.Write(b)
+	msg.WriteString("\x86\x86e.")
+
+	binary.BigEndian.PutUint32(b, uint32(msg.Len()))
+	return append(b[:4], msg.Bytes()...)
+}
+
+func send(t *testing.T, network string, rcv interface{}, message []byte) {
+	conn, err := net.Dial(network, rcv.(addrReceiver).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reverse(name string) string {
+	return string(RowBinary.ReverseBytes([]byte(name)))
+}
+
+func TestPipeline(t *testing.T) {
+	const prefix = "graphite_pipeline"
+	dropTables(t, prefix)
+	createTables(t, prefix)
+	defer dropTables(t, prefix)
+
+	app := startApp(t, prefix)
+	defer stopApp(app)
+
+	now := time.Now().Unix()
+	send(t, "tcp", app.TCP, []byte(fmt.Sprintf("test.tcp.metric 1 %d\n", now)))
+	send(t, "udp", app.UDP, []byte(fmt.Sprintf("test.udp.metric 2 %d\n", now)))
+	send(t, "tcp", app.Pickle, pickleMessage("test.pickle.metric", 3, now))
+
+	for i, name := range []string{"test.tcp.metric", "test.udp.metric", "test.pickle.metric"} {
+		where := fmt.Sprintf("Path = '%s' AND Time = %d AND Value = %d", name, now, i+1)
+		waitCount(t, prefix, where, 1, 10*time.Second)
+
+		where = fmt.Sprintf("Path = '%s' AND Time = %d AND Value = %d", reverse(name), now, i+1)
+		waitCount(t, prefix+"_reverse", where, 1, 10*time.Second)
+	}
+
+	// leaves and parent nodes
+	waitCount(t, prefix+"_tree FINAL", "Path IN ('test.', 'test.tcp.', 'test.udp.metric') AND Deleted = 0", 3, 10*time.Second)
+	count := query(t, fmt.Sprintf("SELECT count() FROM %s_tree FINAL WHERE Path = 'test.' AND Level = 1", prefix))
+	if count != "1" {
+		t.Fatalf("test. of level 1: %s", count)
+	}
+
+	waitCount(t, prefix+"_reverse_tree FINAL", fmt.Sprintf("Path = '%s'", reverse("test.pickle.metric")), 1, 10*time.Second)
+}
+
+func TestErrorRecovery(t *testing.T) {
+	const prefix = "graphite_recovery"
+	dropTables(t, prefix)
+	defer dropTables(t, prefix)
+
+	// tables are missing, uploads fail and files are retried
+	app := startApp(t, prefix)
+	defer stopApp(app)
+
+	now := time.Now().Unix()
+	send(t, "tcp", app.TCP, []byte(fmt.Sprintf("recovery.metric 42 %d\n", now)))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for app.Status().QueueDepth == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("file is not queued for upload")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	createTables(t, prefix)
+
+	waitCount(t, prefix, fmt.Sprintf("Path = 'recovery.metric' AND Time = %d", now), 1, 15*time.Second)
+	waitCount(t, prefix+"_tree FINAL", "Path = 'recovery.metric'", 1, 15*time.Second)
+
+	deadline = time.Now().Add(10 * time.Second)
+	for app.Status().QueueDepth != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth: %d", app.Status().QueueDepth)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestTagsIndex(t *testing.T) {
+	const prefix = "graphite_tags"
+	dropTables(t, prefix)
+	createTables(t, prefix)
+	defer dropTables(t, prefix)
+
+	query(t, "DROP TABLE IF EXISTS "+prefix+"_tagged")
+	query(t, "CREATE TABLE "+prefix+"_tagged (Date Date, Tag1 String, Path String, Tags Array(String), Version UInt32) "+
+		"ENGINE = ReplacingMergeTree(Version) PARTITION BY toYYYYMM(Date) ORDER BY (Tag1, Path, Date)")
+	defer query(t, "DROP TABLE IF EXISTS "+prefix+"_tagged")
+
+	app := startApp(t, prefix, func(cfg *carbon.Config) {
+		cfg.ClickHouse.TagsIndexTable = prefix + "_tagged"
+		// date of rows is today
+		cfg.ClickHouse.TreeDate = time.Time{}
+	})
+	defer stopApp(app)
+
+	now := time.Now().Unix()
+	send(t, "tcp", app.TCP, []byte(fmt.Sprintf("cpu.usage;host=h1;dc=east 1 %d\ncpu.usage;dc=west;host=h2 2 %d\n", now, now)))
+
+	// row per tag of each series, Tags are sorted after __name__
+	waitCount(t, prefix+"_tagged FINAL", "Path LIKE 'cpu.usage;%'", 6, 10*time.Second)
+	paths := query(t, fmt.Sprintf("SELECT Path FROM %s_tagged FINAL WHERE Tag1 = 'dc=east' AND has(Tags, '__name__=cpu.usage') "+
+		"AND Date = today() FORMAT TabSeparated", prefix))
+	if paths != "cpu.usage;host=h1;dc=east" {
+		t.Fatalf("%#v", paths)
+	}
+	tags := query(t, fmt.Sprintf("SELECT Tags FROM %s_tagged FINAL WHERE Tag1 = 'host=h2' FORMAT TabSeparated", prefix))
+	if tags != "['__name__=cpu.usage','dc=west','host=h2']" {
+		t.Fatalf("%#v", tags)
+	}
+
+	// known series aren't inserted again with new series of file
+	send(t, "tcp", app.TCP, []byte(fmt.Sprintf("cpu.usage;host=h1;dc=east 3 %d\nmem.free;host=h1 4 %d\n", now+1, now+1)))
+	waitCount(t, prefix+"_tagged", "Path = 'mem.free;host=h1'", 2, 10*time.Second)
+	waitCount(t, prefix+"_tagged", "Path LIKE 'cpu.usage;%'", 6, time.Second)
+}
@@ -0,0 +1,199 @@
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AsyncInsertConfirmTimeout is time after INSERT when insert not found in system.asynchronous_insert_log is forgotten
+const AsyncInsertConfirmTimeout = 10 * time.Minute
+
+// AsyncInsertSettings are url parameters of INSERT with async-insert-wait-end-of-query. Response is sent
+// after data of async insert is flushed to table
+var AsyncInsertSettings = map[string]string{
+	"async_insert":          "1",
+	"wait_for_async_insert": "1",
+	"wait_end_of_query":     "1",
+}
+
+// AsyncInsertWaitEndOfQuery enables async inserts confirmed after flush. Query ids of INSERT responses are checked
+// in system.asynchronous_insert_log every confirmInterval, 0 interval confirms insert by response. Applied on start
+func AsyncInsertWaitEndOfQuery(enabled bool, confirmInterval time.Duration) Option {
+	return func(u *Uploader) {
+		u.asyncInsert = enabled
+		u.asyncConfirmInterval = confirmInterval
+	}
+}
+
+type asyncInsert struct {
+	dsn   string
+	table string
+	sent  time.Time
+}
+
+// asyncInserts are inserts waiting for confirmation in system.asynchronous_insert_log
+type asyncInserts struct {
+	sync.Mutex
+	pending   map[string]asyncInsert // by query id
+	confirmed uint64                 // atomic
+	failed    uint64                 // atomic
+}
+
+func (a *asyncInserts) add(queryID string, insert asyncInsert) {
+	a.Lock()
+	if a.pending == nil {
+		a.pending = make(map[string]asyncInsert)
+	}
+	a.pending[queryID] = insert
+	a.Unlock()
+}
+
+// count returns count of inserts waiting for confirmation
+func (a *asyncInserts) count() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.pending)
+}
+
+// withAsyncInsert returns settings of INSERT with async insert settings if enabled
+func (u *Uploader) withAsyncInsert(settings map[string]string) map[string]string {
+	if !u.asyncInsert {
+		return settings
+	}
+
+	result := make(map[string]string, len(settings)+len(AsyncInsertSettings))
+	for k, v := range settings {
+		result[k] = v
+	}
+	for k, v := range AsyncInsertSettings {
+		result[k] = v
+	}
+	return result
+}
+
+// trackAsyncInsert remembers query id of successful INSERT for confirmation. Insert without query id
+// or with disabled check is confirmed by response
+func (u *Uploader) trackAsyncInsert(dsn string, table string, queryID string) {
+	if !u.asyncInsert {
+		return
+	}
+	if queryID == "" || u.asyncConfirmInterval <= 0 {
+		atomic.AddUint64(&u.asyncInserts.confirmed, 1)
+		return
+	}
+	u.asyncInserts.add(queryID, asyncInsert{dsn: dsn, table: table, sent: time.Now()})
+}
+
+// asyncInsertsWorker confirms pending async inserts
+func (u *Uploader) asyncInsertsWorker(exit chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-t.C:
+			u.confirmAsyncInserts(time.Now())
+		}
+	}
+}
+
+// confirmAsyncInserts checks status of pending inserts in system.asynchronous_insert_log of each ClickHouse url.
+// Each query is sent under configLock, so timeout and transport are not changed by Reconfigure while query is sent
+func (u *Uploader) confirmAsyncInserts(now time.Time) {
+	a := &u.asyncInserts
+
+	a.Lock()
+	idsByURL := make(map[string][]string)
+	for id, insert := range a.pending {
+		idsByURL[insert.dsn] = append(idsByURL[insert.dsn], id)
+	}
+	a.Unlock()
+
+	for dsn, ids := range idsByURL {
+		u.configLock.RLock()
+		status, err := u.queryAsyncInserts(dsn, ids)
+		u.configLock.RUnlock()
+		if err != nil {
+			u.logger.Warn("async inserts check failed", zap.Error(err))
+			continue
+		}
+
+		a.Lock()
+		for _, id := range ids {
+			insert := a.pending[id]
+			exception, found := status[id]
+			if !found {
+				if now.Sub(insert.sent) > AsyncInsertConfirmTimeout {
+					delete(a.pending, id)
+					u.logger.Warn("async insert is not found in system.asynchronous_insert_log",
+						zap.String("query_id", id),
+						zap.String("table", insert.table),
+					)
+				}
+				continue
+			}
+
+			delete(a.pending, id)
+			if exception == "" {
+				atomic.AddUint64(&a.confirmed, 1)
+				continue
+			}
+			atomic.AddUint64(&a.failed, 1)
+			u.logger.Error("async insert failed",
+				zap.String("query_id", id),
+				zap.String("table", insert.table),
+				zap.String("exception", exception),
+			)
+		}
+		a.Unlock()
+	}
+}
+
+// queryAsyncInserts returns finished inserts by query id. Value is exception of failed insert, empty if insert is flushed.
+// configLock should be read locked by caller
+func (u *Uploader) queryAsyncInserts(dsn string, ids []string) (map[string]string, error) {
+	quoted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		quoted = append(quoted, "'"+strings.Replace(id, "'", "\\'", -1)+"'")
+	}
+
+	body, err := u.post(
+		dsn,
+		fmt.Sprintf("SELECT query_id, status, exception FROM system.asynchronous_insert_log WHERE query_id IN (%s) AND status != 'Preprocessed' FORMAT TabSeparated",
+			strings.Join(quoted, ", ")),
+		nil,
+		u.dataTimeout,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		row := bytes.Split(line, []byte{'\t'})
+		if len(row) != 3 {
+			return nil, fmt.Errorf("unexpected row %#v", string(line))
+		}
+
+		exception := string(row[2])
+		if string(row[1]) != "Ok" && exception == "" {
+			exception = string(row[1])
+		}
+		result[string(row[0])] = exception
+	}
+
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAsyncInsertWaitEndOfQuery(t *testing.T) {
+	var inserts, logQueries, expectAsync uint32
+	var insertLog atomic.Value
+	insertLog.Store("")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		q := r.URL.Query()
+		query := q.Get("query")
+
+		if strings.HasPrefix(query, "SELECT query_id, status, exception FROM system.asynchronous_insert_log") {
+			atomic.AddUint32(&logQueries, 1)
+			w.Write([]byte(insertLog.Load().(string)))
+			return
+		}
+
+		if !strings.HasPrefix(query, "INSERT INTO graphite ") {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+			return
+		}
+		async := q.Get("async_insert") == "1" && q.Get("wait_for_async_insert") == "1" && q.Get("wait_end_of_query") == "1"
+		if async != (atomic.LoadUint32(&expectAsync) == 1) {
+			http.Error(w, "unexpected settings: "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-ClickHouse-Query-Id", fmt.Sprintf("insert-%d", atomic.AddUint32(&inserts, 1)))
+	}))
+	defer srv.Close()
+
+	newUploader := func(enabled bool, interval time.Duration) *Uploader {
+		u := New(
+			ClickHouse(srv.URL),
+			HTTPClient(srv.Client()),
+			DataTables([]string{"graphite"}),
+			AsyncInsertWaitEndOfQuery(enabled, interval),
+		)
+		if enabled {
+			atomic.StoreUint32(&expectAsync, 1)
+		} else {
+			atomic.StoreUint32(&expectAsync, 0)
+		}
+		u.logger = zap.NewNop()
+		return u
+	}
+
+	insert := func(u *Uploader, count int) {
+		for i := 0; i < count; i++ {
+			if _, err := u.insertData(u.clickHouseDSN, "graphite", "RowBinary", nil, time.Second, strings.NewReader("")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stat := func(u *Uploader) map[string]float64 {
+		s := make(map[string]float64)
+		u.Stat(func(metric string, value float64) {
+			s[metric] = value
+		})
+		return s
+	}
+
+	check := func(u *Uploader, confirmed, failed, pending float64) {
+		s := stat(u)
+		if s["asyncInsertsConfirmedTotal"] != confirmed || s["asyncInsertsFailedTotal"] != failed || s["asyncInsertsPendingTotal"] != pending {
+			t.Fatalf("confirmed: %v, failed: %v, pending: %v", s["asyncInsertsConfirmedTotal"], s["asyncInsertsFailedTotal"], s["asyncInsertsPendingTotal"])
+		}
+	}
+
+	// query ids are checked in system.asynchronous_insert_log
+	u := newUploader(true, time.Hour)
+	insert(u, 3)
+	check(u, 0, 0, 3)
+
+	insertLog.Store("insert-1\tOk\t\ninsert-2\tFlushError\tCode: 252. DB::Exception: Too many parts\n")
+	now := time.Now()
+	u.confirmAsyncInserts(now)
+	check(u, 1, 1, 1)
+	if atomic.LoadUint32(&logQueries) != 1 {
+		t.Fatalf("log queries: %d", logQueries)
+	}
+
+	// insert missing in log is forgotten after timeout
+	u.confirmAsyncInserts(now.Add(time.Minute))
+	check(u, 1, 1, 1)
+	u.confirmAsyncInserts(now.Add(AsyncInsertConfirmTimeout + time.Second))
+	check(u, 1, 1, 0)
+
+	// nothing to check
+	u.confirmAsyncInserts(now)
+	if atomic.LoadUint32(&logQueries) != 3 {
+		t.Fatalf("log queries: %d", logQueries)
+	}
+
+	// worker checks periodically
+	u = newUploader(true, 10*time.Millisecond)
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+	insertLog.Store("insert-4\tOk\t\ninsert-5\tOk\t\n")
+	insert(u, 2)
+	for deadline := time.Now().Add(time.Second); stat(u)["asyncInsertsConfirmedTotal"] != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%#v", stat(u))
+		}
+		// config is changed while worker checks inserts
+		u.Reconfigure(DataTimeout(time.Second))
+	}
+	u.Stop()
+
+	// confirmed by response if check is disabled
+	atomic.StoreUint32(&logQueries, 0)
+	u = newUploader(true, 0)
+	insert(u, 2)
+	check(u, 2, 0, 0)
+	if atomic.LoadUint32(&logQueries) != 0 {
+		t.Fatalf("log queries: %d", logQueries)
+	}
+
+	// disabled
+	u = newUploader(false, time.Hour)
+	insert(u, 1)
+	if _, exists := stat(u)["asyncInsertsConfirmedTotal"]; exists || u.asyncInserts.count() != 0 {
+		t.Fatalf("%#v", stat(u))
+	}
+}
@@ -0,0 +1,219 @@
+package uploader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// UploadChunkSize enables upload of data files larger than size by chunks of whole records. Uploaded part is saved
+// in checkpoint file after each chunk, so failed upload is resumed from last chunk. 0 disables chunks
+func UploadChunkSize(size int64) Option {
+	return func(u *Uploader) {
+		u.uploadChunkSize = size
+	}
+}
+
+// MaxInsertBlockSize splits INSERT of data file to data tables by blocks of rows. Blocks are uploaded
+// by chunks with checkpoint like UploadChunkSize. 0 is unlimited
+func MaxInsertBlockSize(rows int64) Option {
+	return func(u *Uploader) {
+		u.maxInsertBlockSize = rows
+	}
+}
+
+// minRecordSize is size of record with empty name: name length{1}, value{8}, timestamp{4}, days(date){2}, version{4}
+const minRecordSize = 19
+
+// chunked returns true if data file of size bytes can contain more than one chunk
+func (u *Uploader) chunked(size int64) bool {
+	if u.uploadChunkSize > 0 && size > u.uploadChunkSize {
+		return true
+	}
+	return u.maxInsertBlockSize > 0 && size > u.maxInsertBlockSize*minRecordSize
+}
+
+// limitChunk sets limits of reader by chunk starting at offset after records
+func (u *Uploader) limitChunk(reader *RowBinary.Reader, offset int64, records int64) {
+	if u.uploadChunkSize > 0 {
+		reader.SetLimit(offset + u.uploadChunkSize)
+	}
+	if u.maxInsertBlockSize > 0 {
+		reader.SetRecordsLimit(records + u.maxInsertBlockSize)
+	}
+}
+
+// checkpointKey returns key of table offset in checkpoint. Key contains name of uploader, so points
+// and reverse points of same table are resumed separately
+func checkpointKey(reverse bool, tablename string) string {
+	if reverse {
+		return "points-reverse/" + tablename
+	}
+	return "points/" + tablename
+}
+
+// checkpointFilename returns file with uploaded offsets of data file by uploader and table. Checkpoint name doesn't start
+// with "default.", so it is not uploaded
+func checkpointFilename(filename string) string {
+	return path.Join(path.Dir(filename), "checkpoint."+path.Base(filename))
+}
+
+// readCheckpoint returns uploaded offsets by checkpointKey. Missing or broken checkpoint is empty
+func readCheckpoint(filename string) map[string]int64 {
+	offsets := make(map[string]int64)
+
+	f, err := os.Open(checkpointFilename(filename))
+	if err != nil {
+		return offsets
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		row := strings.Split(scanner.Text(), "\t")
+		if len(row) != 2 {
+			return make(map[string]int64)
+		}
+		offset, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return make(map[string]int64)
+		}
+		offsets[row[0]] = offset
+	}
+
+	return offsets
+}
+
+// writeCheckpoint replaces checkpoint with "key\toffset" lines
+func writeCheckpoint(filename string, offsets map[string]int64) error {
+	keys := make([]string, 0, len(offsets))
+	for key := range offsets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var body []byte
+	for _, key := range keys {
+		body = append(body, fmt.Sprintf("%s\t%d\n", key, offsets[key])...)
+	}
+
+	checkpoint := checkpointFilename(filename)
+	if err := ioutil.WriteFile(checkpoint+".tmp", body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(checkpoint+".tmp", checkpoint)
+}
+
+// removeCheckpoint deletes checkpoint of uploaded file if exists
+func removeCheckpoint(filename string) {
+	os.Remove(checkpointFilename(filename))
+}
+
+// uploadChunks inserts data file of size bytes to table by chunks. Each INSERT contains records
+// from uploadChunkSize bytes of file and maxInsertBlockSize records at most. Records after first bad record
+// are skipped as in slow read method
+func (u *Uploader) uploadChunks(logger *zap.Logger, filename string, tablename string, reverse bool, size int64) error {
+	options := u.dataTableOptions(tablename)
+	format := u.dataTableFormat(options)
+
+	var shards uint32
+	if options.ShardKeyColumn != "" {
+		var err error
+		shards, err = u.dataTableShards(tablename, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	key := checkpointKey(reverse, tablename)
+	offsets := readCheckpoint(filename)
+	if offsets[key] >= size {
+		logger.Info("table is already uploaded", zap.String("table", tablename))
+		return nil
+	}
+
+	var reader *RowBinary.Reader
+	var err error
+	if reverse {
+		reader, err = RowBinary.NewReverseReader(filename)
+	} else {
+		reader, err = RowBinary.NewReader(filename)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	reader.SetDateType(options.DateColumnType)
+	reader.SetShards(shards)
+	reader.SetPrefixFilter(u.dataTableFilter(tablename))
+	reader.SetTransform(u.preUpload)
+
+	if offsets[key] > 0 {
+		// error means end of readable records, loop below is skipped
+		reader.Skip(offsets[key])
+		logger.Info("upload resumed",
+			zap.String("table", tablename),
+			zap.Int64("offset", offsets[key]),
+			zap.Int64("size", size),
+		)
+	}
+
+	insert := func(data io.Reader) (int64, error) {
+		return u.insertData(
+			u.tableURL(tablename),
+			fmt.Sprintf("%s %s", tablename, dataTableColumns(options)),
+			format,
+			u.dataQuerySettings(),
+			u.dataTimeout,
+			withHeader(format, data, dataTableHeader(options)),
+		)
+	}
+
+	if u.pipelineDepth > 1 {
+		return u.uploadPipeline(logger, reader, filename, tablename, size, offsets, key, insert)
+	}
+
+	for !reader.EOF() && reader.Offset() < size {
+		start, records := reader.Offset(), reader.Records()
+		u.limitChunk(reader, start, records)
+
+		written, err := insert(reader)
+		if err != nil {
+			return err
+		}
+
+		if reader.Offset() == start {
+			// bad record at start of chunk
+			break
+		}
+
+		u.countSkippedRows(logger, tablename, reader.Records()-records, written)
+
+		offsets[key] = reader.Offset()
+		if err = u.writeCheckpoint(filename, offsets); err != nil {
+			return err
+		}
+	}
+
+	offsets[key] = size
+	return u.writeCheckpoint(filename, offsets)
+}
+
+// writeCheckpoint saves checkpoint of upload. Checkpoint of dry run is not saved, so file is uploaded
+// from start after dry run is disabled
+func (u *Uploader) writeCheckpoint(filename string, offsets map[string]int64) error {
+	if u.dryRunRows > 0 {
+		return nil
+	}
+	return writeCheckpoint(filename, offsets)
+}
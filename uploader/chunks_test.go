@@ -0,0 +1,325 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestUploadChunksResume(t *testing.T) {
+	var lock sync.Mutex
+	var uploaded []byte // bodies of successful inserts
+	var requests int
+	failAt := -1
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if requests == failAt {
+			http.Error(w, "Code: 210, e.displayText() = DB::NetException: Connection reset by peer", http.StatusInternalServerError)
+			return
+		}
+		uploaded = append(uploaded, body...)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 100 records of 34 bytes
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for i := 0; i < 100; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%03d", i)), float64(i), now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	data := append([]byte(nil), wb.Bytes()...)
+	wb.Release()
+
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		UploadChunkSize(340),
+	)
+	u.logger = zap.NewNop()
+
+	// 10 chunks, 6th chunk fails
+	failAt = 6
+	if err = u.upload(nil, filename); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+
+	offsets := readCheckpoint(filename)
+	if offsets["points/graphite"] != int64(len(data))/2 || !bytes.Equal(uploaded, data[:len(data)/2]) {
+		t.Fatalf("checkpoint: %#v, uploaded %d of %d bytes", offsets, len(uploaded), len(data))
+	}
+
+	// resumed from 50%
+	requests = 0
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 5 {
+		t.Fatalf("requests: %d", requests)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Fatalf("uploaded %d of %d bytes", len(uploaded), len(data))
+	}
+
+	// uploaded table is skipped
+	requests = 0
+	if err = u.upload(nil, filename); err != nil || requests != 0 {
+		t.Fatalf("err: %#v, requests: %d", err, requests)
+	}
+
+	// checkpoint of points doesn't skip reverse points of same table
+	requests, failAt = 0, -1
+	reverse := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		ReverseDataTables([]string{"graphite"}),
+		UploadChunkSize(340),
+	)
+	reverse.logger = zap.NewNop()
+	if err = reverse.upload(nil, filename); err != nil || requests != 10 {
+		t.Fatalf("err: %#v, requests: %d", err, requests)
+	}
+	if offsets = readCheckpoint(filename); len(offsets) != 2 || offsets["points-reverse/graphite"] != int64(len(data)) {
+		t.Fatalf("checkpoint: %#v", offsets)
+	}
+
+	u.removeFile(filename)
+	if _, err = os.Stat(checkpointFilename(filename)); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint is not removed: %#v", err)
+	}
+}
+
+func TestUploadMaxInsertBlockSize(t *testing.T) {
+	// last block is incomplete
+	rows, blockSize := 550, int64(100)
+
+	var lock sync.Mutex
+	var requests, uploaded int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		uploaded += int(n)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	fd, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(fd)
+
+	// records of 26 bytes
+	now := uint32(time.Now().Unix())
+	days := (&days1970.Days{}).TimestampWithNow(now, now)
+	wb := RowBinary.GetWriteBuffer()
+	for i := 0; i < rows; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("m.%05d", i)), float64(i), now, days, now)
+		if wb.Used > len(wb.Body)-1024 {
+			w.Write(wb.Bytes())
+			wb.Reset()
+		}
+	}
+	w.Write(wb.Bytes())
+	wb.Release()
+	if err = w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		MaxInsertBlockSize(blockSize),
+	)
+	u.logger = zap.NewNop()
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 6 || uploaded != rows*26 {
+		t.Fatalf("requests: %d, uploaded: %d bytes", requests, uploaded)
+	}
+}
+
+func TestUploadPipeline(t *testing.T) {
+	var lock sync.Mutex
+	var requests, inFlight, maxInFlight int
+	uploaded := make(map[string]bool) // chunks by first record
+	failed := false
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		first := string(body[1:16])
+
+		lock.Lock()
+		requests++
+		if inFlight++; inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		lock.Lock()
+		defer lock.Unlock()
+		inFlight--
+		if first == "hello.world.050" && !failed {
+			failed = true
+			http.Error(w, "Code: 210, e.displayText() = DB::NetException: Connection reset by peer", http.StatusInternalServerError)
+			return
+		}
+		uploaded[first] = true
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 100 records of 34 bytes
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for i := 0; i < 100; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%03d", i)), float64(i), now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	data := append([]byte(nil), wb.Bytes()...)
+	wb.Release()
+
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		UploadChunkSize(340),
+		UploadPipelineDepth(4),
+	)
+	u.logger = zap.NewNop()
+
+	// 10 chunks, 6th chunk fails, chunks in flight after it are finished
+	if err = u.upload(nil, filename); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	if maxInFlight != 4 || requests < 6 || requests > 9 {
+		t.Fatalf("requests: %d, in flight: %d", requests, maxInFlight)
+	}
+
+	// checkpoint is not moved by chunks after failed one
+	offsets := readCheckpoint(filename)
+	if offsets["points/graphite"] != int64(len(data))/2 {
+		t.Fatalf("checkpoint: %#v", offsets)
+	}
+
+	requests = 0
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 5 || len(uploaded) != 10 {
+		t.Fatalf("requests: %d, uploaded: %#v", requests, uploaded)
+	}
+	if offsets = readCheckpoint(filename); offsets["points/graphite"] != int64(len(data)) {
+		t.Fatalf("checkpoint: %#v", offsets)
+	}
+}
+
+func BenchmarkUploadPipeline(b *testing.B) {
+	// latency of INSERT in ClickHouse
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(2 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 100 chunks of 1000 records
+	now := uint32(time.Now().Unix())
+	days := (&days1970.Days{}).TimestampWithNow(now, now)
+	var data []byte
+	wb := RowBinary.GetWriteBuffer()
+	for i := 0; i < 100000; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("m.%05d", i)), float64(i), now, days, now)
+		if wb.Used > len(wb.Body)-1024 {
+			data = append(data, wb.Bytes()...)
+			wb.Reset()
+		}
+	}
+	data = append(data, wb.Bytes()...)
+	wb.Release()
+
+	for _, depth := range []int{1, 2, 4, 10} {
+		b.Run(fmt.Sprintf("depth-%d", depth), func(b *testing.B) {
+			u := New(
+				ClickHouse(srv.URL),
+				HTTPClient(srv.Client()),
+				DataTables([]string{"graphite"}),
+				MaxInsertBlockSize(1000),
+				UploadPipelineDepth(depth),
+			)
+			u.logger = zap.NewNop()
+
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				filename := path.Join(dir, fmt.Sprintf("default.%d.%d", depth, i))
+				if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+					b.Fatal(err)
+				}
+				if err := u.upload(nil, filename); err != nil {
+					b.Fatal(err)
+				}
+				u.removeFile(filename)
+			}
+		})
+	}
+}
@@ -75,6 +75,20 @@ func (m CMap) Exists(key string) bool {
 	return ok
 }
 
+// Removes keys matched by f.
+func (m CMap) RemoveIf(f func(key string) bool) {
+	for i := 0; i < shardCount; i++ {
+		shard := m[i]
+		shard.Lock()
+		for key := range shard.items {
+			if f(key) {
+				delete(shard.items, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
 // Sets the given value under the specified key.
 func (m CMap) Add(key string) {
 	shard := m.GetShard(key)
@@ -0,0 +1,208 @@
+package uploader
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// max repeats of one instance in round-robin list
+const consulMaxWeight = 100
+
+// consulDiscovery keeps list of healthy ClickHouse instances registered in Consul.
+// Instances are returned in weighted round-robin order, empty list means static url
+type consulDiscovery struct {
+	addr     string // url of Consul agent
+	service  string
+	tag      string
+	interval time.Duration
+	client   *http.Client
+	hosts    atomic.Value // []consulHost repeated by weight
+	next     uint32       // atomic
+}
+
+// consulHost is instance of service. name is DNS name of instance, empty for IP address
+type consulHost struct {
+	addr string // host:port
+	name string
+}
+
+// serverName returns name verified by TLS connection to instance: own DNS name or name of static url
+func (h consulHost) serverName(static string) string {
+	if h.name != "" {
+		return h.name
+	}
+	return static
+}
+
+// consul health API response, only used fields
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func newConsulDiscovery(addr string, service string, tag string, interval time.Duration) *consulDiscovery {
+	d := &consulDiscovery{
+		addr:     addr,
+		service:  service,
+		tag:      tag,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	d.hosts.Store([]consulHost{})
+	return d
+}
+
+// refresh requests passing instances of service. Last received list is kept on error
+func (d *consulDiscovery) refresh() (int, error) {
+	hosts, err := d.request()
+	if err != nil {
+		return len(d.hosts.Load().([]consulHost)), err
+	}
+
+	d.hosts.Store(hosts)
+	return len(hosts), nil
+}
+
+func (d *consulDiscovery) request() ([]consulHost, error) {
+	u, err := url.Parse(d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = "/v1/health/service/" + d.service
+	q := u.Query()
+	q.Set("passing", "1")
+	if d.tag != "" {
+		q.Set("tag", d.tag)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := d.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("consul response status %d", resp.StatusCode)
+	}
+
+	var entries []consulServiceEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	hosts := make([]consulHost, 0)
+	// interleave instances: a, b, c, a, b, a instead of a, a, a, b, b, c
+	for round := 0; round < consulMaxWeight; round++ {
+		added := false
+		for _, e := range entries {
+			weight := e.Service.Weights.Passing
+			if weight <= 0 {
+				weight = 1
+			}
+			if round >= weight {
+				continue
+			}
+
+			host := e.Service.Address
+			if host == "" {
+				host = e.Node.Address
+			}
+			h := consulHost{addr: net.JoinHostPort(host, strconv.Itoa(e.Service.Port))}
+			if net.ParseIP(host) == nil {
+				h.name = host
+			}
+			hosts = append(hosts, h)
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+
+	return hosts, nil
+}
+
+// host returns next instance. Returns false if there are no instances
+func (d *consulDiscovery) host() (consulHost, bool) {
+	hosts := d.hosts.Load().([]consulHost)
+	if len(hosts) == 0 {
+		return consulHost{}, false
+	}
+	return hosts[int(atomic.AddUint32(&d.next, 1)-1)%len(hosts)], true
+}
+
+// ConsulDiscovery enables ClickHouse instances discovery in Consul. Host of clickhouse url is replaced
+// with address of passing instance of service, other parts of url are kept. TLS certificate of instance is verified
+// by its DNS name, instance with IP address is verified by host of clickhouse url. Applied on start
+func ConsulDiscovery(addr string, service string, tag string, interval time.Duration) Option {
+	return func(u *Uploader) {
+		if service == "" {
+			u.discovery = nil
+			return
+		}
+		u.discovery = newConsulDiscovery(addr, service, tag, interval)
+	}
+}
+
+// serverNameTransport returns transport verifying TLS certificate by name. Transports are created once per name
+func (u *Uploader) serverNameTransport(name string) http.RoundTripper {
+	if name == "" || net.ParseIP(name) != nil {
+		return u.transport
+	}
+
+	u.tlsTransportsLock.Lock()
+	defer u.tlsTransportsLock.Unlock()
+
+	t, exists := u.tlsTransports[name]
+	if !exists {
+		t = newTransport(u.http2, u.connectTimeout, u.writeTimeout, u.readTimeout)
+		t.TLSClientConfig = &tls.Config{ServerName: name}
+		u.tlsTransports[name] = t
+	}
+	return t
+}
+
+// discoveryWorker refreshes list of ClickHouse instances
+func (u *Uploader) discoveryWorker(exit chan struct{}) {
+	t := time.NewTicker(u.discovery.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-t.C:
+			u.refreshDiscovery()
+		}
+	}
+}
+
+func (u *Uploader) refreshDiscovery() {
+	n, err := u.discovery.refresh()
+	if err != nil && n > 0 {
+		u.logger.Warn("consul request failed, last received clickhouse instances are used", zap.Error(err))
+	} else if err != nil {
+		u.logger.Warn("consul request failed, static clickhouse url is used", zap.Error(err))
+	} else if n == 0 {
+		u.logger.Warn("no passing clickhouse instances in consul, static clickhouse url is used")
+	}
+}
@@ -0,0 +1,150 @@
+package uploader
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsulDiscovery(t *testing.T) {
+	var lock sync.Mutex
+	requests := make(map[string]int)
+
+	clickhouse := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			lock.Lock()
+			requests[name]++
+			lock.Unlock()
+		}))
+	}
+
+	static, ch1, ch2 := clickhouse("static"), clickhouse("ch1"), clickhouse("ch2")
+	defer static.Close()
+	defer ch1.Close()
+	defer ch2.Close()
+
+	split := func(s *httptest.Server) (string, string) {
+		host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+		return host, port
+	}
+	host1, port1 := split(ch1)
+	host2, port2 := split(ch2)
+
+	var query string
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.String()
+		// address of node is used if service address is empty
+		fmt.Fprintf(w, `[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "%s", "Port": %s, "Weights": {"Passing": 2, "Warning": 1}}},
+			{"Node": {"Address": "%s"}, "Service": {"Address": "", "Port": %s, "Weights": {"Passing": 1, "Warning": 1}}}
+		]`, host1, port1, host2, port2)
+	}))
+
+	u := New(ClickHouse(static.URL+"/?user=default"), ConsulDiscovery(consul.URL, "clickhouse", "main", time.Hour))
+	u.Start()
+	defer u.Stop()
+
+	if query != "/v1/health/service/clickhouse?passing=1&tag=main" {
+		t.Fatalf("%#v", query)
+	}
+
+	expected := []consulHost{{addr: ch1.Listener.Addr().String()}, {addr: ch2.Listener.Addr().String()}, {addr: ch1.Listener.Addr().String()}}
+	if hosts := u.discovery.hosts.Load().([]consulHost); !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("%#v != %#v", hosts, expected)
+	}
+
+	for i := 0; i < 30; i++ {
+		if _, err := u.Query("SELECT 1", time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock.Lock()
+	if requests["ch1"] != 20 || requests["ch2"] != 10 || requests["static"] != 0 {
+		t.Fatalf("%#v", requests)
+	}
+	requests = make(map[string]int)
+	lock.Unlock()
+
+	// last instances are used if consul is unavailable
+	consul.Close()
+	u.refreshDiscovery()
+
+	if _, err := u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	if requests["static"] != 0 || requests["ch1"]+requests["ch2"] != 1 {
+		t.Fatalf("%#v", requests)
+	}
+	lock.Unlock()
+
+	// static url is used without passing instances
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[]")
+	}))
+	defer empty.Close()
+	u.discovery.addr = empty.URL
+	u.refreshDiscovery()
+
+	if _, err := u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	if requests["static"] != 1 {
+		t.Fatalf("%#v", requests)
+	}
+	lock.Unlock()
+}
+
+func TestConsulDiscoveryTLS(t *testing.T) {
+	// certificate of test server is valid for example.com and 127.0.0.1
+	var serverName string
+	ch := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		serverName = r.TLS.ServerName
+	}))
+	defer ch.Close()
+
+	_, port, _ := net.SplitHostPort(ch.Listener.Addr().String())
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `[
+			{"Service": {"Address": "127.0.0.1", "Port": %s}},
+			{"Service": {"Address": "ch2.example.com", "Port": 8443}}
+		]`, port)
+	}))
+	defer consul.Close()
+
+	u := New(ClickHouse("https://example.com/"), ConsulDiscovery(consul.URL, "clickhouse", "", time.Hour))
+	u.refreshDiscovery()
+
+	// instance with DNS name is verified by own name
+	hosts := u.discovery.hosts.Load().([]consulHost)
+	if len(hosts) != 2 || hosts[0].serverName("example.com") != "example.com" || hosts[1].serverName("example.com") != "ch2.example.com" {
+		t.Fatalf("%#v", hosts)
+	}
+
+	// instance with IP address is verified by host of static url
+	roots := x509.NewCertPool()
+	roots.AddCert(ch.Certificate())
+	u.serverNameTransport("example.com").(*http.Transport).TLSClientConfig.RootCAs = roots
+	u.discovery.hosts.Store(hosts[:1])
+
+	if _, err := u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "example.com" {
+		t.Fatalf("%#v", serverName)
+	}
+}
@@ -0,0 +1,65 @@
+package uploader
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// credentials of ClickHouse user sent by Basic Auth. Empty user is not sent, user of url is used
+type credentials struct {
+	user     string
+	password string
+}
+
+func (c credentials) apply(req *http.Request) {
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+}
+
+// DDLCredentials sets ClickHouse user of schema and management queries: DESCRIBE TABLE, checks of system tables
+// and Query. Empty user is disabled
+func DDLCredentials(user, password string) Option {
+	return func(u *Uploader) {
+		u.ddlCredentials = credentials{user: user, password: password}
+	}
+}
+
+// DMLCredentials sets ClickHouse user of INSERT queries. User can be restricted to INSERT of data, tree and index
+// tables. Empty user is disabled
+func DMLCredentials(user, password string) Option {
+	return func(u *Uploader) {
+		u.dmlCredentials = credentials{user: user, password: password}
+	}
+}
+
+// RedactURL hides password in user info and query of ClickHouse url
+func RedactURL(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return ""
+	}
+
+	if u.User != nil {
+		if _, exists := u.User.Password(); exists {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+
+	q := u.Query()
+	if q.Get("password") != "" {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String()
+}
+
+// redactError returns text of error with redacted url of failed request
+func redactError(err error) string {
+	if e, ok := err.(*url.Error); ok {
+		return fmt.Sprintf("%s %q: %s", e.Op, RedactURL(e.URL), e.Err)
+	}
+	return err.Error()
+}
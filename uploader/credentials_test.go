@@ -0,0 +1,96 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestCredentials(t *testing.T) {
+	var lock sync.Mutex
+	queries := make(map[string][]string)
+
+	// each server accepts only own user
+	newServer := func(name, user, password string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			if u, p, ok := r.BasicAuth(); !ok || u != user || p != password {
+				http.Error(w, "Code: 516. DB::Exception: Authentication failed", http.StatusUnauthorized)
+				return
+			}
+			lock.Lock()
+			queries[name] = append(queries[name], strings.Fields(r.URL.Query().Get("query"))[0])
+			lock.Unlock()
+		}))
+	}
+
+	ddl := newServer("ddl", "admin", "secret")
+	defer ddl.Close()
+	dml := newServer("dml", "writer", "insert-only")
+	defer dml.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	wb.WriteGraphitePoint([]byte("hello.world"), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	u := New(
+		ClickHouse(ddl.URL),
+		HTTPClient(ddl.Client()),
+		DataTables([]string{"graphite"}),
+		DataTableOptions(map[string]TableOptions{"graphite": {URL: dml.URL}}),
+		DDLCredentials("admin", "secret"),
+		DMLCredentials("writer", "insert-only"),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.Query("SELECT count() FROM graphite", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(queries["dml"], ",") != "INSERT" || strings.Join(queries["ddl"], ",") != "SELECT" {
+		t.Fatalf("%#v", queries)
+	}
+
+	// url user is used without credentials
+	u = New(
+		ClickHouse(strings.Replace(ddl.URL, "http://", "http://admin:secret@", 1)),
+		HTTPClient(ddl.Client()),
+	)
+	if _, err = u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// insert by ddl user is rejected
+	u = New(
+		ClickHouse(dml.URL),
+		HTTPClient(dml.Client()),
+		DataTables([]string{"graphite"}),
+		DDLCredentials("writer", "insert-only"),
+		DMLCredentials("admin", "secret"),
+	)
+	if err = u.upload(nil, filename); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Fatalf("%#v", err)
+	}
+}
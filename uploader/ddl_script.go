@@ -0,0 +1,308 @@
+package uploader
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errUnterminated = errors.New("unterminated quote or comment")
+
+// DDLCluster sets cluster of DDL script. ON CLUSTER is added to CREATE statements without it and DROP of rollback.
+// Cluster is checked in system.clusters before script. Empty value disables
+func DDLCluster(cluster string) Option {
+	return func(u *Uploader) {
+		u.ddlCluster = cluster
+	}
+}
+
+// ZooKeeperPathTemplate sets path of Replicated*MergeTree tables of DDL script created without path.
+// {database} and {table} are replaced by database and name of table, other macros like {shard} are expanded
+// by ClickHouse. Replica name is '{replica}'. Empty value disables
+func ZooKeeperPathTemplate(template string) Option {
+	return func(u *Uploader) {
+		u.zookeeperPathTemplate = template
+	}
+}
+
+// ddlObject is object created by CREATE statement of DDL script
+type ddlObject struct {
+	kind    string // TABLE, DICTIONARY or DATABASE. Views are checked and dropped as tables
+	name    string
+	cluster string // ON CLUSTER of statement
+}
+
+const ddlIdentifier = "(?:`[^`]*`|\"[^\"]*\"|\\w+)"
+
+var ddlCreate = regexp.MustCompile(`(?is)^CREATE\s+(?:OR\s+REPLACE\s+)?(?:TEMPORARY\s+)?` +
+	`(TABLE|MATERIALIZED\s+VIEW|LIVE\s+VIEW|VIEW|DICTIONARY|DATABASE)\s+(?:IF\s+NOT\s+EXISTS\s+)?` +
+	`(` + ddlIdentifier + `(?:\.` + ddlIdentifier + `)?)` +
+	`(?:\s+ON\s+CLUSTER\s+(` + ddlIdentifier + `))?`)
+
+// ddlReplicatedEngine matches engine of Replicated*MergeTree table and opening bracket of arguments
+var ddlReplicatedEngine = regexp.MustCompile(`(?i)\bENGINE\s*=\s*(Replicated\w*MergeTree)\b(\s*\(\s*)?`)
+
+// ddlZooKeeperPath matches first argument of Replicated*MergeTree with path
+var ddlZooKeeperPath = regexp.MustCompile(`^'[/{]`)
+
+var (
+	ddlWord     = regexp.MustCompile(`^\w+$`)
+	ddlDatabase = regexp.MustCompile(`^` + ddlIdentifier + `\.`) // database of qualified name
+)
+
+// parseCreate returns object of CREATE statement. Returns false for other statements
+func parseCreate(statement string) (ddlObject, bool) {
+	m := ddlCreate.FindStringSubmatch(statement)
+	if m == nil {
+		return ddlObject{}, false
+	}
+
+	kind := strings.ToUpper(m[1])
+	if strings.HasSuffix(kind, "VIEW") {
+		kind = "TABLE"
+	}
+	return ddlObject{kind: kind, name: m[2], cluster: m[3]}, true
+}
+
+// quoteCluster returns cluster name as identifier
+func quoteCluster(cluster string) string {
+	if ddlWord.MatchString(cluster) {
+		return cluster
+	}
+	return "`" + strings.Replace(cluster, "`", "\\`", -1) + "`"
+}
+
+// unquoteIdentifier removes quotes of identifier
+func unquoteIdentifier(name string) string {
+	if len(name) >= 2 && (name[0] == '`' || name[0] == '"') && name[len(name)-1] == name[0] {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
+// prepareDDL adds ON CLUSTER of DDLCluster and path of ZooKeeperPathTemplate to CREATE statement
+func (u *Uploader) prepareDDL(statement string) string {
+	m := ddlCreate.FindStringSubmatchIndex(statement)
+	if m == nil {
+		return statement
+	}
+
+	if u.ddlCluster != "" && m[6] < 0 {
+		statement = statement[:m[5]] + " ON CLUSTER " + quoteCluster(u.ddlCluster) + statement[m[5]:]
+	}
+
+	if u.zookeeperPathTemplate == "" {
+		return statement
+	}
+	e := ddlReplicatedEngine.FindStringSubmatchIndex(statement)
+	if e == nil {
+		return statement
+	}
+	if e[4] >= 0 && ddlZooKeeperPath.MatchString(statement[e[5]:]) {
+		// path is set by script
+		return statement
+	}
+
+	name := statement[m[4]:m[5]]
+	database, table := u.database, name
+	if i := ddlDatabase.FindStringIndex(name); i != nil {
+		database, table = name[:i[1]-1], name[i[1]:]
+	}
+	if database == "" {
+		database = "default"
+	}
+	path := strings.NewReplacer(
+		"{database}", unquoteIdentifier(database),
+		"{table}", unquoteIdentifier(table),
+	).Replace(u.zookeeperPathTemplate)
+	args := "'" + strings.Replace(path, "'", "\\'", -1) + "', '{replica}'"
+
+	if e[4] < 0 {
+		return statement[:e[3]] + "(" + args + ")" + statement[e[3]:]
+	}
+	if strings.HasPrefix(statement[e[5]:], ")") {
+		return statement[:e[5]] + args + statement[e[5]:]
+	}
+	return statement[:e[5]] + args + ", " + statement[e[5]:]
+}
+
+// checkCluster returns error if DDLCluster is not found in system.clusters
+func (u *Uploader) checkCluster() error {
+	body, err := u.post(
+		u.clickHouseDSN,
+		fmt.Sprintf("SELECT count() FROM system.clusters WHERE cluster=%s FORMAT TabSeparated", ddlString(u.ddlCluster)),
+		nil,
+		u.dataTimeout,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) == "0" {
+		return fmt.Errorf("cluster %#v not found", u.ddlCluster)
+	}
+	return nil
+}
+
+// drop returns DROP statement of object
+func (o ddlObject) drop() string {
+	s := fmt.Sprintf("DROP %s IF EXISTS %s", o.kind, o.name)
+	if o.cluster != "" {
+		s += " ON CLUSTER " + o.cluster
+	}
+	return s
+}
+
+// splitStatements splits script by semicolons outside of quotes and comments. Comments are removed,
+// empty statements are skipped
+func splitStatements(script string) ([]string, error) {
+	var statements []string
+	var current []byte
+
+	flush := func() {
+		if s := strings.TrimSpace(string(current)); s != "" {
+			statements = append(statements, s)
+		}
+		current = current[:0]
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == ';':
+			flush()
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end
+			}
+			current = append(current, ' ')
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return nil, errUnterminated
+			}
+			i += end + 3
+			current = append(current, ' ')
+		case c == '\'' || c == '"' || c == '`':
+			j := i + 1
+			for ; j < len(script) && script[j] != c; j++ {
+				if script[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(script) {
+				return nil, errUnterminated
+			}
+			current = append(current, script[i:j+1]...)
+			i = j
+		default:
+			current = append(current, c)
+		}
+	}
+	flush()
+
+	return statements, nil
+}
+
+// ddlString returns s as string literal
+func ddlString(s string) string {
+	return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+}
+
+// clusterExistsQuery returns query of count of hosts of cluster with object
+func (u *Uploader) clusterExistsQuery(o ddlObject) string {
+	cluster := ddlString(unquoteIdentifier(o.cluster))
+	if o.kind == "DATABASE" {
+		return fmt.Sprintf("SELECT count() FROM clusterAllReplicas(%s, system.databases) WHERE name = %s FORMAT TabSeparated",
+			cluster, ddlString(unquoteIdentifier(o.name)))
+	}
+
+	table := "system.tables"
+	if o.kind == "DICTIONARY" {
+		table = "system.dictionaries"
+	}
+	database, name := "currentDatabase()", o.name
+	if i := ddlDatabase.FindStringIndex(name); i != nil {
+		database, name = ddlString(unquoteIdentifier(name[:i[1]-1])), name[i[1]:]
+	} else if u.database != "" {
+		database = ddlString(u.database)
+	}
+	return fmt.Sprintf("SELECT count() FROM clusterAllReplicas(%s, %s) WHERE database = %s AND name = %s FORMAT TabSeparated",
+		cluster, table, database, ddlString(unquoteIdentifier(name)))
+}
+
+// ddlObjectExists checks object by EXISTS query. Object of ON CLUSTER statement is checked on all hosts of cluster,
+// it exists if any host has it
+func (u *Uploader) ddlObjectExists(o ddlObject) (bool, error) {
+	query := fmt.Sprintf("EXISTS %s %s FORMAT TabSeparated", o.kind, o.name)
+	if o.cluster != "" {
+		query = u.clusterExistsQuery(o)
+	}
+	body, err := u.post(u.clickHouseDSN, query, nil, u.dataTimeout, nil)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(body)) != "0", nil
+}
+
+// ExecDDLScript executes semicolon separated statements of script one by one with DDL credentials.
+// If any statement fails, objects created by previous statements are dropped in reverse order.
+// Objects existed before script are kept, object of ON CLUSTER statement is kept if it existed on any host of cluster. CREATE statements are changed by DDLCluster and ZooKeeperPathTemplate
+func (u *Uploader) ExecDDLScript(script string) error {
+	u.configLock.RLock()
+	defer u.configLock.RUnlock()
+
+	statements, err := splitStatements(script)
+	if err != nil {
+		return err
+	}
+
+	if u.ddlCluster != "" {
+		if err = u.checkCluster(); err != nil {
+			return err
+		}
+	}
+
+	var created []ddlObject
+	for i, s := range statements {
+		s = u.prepareDDL(s)
+		o, isCreate := parseCreate(s)
+		exists := false
+		if isCreate {
+			if exists, err = u.ddlObjectExists(o); err != nil {
+				u.rollbackDDL(created)
+				return fmt.Errorf("statement %d: %s", i+1, err)
+			}
+		}
+
+		if _, err = u.post(u.clickHouseDSN, s, nil, u.dataTimeout, nil); err != nil {
+			u.rollbackDDL(created)
+			return fmt.Errorf("statement %d: %s", i+1, err)
+		}
+
+		if isCreate && !exists {
+			created = append(created, o)
+		}
+	}
+
+	u.logger.Info("ddl script executed", zap.Int("statements", len(statements)), zap.Int("created", len(created)))
+	return nil
+}
+
+// rollbackDDL drops created objects in reverse order. configLock should be locked by caller
+func (u *Uploader) rollbackDDL(created []ddlObject) {
+	for i := len(created) - 1; i >= 0; i-- {
+		s := created[i].drop()
+		if _, err := u.post(u.clickHouseDSN, s, nil, u.dataTimeout, nil); err != nil {
+			u.logger.Error("rollback of ddl script failed", zap.String("query", s), zap.Error(err))
+			continue
+		}
+		u.logger.Info("object of ddl script dropped", zap.String("query", s))
+	}
+}
@@ -0,0 +1,351 @@
+package uploader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplitStatements(t *testing.T) {
+	table := []struct {
+		script   string
+		expected []string
+	}{
+		{"", nil},
+		{"SELECT 1", []string{"SELECT 1"}},
+		{" SELECT 1;\n\n;SELECT 2; ", []string{"SELECT 1", "SELECT 2"}},
+		{"-- comment; of table\nCREATE TABLE a (x String) ENGINE = Memory; /* block; comment */ SELECT 2",
+			[]string{"CREATE TABLE a (x String) ENGINE = Memory", "SELECT 2"}},
+		{"SELECT 'a;b', \"c;d\", `e;f`; SELECT 'it\\'s;'", []string{"SELECT 'a;b', \"c;d\", `e;f`", "SELECT 'it\\'s;'"}},
+		{"SELECT 1 -- last", []string{"SELECT 1"}},
+	}
+
+	for _, c := range table {
+		statements, err := splitStatements(c.script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%#v", statements) != fmt.Sprintf("%#v", c.expected) {
+			t.Fatalf("%#v: %#v != %#v", c.script, statements, c.expected)
+		}
+	}
+
+	for _, script := range []string{"SELECT 'a", "SELECT 1 /* comment"} {
+		if _, err := splitStatements(script); err != errUnterminated {
+			t.Fatalf("%#v: %#v", script, err)
+		}
+	}
+}
+
+func TestParseCreate(t *testing.T) {
+	table := []struct {
+		statement string
+		expected  ddlObject
+		isCreate  bool
+	}{
+		{"CREATE TABLE graphite (Path String) ENGINE = Memory", ddlObject{"TABLE", "graphite", ""}, true},
+		{"create table if not exists db.graphite\n(Path String)", ddlObject{"TABLE", "db.graphite", ""}, true},
+		{"CREATE MATERIALIZED VIEW IF NOT EXISTS `graphite mv` TO graphite AS SELECT 1", ddlObject{"TABLE", "`graphite mv`", ""}, true},
+		{"CREATE OR REPLACE VIEW v AS SELECT 1", ddlObject{"TABLE", "v", ""}, true},
+		{"CREATE DICTIONARY d ON CLUSTER c (id UInt64) PRIMARY KEY id", ddlObject{"DICTIONARY", "d", "c"}, true},
+		{"CREATE DATABASE IF NOT EXISTS graphite", ddlObject{"DATABASE", "graphite", ""}, true},
+		{"ALTER TABLE graphite ADD COLUMN x String", ddlObject{}, false},
+		{"CREATE USER u", ddlObject{}, false},
+	}
+
+	for _, c := range table {
+		o, isCreate := parseCreate(c.statement)
+		if o != c.expected || isCreate != c.isCreate {
+			t.Fatalf("%#v: %#v, %#v", c.statement, o, isCreate)
+		}
+	}
+
+	if s := (ddlObject{"DICTIONARY", "d", "c"}).drop(); s != "DROP DICTIONARY IF EXISTS d ON CLUSTER c" {
+		t.Fatal(s)
+	}
+}
+
+// ddlServer is ClickHouse with objects created by CREATE statements
+type ddlServer struct {
+	sync.Mutex
+	objects map[string]string // name => kind
+	queries []string
+	fail    *regexp.Regexp // failed queries
+	cluster string         // CREATE and DROP without ON CLUSTER fail if set
+	remote  map[string]int // name => count of other hosts of cluster with object
+}
+
+func newDDLServer(objects ...string) *ddlServer {
+	s := &ddlServer{objects: make(map[string]string)}
+	for _, name := range objects {
+		s.objects[name] = "TABLE"
+	}
+	return s
+}
+
+var (
+	ddlExists = regexp.MustCompile(`^EXISTS (\w+) (\S+) FORMAT TabSeparated$`)
+	ddlDrop   = regexp.MustCompile(`^DROP (\w+) IF EXISTS (\S+)(?: ON CLUSTER \S+)?$`)
+	ddlCheck  = regexp.MustCompile(`^SELECT count\(\) FROM system.clusters WHERE cluster='(.*)' FORMAT TabSeparated$`)
+
+	ddlClusterExists = regexp.MustCompile(`^SELECT count\(\) FROM clusterAllReplicas\('(.*)', system\.\w+\) WHERE .*name = '([^']*)' FORMAT TabSeparated$`)
+)
+
+func (s *ddlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ioutil.ReadAll(r.Body)
+	query := r.URL.Query().Get("query")
+
+	s.Lock()
+	defer s.Unlock()
+	s.queries = append(s.queries, query)
+
+	if s.fail != nil && s.fail.MatchString(query) {
+		http.Error(w, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+		return
+	}
+
+	if m := ddlCheck.FindStringSubmatch(query); m != nil {
+		if m[1] == s.cluster {
+			fmt.Fprintln(w, "3")
+		} else {
+			fmt.Fprintln(w, "0")
+		}
+		return
+	}
+
+	if s.cluster != "" && (strings.HasPrefix(query, "CREATE ") || strings.HasPrefix(query, "DROP ")) &&
+		!strings.Contains(query, " ON CLUSTER "+s.cluster) {
+		http.Error(w, "Code: 371. DB::Exception: Table is not replicated on cluster", http.StatusInternalServerError)
+		return
+	}
+
+	if m := ddlClusterExists.FindStringSubmatch(query); m != nil {
+		n := s.remote[m[2]]
+		if _, exists := s.objects[m[2]]; exists {
+			n++
+		}
+		fmt.Fprintln(w, n)
+		return
+	}
+
+	if m := ddlExists.FindStringSubmatch(query); m != nil {
+		if s.objects[m[2]] == m[1] {
+			fmt.Fprintln(w, "1")
+		} else {
+			fmt.Fprintln(w, "0")
+		}
+		return
+	}
+
+	if m := ddlDrop.FindStringSubmatch(query); m != nil {
+		delete(s.objects, m[2])
+		return
+	}
+
+	if o, ok := parseCreate(query); ok {
+		if _, exists := s.objects[o.name]; exists && !strings.Contains(query, "IF NOT EXISTS") {
+			http.Error(w, "Code: 57. DB::Exception: Table already exists", http.StatusInternalServerError)
+			return
+		}
+		s.objects[o.name] = o.kind
+		return
+	}
+
+	if query == "SELECT name FROM system.tables WHERE database = currentDatabase() ORDER BY name FORMAT TabSeparated" {
+		names := make([]string, 0, len(s.objects))
+		for name := range s.objects {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(w, name)
+		}
+	}
+}
+
+const testDDLScript = `
+-- graphite schema
+CREATE TABLE IF NOT EXISTS graphite (
+	Path String, Value Float64, Time UInt32, Date Date, Timestamp UInt32
+) ENGINE = GraphiteMergeTree('graphite_rollup') PARTITION BY toYYYYMM(Date) ORDER BY (Path, Time);
+
+CREATE TABLE graphite_daily (Path String, Value Float64, Date Date) ENGINE = SummingMergeTree ORDER BY (Path, Date);
+
+/* daily averages; updated by inserts */
+CREATE MATERIALIZED VIEW graphite_daily_mv TO graphite_daily AS
+	SELECT Path, avg(Value) AS Value, Date FROM graphite WHERE Path NOT LIKE '%;%' GROUP BY Path, Date;
+
+CREATE DICTIONARY graphite_owners (Path String, Owner String) PRIMARY KEY Path
+	SOURCE(CLICKHOUSE(TABLE 'owners')) LAYOUT(COMPLEX_KEY_HASHED()) LIFETIME(300);
+`
+
+func TestExecDDLScript(t *testing.T) {
+	s := newDDLServer("graphite")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	u := New(ClickHouse(srv.URL))
+	if err := u.ExecDDLScript(testDDLScript); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := u.Query("SELECT name FROM system.tables WHERE database = currentDatabase() ORDER BY name FORMAT TabSeparated", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "graphite\ngraphite_daily\ngraphite_daily_mv\ngraphite_owners\n"
+	if string(body) != expected {
+		t.Fatalf("%#v != %#v", string(body), expected)
+	}
+	if s.objects["graphite_owners"] != "DICTIONARY" {
+		t.Fatalf("%#v", s.objects)
+	}
+}
+
+func TestExecDDLScriptRollback(t *testing.T) {
+	s := newDDLServer("graphite")
+	s.fail = regexp.MustCompile("^CREATE DICTIONARY")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	u := New(ClickHouse(srv.URL))
+	err := u.ExecDDLScript(testDDLScript)
+	if err == nil || !strings.HasPrefix(err.Error(), "statement 4: clickhouse response status 400") {
+		t.Fatalf("%#v", err)
+	}
+
+	// objects created by script are dropped in reverse order, existed table is kept
+	if fmt.Sprint(s.objects) != "map[graphite:TABLE]" {
+		t.Fatalf("%#v", s.objects)
+	}
+	var drops []string
+	for _, q := range s.queries {
+		if strings.HasPrefix(q, "DROP ") {
+			drops = append(drops, q)
+		}
+	}
+	expected := []string{
+		"DROP TABLE IF EXISTS graphite_daily_mv",
+		"DROP TABLE IF EXISTS graphite_daily",
+	}
+	if fmt.Sprintf("%#v", drops) != fmt.Sprintf("%#v", expected) {
+		t.Fatalf("%#v", drops)
+	}
+
+	// nothing is executed for broken script
+	s.queries = nil
+	if err = u.ExecDDLScript("CREATE TABLE a (x String) ENGINE = Memory; SELECT 'a"); err != errUnterminated {
+		t.Fatalf("%#v", err)
+	}
+	if len(s.queries) != 0 {
+		t.Fatalf("%#v", s.queries)
+	}
+}
+
+func TestPrepareDDL(t *testing.T) {
+	table := []struct {
+		statement string
+		expected  string
+	}{
+		{"CREATE TABLE graphite (Path String) ENGINE = ReplicatedMergeTree ORDER BY Path",
+			"CREATE TABLE graphite ON CLUSTER graphite_cluster (Path String) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/default.graphite', '{replica}') ORDER BY Path"},
+		{"CREATE TABLE IF NOT EXISTS `db`.graphite (Path String) ENGINE = ReplicatedGraphiteMergeTree('graphite_rollup')",
+			"CREATE TABLE IF NOT EXISTS `db`.graphite ON CLUSTER graphite_cluster (Path String) ENGINE = ReplicatedGraphiteMergeTree('/clickhouse/tables/{shard}/db.graphite', '{replica}', 'graphite_rollup')"},
+		{"CREATE TABLE t ON CLUSTER other (x String) ENGINE = ReplicatedMergeTree() ORDER BY x",
+			"CREATE TABLE t ON CLUSTER other (x String) ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/default.t', '{replica}') ORDER BY x"},
+		// path is set by script
+		{"CREATE TABLE t (x String) ENGINE = ReplicatedMergeTree('/t/{shard}', '{replica}') ORDER BY x",
+			"CREATE TABLE t ON CLUSTER graphite_cluster (x String) ENGINE = ReplicatedMergeTree('/t/{shard}', '{replica}') ORDER BY x"},
+		{"CREATE TABLE t (x String) ENGINE = MergeTree ORDER BY x",
+			"CREATE TABLE t ON CLUSTER graphite_cluster (x String) ENGINE = MergeTree ORDER BY x"},
+		{"ALTER TABLE graphite ADD COLUMN x String", "ALTER TABLE graphite ADD COLUMN x String"},
+	}
+
+	u := New(DDLCluster("graphite_cluster"), ZooKeeperPathTemplate("/clickhouse/tables/{shard}/{database}.{table}"))
+	for _, c := range table {
+		if s := u.prepareDDL(c.statement); s != c.expected {
+			t.Fatalf("%#v: %#v", c.statement, s)
+		}
+	}
+
+	if s := New(DDLCluster("graphite-cluster")).prepareDDL("CREATE DATABASE graphite"); s != "CREATE DATABASE graphite ON CLUSTER `graphite-cluster`" {
+		t.Fatal(s)
+	}
+	if s := New().prepareDDL(table[0].statement); s != table[0].statement {
+		t.Fatal(s)
+	}
+}
+
+func TestExecDDLScriptOnCluster(t *testing.T) {
+	s := newDDLServer("graphite")
+	s.cluster = "graphite_cluster"
+	s.fail = regexp.MustCompile("^CREATE DICTIONARY")
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	if err := New(ClickHouse(srv.URL), DDLCluster("unknown")).ExecDDLScript(testDDLScript); err == nil || err.Error() != `cluster "unknown" not found` {
+		t.Fatalf("%#v", err)
+	}
+
+	u := New(ClickHouse(srv.URL), DDLCluster("graphite_cluster"))
+	err := u.ExecDDLScript(testDDLScript)
+	if err == nil || !strings.HasPrefix(err.Error(), "statement 4: clickhouse response status 400") {
+		t.Fatalf("%#v", err)
+	}
+
+	// objects are created and dropped on cluster
+	if fmt.Sprint(s.objects) != "map[graphite:TABLE]" {
+		t.Fatalf("%#v", s.objects)
+	}
+	var ddl []string
+	for _, q := range s.queries {
+		if strings.HasPrefix(q, "CREATE ") || strings.HasPrefix(q, "DROP ") {
+			ddl = append(ddl, q[:strings.Index(q, "graphite_cluster")+len("graphite_cluster")])
+		}
+	}
+	expected := []string{
+		"CREATE TABLE IF NOT EXISTS graphite ON CLUSTER graphite_cluster",
+		"CREATE TABLE graphite_daily ON CLUSTER graphite_cluster",
+		"CREATE MATERIALIZED VIEW graphite_daily_mv ON CLUSTER graphite_cluster",
+		"CREATE DICTIONARY graphite_owners ON CLUSTER graphite_cluster",
+		"DROP TABLE IF EXISTS graphite_daily_mv ON CLUSTER graphite_cluster",
+		"DROP TABLE IF EXISTS graphite_daily ON CLUSTER graphite_cluster",
+	}
+	if fmt.Sprintf("%#v", ddl) != fmt.Sprintf("%#v", expected) {
+		t.Fatalf("%#v", ddl)
+	}
+
+	// table existed on other host of cluster isn't dropped
+	s.remote = map[string]int{"graphite_daily": 1}
+	s.queries = nil
+	err = u.ExecDDLScript(`
+		CREATE TABLE IF NOT EXISTS graphite_daily (Path String, Value Float64, Date Date) ENGINE = SummingMergeTree ORDER BY (Path, Date);
+		CREATE DICTIONARY graphite_owners (Path String, Owner String) PRIMARY KEY Path
+			SOURCE(CLICKHOUSE(TABLE 'owners')) LAYOUT(COMPLEX_KEY_HASHED()) LIFETIME(300);
+	`)
+	if err == nil || !strings.HasPrefix(err.Error(), "statement 2: clickhouse response status 400") {
+		t.Fatalf("%#v", err)
+	}
+	if _, exists := s.objects["graphite_daily"]; !exists {
+		t.Fatalf("%#v", s.objects)
+	}
+	expected = []string{
+		"SELECT count() FROM system.clusters WHERE cluster='graphite_cluster' FORMAT TabSeparated",
+		"SELECT count() FROM clusterAllReplicas('graphite_cluster', system.tables) WHERE database = currentDatabase() AND name = 'graphite_daily' FORMAT TabSeparated",
+	}
+	if fmt.Sprintf("%#v", s.queries[:2]) != fmt.Sprintf("%#v", expected) {
+		t.Fatalf("%#v", s.queries)
+	}
+	for _, q := range s.queries {
+		if strings.HasPrefix(q, "DROP ") {
+			t.Fatalf("%#v", s.queries)
+		}
+	}
+}
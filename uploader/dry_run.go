@@ -0,0 +1,277 @@
+package uploader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// DryRun disables queries changing ClickHouse. INSERT is logged as SQL with first and last maxRows rows,
+// which can be executed by clickhouse-client. Uploaded files are kept on disk and exists caches are not changed,
+// files are uploaded again after dry run is disabled. 0 disables
+func DryRun(maxRows int) Option {
+	return func(u *Uploader) {
+		u.dryRunRows = maxRows
+	}
+}
+
+// readOnlyQuery matches queries executed in dry run
+var readOnlyQuery = regexp.MustCompile(`(?i)^\s*(SELECT|DESCRIBE|DESC|EXISTS|SHOW)\s`)
+
+// insertQuery matches INSERT of uploader with table and format
+var insertQuery = regexp.MustCompile(`^INSERT INTO (.+) FORMAT (\w+)$`)
+
+// simpleAggregateFunction matches type of value of AggregatingMergeTree
+var simpleAggregateFunction = regexp.MustCompile(`^SimpleAggregateFunction\(\w+,\s*(.+)\)$`)
+
+// dryRunRequest logs query instead of request. INSERT of RowBinaryWithNamesAndTypes data is logged as SQL,
+// rows of data are returned in X-ClickHouse-Summary header like written rows of ClickHouse response
+func (u *Uploader) dryRunRequest(query string, data io.Reader) (http.Header, error) {
+	header := http.Header{}
+
+	m := insertQuery.FindStringSubmatch(query)
+	if m == nil || data == nil || m[2] != RowBinary.FormatRowBinaryWithNamesAndTypes {
+		u.logger.Info("dry run", zap.String("query", query))
+		return header, nil
+	}
+
+	values, rows, err := valuesQuery(m[1], bufio.NewReader(data), u.dryRunRows)
+	if err != nil {
+		return nil, fmt.Errorf("dry run of %s: %s", m[1], err)
+	}
+
+	if rows > 0 {
+		u.logger.Info("dry run",
+			zap.String("format", m[2]),
+			zap.Int64("rows", rows),
+			zap.String("query", values),
+		)
+	}
+	header.Set("X-ClickHouse-Summary", fmt.Sprintf(`{"written_rows":"%d"}`, rows))
+	return header, nil
+}
+
+// markDryRun remembers file uploaded in dry run. Called by upload with configLock held, so dry run
+// can't be disabled before mark
+func (u *Uploader) markDryRun(filename string) {
+	u.Lock()
+	u.dryRunFiles[filename] = false
+	u.Unlock()
+}
+
+// keepDryRunFile returns true if file is uploaded in dry run. Such file is not removed, it stays in inQueue
+// until dry run is disabled
+func (u *Uploader) keepDryRunFile(filename string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	if _, ok := u.dryRunFiles[filename]; !ok {
+		return false
+	}
+	u.dryRunFiles[filename] = true
+	return true
+}
+
+// releaseDryRunFiles removes files kept by dry run from inQueue, so watch passes them to upload again.
+// Files not yet handled by upload worker are released by next call
+func (u *Uploader) releaseDryRunFiles() {
+	u.Lock()
+	defer u.Unlock()
+
+	for filename, kept := range u.dryRunFiles {
+		if kept {
+			delete(u.inQueue, filename)
+			delete(u.dryRunFiles, filename)
+		}
+	}
+}
+
+// valuesQuery returns "INSERT INTO table VALUES" with first and last maxRows rows of data in total. Data is
+// RowBinaryWithNamesAndTypes. Count of rows is returned, query is invalid without rows
+func valuesQuery(table string, data *bufio.Reader, maxRows int) (string, int64, error) {
+	columns, err := binary.ReadUvarint(data)
+	if err != nil {
+		return "", 0, err
+	}
+	types := make([]string, 2*columns)
+	for i := range types {
+		if types[i], err = readString(data); err != nil {
+			return "", 0, err
+		}
+	}
+	// names are columns of table
+	types = types[columns:]
+
+	first := (maxRows + 1) / 2
+	var head []string
+	tail := make([]string, maxRows-first) // ring buffer
+	var rows int64
+
+	var row []byte
+	for {
+		if _, err = data.Peek(1); err == io.EOF {
+			break
+		}
+
+		row = append(row[:0], '(')
+		for i, t := range types {
+			if i > 0 {
+				row = append(row, ", "...)
+			}
+			if row, err = appendValue(row, data, t); err != nil {
+				return "", 0, fmt.Errorf("row %d: %s", rows+1, err)
+			}
+		}
+		row = append(row, ')')
+
+		if len(head) < first {
+			head = append(head, string(row))
+		} else if len(tail) > 0 {
+			tail[(rows-int64(first))%int64(len(tail))] = string(row)
+		}
+		rows++
+	}
+
+	values := head
+	if rest := rows - int64(len(head)); rest > 0 {
+		n := int64(len(tail))
+		if rest < n {
+			n = rest
+		}
+		for i := rest - n; i < rest; i++ {
+			values = append(values, tail[i%int64(len(tail))])
+		}
+	}
+
+	return fmt.Sprintf("INSERT INTO %s VALUES\n%s;", table, strings.Join(values, ",\n")), rows, nil
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// quoteString returns string literal of SQL
+func quoteString(b []byte, s string) []byte {
+	b = append(b, '\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case 0:
+			b = append(b, '\\', '0')
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '\'')
+}
+
+// appendValue reads value of type from RowBinary and appends it as literal of Values format
+func appendValue(b []byte, r *bufio.Reader, t string) ([]byte, error) {
+	if m := simpleAggregateFunction.FindStringSubmatch(t); m != nil {
+		t = m[1]
+	}
+
+	var fixed [8]byte
+	read := func(n int) ([]byte, error) {
+		_, err := io.ReadFull(r, fixed[:n])
+		return fixed[:n], err
+	}
+
+	switch t {
+	case "String":
+		s, err := readString(r)
+		if err != nil {
+			return b, err
+		}
+		return quoteString(b, s), nil
+	case "Float64":
+		v, err := read(8)
+		if err != nil {
+			return b, err
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(v))
+		switch {
+		case math.IsNaN(f):
+			return append(b, "nan"...), nil
+		case math.IsInf(f, 1):
+			return append(b, "inf"...), nil
+		case math.IsInf(f, -1):
+			return append(b, "-inf"...), nil
+		}
+		return strconv.AppendFloat(b, f, 'g', -1, 64), nil
+	case "UInt8":
+		v, err := read(1)
+		if err != nil {
+			return b, err
+		}
+		return strconv.AppendUint(b, uint64(v[0]), 10), nil
+	case "UInt16":
+		v, err := read(2)
+		if err != nil {
+			return b, err
+		}
+		return strconv.AppendUint(b, uint64(binary.LittleEndian.Uint16(v)), 10), nil
+	case "UInt32", RowBinary.DateTypeDateTime:
+		v, err := read(4)
+		if err != nil {
+			return b, err
+		}
+		return strconv.AppendUint(b, uint64(binary.LittleEndian.Uint32(v)), 10), nil
+	case RowBinary.DateTypeDate:
+		v, err := read(2)
+		if err != nil {
+			return b, err
+		}
+		return quoteString(b, time.Unix(int64(binary.LittleEndian.Uint16(v))*86400, 0).UTC().Format("2006-01-02")), nil
+	case RowBinary.DateTypeDate32:
+		v, err := read(4)
+		if err != nil {
+			return b, err
+		}
+		return quoteString(b, time.Unix(int64(int32(binary.LittleEndian.Uint32(v)))*86400, 0).UTC().Format("2006-01-02")), nil
+	case "Array(String)":
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return b, err
+		}
+		b = append(b, '[')
+		for i := uint64(0); i < n; i++ {
+			if i > 0 {
+				b = append(b, ", "...)
+			}
+			s, err := readString(r)
+			if err != nil {
+				return b, err
+			}
+			b = quoteString(b, s)
+		}
+		return append(b, ']'), nil
+	}
+	return b, fmt.Errorf("unsupported type %s", t)
+}
@@ -0,0 +1,347 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+// valuesParser parses query "INSERT INTO <table> (<columns>) VALUES <rows>;" by ClickHouse Values format:
+// rows are comma separated tuples of literals. Strings are quoted by ' with backslash escapes, numbers include
+// nan and inf, arrays are [] lists of literals
+type valuesParser struct {
+	s   string
+	pos int
+}
+
+var valuesHeader = regexp.MustCompile(`^INSERT INTO (\w+) \(([\w, ]+)\) VALUES\n`)
+
+func parseValuesQuery(query string) (string, []string, [][]interface{}, error) {
+	m := valuesHeader.FindStringSubmatch(query)
+	if m == nil {
+		return "", nil, nil, fmt.Errorf("bad header of %#v", query)
+	}
+	p := &valuesParser{s: query, pos: len(m[0])}
+
+	var rows [][]interface{}
+	for {
+		row, err := p.tuple()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		rows = append(rows, row)
+
+		p.space()
+		if p.next(';') {
+			break
+		}
+		if !p.next(',') {
+			return "", nil, nil, p.errorf("',' or ';' expected")
+		}
+	}
+	if p.pos != len(p.s) {
+		return "", nil, nil, p.errorf("end of query expected")
+	}
+	return m[1], strings.Split(m[2], ", "), rows, nil
+}
+
+func (p *valuesParser) errorf(format string) error {
+	return fmt.Errorf("%s at %d of %#v", format, p.pos, p.s)
+}
+
+func (p *valuesParser) space() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *valuesParser) next(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *valuesParser) list(open, close byte) ([]interface{}, error) {
+	p.space()
+	if !p.next(open) {
+		return nil, p.errorf(string(open) + " expected")
+	}
+	var values []interface{}
+	for {
+		p.space()
+		if p.next(close) {
+			return values, nil
+		}
+		if len(values) > 0 && !p.next(',') {
+			return nil, p.errorf("',' expected")
+		}
+		v, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+}
+
+func (p *valuesParser) tuple() ([]interface{}, error) {
+	return p.list('(', ')')
+}
+
+func (p *valuesParser) literal() (interface{}, error) {
+	p.space()
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("literal expected")
+	}
+
+	switch p.s[p.pos] {
+	case '[':
+		return p.list('[', ']')
+	case '\'':
+		var s []byte
+		for p.pos++; p.pos < len(p.s); p.pos++ {
+			c := p.s[p.pos]
+			if c == '\'' {
+				p.pos++
+				return string(s), nil
+			}
+			if c == '\\' {
+				if p.pos++; p.pos >= len(p.s) {
+					break
+				}
+				c = p.s[p.pos]
+				switch c {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				case 'r':
+					c = '\r'
+				case '0':
+					c = 0
+				}
+			}
+			s = append(s, c)
+		}
+		return nil, p.errorf("unterminated string")
+	}
+
+	end := p.pos
+	for end < len(p.s) && strings.IndexByte(",)] \n", p.s[end]) < 0 {
+		end++
+	}
+	literal := p.s[p.pos:end]
+	f, err := strconv.ParseFloat(literal, 64)
+	if err != nil {
+		return nil, p.errorf("number expected")
+	}
+	p.pos = end
+	return f, nil
+}
+
+func dryRunData(rows int) []byte {
+	wb := RowBinary.NewWriteBufferWithNames(
+		[]string{"Path", "Value", "Time", "Date", "Timestamp"},
+		[]string{"String", "Float64", "UInt32", "Date", "UInt32"},
+	)
+	now := uint32(1422642189)
+	days := (&days1970.Days{}).TimestampWithNow(now, now)
+	for i := 0; i < rows; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("it's.a\\path.%d", i)), float64(i), now, days, now+uint32(i))
+	}
+	return append([]byte(nil), wb.Bytes()...)
+}
+
+func TestValuesQuery(t *testing.T) {
+	for _, c := range []struct {
+		rows, maxRows int
+		expected      []int // Time of logged rows
+	}{
+		{3, 10, []int{0, 1, 2}},
+		{25, 10, []int{0, 1, 2, 3, 4, 20, 21, 22, 23, 24}},
+		{25, 3, []int{0, 1, 24}},
+		{25, 1, []int{0}},
+	} {
+		query, rows, err := valuesQuery("graphite (Path, Value, Time, Date, Timestamp)", bufio.NewReader(bytes.NewReader(dryRunData(c.rows))), c.maxRows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != int64(c.rows) {
+			t.Fatalf("rows: %d", rows)
+		}
+
+		table, columns, values, err := parseValuesQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table != "graphite" || len(columns) != 5 || len(values) != len(c.expected) {
+			t.Fatalf("%s %#v %#v", table, columns, values)
+		}
+		for i, row := range values {
+			n := c.expected[i]
+			expected := []interface{}{fmt.Sprintf("it's.a\\path.%d", n), float64(n), float64(1422642189), "2015-01-30", float64(1422642189 + n)}
+			if fmt.Sprintf("%#v", row) != fmt.Sprintf("%#v", expected) {
+				t.Fatalf("%#v != %#v", row, expected)
+			}
+		}
+	}
+
+	// special values of float and types of tree and tags tables
+	wb := RowBinary.NewWriteBufferWithNames(
+		[]string{"Value", "Level", "Deleted", "Tags", "Date"},
+		[]string{"SimpleAggregateFunction(sum, Float64)", "UInt32", "UInt8", "Array(String)", "Date32"},
+	)
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		wb.WriteFloat64(v)
+		wb.WriteUint32(2)
+		wb.WriteUint8(1)
+		wb.WriteUVarint(2)
+		wb.WriteBytes([]byte("a=1"))
+		wb.WriteBytes([]byte("b='2'"))
+		wb.WriteUint32(16465)
+	}
+	query, _, err := valuesQuery("tags (Value, Level, Deleted, Tags, Date)", bufio.NewReader(bytes.NewReader(wb.Bytes())), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "INSERT INTO tags (Value, Level, Deleted, Tags, Date) VALUES\n" +
+		"(nan, 2, 1, ['a=1', 'b=\\'2\\''], '2015-01-30'),\n" +
+		"(inf, 2, 1, ['a=1', 'b=\\'2\\''], '2015-01-30'),\n" +
+		"(-inf, 2, 1, ['a=1', 'b=\\'2\\''], '2015-01-30');"
+	if query != expected {
+		t.Fatalf("%s", query)
+	}
+	if _, _, _, err = parseValuesQuery(query); err != nil {
+		t.Fatal(err)
+	}
+
+	// truncated row
+	data := dryRunData(2)
+	if _, _, err = valuesQuery("graphite (Path, Value, Time, Date, Timestamp)", bufio.NewReader(bytes.NewReader(data[:len(data)-1])), 10); err == nil {
+		t.Fatal("truncated row is read")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		lock.Lock()
+		queries = append(queries, r.URL.Query().Get("query"))
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for i := 0; i < 100; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%03d", i)), float64(i), now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		TreeTable("graphite_tree"),
+		InsertFormat(RowBinary.FormatRowBinary),
+		UploadChunkSize(1000),
+		DryRun(4),
+	)
+	u.logger = zap.NewNop()
+
+	// file is uploaded by chunks
+	u.inQueue[filename] = true
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.ExecDDLScript("CREATE TABLE t (x String) ENGINE = Memory"); err != nil {
+		t.Fatal(err)
+	}
+
+	// only read-only queries are executed
+	lock.Lock()
+	for _, q := range queries {
+		if !readOnlyQuery.MatchString(q) {
+			t.Fatalf("%#v is executed", q)
+		}
+	}
+	queries = nil
+	lock.Unlock()
+
+	// file, checkpoint and caches are kept as before upload
+	if !u.keepDryRunFile(filename) {
+		t.Fatal("file of dry run isn't kept")
+	}
+	if _, err = os.Stat(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(checkpointFilename(filename)); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint: %v", err)
+	}
+	if n := u.treeExists.Count(); n != 0 {
+		t.Fatalf("tree cache: %d", n)
+	}
+
+	// kept file isn't uploaded again in dry run
+	u.watch(nil)
+	if len(u.queue) != 0 {
+		t.Fatalf("queue: %d", len(u.queue))
+	}
+
+	// file is uploaded after dry run is disabled
+	u.Reconfigure(DryRun(0), InsertFormat(RowBinary.FormatRowBinary))
+	u.watch(nil)
+	if len(u.queue) != 1 || <-u.queue != filename {
+		t.Fatal("file isn't queued after dry run")
+	}
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if u.keepDryRunFile(filename) {
+		t.Fatal("file is kept after dry run")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	inserts := 0
+	for _, q := range queries {
+		if strings.HasPrefix(q, "INSERT INTO graphite ") {
+			inserts++
+		}
+	}
+	// 100 records of 32 bytes by chunks of 1000 bytes
+	if inserts != 4 {
+		t.Fatalf("%#v", queries)
+	}
+}
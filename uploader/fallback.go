@@ -0,0 +1,54 @@
+package uploader
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// schemaMismatch matches ClickHouse errors of changed table schema: THERE_IS_NO_COLUMN, NOT_FOUND_COLUMN_IN_BLOCK,
+// NO_SUCH_COLUMN_IN_TABLE, UNKNOWN_IDENTIFIER and TYPE_MISMATCH
+var schemaMismatch = regexp.MustCompile(`Code: (8|10|16|47|53)[.,]`)
+
+// isSchemaMismatch returns true if INSERT is rejected by ClickHouse because of table schema. Status of response
+// depends on exception code and ClickHouse version (400, 404 or 500), so only code is checked
+func isSchemaMismatch(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.HasPrefix(msg, "clickhouse response status ") && schemaMismatch.MatchString(msg)
+}
+
+// uploadWithFallback uploads file to table by upload. If INSERT fails with schema mismatch then file is uploaded
+// to FallbackTable of table options instead. Chunks uploaded to table before failure are not uploaded to fallback table
+func (u *Uploader) uploadWithFallback(logger *zap.Logger, filename string, tablename string, upload func(filename string, tablename string) error) error {
+	err := upload(filename, tablename)
+
+	fallback := u.dataTableOptions(tablename).FallbackTable
+	if fallback == "" || !isSchemaMismatch(err) {
+		return err
+	}
+
+	atomic.AddUint32(&u.stat.schemaMismatchFallback, 1)
+	logger.Warn("schema mismatch, file is uploaded to fallback table",
+		zap.String("table", tablename),
+		zap.String("fallback_table", fallback),
+		zap.Error(err),
+	)
+
+	// fallback table continues chunked upload from failed chunk
+	reverse := u.isReverseDataTable(tablename)
+	key, fallbackKey := checkpointKey(reverse, tablename), checkpointKey(reverse, fallback)
+	offsets := readCheckpoint(filename)
+	if offsets[key] > offsets[fallbackKey] {
+		offsets[fallbackKey] = offsets[key]
+		if err = u.writeCheckpoint(filename, offsets); err != nil {
+			return err
+		}
+	}
+
+	return upload(filename, fallback)
+}
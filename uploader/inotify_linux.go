@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+)
+
+// max time of waiting for writer marks closed file as ready for upload
+const inotifyInProgressWait = 100 * time.Millisecond
+
+// inotify receives close and move events of files in dir
+type inotify struct {
+	fd   int
+	epfd int
+}
+
+func newInotify(dir string) (*inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)})
+	if err != nil {
+		syscall.Close(epfd)
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return &inotify{fd: fd, epfd: epfd}, nil
+}
+
+func (w *inotify) close() {
+	syscall.Close(w.epfd)
+	syscall.Close(w.fd)
+}
+
+// read waits for events up to timeout and returns names of changed files
+func (w *inotify) read(buf []byte, timeout time.Duration) ([]string, error) {
+	events := make([]syscall.EpollEvent, 1)
+	n, err := syscall.EpollWait(w.epfd, events, int(timeout/time.Millisecond))
+	if err == syscall.EINTR || n == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	n, err = syscall.Read(w.fd, buf)
+	if err == syscall.EAGAIN {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+		e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		offset = nameStart + int(e.Len)
+		if e.Len > 0 && offset <= n {
+			names = append(names, strings.TrimRight(string(buf[nameStart:offset]), "\x00"))
+		}
+	}
+
+	return names, nil
+}
+
+// inotifyWorker requests scan of path after close of each file, so new files are uploaded without waiting for scan interval
+func (u *Uploader) inotifyWorker(exit chan struct{}, w *inotify, dir string) {
+	defer w.close()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		select {
+		case <-exit:
+			return
+		default:
+		}
+
+		names, err := w.read(buf, 100*time.Millisecond)
+		if err != nil {
+			u.logger.Error("inotify read failed", zap.Error(err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		flush := false
+		for _, name := range names {
+			if !strings.HasPrefix(name, "default.") {
+				continue
+			}
+			atomic.AddUint32(&u.stat.inotifyEvents, 1)
+
+			// writer marks file as ready right after close
+			fn := path.Join(dir, name)
+			for deadline := time.Now().Add(inotifyInProgressWait); u.inProgressCallback(fn) && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			flush = true
+		}
+
+		if flush {
+			u.ForceFlush()
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package uploader
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestInotify(t *testing.T) {
+	requests := make(chan struct{}, 16)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		requests <- struct{}{}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(Path(dir), ClickHouse(srv.URL), HTTPClient(srv.Client()), DataTables([]string{"graphite"}),
+		ScanInterval(time.Hour),
+		UseInotify(true),
+	)
+	u.Start()
+	defer u.Stop()
+
+	// files of other types are ignored
+	if err = ioutil.WriteFile(path.Join(dir, "tmp.1"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestDataFile(t, path.Join(dir, "default.1"))
+
+	// scan interval is hour, so file can be uploaded in time only after inotify event
+	select {
+	case <-requests:
+		// pass
+	case <-time.After(10 * time.Second):
+		t.Fatal("file is not uploaded by inotify event")
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["inotifyEvents"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+}
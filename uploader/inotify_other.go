@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package uploader
+
+import (
+	"errors"
+)
+
+type inotify struct{}
+
+func newInotify(dir string) (*inotify, error) {
+	return nil, errors.New("inotify is supported only on linux")
+}
+
+func (u *Uploader) inotifyWorker(exit chan struct{}, w *inotify, dir string) {}
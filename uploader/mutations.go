@@ -0,0 +1,135 @@
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MutationCheck enables periodic check of unfinished mutations of data tables. Warning is logged if count of
+// pending mutations exceeds warnThreshold. 0 interval disables check. Applied on start
+func MutationCheck(interval time.Duration, warnThreshold int) Option {
+	return func(u *Uploader) {
+		u.mutationCheckInterval = interval
+		u.mutationWarnThreshold = warnThreshold
+	}
+}
+
+// mutationsWorker checks pending mutations of data tables
+func (u *Uploader) mutationsWorker(exit chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-t.C:
+			u.checkMutations()
+		}
+	}
+}
+
+// checkMutations counts mutations with is_done=0 of data and reverse data tables, grouped by ClickHouse url.
+// Tables are copied under configLock, queries don't delay Reconfigure. Returns true if warning is logged
+func (u *Uploader) checkMutations() bool {
+	u.configLock.RLock()
+	tablesByURL := make(map[string][]string)
+	var urls []string
+	seen := make(map[string]bool)
+	for _, table := range append(append([]string(nil), u.dataTables...), u.reverseDataTables...) {
+		if seen[table] {
+			continue
+		}
+		seen[table] = true
+
+		dsn := u.tableURL(table)
+		if _, exists := tablesByURL[dsn]; !exists {
+			urls = append(urls, dsn)
+		}
+		tablesByURL[dsn] = append(tablesByURL[dsn], table)
+	}
+	timeout := u.dataTimeout
+	threshold := u.mutationWarnThreshold
+	u.configLock.RUnlock()
+
+	var total int
+	var pending []string // table=count
+	for _, dsn := range urls {
+		counts, err := u.queryMutations(dsn, tablesByURL[dsn], timeout)
+		if err != nil {
+			u.logger.Warn("mutations check failed", zap.Error(err))
+			continue
+		}
+		for _, table := range tablesByURL[dsn] {
+			if n := counts[table]; n > 0 {
+				total += n
+				pending = append(pending, fmt.Sprintf("%s=%d", table, n))
+			}
+		}
+	}
+
+	atomic.StoreUint32(&u.stat.pendingMutations, uint32(total))
+
+	if total <= threshold {
+		return false
+	}
+
+	u.logger.Warn("too many pending mutations of data tables, inserts may be slow",
+		zap.Int("pending", total),
+		zap.Int("threshold", threshold),
+		zap.Strings("tables", pending),
+	)
+	return true
+}
+
+// queryMutations returns count of unfinished mutations by table. Database prefix of table name is ignored
+func (u *Uploader) queryMutations(dsn string, tables []string, timeout time.Duration) (map[string]int, error) {
+	names := make(map[string]string) // table without database => configured name
+	quoted := make([]string, 0, len(tables))
+	for _, table := range tables {
+		name := table[strings.LastIndex(table, ".")+1:]
+		names[name] = table
+		quoted = append(quoted, "'"+strings.Replace(name, "'", "\\'", -1)+"'")
+	}
+
+	body, err := u.post(
+		dsn,
+		fmt.Sprintf("SELECT table, count() FROM system.mutations WHERE is_done=0 AND table IN (%s) GROUP BY table FORMAT TabSeparated",
+			strings.Join(quoted, ", ")),
+		nil,
+		timeout,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		row := bytes.Split(line, []byte{'\t'})
+		if len(row) != 2 {
+			return nil, fmt.Errorf("unexpected row %#v", string(line))
+		}
+
+		n, err := strconv.Atoi(string(row[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		if table, exists := names[string(row[0])]; exists {
+			counts[table] += n
+		}
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,128 @@
+package uploader
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCheckMutations(t *testing.T) {
+	var queries uint32
+	var mutations atomic.Value
+	mutations.Store("graphite\t4\ngraphite_reverse\t3\n")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		query := r.URL.Query().Get("query")
+		if !strings.HasPrefix(query, "SELECT table, count() FROM system.mutations WHERE is_done=0") {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(query, "table IN ('graphite', 'graphite_reverse')") {
+			http.Error(w, "unexpected tables: "+query, http.StatusBadRequest)
+			return
+		}
+		atomic.AddUint32(&queries, 1)
+		w.Write([]byte(mutations.Load().(string)))
+	}))
+	defer srv.Close()
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite", "default.graphite_reverse"}),
+		ReverseDataTables([]string{"graphite"}),
+		MutationCheck(10*time.Millisecond, 5),
+	)
+	u.logger = zap.NewNop()
+
+	pending := func() float64 {
+		stat := make(map[string]float64)
+		u.Stat(func(metric string, value float64) {
+			stat[metric] = value
+		})
+		return stat["pendingMutations"]
+	}
+
+	// 7 pending mutations exceed threshold
+	if !u.checkMutations() {
+		t.Fatal("warning is not logged")
+	}
+	if p := pending(); p != 7 {
+		t.Fatalf("pendingMutations: %v", p)
+	}
+
+	mutations.Store("graphite\t5\n")
+	if u.checkMutations() {
+		t.Fatal("warning is logged for mutations within threshold")
+	}
+	if p := pending(); p != 5 {
+		t.Fatalf("pendingMutations: %v", p)
+	}
+
+	// worker checks periodically
+	if err := u.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer u.Stop()
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&queries) < 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queries: %d", atomic.LoadUint32(&queries))
+		}
+	}
+}
+
+func TestCheckMutationsReconfigure(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		w.Write([]byte("graphite\t4\n"))
+	}))
+	defer srv.Close()
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		MutationCheck(time.Hour, 5),
+	)
+	u.logger = zap.NewNop()
+
+	checked := make(chan bool)
+	go func() {
+		checked <- u.checkMutations()
+	}()
+	<-started
+
+	// Reconfigure isn't blocked by query in progress, threshold of started check isn't changed
+	reconfigured := make(chan struct{})
+	go func() {
+		u.Reconfigure(MutationCheck(time.Hour, 1))
+		close(reconfigured)
+	}()
+	select {
+	case <-reconfigured:
+	case <-time.After(time.Second):
+		t.Fatal("Reconfigure is blocked by mutations check")
+	}
+
+	close(release)
+	if <-checked {
+		t.Fatal("warning is logged for mutations within threshold")
+	}
+}
@@ -0,0 +1,134 @@
+package uploader
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// MaxUploadPipelineDepth is limit of UploadPipelineDepth
+const MaxUploadPipelineDepth = 10
+
+// UploadPipelineDepth sets count of concurrent INSERTs of chunks of one data file. Next chunk is sent before
+// response of previous one, each INSERT in flight uses own connection. Chunks in flight are kept in memory.
+// 1 uploads chunks one by one
+func UploadPipelineDepth(depth int) Option {
+	return func(u *Uploader) {
+		u.pipelineDepth = depth
+	}
+}
+
+type pipelineInsert struct {
+	done     chan struct{}
+	written  int64
+	err      error
+	complete func(written int64) error
+}
+
+// insertPipeline is ring buffer of INSERTs in flight. Results are handled in order of sending, so checkpoint
+// is moved only by uploaded chunks without gaps
+type insertPipeline struct {
+	ring []*pipelineInsert
+	head int
+	n    int
+	err  error // first error, completion of later inserts is skipped
+}
+
+func newInsertPipeline(depth int) *insertPipeline {
+	return &insertPipeline{ring: make([]*pipelineInsert, depth)}
+}
+
+// add sends insert, complete is called with written rows after success of insert and all previous ones.
+// Waits for oldest insert if pipeline is full and returns its error
+func (p *insertPipeline) add(insert func() (int64, error), complete func(written int64) error) error {
+	if p.n == len(p.ring) {
+		if err := p.wait(); err != nil {
+			return err
+		}
+	}
+
+	in := &pipelineInsert{done: make(chan struct{}), complete: complete}
+	go func() {
+		in.written, in.err = insert()
+		close(in.done)
+	}()
+
+	p.ring[(p.head+p.n)%len(p.ring)] = in
+	p.n++
+	return nil
+}
+
+// wait handles oldest insert
+func (p *insertPipeline) wait() error {
+	in := p.ring[p.head]
+	p.ring[p.head] = nil
+	p.head = (p.head + 1) % len(p.ring)
+	p.n--
+
+	<-in.done
+	if p.err != nil {
+		return p.err
+	}
+	if p.err = in.err; p.err == nil {
+		p.err = in.complete(in.written)
+	}
+	return p.err
+}
+
+// flush waits for all inserts in flight. Returns first error
+func (p *insertPipeline) flush() error {
+	for p.n > 0 {
+		p.wait()
+	}
+	return p.err
+}
+
+// uploadPipeline is loop of uploadChunks with UploadPipelineDepth inserts in flight. Records of chunk are read
+// to memory, so reader is free for next chunk while previous ones are sent. Chunks sent after failed one
+// are uploaded again on resume
+func (u *Uploader) uploadPipeline(logger *zap.Logger, reader *RowBinary.Reader, filename string, tablename string, size int64,
+	offsets map[string]int64, key string, insert func(data io.Reader) (int64, error)) error {
+
+	p := newInsertPipeline(u.pipelineDepth)
+
+	var err error
+	for err == nil && !reader.EOF() && reader.Offset() < size {
+		start, records := reader.Offset(), reader.Records()
+		u.limitChunk(reader, start, records)
+
+		var body []byte
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			break
+		}
+		end, rows := reader.Offset(), reader.Records()-records
+		if end == start {
+			// bad record at start of chunk
+			break
+		}
+
+		err = p.add(
+			func() (int64, error) {
+				return insert(bytes.NewReader(body))
+			},
+			func(written int64) error {
+				u.countSkippedRows(logger, tablename, rows, written)
+				offsets[key] = end
+				return u.writeCheckpoint(filename, offsets)
+			},
+		)
+	}
+
+	if flushErr := p.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return err
+	}
+
+	offsets[key] = size
+	return u.writeCheckpoint(filename, offsets)
+}
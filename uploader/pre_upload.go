@@ -0,0 +1,16 @@
+package uploader
+
+import (
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// preUploadSymbol is transform exported by pre-upload plugin
+const preUploadSymbol = "TransformRows"
+
+// PreUploadTransform sets transform of data and reverse data table rows before INSERT. Counts of rows
+// skipped by ClickHouse are not checked with transform. nil disables transform
+func PreUploadTransform(f RowBinary.TransformFunc) Option {
+	return func(u *Uploader) {
+		u.preUpload = f
+	}
+}
@@ -0,0 +1,33 @@
+//go:build go1.8 && (linux || darwin || freebsd) && cgo
+// +build go1.8
+// +build linux darwin freebsd
+// +build cgo
+
+package uploader
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// LoadPreUploadPlugin opens Go plugin with TransformRows function for PreUploadTransform. Plugin can't be
+// unloaded, same filename returns already loaded plugin
+func LoadPreUploadPlugin(filename string) (RowBinary.TransformFunc, error) {
+	p, err := plugin.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sym, err := p.Lookup(preUploadSymbol)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := sym.(func([]RowBinary.Row) []RowBinary.Row)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s is %T, func([]RowBinary.Row) []RowBinary.Row expected", filename, preUploadSymbol, sym)
+	}
+	return f, nil
+}
@@ -0,0 +1,14 @@
+//go:build !go1.8 || !(linux || darwin || freebsd) || !cgo
+// +build !go1.8 !linux,!darwin,!freebsd !cgo
+
+package uploader
+
+import (
+	"errors"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+func LoadPreUploadPlugin(filename string) (RowBinary.TransformFunc, error) {
+	return nil, errors.New("plugins are supported only on linux, darwin and freebsd with cgo")
+}
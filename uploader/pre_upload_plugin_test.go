@@ -0,0 +1,81 @@
+//go:build go1.8 && (linux || darwin || freebsd) && cgo
+// +build go1.8
+// +build linux darwin freebsd
+// +build cgo
+
+package uploader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestPreUploadPlugin(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is required for build of plugin")
+	}
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// plugin must be built with same flags as test binary
+	so := path.Join(dir, "double_values.so")
+	args := []string{"build", "-buildmode=plugin", "-o", so}
+	if raceEnabled {
+		args = append(args, "-race")
+	}
+	if out, err := exec.Command("go", append(args, "./testdata/double_values")...).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+
+	transform, err := LoadPreUploadPlugin(so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadPreUploadPlugin(path.Join(dir, "missing.so")); err == nil {
+		t.Fatal("missing plugin is loaded")
+	}
+
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		PreUploadTransform(transform),
+	)
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// value of hello.world is after name
+	n := 1 + len("hello.world")
+	if len(body) != len(file) || !bytes.Equal(body[:n], file[:n]) || !bytes.Equal(body[n+8:], file[n+8:]) {
+		t.Fatalf("%#v != %#v", body, file)
+	}
+	if v := math.Float64frombits(binary.LittleEndian.Uint64(body[n:])); v != 84 {
+		t.Fatal(v)
+	}
+}
@@ -0,0 +1,116 @@
+package uploader
+
+import (
+	"io"
+	"sync"
+)
+
+// readAheadBufferSize is size of each read ahead buffer
+const readAheadBufferSize = 512 * 1024
+
+var readAheadPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, readAheadBufferSize)
+	},
+}
+
+// ReadAheadBuffers sets count of data file buffers read by separate goroutine while previous buffers are sent
+// to ClickHouse. Disk reads of data table upload are overlapped with network writes. 0 - disabled
+func ReadAheadBuffers(buffers int) Option {
+	return func(u *Uploader) {
+		u.readAheadBuffers = buffers
+	}
+}
+
+type readAheadChunk struct {
+	b   []byte
+	err error
+}
+
+// readAheadReader reads source by separate goroutine up to buffers chunks ahead of Read
+type readAheadReader struct {
+	chunks    chan readAheadChunk
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	buf       []byte // current chunk, returned to pool on next chunk
+	unread    []byte
+	err       error
+}
+
+func newReadAheadReader(source io.Reader, buffers int) *readAheadReader {
+	r := &readAheadReader{
+		chunks: make(chan readAheadChunk, buffers),
+		done:   make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(r.chunks)
+
+		for {
+			b := readAheadPool.Get().([]byte)
+			n, err := io.ReadFull(source, b)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+
+			select {
+			case r.chunks <- readAheadChunk{b: b[:n], err: err}:
+			case <-r.done:
+				readAheadPool.Put(b)
+				return
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	for len(r.unread) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.buf != nil {
+			readAheadPool.Put(r.buf[:cap(r.buf)])
+			r.buf = nil
+		}
+
+		c, ok := <-r.chunks
+		if !ok {
+			r.err = io.ErrClosedPipe
+			continue
+		}
+		r.buf, r.unread, r.err = c.b, c.b, c.err
+	}
+
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+	return n, nil
+}
+
+// Close stops read goroutine and waits for end of its current read. Source can be closed after it
+func (r *readAheadReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+	})
+	r.wg.Wait()
+	return nil
+}
+
+// readAhead returns reader of data with read ahead goroutine and its close function. data is returned as is
+// if read ahead is disabled
+func (u *Uploader) readAhead(data io.Reader) (io.Reader, func()) {
+	if u.readAheadBuffers <= 0 {
+		return data, func() {}
+	}
+	r := newReadAheadReader(data, u.readAheadBuffers)
+	return r, func() { r.Close() }
+}
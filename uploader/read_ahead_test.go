@@ -0,0 +1,103 @@
+package uploader
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// slowReader returns at most size bytes per Read after delay
+type slowReader struct {
+	r     io.Reader
+	size  int
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	if len(p) > s.size {
+		p = p[:s.size]
+	}
+	return s.r.Read(p)
+}
+
+func TestReadAheadReader(t *testing.T) {
+	data := make([]byte, 3*readAheadBufferSize+12345)
+	rand.Read(data)
+
+	r := newReadAheadReader(&slowReader{r: bytes.NewReader(data), size: 100000}, 2)
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("err: %#v, read %d of %d bytes", err, len(b), len(data))
+	}
+
+	// error after data
+	failed := errors.New("disk failed")
+	r = newReadAheadReader(io.MultiReader(bytes.NewReader(data[:1000]), &errorReader{failed}), 2)
+	b, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != failed || !bytes.Equal(b, data[:1000]) {
+		t.Fatalf("err: %#v, read %d bytes", err, len(b))
+	}
+
+	// close before end of source stops read goroutine
+	r = newReadAheadReader(bytes.NewReader(data), 1)
+	if _, err = r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		r.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("read goroutine is not stopped")
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+// benchmarkReadAhead reads file from disk with latency and sends it to network with latency of same size
+func benchmarkReadAhead(b *testing.B, buffers int) {
+	data := make([]byte, 8*readAheadBufferSize)
+	buf := make([]byte, 64*1024)
+	b.SetBytes(int64(len(data)))
+
+	for i := 0; i < b.N; i++ {
+		var r io.Reader = &slowReader{r: bytes.NewReader(data), size: 256 * 1024, delay: time.Millisecond}
+		u := &Uploader{readAheadBuffers: buffers}
+		r, stop := u.readAhead(r)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				// network write of 256KB takes about 1ms
+				time.Sleep(time.Duration(n) * time.Millisecond / (256 * 1024))
+			}
+			if err != nil {
+				break
+			}
+		}
+		stop()
+	}
+}
+
+func BenchmarkReadAheadDisabled(b *testing.B) {
+	benchmarkReadAhead(b, 0)
+}
+
+func BenchmarkReadAhead(b *testing.B) {
+	benchmarkReadAhead(b, 2)
+}
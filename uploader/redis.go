@@ -0,0 +1,299 @@
+package uploader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisCache shares tree exists cache between several carbon-clickhouse instances.
+// Minimal RESP client: pipelined SET NX and DEL with MOVED redirects for Redis Cluster
+type redisCache struct {
+	sync.Mutex
+	addrs   []string // seed nodes
+	ttl     time.Duration
+	timeout time.Duration
+	conns   map[string]*redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// redis reply. err is set for error replies, nil is set for null bulk string
+type redisReply struct {
+	value string
+	nil   bool
+	err   string
+}
+
+const redisPipelineSize = 1000
+
+// first delay before retry of connection to seed nodes, doubled after each retry
+const redisRetryDelay = 100 * time.Millisecond
+
+var errRedisTimeout = errors.New("redis: timeout")
+
+// isRedisTimeout returns true if request failed by deadline
+func isRedisTimeout(err error) bool {
+	if err == errRedisTimeout {
+		return true
+	}
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+func newRedisCache(addrs []string, ttl time.Duration) *redisCache {
+	return &redisCache{
+		addrs:   addrs,
+		ttl:     ttl,
+		timeout: 5 * time.Second,
+		conns:   make(map[string]*redisConn),
+	}
+}
+
+func (rc *redisCache) conn(addr string, deadline time.Time) (*redisConn, error) {
+	if c, exists := rc.conns[addr]; exists {
+		return c, nil
+	}
+
+	timeout := deadline.Sub(time.Now())
+	if timeout <= 0 {
+		return nil, errRedisTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	rc.conns[addr] = c
+	return c, nil
+}
+
+// seed returns connection to any available seed node. Connection is retried up to retries times
+// with doubling delay until deadline. Commands are not sent yet, so retry can't claim keys twice
+func (rc *redisCache) seed(deadline time.Time, retries int) (string, *redisConn, error) {
+	var err error
+	var c *redisConn
+
+	delay := redisRetryDelay
+	for attempt := 0; ; attempt++ {
+		for _, addr := range rc.addrs {
+			c, err = rc.conn(addr, deadline)
+			if err == nil {
+				return addr, c, nil
+			}
+		}
+
+		if err == nil {
+			return "", nil, errors.New("redis address is not configured")
+		}
+		if attempt >= retries || isRedisTimeout(err) {
+			return "", nil, err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return "", nil, errRedisTimeout
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (rc *redisCache) closeConn(addr string) {
+	if c, exists := rc.conns[addr]; exists {
+		c.conn.Close()
+		delete(rc.conns, addr)
+	}
+}
+
+func (c *redisConn) writeCommand(args ...string) {
+	fmt.Fprintf(c.writer, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(a), a)
+	}
+}
+
+func (c *redisConn) readReply() (redisReply, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return redisReply{}, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return redisReply{}, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return redisReply{value: line[1:]}, nil
+	case '-':
+		return redisReply{err: line[1:]}, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return redisReply{}, err
+		}
+		if n < 0 {
+			return redisReply{nil: true}, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(c.reader, b); err != nil {
+			return redisReply{}, err
+		}
+		return redisReply{value: string(b[:n])}, nil
+	}
+
+	return redisReply{}, fmt.Errorf("redis: unsupported reply %#v", line)
+}
+
+// do sends pipelined commands to node and reads replies
+func (rc *redisCache) do(addr string, c *redisConn, commands [][]string, deadline time.Time) ([]redisReply, error) {
+	c.conn.SetDeadline(deadline)
+	defer c.conn.SetDeadline(time.Time{})
+
+	for _, cmd := range commands {
+		c.writeCommand(cmd...)
+	}
+	if err := c.writer.Flush(); err != nil {
+		rc.closeConn(addr)
+		return nil, err
+	}
+
+	replies := make([]redisReply, len(commands))
+	for i := 0; i < len(commands); i++ {
+		r, err := c.readReply()
+		if err != nil {
+			rc.closeConn(addr)
+			return nil, err
+		}
+		replies[i] = r
+	}
+
+	return replies, nil
+}
+
+// exec executes commands with following of cluster redirects until deadline
+func (rc *redisCache) exec(commands [][]string, deadline time.Time, retries int) ([]redisReply, error) {
+	addr, c, err := rc.seed(deadline, retries)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := rc.do(addr, c, commands, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range replies {
+		// -MOVED 3999 127.0.0.1:6381
+		if !strings.HasPrefix(r.err, "MOVED ") && !strings.HasPrefix(r.err, "ASK ") {
+			continue
+		}
+
+		f := strings.Fields(r.err)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("redis: bad redirect %#v", r.err)
+		}
+
+		nodeConn, err := rc.conn(f[2], deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd := [][]string{commands[i]}
+		if f[0] == "ASK" {
+			cmd = [][]string{{"ASKING"}, commands[i]}
+		}
+
+		moved, err := rc.do(f[2], nodeConn, cmd, deadline)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = moved[len(moved)-1]
+	}
+
+	for _, r := range replies {
+		if r.err != "" {
+			return nil, fmt.Errorf("redis: %s", r.err)
+		}
+	}
+
+	return replies, nil
+}
+
+// Claim atomically marks keys as uploaded by this instance. Returns false for keys already claimed by other instance.
+// Claim of all keys is limited by timeout, failed connection is retried up to retries times
+func (rc *redisCache) Claim(keys []string, timeout time.Duration, retries int) ([]bool, error) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	result := make([]bool, 0, len(keys))
+	ttl := strconv.FormatInt(int64(rc.ttl/time.Millisecond), 10)
+
+	for offset := 0; offset < len(keys); offset += redisPipelineSize {
+		end := offset + redisPipelineSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		commands := make([][]string, 0, end-offset)
+		for _, k := range keys[offset:end] {
+			if rc.ttl > 0 {
+				commands = append(commands, []string{"SET", k, "1", "NX", "PX", ttl})
+			} else {
+				commands = append(commands, []string{"SET", k, "1", "NX"})
+			}
+		}
+
+		replies, err := rc.exec(commands, deadline, retries)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range replies {
+			result = append(result, !r.nil)
+		}
+	}
+
+	return result, nil
+}
+
+// Release removes claims. Used if tree upload failed
+func (rc *redisCache) Release(keys []string) error {
+	rc.Lock()
+	defer rc.Unlock()
+
+	for offset := 0; offset < len(keys); offset += redisPipelineSize {
+		end := offset + redisPipelineSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		// DEL by one key. Keys can be in different cluster slots
+		commands := make([][]string, 0, end-offset)
+		for _, k := range keys[offset:end] {
+			commands = append(commands, []string{"DEL", k})
+		}
+
+		if _, err := rc.exec(commands, time.Now().Add(rc.timeout), 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package uploader
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRedis is tiny in-memory redis node with SET NX and DEL support.
+// Keys not owned by node are redirected with MOVED like Redis Cluster does
+type testRedis struct {
+	sync.Mutex
+	listener net.Listener
+	keys     map[string]bool
+	owns     func(key string) bool
+	moved    string
+	delay    time.Duration // of each reply
+	done     chan struct{}
+}
+
+func newTestRedis(t *testing.T) *testRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &testRedis{
+		listener: l,
+		keys:     make(map[string]bool),
+		owns:     func(string) bool { return true },
+		done:     make(chan struct{}),
+	}
+	go r.serve()
+	return r
+}
+
+func (r *testRedis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *testRedis) Close() {
+	r.listener.Close()
+	close(r.done)
+}
+
+func (r *testRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *testRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+		args := make([]string, n)
+		for i := 0; i < n; i++ {
+			line, err = reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, size+2)
+			if _, err = io.ReadFull(reader, b); err != nil {
+				return
+			}
+			args[i] = string(b[:size])
+		}
+
+		r.Lock()
+		delay := r.delay
+		r.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-r.done:
+			return
+		}
+
+		io.WriteString(conn, r.exec(args))
+	}
+}
+
+func (r *testRedis) exec(args []string) string {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(args) > 1 && !r.owns(args[1]) {
+		return "-MOVED 1 " + r.moved + "\r\n"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		if r.keys[args[1]] {
+			return "$-1\r\n"
+		}
+		r.keys[args[1]] = true
+		return "+OK\r\n"
+	case "DEL":
+		if r.keys[args[1]] {
+			delete(r.keys, args[1])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisCacheClaim(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+
+	rc := newRedisCache([]string{r.Addr()}, 0)
+
+	claimed, err := rc.Claim([]string{"a", "b"}, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed[0] || !claimed[1] {
+		t.Fatalf("%#v", claimed)
+	}
+
+	claimed, err = rc.Claim([]string{"b", "c"}, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed[0] || !claimed[1] {
+		t.Fatalf("%#v", claimed)
+	}
+
+	if err = rc.Release([]string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err = rc.Claim([]string{"b"}, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed[0] {
+		t.Fatalf("%#v", claimed)
+	}
+}
+
+func TestRedisCacheClusterRedirect(t *testing.T) {
+	r1 := newTestRedis(t)
+	defer r1.Close()
+	r2 := newTestRedis(t)
+	defer r2.Close()
+
+	// keys with "b" prefix are stored on second node
+	r1.owns = func(key string) bool { return !strings.HasPrefix(key, "b") }
+	r1.moved = r2.Addr()
+
+	rc := newRedisCache([]string{r1.Addr()}, 0)
+
+	claimed, err := rc.Claim([]string{"a", "b", "b"}, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed[0] || !claimed[1] || claimed[2] {
+		t.Fatalf("%#v", claimed)
+	}
+
+	if !r1.keys["a"] || r1.keys["b"] || !r2.keys["b"] {
+		t.Fatalf("%#v, %#v", r1.keys, r2.keys)
+	}
+}
+
+func TestSharedTreeCache(t *testing.T) {
+	var treeRequests, treeRows uint32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(r.URL.Query().Get("query"), "graphite_tree") {
+			atomic.AddUint32(&treeRequests, 1)
+			atomic.AddUint32(&treeRows, uint32(strings.Count(string(body), "hello.")))
+		}
+	}))
+	defer srv.Close()
+
+	r := newTestRedis(t)
+	defer r.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	// two instances receive same metric
+	for i := 0; i < 2; i++ {
+		u := New(
+			ClickHouse(srv.URL),
+			HTTPClient(srv.Client()),
+			TreeTable("graphite_tree"),
+			TreeCacheRedis([]string{r.Addr()}, 0),
+		)
+
+		if err = u.upload(nil, filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// hello.world and hello.
+	if treeRequests != 1 || treeRows != 2 {
+		t.Fatalf("tree requests: %d, rows: %d", treeRequests, treeRows)
+	}
+}
+
+func TestSharedTreeCacheUnavailable(t *testing.T) {
+	var treeRequests uint32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if strings.Contains(r.URL.Query().Get("query"), "graphite_tree") {
+			atomic.AddUint32(&treeRequests, 1)
+		}
+	}))
+	defer srv.Close()
+
+	// closed port
+	r := newTestRedis(t)
+	r.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		TreeTable("graphite_tree"),
+		TreeCacheRedis([]string{r.Addr()}, 0),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if treeRequests != 1 {
+		t.Fatalf("tree requests: %d", treeRequests)
+	}
+}
+
+func TestSharedTreeCacheTimeout(t *testing.T) {
+	var treeRequests uint32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if strings.Contains(r.URL.Query().Get("query"), "graphite_tree") {
+			atomic.AddUint32(&treeRequests, 1)
+		}
+	}))
+	defer srv.Close()
+
+	// redis is slower than check timeout
+	r := newTestRedis(t)
+	r.delay = 10 * time.Second
+	defer r.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		TreeTable("graphite_tree"),
+		TreeCacheRedis([]string{r.Addr()}, 0),
+		TreeCheckTimeout(200*time.Millisecond, 3),
+	)
+
+	start := time.Now()
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// names are assumed new, timed out check is not retried
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("upload is blocked for %s", d)
+	}
+	if treeRequests != 1 {
+		t.Fatalf("tree requests: %d", treeRequests)
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["treeCheckTimeoutsTotal"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+}
+
+func TestRedisCacheRetries(t *testing.T) {
+	// closed port
+	r := newTestRedis(t)
+	r.Close()
+
+	rc := newRedisCache([]string{r.Addr()}, 0)
+
+	// 100ms and 200ms delays before retries
+	start := time.Now()
+	if _, err := rc.Claim([]string{"a"}, time.Second, 2); err == nil || isRedisTimeout(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("retries took %s", d)
+	}
+
+	// retries are limited by timeout
+	start = time.Now()
+	if _, err := rc.Claim([]string{"a"}, 250*time.Millisecond, 10); !isRedisTimeout(err) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("retries took %s", d)
+	}
+}
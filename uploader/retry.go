@@ -0,0 +1,387 @@
+package uploader
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"go.uber.org/zap"
+)
+
+// interval of checking retry queue for files ready for next attempt
+const retryCheckInterval = 100 * time.Millisecond
+
+type retryEntry struct {
+	attempts int
+	next     time.Time // time of next attempt
+	target   string    // ClickHouse host of last failed attempt. Empty - not known before first retry
+}
+
+// targetError is error of upload to ClickHouse host of failed table
+type targetError struct {
+	error
+	target string
+}
+
+// targetHost returns host of ClickHouse url
+func targetHost(dsn string) string {
+	p, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	return p.Host
+}
+
+// tableError returns err with ClickHouse host of table, so retry attempts of file are counted in budget of the host
+func (u *Uploader) tableError(table string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &targetError{error: err, target: targetHost(u.tableURL(table))}
+}
+
+// retryBudgets is time of retry attempts in current hour by ClickHouse host. Outage of one host doesn't stop
+// retries of files failed on others
+type retryBudgets struct {
+	sync.Mutex
+	hour int64 // unix hour of used
+	used map[string]time.Duration
+}
+
+// add counts d in budget of target in hour. Counters are reset at top of hour
+func (b *retryBudgets) add(target string, hour int64, d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.used == nil || b.hour != hour {
+		b.used = make(map[string]time.Duration)
+		b.hour = hour
+	}
+	b.used[target] += d
+}
+
+// maxUsed returns time used by target in hour. Returns maximum of all targets if target is empty
+func (b *retryBudgets) maxUsed(target string, hour int64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.hour != hour {
+		return 0
+	}
+	if target != "" {
+		return b.used[target]
+	}
+	var max time.Duration
+	for _, d := range b.used {
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// retryBackoff returns delay before next attempt: minBackoff doubled after each failed attempt up to maxBackoff
+func retryBackoff(attempts int, minBackoff, maxBackoff time.Duration) time.Duration {
+	d := minBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// RetryQueueDepth returns count of failed files waiting for next attempt
+func (u *Uploader) RetryQueueDepth() int {
+	return int(atomic.LoadUint32(&u.stat.retryQueueDepth)) + len(u.retryChan)
+}
+
+// RetryBudgetRemaining returns least time left for retry attempts of ClickHouse hosts in current hour.
+// -1 if budget is unlimited
+func (u *Uploader) RetryBudgetRemaining() time.Duration {
+	return u.retryBudgetRemaining("")
+}
+
+// retryBudgetRemaining returns time left for retry attempts of target in current hour. Empty target - least time
+// of all targets. -1 if budget is unlimited
+func (u *Uploader) retryBudgetRemaining(target string) time.Duration {
+	u.configLock.RLock()
+	budget := u.retryBudget
+	u.configLock.RUnlock()
+
+	if budget <= 0 {
+		return -1
+	}
+
+	used := u.retryBudgets.maxUsed(target, time.Now().Unix()/3600)
+	if used >= budget {
+		return 0
+	}
+	return budget - used
+}
+
+// RequeueDeadLetters moves data files of dead letter directory of each data path (see DeadLetterDir) back to
+// its data path with checkpoints of chunks and row indexes, so they are uploaded again to tables of the path.
+// Files existing in data path are skipped. Returns count of moved files
+func (u *Uploader) RequeueDeadLetters() (int, error) {
+	u.configLock.RLock()
+	deadLetterPath := u.deadLetterPath
+	dataPaths := u.dataPaths()
+	u.configLock.RUnlock()
+
+	if deadLetterPath == "" {
+		return 0, errors.New("dead letter path is not configured")
+	}
+
+	count := 0
+	for _, dataPath := range dataPaths {
+		n, err := u.requeueDeadLetters(DeadLetterDir(deadLetterPath, dataPath), dataPath)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	if count > 0 {
+		u.logger.Info("dead letters are requeued", zap.Int("files", count))
+		u.ForceFlush()
+	}
+	return count, nil
+}
+
+// requeueDeadLetters moves data files of dead letter directory to data path. Returns count of moved files
+func (u *Uploader) requeueDeadLetters(deadLetterDir string, dataPath string) (int, error) {
+	files, err := ioutil.ReadDir(deadLetterDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "default.") {
+			continue
+		}
+
+		filename := path.Join(deadLetterDir, f.Name())
+		target := path.Join(dataPath, f.Name())
+		if _, err = os.Stat(target); err == nil {
+			u.logger.Warn("dead letter exists in data path, skipped", zap.String("filename", filename))
+			continue
+		}
+
+		// checkpoint is moved before file, so upload of file is resumed by scan
+		for _, fn := range []string{checkpointFilename(filename), RowBinary.IndexFilename(filename)} {
+			if err = os.Rename(fn, path.Join(dataPath, path.Base(fn))); err != nil && !os.IsNotExist(err) {
+				return count, err
+			}
+		}
+		if err = os.Rename(filename, target); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// moveToDeadLetter moves file, checkpoint of its chunks and row index to dead letter directory of its data path
+func (u *Uploader) moveToDeadLetter(filename string, deadLetterPath string) error {
+	dir := DeadLetterDir(deadLetterPath, path.Dir(filename))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	target := path.Join(dir, path.Base(filename))
+	if err := os.Rename(filename, target); err != nil {
+		return err
+	}
+
+	for _, fn := range []string{checkpointFilename(filename), RowBinary.IndexFilename(filename)} {
+		if err := os.Rename(fn, path.Join(dir, path.Base(fn))); err != nil && !os.IsNotExist(err) {
+			u.logger.Error("file can't be moved to dead letter path", zap.String("filename", fn), zap.Error(err))
+		}
+	}
+
+	u.logger.Error("retry budget is exhausted, file is moved to dead letter path",
+		zap.String("filename", filename),
+		zap.String("target", target),
+	)
+	return nil
+}
+
+// deadLetterExhausted moves all files of ClickHouse hosts with exhausted retry budget to dead letter path.
+// Files failed to move wait for reset of budget
+func (u *Uploader) deadLetterExhausted(files map[string]*retryEntry, deadLetterPath string) {
+	for filename, e := range files {
+		if e.target == "" || u.retryBudgetRemaining(e.target) != 0 {
+			continue
+		}
+		if err := u.moveToDeadLetter(filename, deadLetterPath); err != nil {
+			u.logger.Error("file can't be moved to dead letter path", zap.String("filename", filename), zap.Error(err))
+			continue
+		}
+
+		delete(files, filename)
+		u.Lock()
+		delete(u.inQueue, filename)
+		u.Unlock()
+	}
+	atomic.StoreUint32(&u.stat.retryQueueDepth, uint32(len(files)))
+}
+
+// removeFile deletes uploaded file, checkpoint of chunks and row index
+func (u *Uploader) removeFile(filename string) {
+	removeCheckpoint(filename)
+	os.Remove(RowBinary.IndexFilename(filename))
+	err := os.Remove(filename)
+	if err != nil {
+		u.logger.Error("file delete failed",
+			zap.String("filename", filename),
+			zap.Error(err),
+		)
+	} else {
+		u.logger.Info("file deleted",
+			zap.String("filename", filename),
+		)
+	}
+}
+
+// retryWorker uploads only failed files received from upload workers. Upload workers are not blocked by stuck files.
+// Files are kept in inQueue until successful upload, so watch doesn't pass them to upload workers again.
+// One file is uploaded per wakeup, so failed files are received while other files are retried
+func (u *Uploader) retryWorker(exit chan struct{}) {
+	files := make(map[string]*retryEntry)
+
+	ticker := time.NewTicker(retryCheckInterval)
+	defer ticker.Stop()
+
+	// ready is closed channel, used instead of ticker while due files are left
+	ready := make(chan time.Time)
+	close(ready)
+	more := false
+
+	for {
+		due := ticker.C
+		if more {
+			due = ready
+		}
+
+		select {
+		case <-exit:
+			return
+		case filename := <-u.retryChan:
+			u.configLock.RLock()
+			backoff := retryBackoff(1, u.retryMinBackoff, u.retryMaxBackoff)
+			u.configLock.RUnlock()
+
+			files[filename] = &retryEntry{attempts: 1, next: time.Now().Add(backoff)}
+			atomic.StoreUint32(&u.stat.retryQueueDepth, uint32(len(files)))
+		case <-u.restartChan:
+			u.serverRestarted()
+			for _, e := range files {
+				e.attempts = 0
+				e.next = time.Now()
+			}
+			more = u.retryDue(exit, files)
+		case <-due:
+			more = u.retryDue(exit, files)
+		}
+	}
+}
+
+// retryUpload uploads failed file and counts attempt in retry budget of ClickHouse host failed the attempt.
+// Successful attempt is counted for host of previous failure. Host of entry is updated
+func (u *Uploader) retryUpload(exit chan struct{}, filename string, entry *retryEntry) error {
+	start := time.Now()
+	err := u.upload(exit, filename)
+	if e, ok := err.(*targetError); ok {
+		entry.target = e.target
+	}
+
+	target := entry.target
+	if target == "" {
+		u.configLock.RLock()
+		target = targetHost(u.clickHouseDSN)
+		u.configLock.RUnlock()
+	}
+	u.retryBudgets.add(target, start.Unix()/3600, time.Since(start))
+	return err
+}
+
+// retryDue uploads one file with expired backoff, oldest attempt first, so retry worker receives new failed files
+// between attempts. Returns true if file was handled and other files may be due. Files of ClickHouse host with
+// exhausted retry budget are moved to dead letter path. Without dead letter path or if move failed they are requeued
+// for attempt after reset of budget at top of next hour
+func (u *Uploader) retryDue(exit chan struct{}, files map[string]*retryEntry) bool {
+	u.configLock.RLock()
+	deadLetterPath := u.deadLetterPath
+	u.configLock.RUnlock()
+	if deadLetterPath != "" {
+		u.deadLetterExhausted(files, deadLetterPath)
+	}
+
+	var filename string
+	var entry *retryEntry
+
+	now := time.Now()
+	for fn, e := range files {
+		if e.next.After(now) {
+			continue
+		}
+		if e.target != "" && u.retryBudgetRemaining(e.target) == 0 {
+			e.next = time.Unix((now.Unix()/3600+1)*3600, 0)
+			u.logger.Warn("retry budget is exhausted, file is requeued for next hour",
+				zap.String("filename", fn),
+				zap.String("target", e.target),
+			)
+			continue
+		}
+		if entry == nil || e.next.Before(entry.next) {
+			filename, entry = fn, e
+		}
+	}
+
+	if entry == nil {
+		return false
+	}
+
+	select {
+	case <-exit:
+		return false
+	default:
+	}
+
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		// removed by somebody else
+		delete(files, filename)
+	} else if err = u.retryUpload(exit, filename, entry); err == nil {
+		delete(files, filename)
+		if u.keepDryRunFile(filename) {
+			atomic.StoreUint32(&u.stat.retryQueueDepth, uint32(len(files)))
+			return true
+		}
+		u.removeFile(filename)
+	} else {
+		entry.attempts++
+		u.configLock.RLock()
+		entry.next = time.Now().Add(retryBackoff(entry.attempts, u.retryMinBackoff, u.retryMaxBackoff))
+		u.configLock.RUnlock()
+		return true
+	}
+
+	u.Lock()
+	delete(u.inQueue, filename)
+	u.Unlock()
+	atomic.StoreUint32(&u.stat.retryQueueDepth, uint32(len(files)))
+	return true
+}
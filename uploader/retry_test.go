@@ -0,0 +1,370 @@
+package uploader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	table := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{9, 256 * time.Second},
+		{10, 5 * time.Minute},
+		{1000, 5 * time.Minute},
+	}
+
+	for _, p := range table {
+		if d := retryBackoff(p.attempts, time.Second, 5*time.Minute); d != p.expected {
+			t.Fatalf("%d: %s != %s", p.attempts, d, p.expected)
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	var stuckRequests uint32
+	var fixed int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("stuck.metric")) {
+			atomic.AddUint32(&stuckRequests, 1)
+			if atomic.LoadInt32(&fixed) == 0 {
+				http.Error(w, "Code: 241, Memory limit exceeded", http.StatusInternalServerError)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// oldest file is uploaded first and fails
+	stuck := path.Join(dir, "default.1")
+	wb := RowBinary.GetWriteBuffer()
+	wb.WriteGraphitePoint([]byte("stuck.metric"), 42, 1422642189, 16466, 1422642189)
+	if err = ioutil.WriteFile(stuck, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		RetryBackoff(50*time.Millisecond, 200*time.Millisecond),
+	)
+	u.Start()
+	defer u.Stop()
+
+	waitFor := func(message string, cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal(message)
+			}
+		}
+	}
+
+	waitFor("stuck file is not retried", func() bool {
+		return atomic.LoadUint32(&stuckRequests) >= 3
+	})
+
+	// new files are uploaded while stuck file is retried
+	for _, name := range []string{"default.2", "default.3", "default.4"} {
+		writeTestDataFile(t, path.Join(dir, name))
+	}
+
+	waitFor("new files are not uploaded", func() bool {
+		files, _ := ioutil.ReadDir(dir)
+		return len(files) == 1
+	})
+
+	if _, err = os.Stat(stuck); err != nil {
+		t.Fatal(err)
+	}
+	if d := u.RetryQueueDepth(); d != 1 {
+		t.Fatalf("retry queue depth: %d", d)
+	}
+
+	atomic.StoreInt32(&fixed, 1)
+
+	waitFor("stuck file is not uploaded after fix", func() bool {
+		_, err := os.Stat(stuck)
+		return os.IsNotExist(err) && u.RetryQueueDepth() == 0
+	})
+}
+
+func TestRetryQueueFull(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		http.Error(w, "Code: 241, Memory limit exceeded", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+	)
+	// retry worker isn't started, queue of one file is full after first failure
+	u.retryChan = make(chan string, 1)
+
+	files := []string{path.Join(dir, "default.1"), path.Join(dir, "default.2")}
+	for _, filename := range files {
+		writeTestDataFile(t, filename)
+		u.inQueue[filename] = true
+		u.queue <- filename
+	}
+
+	exit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		u.uploadWorker(exit)
+		close(done)
+	}()
+
+	// upload worker isn't blocked by full queue
+	for deadline := time.Now().Add(5 * time.Second); len(u.queue) != 0 || atomic.LoadUint32(&u.stat.retryDropped) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue: %d, dropped: %d", len(u.queue), atomic.LoadUint32(&u.stat.retryDropped))
+		}
+	}
+	close(exit)
+	<-done
+
+	// dropped file is removed from inQueue, so next scan queues it again
+	if filename := <-u.retryChan; filename != files[0] {
+		t.Fatal(filename)
+	}
+	u.Lock()
+	if !u.inQueue[files[0]] || u.inQueue[files[1]] {
+		t.Fatalf("%#v", u.inQueue)
+	}
+	u.Unlock()
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["retryDropped"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+}
+
+func TestRetryDueOneFile(t *testing.T) {
+	var requests uint32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddUint32(&requests, 1)
+		http.Error(w, "Code: 241, Memory limit exceeded", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		RetryBackoff(time.Minute, time.Minute),
+	)
+
+	files := make(map[string]*retryEntry)
+	for _, name := range []string{"default.1", "default.2", "default.3"} {
+		fn := path.Join(dir, name)
+		writeTestDataFile(t, fn)
+		files[fn] = &retryEntry{attempts: 1, next: time.Now()}
+		u.inQueue[fn] = true
+	}
+
+	// one file is uploaded per call, so retry worker reads retry queue between uploads
+	for i := uint32(1); i <= 3; i++ {
+		if !u.retryDue(nil, files) {
+			t.Fatalf("%d: no file is retried", i)
+		}
+		if n := atomic.LoadUint32(&requests); n != i {
+			t.Fatalf("%d: requests: %d", i, n)
+		}
+	}
+	if u.retryDue(nil, files) {
+		t.Fatal("file is retried before backoff")
+	}
+	if len(files) != 3 || len(u.inQueue) != 3 {
+		t.Fatalf("%#v, %#v", files, u.inQueue)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var requests, otherRequests uint32
+	var fixed int32
+
+	// ClickHouse under sustained outage, each attempt takes 30ms
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddUint32(&requests, 1)
+		time.Sleep(30 * time.Millisecond)
+		http.Error(w, "Code: 210. DB::NetException: Connection refused", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	// other ClickHouse fails until fix
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		atomic.AddUint32(&otherRequests, 1)
+		if atomic.LoadInt32(&fixed) == 0 {
+			http.Error(w, "Code: 210. DB::NetException: Connection refused", http.StatusInternalServerError)
+		}
+	}))
+	defer other.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	otherDir, deadLetter := path.Join(dir, "other"), path.Join(dir, "dead-letter")
+	if err = os.Mkdir(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		DataTables([]string{"graphite", "graphite_other"}),
+		DataTableOptions(map[string]TableOptions{"graphite_other": {URL: other.URL}}),
+		TablePaths(map[string]string{"graphite_other": otherDir}),
+		RetryBackoff(time.Millisecond, time.Millisecond),
+		RetryBudget(100*time.Millisecond),
+		DeadLetterPath(deadLetter),
+	)
+	if r := u.RetryBudgetRemaining(); r != 100*time.Millisecond {
+		t.Fatal(r)
+	}
+
+	files := make(map[string]*retryEntry)
+	for _, fn := range []string{path.Join(dir, "default.1"), path.Join(dir, "default.2"), path.Join(otherDir, "default.3")} {
+		writeTestDataFile(t, fn)
+		files[fn] = &retryEntry{attempts: 1, next: time.Now()}
+		u.inQueue[fn] = true
+	}
+	if err = writeCheckpoint(path.Join(dir, "default.2"), map[string]int64{checkpointKey(false, "graphite"): 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// attempts of failed host are stopped after 100ms, other host isn't affected
+	for deadline := time.Now().Add(5 * time.Second); u.retryBudgetRemaining(targetHost(srv.URL)) != 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("budget isn't exhausted: %d requests", atomic.LoadUint32(&requests))
+		}
+		u.retryDue(nil, files)
+	}
+	if r := u.retryBudgetRemaining(targetHost(other.URL)); r <= 0 {
+		t.Fatal(r)
+	}
+	if r := u.RetryBudgetRemaining(); r != 0 {
+		t.Fatal(r)
+	}
+
+	atomic.StoreInt32(&fixed, 1)
+	for deadline := time.Now().Add(5 * time.Second); len(files) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("file of other host isn't retried: %d requests", atomic.LoadUint32(&otherRequests))
+		}
+		u.retryDue(nil, files)
+	}
+	n := atomic.LoadUint32(&requests)
+	if n < 3 || n > 5 {
+		t.Fatalf("requests: %d", n)
+	}
+	if _, err = os.Stat(path.Join(otherDir, "default.3")); !os.IsNotExist(err) {
+		t.Fatalf("file of other host: %v", err)
+	}
+
+	// all files of exhausted host are moved to dead letter directory of their path with checkpoint
+	deadLetterDir := DeadLetterDir(deadLetter, dir)
+	for _, name := range []string{"default.1", "default.2", "checkpoint.default.2"} {
+		if _, err = os.Stat(path.Join(deadLetterDir, name)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(path.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if len(u.inQueue) != 0 || u.RetryQueueDepth() != 0 {
+		t.Fatalf("%#v, %d", u.inQueue, u.RetryQueueDepth())
+	}
+
+	// without dead letter path files of exhausted host wait for next hour
+	u.configLock.Lock()
+	u.deadLetterPath = ""
+	u.configLock.Unlock()
+	fn := path.Join(dir, "default.4")
+	writeTestDataFile(t, fn)
+	files[fn] = &retryEntry{attempts: 1, next: time.Now(), target: targetHost(srv.URL)}
+	u.retryDue(nil, files)
+	if atomic.LoadUint32(&requests) != n {
+		t.Fatal("files are retried after budget")
+	}
+	if nextHour := time.Unix((time.Now().Unix()/3600+1)*3600, 0); !files[fn].next.Equal(nextHour) {
+		t.Fatalf("%s: %s", fn, files[fn].next)
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if v, ok := stat["retryBudgetRemainingSeconds"]; !ok || v != 0 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// budget is reset in next hour
+	u.retryBudgets.Lock()
+	u.retryBudgets.hour--
+	u.retryBudgets.Unlock()
+	if r := u.RetryBudgetRemaining(); r != 100*time.Millisecond {
+		t.Fatal(r)
+	}
+
+	// unlimited
+	u = New(Path(dir))
+	if r := u.RetryBudgetRemaining(); r != -1 {
+		t.Fatal(r)
+	}
+	stat = make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if _, ok := stat["retryBudgetRemainingSeconds"]; ok {
+		t.Fatalf("%#v", stat)
+	}
+}
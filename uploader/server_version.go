@@ -0,0 +1,64 @@
+package uploader
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// serverVersion is last Server header of ClickHouse responses by host. Changed value means restart of upgraded server.
+// Hosts of discovery and table urls can run different versions, so they are compared separately
+type serverVersion struct {
+	sync.Mutex
+	versions map[string]string
+}
+
+// update stores version of host and returns previous one. Returns false if version is not changed or not known before
+func (s *serverVersion) update(host string, version string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.versions == nil {
+		s.versions = make(map[string]string)
+	}
+	old := s.versions[host]
+	s.versions[host] = version
+	return old, old != "" && old != version
+}
+
+// VersionChanges returns count of detected ClickHouse version changes since start
+func (u *Uploader) VersionChanges() uint32 {
+	return atomic.LoadUint32(&u.stat.versionChanges)
+}
+
+// checkServerVersion clears caches of tree and tags index tables on version change of ClickHouse server
+// and requests schema detection and immediate retry of failed files from retry worker.
+// Responses without Server header are ignored
+func (u *Uploader) checkServerVersion(host string, version string) {
+	if version == "" {
+		return
+	}
+
+	old, changed := u.serverVersion.update(host, version)
+	if !changed {
+		return
+	}
+
+	atomic.AddUint32(&u.stat.versionChanges, 1)
+	u.logger.Info("clickhouse version changed", zap.String("host", host), zap.String("old", old), zap.String("new", version))
+
+	u.ClearTreeExistsCache()
+
+	select {
+	case u.restartChan <- struct{}{}:
+	default:
+		// restart is already requested
+	}
+}
+
+// serverRestarted requests detection of tree table schemas again. Failed files are retried by caller immediately,
+// so files failed during restart are not delayed by backoff of sustained outage
+func (u *Uploader) serverRestarted() {
+	u.detectTreeSchemas()
+}
@@ -0,0 +1,157 @@
+package uploader
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerVersionChange(t *testing.T) {
+	var lock sync.Mutex
+	version := "ClickHouse/23.8.1"
+	down := false
+	var describes uint32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+
+		w.Header().Set("Server", version)
+		query := r.URL.Query().Get("query")
+		if down && strings.HasPrefix(query, "INSERT ") {
+			http.Error(w, "Code: 210. DB::NetException: Connection refused", http.StatusInternalServerError)
+			return
+		}
+		if strings.HasPrefix(query, "DESCRIBE TABLE ") {
+			atomic.AddUint32(&describes, 1)
+			io.WriteString(w, "Date\tDate\nLevel\tUInt32\nPath\tString\nVersion\tUInt32\n")
+		}
+	}))
+	defer srv.Close()
+
+	setVersion := func(v string, d bool) {
+		lock.Lock()
+		version, down = v, d
+		lock.Unlock()
+	}
+
+	wait := func(f func() bool) bool {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if f() {
+				return true
+			}
+		}
+		return false
+	}
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		TreeTable("graphite_tree"),
+		RetryBackoff(time.Hour, time.Hour),
+		ScanInterval(time.Hour),
+	)
+	u.Start()
+	defer u.Stop()
+
+	if !wait(func() bool { return atomic.LoadUint32(&describes) == 1 }) {
+		t.Fatalf("describes: %d", atomic.LoadUint32(&describes))
+	}
+
+	// same version
+	u.treeExists.Add("hello.world")
+	if _, err = u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if u.VersionChanges() != 0 || u.treeExists.Count() != 1 {
+		t.Fatalf("%d, %d", u.VersionChanges(), u.treeExists.Count())
+	}
+
+	// upgraded server, cache is cleared and schema of tree is detected again
+	setVersion("ClickHouse/24.3.2", false)
+	if _, err = u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if u.VersionChanges() != 1 || u.treeExists.Count() != 0 {
+		t.Fatalf("%d, %d", u.VersionChanges(), u.treeExists.Count())
+	}
+	if !wait(func() bool { return atomic.LoadUint32(&describes) == 2 }) {
+		t.Fatalf("describes: %d", atomic.LoadUint32(&describes))
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["clickhouseVersionChangesTotal"] != 1 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// file failed during restart waits for backoff of sustained outage
+	setVersion("ClickHouse/24.3.2", true)
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+	if err = u.upload(nil, filename); err == nil {
+		t.Fatal("upload to stopped server")
+	}
+	u.retryChan <- filename
+	if !wait(func() bool { return u.RetryQueueDepth() == 1 && len(u.retryChan) == 0 }) {
+		t.Fatal("file is not received by retry worker")
+	}
+
+	// ... until server is back with new version
+	setVersion("ClickHouse/24.4.1", false)
+	if _, err = u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !wait(func() bool {
+		_, err := os.Stat(filename)
+		return os.IsNotExist(err)
+	}) {
+		t.Fatal("file is not retried after restart")
+	}
+	if u.VersionChanges() != 2 || u.RetryQueueDepth() != 0 {
+		t.Fatalf("%d, %d", u.VersionChanges(), u.RetryQueueDepth())
+	}
+}
+
+func TestServerVersionByHost(t *testing.T) {
+	version := func(v string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Server", v)
+		}))
+	}
+	old, upgraded := version("ClickHouse/23.8.1"), version("ClickHouse/24.3.2")
+	defer old.Close()
+	defer upgraded.Close()
+
+	// responses of hosts with different versions are not version changes
+	u := New(ClickHouse(old.URL))
+	for i := 0; i < 2; i++ {
+		for _, dsn := range []string{old.URL, upgraded.URL} {
+			if _, err := u.post(dsn, "SELECT 1", nil, time.Second, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if n := u.VersionChanges(); n != 0 {
+		t.Fatalf("version changes: %d", n)
+	}
+}
@@ -0,0 +1,62 @@
+package uploader
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// SessionID enables session_id parameter of INSERT queries, so ClickHouse keeps session state between inserts.
+// Id is generated on start of uploader and changed by ResetSession. ClickHouse rejects concurrent queries
+// of one session, so one upload thread is required
+func SessionID(enabled bool) Option {
+	return func(u *Uploader) {
+		u.sessionEnabled = enabled
+	}
+}
+
+// newSessionID returns random UUID version 4
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// SessionID returns current session id of INSERT queries. Empty if disabled
+func (u *Uploader) SessionID() string {
+	u.sessionLock.Lock()
+	defer u.sessionLock.Unlock()
+
+	if !u.sessionEnabled {
+		return ""
+	}
+	return u.sessionID
+}
+
+// ResetSession replaces session id by new one, next INSERT starts new ClickHouse session. Returns new id
+func (u *Uploader) ResetSession() string {
+	id := newSessionID()
+
+	u.sessionLock.Lock()
+	u.sessionID = id
+	u.sessionLock.Unlock()
+
+	u.logger.Info("session reset")
+	return id
+}
+
+// withSession returns settings with session_id if enabled
+func (u *Uploader) withSession(settings map[string]string) map[string]string {
+	id := u.SessionID()
+	if id == "" {
+		return settings
+	}
+
+	result := make(map[string]string, len(settings)+1)
+	for k, v := range settings {
+		result[k] = v
+	}
+	result["session_id"] = id
+	return result
+}
@@ -0,0 +1,85 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionID(t *testing.T) {
+	var lock sync.Mutex
+	var sessions []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		q := r.URL.Query()
+		lock.Lock()
+		if strings.HasPrefix(q.Get("query"), "INSERT ") {
+			sessions = append(sessions, q.Get("session_id"))
+		} else if q.Get("session_id") != "" {
+			sessions = append(sessions, "select with session")
+		}
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	newUploader := func(enabled bool) *Uploader {
+		return New(
+			ClickHouse(srv.URL),
+			HTTPClient(srv.Client()),
+			SessionID(enabled),
+		)
+	}
+
+	insert := func(u *Uploader, count int) []string {
+		lock.Lock()
+		sessions = nil
+		lock.Unlock()
+		for i := 0; i < count; i++ {
+			if err := u.uploadData(u.clickHouseDSN, "graphite", "RowBinary", nil, time.Second, strings.NewReader("")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := u.Query("SELECT 1", time.Second); err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return sessions
+	}
+
+	u := newUploader(true)
+	id := u.SessionID()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("session id: %#v", id)
+	}
+
+	// same id in all inserts, other queries are sent without session
+	if s := insert(u, 3); strings.Join(s, ",") != strings.Join([]string{id, id, id}, ",") {
+		t.Fatalf("%#v", s)
+	}
+
+	newID := u.ResetSession()
+	if newID == id || u.SessionID() != newID {
+		t.Fatalf("%#v, %#v", id, newID)
+	}
+	if s := insert(u, 2); strings.Join(s, ",") != strings.Join([]string{newID, newID}, ",") {
+		t.Fatalf("%#v", s)
+	}
+
+	// each uploader has own session
+	if other := newUploader(true); other.SessionID() == u.SessionID() {
+		t.Fatal("session id is not unique")
+	}
+
+	// disabled
+	u = newUploader(false)
+	if s := insert(u, 2); strings.Join(s, ",") != "," || u.SessionID() != "" {
+		t.Fatalf("%#v", s)
+	}
+}
@@ -0,0 +1,79 @@
+package uploader
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+)
+
+// TablePaths sets data paths of data and reverse data tables by name. Files of these paths are uploaded
+// only to own tables, files of Path are uploaded to other tables, tree, tags index and tenant tables.
+// Should be passed to New
+func TablePaths(paths map[string]string) Option {
+	return func(u *Uploader) {
+		u.tablePaths = make(map[string]string, len(paths))
+		for table, p := range paths {
+			u.tablePaths[table] = path.Clean(p)
+		}
+	}
+}
+
+// dataPaths returns Path and data paths of tables
+func (u *Uploader) dataPaths() []string {
+	paths := []string{u.path}
+	known := map[string]bool{path.Clean(u.path): true}
+	for _, p := range u.tablePaths {
+		if !known[p] {
+			known[p] = true
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths[1:])
+	return paths
+}
+
+// DeadLetterDir returns directory of dead letters of data path in deadLetterPath. Each data path has own directory
+// named by base name and hash of path, so files of different paths don't collide and are requeued to own path.
+// Empty if deadLetterPath is empty
+func DeadLetterDir(deadLetterPath string, dataPath string) string {
+	if deadLetterPath == "" {
+		return ""
+	}
+	dataPath = path.Clean(dataPath)
+	h := fnv.New64a()
+	h.Write([]byte(dataPath))
+	return path.Join(deadLetterPath, fmt.Sprintf("%s-%016x", path.Base(dataPath), h.Sum64()))
+}
+
+// hasOwnPath returns true if table has own data path
+func (u *Uploader) hasOwnPath(table string) bool {
+	_, exists := u.tablePaths[table]
+	return exists
+}
+
+// pathTables returns tables of data path. Nil for Path
+func (u *Uploader) pathTables(dir string) []string {
+	if dir == path.Clean(u.path) {
+		return nil
+	}
+
+	var tables []string
+	for table, p := range u.tablePaths {
+		if p == dir {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// isReverseDataTable returns true if table is reverse data table
+func (u *Uploader) isReverseDataTable(table string) bool {
+	for _, t := range u.reverseDataTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUploadTablePaths(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		q := r.URL.Query().Get("query")
+		if strings.HasPrefix(q, "INSERT INTO ") {
+			lock.Lock()
+			queries = append(queries, strings.Fields(q)[2])
+			lock.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cold, hot := path.Join(dir, "cold"), path.Join(dir, "hot")
+	for _, p := range []string{cold, hot} {
+		if err = os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestDataFile(t, path.Join(cold, "default.2"))
+	writeTestDataFile(t, path.Join(hot, "default.1"))
+
+	u := New(
+		Path(cold),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite", "graphite_hot"}),
+		ReverseDataTables([]string{"graphite_reverse", "graphite_hot_reverse"}),
+		TreeTable("graphite_tree"),
+		TablePaths(map[string]string{"graphite_hot": hot + "/", "graphite_hot_reverse": hot}),
+	)
+
+	// files of all paths are ordered by time
+	files, err := u.listFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortFiles(files, UploadOrderOldestFirst)
+	if fmt.Sprint(files) != fmt.Sprint([]string{path.Join(hot, "default.1"), path.Join(cold, "default.2")}) {
+		t.Fatalf("%#v", files)
+	}
+
+	expected := [][]string{
+		{"graphite_hot", "graphite_hot_reverse"},
+		{"graphite", "graphite_reverse", "graphite_tree"},
+	}
+	for i, fn := range files {
+		queries = nil
+		if err = u.upload(nil, fn); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(queries) != fmt.Sprint(expected[i]) {
+			t.Fatalf("%s: %#v", fn, queries)
+		}
+	}
+}
+
+func TestRequeueDeadLettersTablePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cold, hot, deadLetter := path.Join(dir, "cold"), path.Join(dir, "hot"), path.Join(dir, "dead-letter")
+	if DeadLetterDir(deadLetter, hot+"/") != DeadLetterDir(deadLetter, hot) || DeadLetterDir(deadLetter, hot) == DeadLetterDir(deadLetter, cold) {
+		t.Fatalf("%#v, %#v", DeadLetterDir(deadLetter, hot), DeadLetterDir(deadLetter, cold))
+	}
+
+	// corrupt file of table path with checkpoint of chunks
+	hotDeadLetter := DeadLetterDir(deadLetter, hot)
+	for _, p := range []string{cold, hot, hotDeadLetter} {
+		if err = os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := path.Join(hotDeadLetter, "default.1")
+	writeTestDataFile(t, filename)
+	if err = writeCheckpoint(filename, map[string]int64{checkpointKey(false, "graphite_hot"): 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		Path(cold),
+		DataTables([]string{"graphite", "graphite_hot"}),
+		TablePaths(map[string]string{"graphite_hot": hot}),
+		DeadLetterPath(deadLetter),
+	)
+
+	// file is returned to own path, so it is uploaded only to table of the path
+	if n, err := u.RequeueDeadLetters(); n != 1 || err != nil {
+		t.Fatalf("%d, %#v", n, err)
+	}
+	for _, fn := range []string{path.Join(hot, "default.1"), checkpointFilename(path.Join(hot, "default.1"))} {
+		if _, err = os.Stat(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(cold); len(files) != 0 {
+		t.Fatalf("%d files in data path", len(files))
+	}
+	if files, _ := ioutil.ReadDir(hotDeadLetter); len(files) != 0 {
+		t.Fatalf("%d files in dead letter path", len(files))
+	}
+	if tables := u.pathTables(hot); fmt.Sprint(tables) != "[graphite_hot]" {
+		t.Fatalf("%#v", tables)
+	}
+}
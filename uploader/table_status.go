@@ -0,0 +1,82 @@
+package uploader
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// TableUploadStatus is state of INSERT queries of one table since start
+type TableUploadStatus struct {
+	LastUploadTime    time.Time `json:"last_upload_time"`  // time of last successful INSERT. Zero if nothing is uploaded
+	LastUploadRows    int64     `json:"last_upload_rows"`  // rows of last successful INSERT. -1 if ClickHouse didn't report written rows
+	LastUploadError   string    `json:"last_upload_error"` // error of last INSERT. Empty if it's successful
+	TotalRowsUploaded int64     `json:"total_rows_uploaded"`
+	TotalErrors       int64     `json:"total_errors"`
+}
+
+// tableStatus tracks TableUploadStatus of tables
+type tableStatus struct {
+	sync.Mutex
+	tables map[string]*TableUploadStatus
+}
+
+// add updates status of table by result of INSERT. table can be followed by column list
+func (s *tableStatus) add(table string, written int64, err error) {
+	if i := strings.IndexByte(table, ' '); i >= 0 {
+		table = table[:i]
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tables == nil {
+		s.tables = make(map[string]*TableUploadStatus)
+	}
+	t := s.tables[table]
+	if t == nil {
+		t = &TableUploadStatus{}
+		s.tables[table] = t
+	}
+
+	if err != nil {
+		t.LastUploadError = redactError(err)
+		t.TotalErrors++
+		return
+	}
+
+	t.LastUploadTime = time.Now()
+	t.LastUploadRows = written
+	t.LastUploadError = ""
+	if written > 0 {
+		t.TotalRowsUploaded += written
+	}
+}
+
+// TableStatus returns upload state of configured tables and other tables which received INSERT queries
+func (u *Uploader) TableStatus() map[string]TableUploadStatus {
+	u.configLock.RLock()
+	tables := make([]string, 0, len(u.dataTables)+len(u.reverseDataTables)+len(u.tenantTables)+2)
+	tables = append(tables, u.dataTables...)
+	tables = append(tables, u.reverseDataTables...)
+	tables = append(tables, u.tenantTableNames()...)
+	for _, t := range []string{u.treeTable, u.reverseTreeTable} {
+		if t != "" {
+			tables = append(tables, t)
+		}
+	}
+	u.configLock.RUnlock()
+
+	s := &u.tableStatus
+	s.Lock()
+	defer s.Unlock()
+
+	result := make(map[string]TableUploadStatus, len(tables)+len(s.tables))
+	for _, t := range tables {
+		result[t] = TableUploadStatus{}
+	}
+	for t, status := range s.tables {
+		result[t] = *status
+	}
+	return result
+}
@@ -0,0 +1,251 @@
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// Date, Tag1, Path, Tags, Version. Schema of graphite-clickhouse tagged table: seriesByTag finds Path
+// by first expression in Tag1 and checks others in Tags
+var (
+	tagsIndexColumns = []string{"Date", "Tag1", "Path", "Tags", "Version"}
+	tagsIndexTypes   = []string{"Date", "String", "String", "Array(String)", "UInt32"}
+)
+
+// count of bits in bloom filter of known tagged series
+const tagsBloomBits = 1 << 24
+
+// TagsIndexTable sets table of tagged metrics index. Each tagged metric "name;tag1=value1;tag2=value2" is inserted
+// as one row per tag with all tags of metric, including "__name__=name". Table should be ReplacingMergeTree
+// with Version, so rows inserted again are collapsed. Empty table is disabled
+func TagsIndexTable(t string) Option {
+	return func(u *Uploader) {
+		u.tagsTable = t
+	}
+}
+
+// bloomFilter of fixed size without false negatives. Safe for concurrent use
+type bloomFilter struct {
+	bits []uint32 // atomic
+}
+
+func newBloomFilter(bits int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint32, (bits+31)/32)}
+}
+
+// positions returns 4 bit positions of key by double hashing
+func (b *bloomFilter) positions(key string) [4]uint32 {
+	h1 := fnv32(key)
+	h2 := crc32.ChecksumIEEE([]byte(key)) | 1
+	n := uint32(len(b.bits) * 32)
+
+	var result [4]uint32
+	for i := range result {
+		result[i] = (h1 + uint32(i)*h2) % n
+	}
+	return result
+}
+
+func (b *bloomFilter) add(key string) {
+	for _, p := range b.positions(key) {
+		word, mask := &b.bits[p/32], uint32(1)<<(p%32)
+		for {
+			v := atomic.LoadUint32(word)
+			if v&mask != 0 || atomic.CompareAndSwapUint32(word, v, v|mask) {
+				break
+			}
+		}
+	}
+}
+
+// mayContain returns false if key is not added since clear
+func (b *bloomFilter) mayContain(key string) bool {
+	for _, p := range b.positions(key) {
+		if atomic.LoadUint32(&b.bits[p/32])&(uint32(1)<<(p%32)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) clear() {
+	for i := range b.bits {
+		atomic.StoreUint32(&b.bits[i], 0)
+	}
+}
+
+// parseTags returns sorted tags of tagged metric name with "__name__" first. Returns nil for plain or invalid name
+func parseTags(name []byte) []string {
+	if bytes.IndexByte(name, ';') < 0 {
+		return nil
+	}
+
+	parts := bytes.Split(name, []byte{';'})
+	if len(parts[0]) == 0 {
+		return nil
+	}
+
+	tags := make([]string, 0, len(parts))
+	for _, tag := range parts[1:] {
+		eq := bytes.IndexByte(tag, '=')
+		if eq <= 0 || eq == len(tag)-1 {
+			return nil
+		}
+		tags = append(tags, string(tag))
+	}
+	sort.Strings(tags)
+
+	return append([]string{"__name__=" + string(parts[0])}, tags...)
+}
+
+// tagsIndex is rows of tagged series of file, which are not found in exists cache
+type tagsIndex struct {
+	data   *bytes.Buffer
+	days   uint16 // Date of rows
+	series []string
+	rows   int
+}
+
+// knownSeries checks key of tree exists cache format (days, path) by bloom filter first, series never added
+// to cache are not looked up
+func (u *Uploader) knownSeries(key []byte) bool {
+	if !u.tagsBloom.mayContain(unsafeString(key)) {
+		return false
+	}
+	return u.tagsExists.Exists(unsafeString(key))
+}
+
+// advanceTagsDays removes series of old dates from tags exists cache if days is newest date of tags index.
+// Bloom filter is rebuilt by kept series, series missed by lookups during rebuild are only inserted again
+func (u *Uploader) advanceTagsDays(days uint16) {
+	for {
+		last := atomic.LoadUint32(&u.lastTagsDays)
+		if uint32(days) <= last {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&u.lastTagsDays, last, uint32(days)) {
+			break
+		}
+	}
+
+	u.tagsBloom.clear()
+	u.tagsExists.RemoveIf(func(key string) bool {
+		if treeKeyDays(key)+treeExistsDays <= days {
+			return true
+		}
+		u.tagsBloom.add(key)
+		return false
+	})
+}
+
+// makeTagsIndex reads tagged metrics of file and makes index rows of new series
+func (u *Uploader) makeTagsIndex(filename string) (*tagsIndex, error) {
+	reader, err := RowBinary.NewReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	now := time.Now()
+	days := u.treeDays(now)
+	if d, ok := fileDays(filename); ok && u.treeDate.IsZero() {
+		days = d
+	}
+	version := uint32(now.Unix())
+
+	u.advanceTagsDays(days)
+
+	index := &tagsIndex{data: bytes.NewBuffer(nil), days: days}
+	uniq := make(map[string]bool)
+	wb := RowBinary.GetWriteBuffer()
+	defer wb.Release()
+	var key []byte
+
+	for {
+		name, err := reader.ReadRecord()
+		if err != nil { // io.EOF or corrupted file
+			break
+		}
+
+		key = appendTreeKey(key[:0], days, name)
+		if uniq[unsafeString(name)] || u.knownSeries(key) {
+			continue
+		}
+
+		tags := parseTags(name)
+		if tags == nil {
+			continue
+		}
+
+		path := string(name)
+		uniq[path] = true
+		index.series = append(index.series, path)
+
+		for _, tag := range tags {
+			wb.Reset()
+			wb.WriteUint16(days)
+			wb.WriteString(tag)
+			wb.WriteString(path)
+			wb.WriteUVarint(uint64(len(tags)))
+			for _, t := range tags {
+				wb.WriteString(t)
+			}
+			wb.WriteUint32(version)
+
+			index.data.Write(wb.Bytes())
+			index.rows++
+		}
+	}
+
+	return index, nil
+}
+
+// uploadTagsIndex inserts index rows of new tagged series of file by one query. Series are remembered after success
+func (u *Uploader) uploadTagsIndex(filename string) error {
+	if u.tagsTable == "" {
+		return nil
+	}
+
+	index, err := u.makeTagsIndex(filename)
+	if err != nil {
+		return err
+	}
+	if index.rows == 0 {
+		return nil
+	}
+
+	err = u.uploadData(
+		u.tableURL(u.tagsTable),
+		fmt.Sprintf("%s (%s)", u.tagsTable, strings.Join(tagsIndexColumns, ", ")),
+		u.insertFormat,
+		u.treeQuerySettings,
+		u.treeTimeout,
+		withHeader(u.insertFormat, index.data, formatHeader(tagsIndexColumns, tagsIndexTypes)),
+	)
+	if err != nil || u.dryRunRows > 0 {
+		return err
+	}
+	if index.days+treeExistsDays <= uint16(atomic.LoadUint32(&u.lastTagsDays)) {
+		// removed from cache by newer index
+		return nil
+	}
+
+	for _, path := range index.series {
+		key := treeKey(index.days, path)
+		u.tagsBloom.add(key)
+		u.tagsExists.Add(key)
+	}
+	return nil
+}
+
+func (u *Uploader) clearTagsExists() {
+	u.tagsExists.Clear()
+	u.tagsBloom.clear()
+}
@@ -0,0 +1,303 @@
+package uploader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestParseTags(t *testing.T) {
+	table := []struct {
+		name     string
+		expected []string
+	}{
+		{"hello.world", nil},
+		{"cpu.usage;host=h1;dc=east", []string{"__name__=cpu.usage", "dc=east", "host=h1"}},
+		{"cpu.usage;dc=east", []string{"__name__=cpu.usage", "dc=east"}},
+		{"cpu.usage;dc=a=b", []string{"__name__=cpu.usage", "dc=a=b"}},
+		{";dc=east", nil},
+		{"cpu.usage;dc", nil},
+		{"cpu.usage;=east", nil},
+		{"cpu.usage;dc=", nil},
+		{"cpu.usage;", nil},
+	}
+
+	for _, c := range table {
+		if tags := parseTags([]byte(c.name)); fmt.Sprint(tags) != fmt.Sprint(c.expected) {
+			t.Fatalf("%s: %#v != %#v", c.name, tags, c.expected)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	b := newBloomFilter(1024)
+
+	for i := 0; i < 50; i++ {
+		b.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 50; i++ {
+		if !b.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("key%d is not found", i)
+		}
+	}
+
+	b.clear()
+	if b.mayContain("key1") {
+		t.Fatal("key1 is found after clear")
+	}
+}
+
+// tagsIndexRow is row of tagged table read by graphite-clickhouse
+type tagsIndexRow struct {
+	days uint16
+	tag1 string
+	path string
+	tags []string
+}
+
+func readTagsIndexRows(t *testing.T, body []byte) []tagsIndexRow {
+	readString := func() string {
+		l, n := binary.Uvarint(body)
+		if n <= 0 || n+int(l) > len(body) {
+			t.Fatalf("broken row: %#v", body)
+		}
+		s := string(body[n : n+int(l)])
+		body = body[n+int(l):]
+		return s
+	}
+
+	var rows []tagsIndexRow
+	for len(body) > 0 {
+		var r tagsIndexRow
+		r.days = binary.LittleEndian.Uint16(body)
+		body = body[2:]
+		r.tag1 = readString()
+		r.path = readString()
+		count, n := binary.Uvarint(body)
+		body = body[n:]
+		for i := uint64(0); i < count; i++ {
+			r.tags = append(r.tags, readString())
+		}
+		body = body[4:] // Version
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// seriesByTag returns paths of series matching all exact expressions like find query of graphite-clickhouse:
+// first expression is matched by Tag1, other ones by Tags
+func seriesByTag(rows []tagsIndexRow, expr ...string) []string {
+	uniq := make(map[string]bool)
+RowLoop:
+	for _, r := range rows {
+		if r.tag1 != expr[0] {
+			continue
+		}
+		for _, e := range expr[1:] {
+			found := false
+			for _, tag := range r.tags {
+				found = found || tag == e
+			}
+			if !found {
+				continue RowLoop
+			}
+		}
+		uniq[r.path] = true
+	}
+
+	result := make([]string, 0, len(uniq))
+	for p := range uniq {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestUploadTagsIndex(t *testing.T) {
+	var lock sync.Mutex
+	bodies := make(map[string][]byte)
+	inserts := make(map[string]int)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query := r.URL.Query().Get("query")
+		table := strings.Fields(query)[2]
+		lock.Lock()
+		bodies[table] = body
+		inserts[table]++
+		lock.Unlock()
+
+		if table == "graphite_tagged" && !strings.HasPrefix(query, "INSERT INTO graphite_tagged (Date, Tag1, Path, Tags, Version) ") {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{
+		"cpu.usage;host=h1;dc=east",
+		"hello.world",
+		"cpu.usage;dc=west;host=h2",
+		"cpu.usage;host=h1;dc=east",
+		"mem.free;dc=east;host=h1",
+		"broken;tag",
+	}
+
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for _, name := range names {
+		wb.WriteGraphitePoint([]byte(name), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		TagsIndexTable("graphite_tagged"),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readTagsIndexRows(t, bodies["graphite_tagged"])
+	// one row per tag of each series
+	if len(rows) != 9 {
+		t.Fatalf("rows: %#v", rows)
+	}
+	for _, r := range rows {
+		if r.days != u.treeDays(time.Now()) {
+			t.Fatalf("date: %#v", r)
+		}
+	}
+
+	table := []struct {
+		expr     []string
+		expected []string
+	}{
+		{[]string{"__name__=cpu.usage"}, []string{"cpu.usage;dc=west;host=h2", "cpu.usage;host=h1;dc=east"}},
+		{[]string{"dc=east"}, []string{"cpu.usage;host=h1;dc=east", "mem.free;dc=east;host=h1"}},
+		{[]string{"__name__=cpu.usage", "dc=east"}, []string{"cpu.usage;host=h1;dc=east"}},
+		{[]string{"host=h1", "__name__=mem.free"}, []string{"mem.free;dc=east;host=h1"}},
+		{[]string{"host=h2", "dc=east"}, []string{}},
+		{[]string{"__name__=hello.world"}, []string{}},
+	}
+	for _, c := range table {
+		if paths := seriesByTag(rows, c.expr...); fmt.Sprint(paths) != fmt.Sprint(c.expected) {
+			t.Fatalf("seriesByTag(%s): %#v", strings.Join(c.expr, ", "), paths)
+		}
+	}
+
+	// known series are not inserted again
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if inserts["graphite_tagged"] != 1 || inserts["graphite"] != 2 {
+		t.Fatalf("%#v", inserts)
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["tagsExistsCacheSize"] != 3 {
+		t.Fatalf("%#v", stat)
+	}
+
+	u.ClearTreeExistsCache()
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if inserts["graphite_tagged"] != 2 {
+		t.Fatalf("%#v", inserts)
+	}
+}
+
+func TestUploadTagsIndexDates(t *testing.T) {
+	var lock sync.Mutex
+	var dates []uint16
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.URL.Query().Get("query"), "INSERT INTO graphite_tagged ") {
+			lock.Lock()
+			for _, row := range readTagsIndexRows(t, body) {
+				dates = append(dates, row.days)
+			}
+			lock.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files of date partitioned writer
+	var files []string
+	for _, date := range []string{"20150130", "20150131"} {
+		wb := RowBinary.GetWriteBuffer()
+		now := uint32(time.Now().Unix())
+		wb.WriteGraphitePoint([]byte("cpu.usage;host=h1"), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+		filename := path.Join(dir, "default.1."+date)
+		if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wb.Release()
+		files = append(files, filename)
+	}
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		TagsIndexTable("graphite_tagged"),
+		TreeDate(time.Time{}),
+	)
+
+	// series is inserted once per date by rows of 2 tags, interleaved dates don't clear cache
+	for _, filename := range []string{files[0], files[1], files[0], files[1]} {
+		if err = u.upload(nil, filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(dates) != "[16465 16465 16466 16466]" {
+		t.Fatalf("%#v", dates)
+	}
+
+	// series of dates older than treeExistsDays are removed by newer date
+	u.advanceTagsDays(16465 + treeExistsDays)
+	if n := u.tagsExists.Count(); n != 1 {
+		t.Fatalf("tags exists cache: %d", n)
+	}
+	if u.knownSeries(appendTreeKey(nil, 16465, []byte("cpu.usage;host=h1"))) {
+		t.Fatal("series of old date is known")
+	}
+	if !u.knownSeries(appendTreeKey(nil, 16466, []byte("cpu.usage;host=h1"))) {
+		t.Fatal("series isn't known after rebuild of bloom filter")
+	}
+}
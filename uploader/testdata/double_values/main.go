@@ -0,0 +1,16 @@
+// Sample plugin of clickhouse.pre-upload-plugin, doubles values of all points.
+//
+//	go build -buildmode=plugin -o double_values.so ./uploader/testdata/double_values
+package main
+
+import (
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// TransformRows is called before each INSERT to data and reverse data tables
+func TransformRows(rows []RowBinary.Row) []RowBinary.Row {
+	for i := range rows {
+		rows[i].Value *= 2
+	}
+	return rows
+}
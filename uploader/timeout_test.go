@@ -0,0 +1,94 @@
+package uploader
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// zeroReader is endless body of INSERT
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// silentServer accepts connections, but doesn't read or write. Connections are closed with listener
+func silentServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	return listener
+}
+
+func TestUploadTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	silent := silentServer(t)
+	defer silent.Close()
+
+	table := []struct {
+		name    string
+		url     string
+		options []Option
+		body    io.Reader
+		err     string // empty for success
+	}{
+		{"read-timeout", slow.URL, []Option{ReadTimeout(100 * time.Millisecond)}, strings.NewReader("data"), "timeout awaiting response headers"},
+		{"read-timeout-passed", slow.URL, []Option{ReadTimeout(time.Second)}, strings.NewReader("data"), ""},
+		// TLS handshake is not answered
+		{"connect-timeout", "https://" + silent.Addr().String(), []Option{ConnectTimeout(100 * time.Millisecond)}, strings.NewReader("data"), "TLS handshake timeout"},
+		// body is not read, so write is blocked after socket buffers are full
+		{"write-timeout", "http://" + silent.Addr().String(), []Option{WriteTimeout(100 * time.Millisecond)}, io.LimitReader(zeroReader{}, 1<<30), "i/o timeout"},
+	}
+
+	for _, c := range table {
+		u := New(append([]Option{ClickHouse(c.url)}, c.options...)...)
+
+		start := time.Now()
+		err := u.uploadData(u.clickHouseDSN, "graphite", RowBinary.FormatRowBinary, nil, 10*time.Second, c.body)
+
+		if c.err == "" && err != nil {
+			t.Fatalf("%s: %#v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%s: %#v", c.name, err)
+		}
+		// data-timeout is not reached
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%s: %s", c.name, time.Since(start))
+		}
+	}
+}
@@ -2,11 +2,14 @@ package uploader
 
 import (
 	"bytes"
+	"fmt"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"go.uber.org/zap"
+
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
-	"github.com/lomik/carbon-clickhouse/helper/days1970"
 )
 
 // https://github.com/golang/go/issues/2632#issuecomment-66061057
@@ -14,18 +17,128 @@ func unsafeString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// treeExistsDays is count of dates kept in tree exists cache. Names of older dates are removed
+// when tree of newer date is made
+const treeExistsDays = 7
+
 type Tree struct {
 	data        *bytes.Buffer
 	dataReverse *bytes.Buffer
+	days        uint16 // Date of rows
 	uniq        map[string]bool
+	claimed     []string // keys claimed in shared tree cache
+	rows        int      // count of rows in data
 	uploader    *Uploader
 }
 
 func (tree *Tree) Success() {
+	if tree.uploader.dryRunRows > 0 {
+		// rows are not inserted
+		return
+	}
+	if tree.days+treeExistsDays <= uint16(atomic.LoadUint32(&tree.uploader.lastTreeDays)) {
+		// removed from cache by newer tree
+		return
+	}
 	// copy data from local uniq to global
-	for key, _ := range tree.uniq {
-		tree.uploader.treeExists.Add(key)
+	for name := range tree.uniq {
+		tree.uploader.treeExists.Add(treeKey(tree.days, name))
+	}
+}
+
+// appendTreeKey appends key of tree exists cache: days{2}, name
+func appendTreeKey(b []byte, days uint16, name []byte) []byte {
+	b = append(b, byte(days), byte(days>>8))
+	return append(b, name...)
+}
+
+func treeKey(days uint16, name string) string {
+	return string(appendTreeKey(make([]byte, 0, len(name)+2), days, []byte(name)))
+}
+
+// treeKeyDays returns date of key of tree exists cache
+func treeKeyDays(key string) uint16 {
+	return uint16(key[0]) | uint16(key[1])<<8
+}
+
+// advanceTreeDays removes names of old dates from tree exists cache if days is newest date of trees
+func (u *Uploader) advanceTreeDays(days uint16) {
+	for {
+		last := atomic.LoadUint32(&u.lastTreeDays)
+		if uint32(days) <= last {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&u.lastTreeDays, last, uint32(days)) {
+			break
+		}
+	}
+
+	u.treeExists.RemoveIf(func(key string) bool {
+		return treeKeyDays(key)+treeExistsDays <= days
+	})
+}
+
+// Release removes claims from shared tree cache if tree upload failed
+func (tree *Tree) Release() {
+	if tree.uploader.sharedTree == nil || len(tree.claimed) == 0 {
+		return
+	}
+
+	if err := tree.uploader.sharedTree.Release(tree.claimed); err != nil {
+		tree.uploader.logger.Warn("shared tree cache release failed", zap.Error(err))
+	}
+}
+
+func (u *Uploader) sharedTreeKey(days uint16, name []byte) string {
+	return fmt.Sprintf("%s:%d:%s", u.treeTable, days, name)
+}
+
+// claimShared filters out names already uploaded by other instances. On shared cache error or timeout
+// all names are returned
+func (u *Uploader) claimShared(tree *Tree, days uint16, names [][]byte) [][]byte {
+	if u.sharedTree == nil || len(names) == 0 || u.dryRunRows > 0 {
+		return names
 	}
+
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = u.sharedTreeKey(days, name)
+	}
+
+	claimed, err := u.sharedTree.Claim(keys, u.treeCheckTimeout, u.treeCheckRetries)
+	if err != nil {
+		// fallback to local cache
+		if isRedisTimeout(err) {
+			atomic.AddUint32(&u.stat.treeCheckTimeouts, 1)
+		}
+		u.logger.Warn("shared tree cache unavailable", zap.Error(err))
+		return names
+	}
+
+	result := names[:0]
+	for i, name := range names {
+		if claimed[i] {
+			tree.claimed = append(tree.claimed, keys[i])
+			result = append(result, name)
+		} else {
+			// uploaded by other instance. remember it locally after success
+			tree.uniq[string(name)] = true
+		}
+	}
+
+	return result
+}
+
+// treeDays returns days from 1970-01-01 for Date column of tree records.
+// Zero treeDate means current date in treeDateLocation
+func (u *Uploader) treeDays(now time.Time) uint16 {
+	t := u.treeDate
+	if t.IsZero() {
+		t = now
+	}
+	t = t.In(u.treeDateLocation)
+
+	return uint16(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Unix() / 86400)
 }
 
 func (u *Uploader) MakeTree(filename string, withReverse bool) (*Tree, error) {
@@ -35,12 +148,21 @@ func (u *Uploader) MakeTree(filename string, withReverse bool) (*Tree, error) {
 	}
 	defer reader.Close()
 
-	days := (&days1970.Days{}).Timestamp(uint32(u.treeDate.Unix()))
-	version := uint32(time.Now().Unix())
+	now := time.Now()
+	days := u.treeDays(now)
+	if d, ok := fileDays(filename); ok && u.treeDate.IsZero() {
+		// date partitioned file. tree records are dated by metrics
+		days = d
+	}
+	version := uint32(now.Unix())
+
+	// names are cached by date, so files of several dates don't invalidate each other
+	u.advanceTreeDays(days)
 
 	tree := &Tree{
 		data:        bytes.NewBuffer(nil),
 		dataReverse: bytes.NewBuffer(nil),
+		days:        days,
 		uniq:        make(map[string]bool),
 		uploader:    u,
 	}
@@ -50,23 +172,35 @@ func (u *Uploader) MakeTree(filename string, withReverse bool) (*Tree, error) {
 	// var exists bool
 	var p []byte
 
-	wb := RowBinary.GetWriteBuffer()
+	names := make([][]byte, 0)
+	newNames := make(map[string]bool)
+	var key []byte
 
-LineLoop:
 	for {
 		name, err := reader.ReadRecord()
 		if err != nil { // io.EOF or corrupted file
 			break
 		}
 
-		if u.treeExists.Exists(unsafeString(name)) {
-			continue LineLoop
+		key = appendTreeKey(key[:0], days, name)
+		if u.treeExists.Exists(unsafeString(key)) {
+			continue
 		}
 
-		if tree.uniq[unsafeString(name)] {
-			continue LineLoop
+		if newNames[unsafeString(name)] {
+			continue
 		}
 
+		name = append([]byte(nil), name...)
+		newNames[unsafeString(name)] = true
+		names = append(names, name)
+	}
+
+	names = u.claimShared(tree, days, names)
+
+	wb := RowBinary.GetWriteBuffer()
+
+	for _, name := range names {
 		p = name
 		level = 1
 		for index = bytes.IndexByte(p, '.'); index >= 0; index = bytes.IndexByte(p, '.') {
@@ -77,10 +211,8 @@ LineLoop:
 		wb.Reset()
 
 		tree.uniq[string(name)] = true
-		wb.WriteUint16(days)
-		wb.WriteUint32(uint32(level))
-		wb.WriteBytes(name)
-		wb.WriteUint32(version)
+		u.treeSchema.writeRow(wb, days, uint32(level), name, false, version)
+		tree.rows++
 
 		// fmt.Println(string(name), level)
 
@@ -93,10 +225,8 @@ LineLoop:
 			}
 
 			tree.uniq[string(p[:index+1])] = true
-			wb.WriteUint16(days)
-			wb.WriteUint32(uint32(l))
-			wb.WriteBytes(p[:index+1])
-			wb.WriteUint32(version)
+			u.treeSchema.writeRow(wb, days, uint32(l), p[:index+1], false, version)
+			tree.rows++
 
 			// fmt.Println(string(p[:index+1]), level)
 			p = p[:index]
@@ -107,10 +237,7 @@ LineLoop:
 		if withReverse {
 			wb.Reset()
 
-			wb.WriteUint16(days)
-			wb.WriteUint32(uint32(level))
-			wb.WriteReversePath(name)
-			wb.WriteUint32(version)
+			u.reverseTreeSchema.writeRow(wb, days, uint32(level), name, true, version)
 
 			tree.dataReverse.Write(wb.Bytes()) // @TODO: error check?
 		}
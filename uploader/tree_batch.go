@@ -0,0 +1,124 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TreeInsertBatch sets max count of tree rows and max delay of tree rows accumulated from concurrently uploaded files.
+// Accumulated rows are inserted by one query per tree table when count or delay is reached or when all upload threads
+// wait for tree insert. Upload of each file waits for insert of its rows up to delay. 0 size (default) - each file
+// inserts own tree rows without delay
+func TreeInsertBatch(size int, delay time.Duration) Option {
+	return func(u *Uploader) {
+		u.treeBatchSize = size
+		u.treeBatchDelay = delay
+	}
+}
+
+// pendingTrees are trees waiting for common insert
+type pendingTrees struct {
+	trees []*Tree
+	rows  int
+	timer *time.Timer
+	done  chan struct{}
+	err   error // result of insert, valid after close of done
+}
+
+// treeBatch accumulates trees of concurrent uploads
+type treeBatch struct {
+	lock    sync.Mutex
+	pending *pendingTrees
+}
+
+// insertTree inserts rows of tree with rows of other upload threads. Blocks until rows are inserted.
+// Caller holds configLock.RLock, so config is not changed until all pending trees are inserted
+func (u *Uploader) insertTree(tree *Tree) error {
+	if u.treeBatchSize <= 0 {
+		return u.insertTrees([]*Tree{tree})
+	}
+
+	b := &u.treeBatch
+	b.lock.Lock()
+	p := b.pending
+	if p == nil {
+		p = &pendingTrees{done: make(chan struct{})}
+		p.timer = time.AfterFunc(u.treeBatchDelay, func() {
+			u.flushTrees(p)
+		})
+		b.pending = p
+	}
+	p.trees = append(p.trees, tree)
+	p.rows += tree.rows
+	full := p.rows >= u.treeBatchSize || len(p.trees) >= u.threads
+	b.lock.Unlock()
+
+	if full {
+		u.flushTrees(p)
+	}
+
+	<-p.done
+	return p.err
+}
+
+// flushTrees inserts pending trees. Trees already taken by other flush are skipped
+func (u *Uploader) flushTrees(p *pendingTrees) {
+	b := &u.treeBatch
+	b.lock.Lock()
+	if b.pending != p {
+		b.lock.Unlock()
+		return
+	}
+	b.pending = nil
+	b.lock.Unlock()
+
+	p.timer.Stop()
+	p.err = u.insertTrees(p.trees)
+	close(p.done)
+}
+
+// insertTrees inserts rows of trees by one query to tree table and one query to reverse tree table
+func (u *Uploader) insertTrees(trees []*Tree) error {
+	data := make([]io.Reader, 0, len(trees))
+	dataReverse := make([]io.Reader, 0, len(trees))
+	for _, tree := range trees {
+		if tree.data.Len() > 0 {
+			data = append(data, tree.data)
+		}
+		if tree.dataReverse.Len() > 0 {
+			dataReverse = append(dataReverse, tree.dataReverse)
+		}
+	}
+
+	if len(data) > 0 {
+		err := u.uploadData(
+			u.tableURL(u.treeTable),
+			fmt.Sprintf("%s %s", u.treeTable, u.treeSchema.columnList()),
+			u.insertFormat,
+			u.treeQuerySettings,
+			u.treeTimeout,
+			withHeader(u.insertFormat, io.MultiReader(data...), u.treeSchema.header()),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if u.reverseTreeTable != "" && len(dataReverse) > 0 {
+		err := u.uploadData(
+			u.tableURL(u.reverseTreeTable),
+			fmt.Sprintf("%s %s", u.reverseTreeTable, u.reverseTreeSchema.columnList()),
+			u.insertFormat,
+			u.treeQuerySettings,
+			u.treeTimeout,
+			withHeader(u.insertFormat, io.MultiReader(dataReverse...), u.reverseTreeSchema.header()),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
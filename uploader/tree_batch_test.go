@@ -0,0 +1,109 @@
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func TestTreeInsertBatch(t *testing.T) {
+	const files = 25
+	const batchSize = 10
+
+	var lock sync.Mutex
+	var inserts [][]byte
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.URL.Query().Get("query"), "INSERT INTO graphite_tree ") {
+			lock.Lock()
+			inserts = append(inserts, body)
+			lock.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		TreeTable("graphite_tree"),
+		Threads(100),
+		TreeInsertBatch(batchSize, time.Second),
+	)
+
+	// each file adds one tree row
+	now := uint32(time.Now().Unix())
+	filenames := make([]string, files)
+	for i := range filenames {
+		wb := RowBinary.GetWriteBuffer()
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("metric_%02d", i)), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+		filenames[i] = path.Join(dir, fmt.Sprintf("default.%d", i))
+		if err := ioutil.WriteFile(filenames[i], wb.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wb.Release()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, files)
+	for _, filename := range filenames {
+		wg.Add(1)
+		go func(filename string) {
+			defer wg.Done()
+			errs <- u.upload(nil, filename)
+		}(filename)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if expected := (files + batchSize - 1) / batchSize; len(inserts) != expected {
+		t.Fatalf("inserts: %d, expected %d", len(inserts), expected)
+	}
+
+	all := bytes.Join(inserts, nil)
+	for i := 0; i < files; i++ {
+		if name := fmt.Sprintf("metric_%02d", i); bytes.Count(all, []byte(name)) != 1 {
+			t.Fatalf("%s not inserted once", name)
+		}
+		if !u.treeExists.Exists(treeKey(u.treeDays(time.Now()), fmt.Sprintf("metric_%02d", i))) {
+			t.Fatalf("metric_%02d not cached", i)
+		}
+	}
+
+	// single thread doesn't wait for delay
+	u = New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		TreeTable("graphite_tree"),
+		TreeInsertBatch(batchSize, time.Hour),
+	)
+	if err := u.upload(nil, filenames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(inserts) != 1+(files+batchSize-1)/batchSize {
+		t.Fatalf("inserts: %d", len(inserts))
+	}
+}
@@ -0,0 +1,208 @@
+package uploader
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// treeSchema is set of tree table columns written by uploader
+type treeSchema struct {
+	name    string
+	columns []string
+	types   []string
+}
+
+var (
+	// Date, Level, Path, Version
+	treeSchemaDefault = &treeSchema{
+		name:    "default",
+		columns: []string{"Date", "Level", "Path", "Version"},
+		types:   []string{"Date", "UInt32", "String", "UInt32"},
+	}
+	// Date, Level, Path, Reversed, Version. Reversed is 1 for rows with reversed path
+	treeSchemaLegacy = &treeSchema{
+		name:    "legacy",
+		columns: []string{"Date", "Level", "Path", "Reversed", "Version"},
+		types:   []string{"Date", "UInt32", "String", "UInt8", "UInt32"},
+	}
+	// Date, Path, Tags, Version. Tags are empty for plain graphite metrics
+	treeSchemaTagged = &treeSchema{
+		name:    "tagged",
+		columns: []string{"Date", "Path", "Tags", "Version"},
+		types:   []string{"Date", "String", "Array(String)", "UInt32"},
+	}
+)
+
+var treeSchemas = []*treeSchema{treeSchemaDefault, treeSchemaLegacy, treeSchemaTagged}
+
+// columnList returns columns for INSERT query
+func (s *treeSchema) columnList() string {
+	return fmt.Sprintf("(%s)", strings.Join(s.columns, ", "))
+}
+
+func (s *treeSchema) header() []byte {
+	return formatHeader(s.columns, s.types)
+}
+
+// writeRow writes tree record in order of schema columns
+func (s *treeSchema) writeRow(wb *RowBinary.WriteBuffer, days uint16, level uint32, path []byte, reversed bool, version uint32) {
+	for _, c := range s.columns {
+		switch c {
+		case "Date":
+			wb.WriteUint16(days)
+		case "Level":
+			wb.WriteUint32(level)
+		case "Path":
+			if reversed {
+				wb.WriteReversePath(path)
+			} else {
+				wb.WriteBytes(path)
+			}
+		case "Reversed":
+			if reversed {
+				wb.WriteUint8(1)
+			} else {
+				wb.WriteUint8(0)
+			}
+		case "Tags":
+			wb.WriteUVarint(0)
+		case "Version":
+			wb.WriteUint32(version)
+		}
+	}
+}
+
+// matchTreeSchema returns known schema with most columns present in table. Other table columns are filled by defaults
+func matchTreeSchema(columns []string) *treeSchema {
+	exists := make(map[string]bool)
+	for _, c := range columns {
+		exists[c] = true
+	}
+
+	var result *treeSchema
+
+SchemaLoop:
+	for _, s := range treeSchemas {
+		for _, c := range s.columns {
+			if !exists[c] {
+				continue SchemaLoop
+			}
+		}
+
+		if result == nil || len(s.columns) > len(result.columns) {
+			result = s
+		}
+	}
+
+	return result
+}
+
+// describeTree detects schema of tree table with DESCRIBE TABLE query
+func (u *Uploader) describeTree(table string) (*treeSchema, error) {
+	body, err := u.post(u.tableURL(table), fmt.Sprintf("DESCRIBE TABLE %s FORMAT TabSeparated", table), nil, u.treeTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, 0)
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		columns = append(columns, string(bytes.SplitN(line, []byte{'\t'}, 2)[0]))
+	}
+
+	s := matchTreeSchema(columns)
+	if s == nil {
+		return nil, fmt.Errorf("unsupported schema of tree table %s: %s", table, strings.Join(columns, ", "))
+	}
+
+	return s, nil
+}
+
+// detectTreeSchemas requests detection of tree table schemas from schema worker. Uploads aren't blocked
+// by detection, current schemas are used until tables are described
+func (u *Uploader) detectTreeSchemas() {
+	atomic.AddUint32(&u.schemaRequests, 1)
+	select {
+	case u.schemaChan <- struct{}{}:
+	default:
+		// detection is already requested
+	}
+}
+
+// updateTreeSchemas describes tree tables and sets their schemas. Default schema is used for failed table.
+// Result is dropped if detection is requested again meanwhile. Returns false if detection of some table failed
+func (u *Uploader) updateTreeSchemas() bool {
+	requests := atomic.LoadUint32(&u.schemaRequests)
+	ok := true
+	detect := func(table string) *treeSchema {
+		if table == "" {
+			return treeSchemaDefault
+		}
+
+		s, err := u.describeTree(table)
+		if err != nil {
+			ok = false
+			u.logger.Warn("tree table schema detection failed, default schema is used",
+				zap.String("table", table),
+				zap.Error(err),
+			)
+			return treeSchemaDefault
+		}
+
+		u.logger.Info("tree table schema detected",
+			zap.String("table", table),
+			zap.String("schema", s.name),
+		)
+		return s
+	}
+
+	u.configLock.RLock()
+	tree, reverseTree := detect(u.treeTable), detect(u.reverseTreeTable)
+	u.configLock.RUnlock()
+
+	u.configLock.Lock()
+	defer u.configLock.Unlock()
+	if atomic.LoadUint32(&u.schemaRequests) != requests {
+		// tables may be changed by Reconfigure
+		return true
+	}
+	u.treeSchema, u.reverseTreeSchema = tree, reverseTree
+	return ok
+}
+
+// schemaWorker detects schemas of tree tables on request. Failed detection is retried with backoff of failed files
+func (u *Uploader) schemaWorker(exit chan struct{}) {
+	attempts := 0
+	var retry <-chan time.Time
+
+	for {
+		select {
+		case <-exit:
+			return
+		case <-u.schemaChan:
+			attempts = 0
+		case <-retry:
+		}
+
+		retry = nil
+		if u.updateTreeSchemas() {
+			attempts = 0
+			continue
+		}
+
+		attempts++
+		u.configLock.RLock()
+		backoff := retryBackoff(attempts, u.retryMinBackoff, u.retryMaxBackoff)
+		u.configLock.RUnlock()
+		retry = time.After(backoff)
+	}
+}
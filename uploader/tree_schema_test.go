@@ -0,0 +1,164 @@
+package uploader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTreeSchemaDetection(t *testing.T) {
+	table := []struct {
+		describe string
+		schema   *treeSchema
+		query    string
+		bodySize int // rows of hello.world and hello.
+	}{
+		{
+			"Date\tDate\t\t\nLevel\tUInt32\t\t\nPath\tString\t\t\nVersion\tUInt32\t\t\n",
+			treeSchemaDefault,
+			"INSERT INTO graphite_tree (Date, Level, Path, Version) FORMAT RowBinary",
+			(2 + 4 + 12 + 4) + (2 + 4 + 7 + 4),
+		},
+		{
+			"Date\tDate\t\t\nLevel\tUInt32\t\t\nPath\tString\t\t\nReversed\tUInt8\t\t\nVersion\tUInt32\t\t\n",
+			treeSchemaLegacy,
+			"INSERT INTO graphite_tree (Date, Level, Path, Reversed, Version) FORMAT RowBinary",
+			(2 + 4 + 12 + 1 + 4) + (2 + 4 + 7 + 1 + 4),
+		},
+		{
+			"Date\tDate\t\t\nPath\tString\t\t\nTags\tArray(String)\t\t\nVersion\tUInt32\t\t\n",
+			treeSchemaTagged,
+			"INSERT INTO graphite_tree (Date, Path, Tags, Version) FORMAT RowBinary",
+			(2 + 12 + 1 + 4) + (2 + 7 + 1 + 4),
+		},
+		{
+			// extra columns are filled by defaults
+			"Date\tDate\t\t\nLevel\tUInt32\t\t\nPath\tString\t\t\nDeleted\tUInt8\t\t\nVersion\tUInt32\t\t\n",
+			treeSchemaDefault,
+			"INSERT INTO graphite_tree (Date, Level, Path, Version) FORMAT RowBinary",
+			(2 + 4 + 12 + 4) + (2 + 4 + 7 + 4),
+		},
+		{
+			// unknown schema, default is used
+			"Date\tDate\t\t\nName\tString\t\t\n",
+			treeSchemaDefault,
+			"INSERT INTO graphite_tree (Date, Level, Path, Version) FORMAT RowBinary",
+			(2 + 4 + 12 + 4) + (2 + 4 + 7 + 4),
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	for _, c := range table {
+		var lock sync.Mutex
+		var query string
+		var bodySize int
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			q := r.URL.Query().Get("query")
+			if strings.HasPrefix(q, "DESCRIBE TABLE graphite_tree") {
+				w.Write([]byte(c.describe))
+				return
+			}
+			lock.Lock()
+			query, bodySize = q, len(body)
+			lock.Unlock()
+		}))
+
+		u := New(
+			ClickHouse(srv.URL),
+			HTTPClient(srv.Client()),
+			TreeTable("graphite_tree"),
+		)
+		u.updateTreeSchemas()
+
+		if u.treeSchema != c.schema {
+			t.Fatalf("schema: %s != %s", u.treeSchema.name, c.schema.name)
+		}
+
+		if err = u.upload(nil, filename); err != nil {
+			t.Fatal(err)
+		}
+
+		srv.Close()
+
+		if query != c.query {
+			t.Fatalf("%s: query: %#v", c.schema.name, query)
+		}
+		if bodySize != c.bodySize {
+			t.Fatalf("%s: body size: %d != %d", c.schema.name, bodySize, c.bodySize)
+		}
+	}
+}
+
+func TestTreeSchemaDetectionRetry(t *testing.T) {
+	var describes int32
+	block := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if !strings.HasPrefix(r.URL.Query().Get("query"), "DESCRIBE TABLE graphite_tree") {
+			return
+		}
+		// first attempt is stuck until Start returns, second one fails
+		switch atomic.AddInt32(&describes, 1) {
+		case 1:
+			<-block
+			http.Error(w, "Code: 210. DB::NetException: Connection refused", http.StatusInternalServerError)
+		case 2:
+			http.Error(w, "Code: 210. DB::NetException: Connection refused", http.StatusInternalServerError)
+		default:
+			w.Write([]byte("Date\tDate\t\t\nPath\tString\t\t\nTags\tArray(String)\t\t\nVersion\tUInt32\t\t\n"))
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(
+		Path(dir),
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		TreeTable("graphite_tree"),
+		RetryBackoff(time.Millisecond, time.Millisecond),
+	)
+
+	// Start isn't blocked by detection
+	u.Start()
+	close(block)
+	defer u.Stop()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		u.configLock.RLock()
+		s := u.treeSchema
+		u.configLock.RUnlock()
+		if s == treeSchemaTagged {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("schema isn't detected: %d describes", atomic.LoadInt32(&describes))
+		}
+	}
+	if n := atomic.LoadInt32(&describes); n != 3 {
+		t.Fatalf("describes: %d", n)
+	}
+}
@@ -0,0 +1,157 @@
+package uploader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTreeDaysTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	u := New(TreeDate(time.Time{}), TreeDateLocation(loc))
+
+	// 2017-05-15 23:30 in New York is 2017-05-16 03:30 UTC
+	beforeMidnight := time.Date(2017, 5, 15, 23, 30, 0, 0, loc)
+	afterMidnight := time.Date(2017, 5, 16, 0, 30, 0, 0, loc)
+
+	expected := uint16(time.Date(2017, 5, 15, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+
+	if d := u.treeDays(beforeMidnight); d != expected {
+		t.Fatalf("%d != %d", d, expected)
+	}
+
+	if d := u.treeDays(afterMidnight); d != expected+1 {
+		t.Fatalf("%d != %d", d, expected+1)
+	}
+
+	// fixed tree date
+	u = New(TreeDate(time.Date(2016, 11, 1, 0, 0, 0, 0, loc)), TreeDateLocation(loc))
+	expected = uint16(time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+
+	if d := u.treeDays(afterMidnight); d != expected {
+		t.Fatalf("%d != %d", d, expected)
+	}
+}
+
+// treeRows returns sorted "<days> <path>" of rows of default tree schema
+func treeRows(t *testing.T, data []byte) []string {
+	rows := make([]string, 0)
+	for len(data) > 0 {
+		// Date{2}, Level{4}, Path, Version{4}
+		l, n := binary.Uvarint(data[6:])
+		if n <= 0 || len(data) < 6+n+int(l)+4 {
+			t.Fatalf("broken row: %#v", data)
+		}
+		rows = append(rows, fmt.Sprintf("%d %s", binary.LittleEndian.Uint16(data), data[6+n:6+n+int(l)]))
+		data = data[6+n+int(l)+4:]
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func TestMakeTreeDatePartitioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(TreeDate(time.Time{}))
+	today := u.treeDays(time.Now())
+
+	table := []struct {
+		filename string
+		expected []string
+	}{
+		{"default.1.20150130", []string{"16465 hello.", "16465 hello.world"}},
+		{"default.2.20150131", []string{"16466 hello.", "16466 hello.world"}},
+		// names of date are cached after upload of other date
+		{"default.3.20150130", []string{}},
+		{"default.4", []string{fmt.Sprintf("%d hello.", today), fmt.Sprintf("%d hello.world", today)}},
+		// old dates are removed from cache by newer one
+		{"default.5.20150131", []string{"16466 hello.", "16466 hello.world"}},
+		{"default.6.20150131", []string{"16466 hello.", "16466 hello.world"}},
+		{"default.7", []string{}},
+	}
+
+	for _, c := range table {
+		filename := path.Join(dir, c.filename)
+		writeTestDataFile(t, filename)
+
+		tree, err := u.MakeTree(filename, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Success()
+
+		if rows := treeRows(t, tree.data.Bytes()); fmt.Sprint(rows) != fmt.Sprint(c.expected) {
+			t.Fatalf("%s: %#v, expected %#v", c.filename, rows, c.expected)
+		}
+		if tree.rows != len(c.expected) {
+			t.Fatalf("%s: rows %d", c.filename, tree.rows)
+		}
+	}
+
+	if n := u.treeExists.Count(); n != 2 {
+		t.Fatalf("tree cache: %d", n)
+	}
+}
+
+func TestMakeTreeConcurrentDates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(TreeDate(time.Time{}))
+
+	files := []string{"default.1.20150130", "default.2.20150131", "default.3.20150201"}
+	for _, fn := range files {
+		writeTestDataFile(t, path.Join(dir, fn))
+	}
+
+	// threads upload files of own dates concurrently, each tree is made once
+	var lock sync.Mutex
+	var rows []string
+	var wg sync.WaitGroup
+	for _, fn := range files {
+		wg.Add(1)
+		go func(filename string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				tree, err := u.MakeTree(filename, false)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				tree.Success()
+
+				lock.Lock()
+				rows = append(rows, treeRows(t, tree.data.Bytes())...)
+				lock.Unlock()
+			}
+		}(path.Join(dir, fn))
+	}
+	wg.Wait()
+
+	sort.Strings(rows)
+	expected := []string{
+		"16465 hello.", "16465 hello.world",
+		"16466 hello.", "16466 hello.world",
+		"16467 hello.", "16467 hello.world",
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Fatalf("%#v", rows)
+	}
+}
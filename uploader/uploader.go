@@ -1,28 +1,40 @@
 package uploader
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/lomik/stop"
-	"github.com/lomik/zapwriter"
 	"go.uber.org/zap"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
+	"github.com/lomik/carbon-clickhouse/writer"
 )
 
 type Option func(u *Uploader)
 
+const (
+	UploadOrderOldestFirst = "oldest_first"
+	UploadOrderNewestFirst = "newest_first"
+	UploadOrderRoundRobin  = "round_robin"
+)
+
 func Path(path string) Option {
 	return func(u *Uploader) {
 		u.path = path
@@ -35,6 +47,14 @@ func ClickHouse(dsn string) Option {
 	}
 }
 
+// Database is passed as database parameter of all queries. Table names with "<db>." prefix are not changed.
+// Database parameter of table url is not overridden
+func Database(name string) Option {
+	return func(u *Uploader) {
+		u.database = name
+	}
+}
+
 func DataTables(t []string) Option {
 	return func(u *Uploader) {
 		u.dataTables = t
@@ -47,12 +67,68 @@ func ReverseDataTables(t []string) Option {
 	}
 }
 
+// TenantTables creates option for New contructor. Metrics with prefixes of tenant table are uploaded
+// only to it, data and reverse data tables skip them
+func TenantTables(tables map[string][]string) Option {
+	return func(u *Uploader) {
+		u.tenantTables = tables
+		u.tenantPrefixes = nil
+		for _, prefixes := range tables {
+			u.tenantPrefixes = append(u.tenantPrefixes, prefixes...)
+		}
+		sort.Strings(u.tenantPrefixes)
+	}
+}
+
+// EngineAggregatingMergeTree is engine of data table with SimpleAggregateFunction Value column
+const EngineAggregatingMergeTree = "AggregatingMergeTree"
+
+// TableOptions are settings of data table schema
+type TableOptions struct {
+	DateColumn     string // name of Date column
+	DateColumnType string // RowBinary.DateType* value
+	Engine         string // EngineAggregatingMergeTree or empty for plain columns
+	ValueFunction  string // function of SimpleAggregateFunction Value column. sum by default
+	URL            string // overrides ClickHouse url for table. Also applied to tree tables
+	ShardKeyColumn string // UInt32 column of CRC32(Path) % shards for sharding_key of Distributed table. Disabled if empty
+	Cluster        string // cluster of Distributed table. Count of shards is read from system.clusters
+	FallbackTable  string // file is uploaded to this table if INSERT fails with schema mismatch. Disabled if empty
+}
+
+// DataTableOptions sets schema settings by data table name. Tables without options use Date column of Date type
+func DataTableOptions(o map[string]TableOptions) Option {
+	return func(u *Uploader) {
+		u.tableOptions = o
+	}
+}
+
 func DataTimeout(t time.Duration) Option {
 	return func(u *Uploader) {
 		u.dataTimeout = t
 	}
 }
 
+// ConnectTimeout limits TCP connect with ClickHouse. TLS handshake is limited by 10s or by connect timeout if it's less
+func ConnectTimeout(t time.Duration) Option {
+	return func(u *Uploader) {
+		u.connectTimeout = t
+	}
+}
+
+// WriteTimeout limits each blocked write of request to ClickHouse. 0 is unlimited
+func WriteTimeout(t time.Duration) Option {
+	return func(u *Uploader) {
+		u.writeTimeout = t
+	}
+}
+
+// ReadTimeout limits waiting of ClickHouse response headers after request is sent. 0 is unlimited
+func ReadTimeout(t time.Duration) Option {
+	return func(u *Uploader) {
+		u.readTimeout = t
+	}
+}
+
 func TreeTable(t string) Option {
 	return func(u *Uploader) {
 		u.treeTable = t
@@ -71,18 +147,157 @@ func TreeDate(t time.Time) Option {
 	}
 }
 
+func TreeDateLocation(loc *time.Location) Option {
+	return func(u *Uploader) {
+		u.treeDateLocation = loc
+	}
+}
+
 func TreeTimeout(t time.Duration) Option {
 	return func(u *Uploader) {
 		u.treeTimeout = t
 	}
 }
 
+// QuerySettings are appended to url of data tables INSERT query
+func QuerySettings(s map[string]string) Option {
+	return func(u *Uploader) {
+		u.querySettings = s
+	}
+}
+
+// RequestSettings are appended to url of every INSERT query of data and tree tables
+func RequestSettings(s map[string]string) Option {
+	return func(u *Uploader) {
+		u.requestSettings = s
+	}
+}
+
+// AllowInsertErrors sets max count and ratio of bad rows skipped by ClickHouse in data tables INSERT
+func AllowInsertErrors(num int, ratio float64) Option {
+	return func(u *Uploader) {
+		u.allowErrorsNum = num
+		u.allowErrorsRatio = ratio
+	}
+}
+
+// TreeQuerySettings are appended to url of tree tables INSERT query
+func TreeQuerySettings(s map[string]string) Option {
+	return func(u *Uploader) {
+		u.treeQuerySettings = s
+	}
+}
+
+func InsertFormat(f string) Option {
+	return func(u *Uploader) {
+		u.insertFormat = f
+	}
+}
+
+func HTTP2(enabled bool) Option {
+	return func(u *Uploader) {
+		u.http2 = enabled
+	}
+}
+
+func UploadOrder(order string) Option {
+	return func(u *Uploader) {
+		u.uploadOrder = order
+	}
+}
+
+// TreeCacheRedis enables tree exists cache shared between instances via Redis.
+// Several addresses are seed nodes of Redis Cluster
+func TreeCacheRedis(addrs []string, ttl time.Duration) Option {
+	return func(u *Uploader) {
+		if len(addrs) == 0 {
+			u.sharedTree = nil
+			return
+		}
+		u.sharedTree = newRedisCache(addrs, ttl)
+	}
+}
+
+// TreeCheckTimeout limits check of tree names in shared tree cache. Failed connection is retried up to
+// maxRetries times within timeout. Names are assumed not existing and inserted to tree if check timed out or failed
+func TreeCheckTimeout(timeout time.Duration, maxRetries int) Option {
+	return func(u *Uploader) {
+		u.treeCheckTimeout = timeout
+		u.treeCheckRetries = maxRetries
+	}
+}
+
+// HTTPClient sets client for all ClickHouse requests instead of internally constructed one.
+// data-timeout and tree-timeout are applied to requests with context
+func HTTPClient(c *http.Client) Option {
+	return func(u *Uploader) {
+		u.httpClient = c
+	}
+}
+
+// RetryBackoff sets delay before next upload attempt of failed file. Delay is doubled after each failure up to max
+func RetryBackoff(min time.Duration, max time.Duration) Option {
+	return func(u *Uploader) {
+		u.retryMinBackoff = min
+		u.retryMaxBackoff = max
+	}
+}
+
+// RetryBudget limits total time of retry attempts of failed files in each hour by ClickHouse host. If budget
+// of host is exhausted, files failed on it are moved to DeadLetterPath. Without DeadLetterPath files wait for
+// next hour. 0 is unlimited
+func RetryBudget(budget time.Duration) Option {
+	return func(u *Uploader) {
+		u.retryBudget = budget
+	}
+}
+
+// DeadLetterPath sets directory of files moved by writer, returned to data paths by RequeueDeadLetters.
+// Files of each data path are in own DeadLetterDir
+func DeadLetterPath(p string) Option {
+	return func(u *Uploader) {
+		u.deadLetterPath = p
+	}
+}
+
+// ScanInterval sets interval of path scan for new files
+func ScanInterval(d time.Duration) Option {
+	return func(u *Uploader) {
+		u.scanInterval = d
+	}
+}
+
+// UseInotify enables immediate scan after file close. Supported only on linux, other platforms use only scan interval
+func UseInotify(enabled bool) Option {
+	return func(u *Uploader) {
+		u.useInotify = enabled
+	}
+}
+
 func InProgressCallback(cb func(string) bool) Option {
 	return func(u *Uploader) {
 		u.inProgressCallback = cb
 	}
 }
 
+// MaxPendingFiles is watermark of closed files waiting for upload. Slack of writer is reduced by them. 0 - disabled
+func MaxPendingFiles(n int) Option {
+	return func(u *Uploader) {
+		u.maxPendingFiles = n
+	}
+}
+
+// DefaultMaxResponseSize is limit of ClickHouse response body read by uploader
+const DefaultMaxResponseSize = 1 << 20
+
+// MaxResponseSize sets limit of ClickHouse response body in bytes. Long error bodies are truncated with warning,
+// long results of successful queries are errors
+func MaxResponseSize(n int64) Option {
+	return func(u *Uploader) {
+		u.maxResponseSize = n
+	}
+}
+
 func Threads(t int) Option {
 	return func(u *Uploader) {
 		u.threads = t
@@ -97,57 +312,380 @@ type Uploader struct {
 		uploaded  uint32
 		errors    uint32
 		unhandled uint32 // @TODO: maxUnhandled
+		oldest    int64  // atomic. unixnano of oldest unhandled file, 0 if nothing
+		waiting   uint32 // atomic. unhandled files not in progress of writing
+
+		retryQueueDepth  uint32 // atomic. failed files received by retry worker
+		retryDropped     uint32 // atomic. failed files not received by full queue of retry worker
+		inotifyEvents    uint32 // atomic
+		skippedRows      uint32 // atomic. rows not inserted by input_format_allow_errors settings
+		pendingMutations uint32 // atomic. unfinished mutations of data tables on last check
+
+		schemaMismatchFallback uint32 // atomic. files uploaded to fallback table since start
+		treeCheckTimeouts      uint32 // atomic. shared tree cache checks timed out since start
+		versionChanges         uint32 // atomic. changes of Server header since start
 	}
-	path               string
-	clickHouseDSN      string
-	dataTables         []string
-	reverseDataTables  []string
-	dataTimeout        time.Duration
-	treeTable          string
-	reverseTreeTable   string
-	treeTimeout        time.Duration
-	treeDate           time.Time
-	threads            int
-	inProgressCallback func(string) bool
-	queue              chan string
-	inQueue            map[string]bool // current uploading files
-	treeExists         CMap            // store known keys and don't load it to clickhouse tree
-	logger             *zap.Logger
+	configLock            sync.RWMutex // guards settings changed by Reconfigure. Read locked while file uploading
+	path                  string
+	clickHouseDSN         string
+	database              string // database parameter of queries. Empty - default database of user
+	ddlCredentials        credentials
+	dmlCredentials        credentials
+	sessionEnabled        bool       // session_id parameter of INSERT queries
+	sessionLock           sync.Mutex // guards sessionID
+	sessionID             string
+	preUpload             RowBinary.TransformFunc // transform of data table rows. nil - files are uploaded as is
+	dataTables            []string
+	reverseDataTables     []string
+	tenantTables          map[string][]string // table => prefixes of metrics
+	tenantPrefixes        []string            // prefixes of all tenant tables
+	tablePaths            map[string]string   // table => own data path
+	tableOptions          map[string]TableOptions
+	dataTimeout           time.Duration
+	connectTimeout        time.Duration
+	writeTimeout          time.Duration
+	readTimeout           time.Duration
+	treeTable             string
+	reverseTreeTable      string
+	tagsTable             string
+	treeTimeout           time.Duration
+	treeDate              time.Time // zero value means current date
+	treeDateLocation      *time.Location
+	lastTreeDays          uint32 // atomic. newest days of trees
+	lastTagsDays          uint32 // atomic. newest days of tags index
+	threads               int
+	maxPendingFiles       int // watermark of Slack. 0 - disabled
+	maxResponseSize       int64
+	pipelineDepth         int    // concurrent INSERTs of chunks of file
+	ddlCluster            string // ON CLUSTER of DDL script
+	zookeeperPathTemplate string // path of replicated tables of DDL script
+	dryRunRows            int    // rows of INSERT logged by dry run. 0 - disabled
+	querySettings         map[string]string
+	allowErrorsNum        int     // input_format_allow_errors_num of data tables INSERT. 0 - disabled
+	allowErrorsRatio      float64 // input_format_allow_errors_ratio of data tables INSERT. 0 - disabled
+	treeQuerySettings     map[string]string
+	requestSettings       map[string]string // appended to url of data and tree tables INSERT
+	treeBatchSize         int               // max tree rows of concurrent uploads inserted together. 0 - disabled
+	treeBatchDelay        time.Duration
+	treeBatch             treeBatch
+	tableStatus           tableStatus
+	insertFormat          string
+	http2                 bool
+	uploadOrder           string
+	transport             http.RoundTripper
+	httpClient            *http.Client // overrides client with transport if set
+	treeSchema            *treeSchema  // detected columns of tree table
+	reverseTreeSchema     *treeSchema  // detected columns of reverse tree table
+	inProgressCallback    func(string) bool
+	queue                 chan string
+	retryChan             chan string   // failed files for retry worker
+	flushChan             chan struct{} // requests of immediate watch
+	restartChan           chan struct{} // detected restarts of ClickHouse with new version
+	schemaChan            chan struct{} // requests of tree schemas detection
+	schemaRequests        uint32        // atomic. requests of tree schemas detection since start
+	serverVersion         serverVersion
+	retryMinBackoff       time.Duration
+	retryMaxBackoff       time.Duration
+	retryBudget           time.Duration // time of retry attempts in hour by ClickHouse host. 0 - unlimited
+	retryBudgets          retryBudgets
+	deadLetterPath        string // files failed on close by writer, requeued by RequeueDeadLetters
+	scanInterval          time.Duration
+	useInotify            bool          // watch closed files on linux, applied on start
+	uploadChunkSize       int64         // files larger than limit are uploaded by chunks with checkpoint. 0 - disabled
+	maxInsertBlockSize    int64         // max rows in INSERT of data table. 0 - unlimited
+	readAheadBuffers      int           // buffers of data file read while previous are sent. 0 - disabled
+	mutationCheckInterval time.Duration // 0 - disabled, applied on start
+	mutationWarnThreshold int
+	asyncInsert           bool          // async inserts confirmed after flush
+	asyncConfirmInterval  time.Duration // check of system.asynchronous_insert_log. 0 - disabled, applied on start
+	asyncInserts          asyncInserts
+	inQueue               map[string]bool // current uploading and retried files
+	dryRunFiles           map[string]bool // files uploaded in dry run => kept by upload worker
+	shardsLock            sync.Mutex
+	shards                map[string]uint32          // detected count of shards by data table
+	treeExists            CMap                       // store known keys and don't load it to clickhouse tree
+	tagsExists            CMap                       // known series of tags index table
+	tagsBloom             *bloomFilter               // series added to tagsExists, checked before it
+	sharedTree            *redisCache                // optional tree exists cache shared with other instances
+	treeCheckTimeout      time.Duration              // limit of check in shared tree cache
+	treeCheckRetries      int                        // connection retries of check in shared tree cache
+	discovery             *consulDiscovery           // optional instances of clickhouse url
+	tlsTransports         map[string]*http.Transport // by TLS server name of discovered instances
+	tlsTransportsLock     sync.Mutex
+	logger                *zap.Logger
 }
 
 func New(options ...Option) *Uploader {
 
 	u := &Uploader{
-		path:               "/data/carbon-clickhouse/",
-		dataTables:         []string{},
-		reverseDataTables:  []string{},
-		treeTable:          "",
-		dataTimeout:        time.Minute,
-		treeTimeout:        time.Minute,
-		treeDate:           time.Date(2016, 11, 1, 0, 0, 0, 0, time.Local),
-		inProgressCallback: func(string) bool { return false },
-		queue:              make(chan string, 1024),
-		inQueue:            make(map[string]bool),
-		threads:            1,
-		treeExists:         NewCMap(),
-		logger:             zapwriter.Logger("uploader"),
+		path:                  "/data/carbon-clickhouse/",
+		dataTables:            []string{},
+		reverseDataTables:     []string{},
+		tableOptions:          map[string]TableOptions{},
+		treeTable:             "",
+		dataTimeout:           time.Minute,
+		connectTimeout:        30 * time.Second,
+		treeTimeout:           time.Minute,
+		maxResponseSize:       DefaultMaxResponseSize,
+		pipelineDepth:         1,
+		treeCheckTimeout:      5 * time.Second,
+		treeCheckRetries:      3,
+		treeDate:              time.Date(2016, 11, 1, 0, 0, 0, 0, time.UTC),
+		treeDateLocation:      time.UTC,
+		inProgressCallback:    func(string) bool { return false },
+		queue:                 make(chan string, 1024),
+		retryChan:             make(chan string, 1024),
+		flushChan:             make(chan struct{}, 1),
+		restartChan:           make(chan struct{}, 1),
+		schemaChan:            make(chan struct{}, 1),
+		retryMinBackoff:       time.Second,
+		retryMaxBackoff:       5 * time.Minute,
+		scanInterval:          time.Second,
+		mutationWarnThreshold: 5,
+		inQueue:               make(map[string]bool),
+		dryRunFiles:           make(map[string]bool),
+		shards:                make(map[string]uint32),
+		threads:               1,
+		readAheadBuffers:      2,
+		treeBatchSize:         0,
+		treeBatchDelay:        100 * time.Millisecond,
+		insertFormat:          RowBinary.FormatRowBinary,
+		uploadOrder:           UploadOrderOldestFirst,
+		treeExists:            NewCMap(),
+		tagsExists:            NewCMap(),
+		tagsBloom:             newBloomFilter(tagsBloomBits),
+		treeSchema:            treeSchemaDefault,
+		reverseTreeSchema:     treeSchemaDefault,
+		sessionID:             newSessionID(),
+		logger:                logging.Logger("uploader"),
 	}
 
 	for _, o := range options {
 		o(u)
 	}
+	if u.dryRunRows > 0 {
+		// types of columns are required by SQL of dry run
+		u.insertFormat = RowBinary.FormatRowBinaryWithNamesAndTypes
+	}
+
+	u.transport = newTransport(u.http2, u.connectTimeout, u.writeTimeout, u.readTimeout)
+	u.tlsTransports = make(map[string]*http.Transport)
 
 	return u
 }
 
+// dataTableOptions returns schema settings of data table with defaults
+func (u *Uploader) dataTableOptions(table string) TableOptions {
+	o := u.tableOptions[table]
+	if o.DateColumn == "" {
+		o.DateColumn = "Date"
+	}
+	if o.DateColumnType == "" {
+		o.DateColumnType = RowBinary.DateTypeDate
+	}
+	if o.Engine == EngineAggregatingMergeTree && o.ValueFunction == "" {
+		o.ValueFunction = "sum"
+	}
+	return o
+}
+
+// tableURL returns ClickHouse url of data or tree table
+func (u *Uploader) tableURL(table string) string {
+	if o, exists := u.tableOptions[table]; exists && o.URL != "" {
+		return o.URL
+	}
+	return u.clickHouseDSN
+}
+
+// dataTableFormat returns INSERT format of data table. SimpleAggregateFunction column type is passed in header,
+// values are serialized same as Float64
+func (u *Uploader) dataTableFormat(o TableOptions) string {
+	if o.Engine == EngineAggregatingMergeTree {
+		return RowBinary.FormatRowBinaryWithNamesAndTypes
+	}
+	return u.insertFormat
+}
+
+func dataTableColumns(o TableOptions) string {
+	if o.ShardKeyColumn != "" {
+		return fmt.Sprintf("(Path, Value, Time, %s, Timestamp, %s)", o.DateColumn, o.ShardKeyColumn)
+	}
+	return fmt.Sprintf("(Path, Value, Time, %s, Timestamp)", o.DateColumn)
+}
+
+func dataTableHeader(o TableOptions) []byte {
+	valueType := "Float64"
+	if o.Engine == EngineAggregatingMergeTree {
+		valueType = fmt.Sprintf("SimpleAggregateFunction(%s, Float64)", o.ValueFunction)
+	}
+
+	names := []string{"Path", "Value", "Time", o.DateColumn, "Timestamp"}
+	types := []string{"String", valueType, "UInt32", o.DateColumnType, "UInt32"}
+	if o.ShardKeyColumn != "" {
+		names = append(names, o.ShardKeyColumn)
+		types = append(types, "UInt32")
+	}
+
+	return formatHeader(names, types)
+}
+
+// dataTableShards returns count of shards of Distributed table cluster. Successful result is cached until Reconfigure
+func (u *Uploader) dataTableShards(table string, o TableOptions) (uint32, error) {
+	u.shardsLock.Lock()
+	shards, exists := u.shards[table]
+	u.shardsLock.Unlock()
+
+	if exists {
+		return shards, nil
+	}
+
+	body, err := u.post(
+		u.tableURL(table),
+		fmt.Sprintf("SELECT count() FROM system.clusters WHERE cluster='%s' AND replica_num=1 FORMAT TabSeparated",
+			strings.Replace(strings.Replace(o.Cluster, "\\", "\\\\", -1), "'", "\\'", -1)),
+		nil,
+		u.dataTimeout,
+		nil,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(body)), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("cluster %#v not found", o.Cluster)
+	}
+
+	u.logger.Info("cluster shards detected",
+		zap.String("table", table),
+		zap.String("cluster", o.Cluster),
+		zap.Uint64("shards", n),
+	)
+
+	u.shardsLock.Lock()
+	u.shards[table] = uint32(n)
+	u.shardsLock.Unlock()
+
+	return uint32(n), nil
+}
+
+func formatHeader(names []string, types []string) []byte {
+	wb := RowBinary.NewWriteBufferWithNames(names, types)
+	return append([]byte(nil), wb.Bytes()...)
+}
+
+// withHeader prepends RowBinaryWithNamesAndTypes header to data if required by insert format
+func withHeader(format string, data io.Reader, header []byte) io.Reader {
+	if format != RowBinary.FormatRowBinaryWithNamesAndTypes {
+		return data
+	}
+
+	return io.MultiReader(bytes.NewReader(header), data)
+}
+
+// Reconfigure applies options without stopping upload workers. Waits for in-progress uploads,
+// they are finished with old settings. Intended for clickhouse url, tables, timeouts and insert format change
+func (u *Uploader) Reconfigure(options ...Option) {
+	u.configLock.Lock()
+	defer u.configLock.Unlock()
+
+	treeURL, reverseTreeURL := u.tableURL(u.treeTable), u.tableURL(u.reverseTreeTable)
+	treeTable, reverseTreeTable := u.treeTable, u.reverseTreeTable
+	tagsURL, tagsTable := u.tableURL(u.tagsTable), u.tagsTable
+	database := u.database
+
+	for _, o := range options {
+		o(u)
+	}
+	if u.dryRunRows > 0 {
+		// types of columns are required by SQL of dry run
+		u.insertFormat = RowBinary.FormatRowBinaryWithNamesAndTypes
+	}
+
+	u.transport = newTransport(u.http2, u.connectTimeout, u.writeTimeout, u.readTimeout)
+	u.tlsTransportsLock.Lock()
+	u.tlsTransports = make(map[string]*http.Transport)
+	u.tlsTransportsLock.Unlock()
+
+	// cluster or url of table may be changed
+	u.shardsLock.Lock()
+	u.shards = make(map[string]uint32)
+	u.shardsLock.Unlock()
+
+	// tree cache and schema are known only for old server and tables
+	if treeTable != u.treeTable || reverseTreeTable != u.reverseTreeTable || database != u.database ||
+		treeURL != u.tableURL(u.treeTable) || reverseTreeURL != u.tableURL(u.reverseTreeTable) {
+		u.treeExists.Clear()
+		u.treeSchema, u.reverseTreeSchema = treeSchemaDefault, treeSchemaDefault
+		u.detectTreeSchemas()
+	}
+
+	if tagsTable != u.tagsTable || database != u.database || tagsURL != u.tableURL(u.tagsTable) {
+		u.clearTagsExists()
+	}
+
+	u.logger.Info("reconfigured", zap.String("clickhouse", u.clickHouseDSN))
+}
+
 func (u *Uploader) Start() error {
 	return u.StartFunc(func() error {
+		if u.discovery != nil {
+			u.refreshDiscovery()
+			u.Go(u.discoveryWorker)
+		}
+
+		for _, name := range UnknownRequestSettings(u.requestSettings) {
+			u.logger.Warn("unknown clickhouse setting in per-request settings", zap.String("setting", name))
+		}
+
+		u.detectTreeSchemas()
+		u.Go(u.schemaWorker)
+
+		u.configLock.Lock()
+		mutationCheckInterval := u.mutationCheckInterval
+		asyncConfirmInterval := u.asyncConfirmInterval
+		if !u.asyncInsert {
+			asyncConfirmInterval = 0
+		}
+		u.configLock.Unlock()
+
+		if u.useInotify {
+			for _, dir := range u.dataPaths() {
+				dir := dir
+				w, err := newInotify(dir)
+				if err != nil {
+					u.logger.Warn("inotify is not started, only scan interval is used", zap.String("path", dir), zap.Error(err))
+					continue
+				}
+				u.Go(func(exit chan struct{}) {
+					u.inotifyWorker(exit, w, dir)
+				})
+			}
+		}
+
 		u.Go(u.watchWorker)
 
 		for i := 0; i < u.threads; i++ {
 			u.Go(u.uploadWorker)
 		}
 
+		u.Go(u.retryWorker)
+
+		if mutationCheckInterval > 0 {
+			u.Go(func(exit chan struct{}) {
+				u.mutationsWorker(exit, mutationCheckInterval)
+			})
+		}
+
+		if asyncConfirmInterval > 0 {
+			u.Go(func(exit chan struct{}) {
+				u.asyncInsertsWorker(exit, asyncConfirmInterval)
+			})
+		}
+
 		return nil
 	})
 }
@@ -163,48 +701,414 @@ func (u *Uploader) Stat(send func(metric string, value float64)) {
 
 	send("unhandled", float64(atomic.LoadUint32(&u.stat.unhandled)))
 
+	send("retryQueueDepth", float64(u.RetryQueueDepth()))
+
+	retryDropped := atomic.LoadUint32(&u.stat.retryDropped)
+	atomic.AddUint32(&u.stat.retryDropped, -retryDropped)
+	send("retryDropped", float64(retryDropped))
+
+	inotifyEvents := atomic.LoadUint32(&u.stat.inotifyEvents)
+	atomic.AddUint32(&u.stat.inotifyEvents, -inotifyEvents)
+	send("inotifyEvents", float64(inotifyEvents))
+
+	skippedRows := atomic.LoadUint32(&u.stat.skippedRows)
+	atomic.AddUint32(&u.stat.skippedRows, -skippedRows)
+	send("skippedRows", float64(skippedRows))
+
+	send("pendingMutations", float64(atomic.LoadUint32(&u.stat.pendingMutations)))
+
+	send("schemaMismatchFallbackTotal", float64(atomic.LoadUint32(&u.stat.schemaMismatchFallback)))
+
+	if u.sharedTree != nil {
+		send("treeCheckTimeoutsTotal", float64(atomic.LoadUint32(&u.stat.treeCheckTimeouts)))
+	}
+
+	if u.asyncInsert {
+		send("asyncInsertsConfirmedTotal", float64(atomic.LoadUint64(&u.asyncInserts.confirmed)))
+		send("asyncInsertsFailedTotal", float64(atomic.LoadUint64(&u.asyncInserts.failed)))
+		send("asyncInsertsPendingTotal", float64(u.asyncInserts.count()))
+	}
+
+	send("clickhouseVersionChangesTotal", float64(u.VersionChanges()))
+
+	if remaining := u.RetryBudgetRemaining(); remaining >= 0 {
+		send("retryBudgetRemainingSeconds", remaining.Seconds())
+	}
+
 	send("treeExistsCacheSize", float64(u.treeExists.Count()))
+
+	if u.tagsTable != "" {
+		send("tagsExistsCacheSize", float64(u.tagsExists.Count()))
+	}
+}
+
+// Unhandled returns count of files waiting for upload
+func (u *Uploader) Unhandled() int {
+	return int(atomic.LoadUint32(&u.stat.unhandled))
+}
+
+// Slack returns count of files writer can close before pending files reach watermark. Value is updated on scan
+// of path. -1 if watermark is disabled
+func (u *Uploader) Slack() int {
+	if u.maxPendingFiles <= 0 {
+		return -1
+	}
+	if slack := u.maxPendingFiles - int(atomic.LoadUint32(&u.stat.waiting)); slack > 0 {
+		return slack
+	}
+	return 0
 }
 
+// Lag returns age of oldest file waiting for upload
+func (u *Uploader) Lag() time.Duration {
+	oldest := atomic.LoadInt64(&u.stat.oldest)
+	if oldest == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, oldest))
+}
+
+// ClearTreeExistsCache clears known names of tree and tags index tables, so they are inserted again
 func (u *Uploader) ClearTreeExistsCache() {
 	u.treeExists.Clear()
+	u.clearTagsExists()
+}
+
+// writeTimeoutConn fails Write blocked longer than timeout
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// newTransport creates transport with timeouts: connect limits TCP connect and TLS handshake (not more than 10s),
+// write limits each blocked write of request, read limits waiting of response headers after request is sent. 0 is unlimited
+func newTransport(http2 bool, connectTimeout, writeTimeout, readTimeout time.Duration) *http.Transport {
+	tlsHandshakeTimeout := 10 * time.Second
+	if connectTimeout > 0 && connectTimeout < tlsHandshakeTimeout {
+		tlsHandshakeTimeout = connectTimeout
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || writeTimeout <= 0 {
+				return conn, err
+			}
+			return &writeTimeoutConn{Conn: conn, timeout: writeTimeout}, nil
+		},
+		ForceAttemptHTTP2:     http2, // fallback to HTTP/1.1 if server doesn't offer h2 via ALPN
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// ReservedQuerySettings are url parameters managed by carbon-clickhouse. Can't be overridden by query settings
+var ReservedQuerySettings = []string{"query", "input_format_allow_errors_num", "input_format_allow_errors_ratio"}
+
+// KnownRequestSettings are ClickHouse settings expected in per-request settings. Other names are sent too with warning on start
+var KnownRequestSettings = []string{
+	"async_insert",
+	"wait_for_async_insert",
+	"insert_quorum",
+	"insert_quorum_timeout",
+	"insert_deduplicate",
+	"insert_distributed_sync",
+	"max_insert_threads",
+	"max_memory_usage",
+	"max_execution_time",
+	"priority",
 }
 
-func uploadData(chUrl string, table string, timeout time.Duration, data io.Reader) error {
-	p, err := url.Parse(chUrl)
+// UnknownRequestSettings returns sorted names of settings which are not in KnownRequestSettings
+func UnknownRequestSettings(settings map[string]string) []string {
+	var unknown []string
+	for name := range settings {
+		known := false
+		for _, k := range KnownRequestSettings {
+			if name == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// withRequestSettings returns INSERT query settings with per-request settings
+func (u *Uploader) withRequestSettings(settings map[string]string) map[string]string {
+	if len(u.requestSettings) == 0 {
+		return settings
+	}
+
+	result := make(map[string]string, len(settings)+len(u.requestSettings))
+	for k, v := range u.requestSettings {
+		result[k] = v
+	}
+	for k, v := range settings {
+		result[k] = v
+	}
+	return result
+}
+
+// post executes query in ClickHouse with optional request body and returns response body.
+// settings are added to url query. Query is sent with DDL credentials
+func (u *Uploader) post(dsn string, query string, settings map[string]string, timeout time.Duration, data io.Reader) ([]byte, error) {
+	body, _, err := u.request(dsn, query, settings, u.ddlCredentials, timeout, data)
+	return body, err
+}
+
+// request is post with headers of response
+func (u *Uploader) request(dsn string, query string, settings map[string]string, c credentials, timeout time.Duration, data io.Reader) ([]byte, http.Header, error) {
+	if u.dryRunRows > 0 && !readOnlyQuery.MatchString(query) {
+		header, err := u.dryRunRequest(query, data)
+		return nil, header, err
+	}
+
+	p, err := url.Parse(dsn)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	transport := u.transport
+	if u.discovery != nil && dsn == u.clickHouseDSN {
+		if h, ok := u.discovery.host(); ok {
+			if p.Scheme == "https" {
+				transport = u.serverNameTransport(h.serverName(p.Hostname()))
+			}
+			p.Host = h.addr
+		}
 	}
 
 	q := p.Query()
 
-	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT RowBinary", table))
+	if u.database != "" && q.Get("database") == "" {
+		q.Set("database", u.database)
+	}
+	for k, v := range settings {
+		q.Set(k, v)
+	}
+	q.Set("query", query)
 	p.RawQuery = q.Encode()
 	queryUrl := p.String()
 
 	req, err := http.NewRequest("POST", queryUrl, data)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	c.apply(req)
+
+	client := u.httpClient
+	if client == nil {
+		client = &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		}
+	} else if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
 	}
 
-	client := &http.Client{Timeout: timeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
+	u.checkServerVersion(req.URL.Host, resp.Header.Get("Server"))
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, string(body))
+		// serialized exception with stack trace can be long
+		body, truncated := readResponse(resp.Body, u.maxResponseSize)
+		if truncated {
+			u.logger.Warn("clickhouse response is truncated",
+				zap.Int("status", resp.StatusCode),
+				zap.Int64("limit", u.maxResponseSize),
+			)
+		}
+		return nil, nil, fmt.Errorf("clickhouse response status %d: %s", resp.StatusCode, body)
 	}
 
-	return nil
+	// result of query is used by caller, truncated result is an error
+	body, truncated := readResponse(resp.Body, u.maxResponseSize)
+	if truncated {
+		return nil, nil, fmt.Errorf("clickhouse response is longer than %d bytes", u.maxResponseSize)
+	}
+
+	return body, resp.Header, nil
+}
+
+// readResponse reads up to limit bytes of body. Returns true if body is longer. Unlike ioutil.ReadAll,
+// buffer is doubled, so allocated memory is about 2*limit for any length of body
+func readResponse(body io.Reader, limit int64) ([]byte, bool) {
+	b := make([]byte, 0, 512)
+	for {
+		if len(b) == cap(b) {
+			size := 2 * int64(cap(b))
+			if size > limit+1 {
+				size = limit + 1
+			}
+			if int64(len(b)) == size {
+				break
+			}
+			b = append(make([]byte, 0, size), b...)
+		}
+		n, err := body.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err != nil {
+			break
+		}
+	}
+
+	if int64(len(b)) > limit {
+		return b[:limit], true
+	}
+	return b, false
+}
+
+// Query executes SELECT query in ClickHouse and returns response body
+func (u *Uploader) Query(query string, timeout time.Duration) ([]byte, error) {
+	u.configLock.RLock()
+	defer u.configLock.RUnlock()
+
+	return u.post(u.clickHouseDSN, query, nil, timeout, nil)
+}
+
+func (u *Uploader) uploadData(dsn string, table string, format string, settings map[string]string, timeout time.Duration, data io.Reader) error {
+	_, err := u.insertData(dsn, table, format, settings, timeout, data)
+	return err
+}
+
+// insertData is uploadData with count of written rows from X-ClickHouse-Summary header. Returns -1 if count is unknown
+func (u *Uploader) insertData(dsn string, table string, format string, settings map[string]string, timeout time.Duration, data io.Reader) (int64, error) {
+	written, err := u.insert(dsn, table, format, settings, timeout, data)
+	u.tableStatus.add(table, written, err)
+	return written, err
+}
+
+// insert is insertData without update of table status
+func (u *Uploader) insert(dsn string, table string, format string, settings map[string]string, timeout time.Duration, data io.Reader) (int64, error) {
+	_, header, err := u.request(dsn, fmt.Sprintf("INSERT INTO %s FORMAT %s", table, format), u.withSession(u.withAsyncInsert(u.withRequestSettings(settings))), u.dmlCredentials, timeout, data)
+	if err != nil {
+		return -1, err
+	}
+	u.trackAsyncInsert(dsn, table, header.Get("X-ClickHouse-Query-Id"))
+
+	var summary struct {
+		WrittenRows string `json:"written_rows"`
+	}
+	if json.Unmarshal([]byte(header.Get("X-ClickHouse-Summary")), &summary) != nil {
+		return -1, nil
+	}
+
+	written, err := strconv.ParseInt(summary.WrittenRows, 10, 64)
+	if err != nil {
+		return -1, nil
+	}
+	return written, nil
+}
+
+// dataQuerySettings returns query settings of data tables INSERT with allowed errors
+func (u *Uploader) dataQuerySettings() map[string]string {
+	if u.allowErrorsNum == 0 && u.allowErrorsRatio == 0 {
+		return u.querySettings
+	}
+
+	settings := make(map[string]string, len(u.querySettings)+2)
+	for k, v := range u.querySettings {
+		settings[k] = v
+	}
+	settings["input_format_allow_errors_num"] = strconv.Itoa(u.allowErrorsNum)
+	settings["input_format_allow_errors_ratio"] = strconv.FormatFloat(u.allowErrorsRatio, 'f', -1, 64)
+	return settings
+}
+
+// tenantTableNames returns sorted tenant tables
+func (u *Uploader) tenantTableNames() []string {
+	tables := make([]string, 0, len(u.tenantTables))
+	for table := range u.tenantTables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// dataTableFilter returns prefix filter of table rows: only prefixes of tenant table or all except tenant prefixes.
+// Fallback table of tenant table is filtered as tenant table
+func (u *Uploader) dataTableFilter(tablename string) ([]string, bool) {
+	if prefixes, exists := u.tenantTables[tablename]; exists {
+		return prefixes, true
+	}
+	for tenant, prefixes := range u.tenantTables {
+		if u.tableOptions[tenant].FallbackTable == tablename {
+			return prefixes, true
+		}
+	}
+	return u.tenantPrefixes, false
+}
+
+// checkSkippedRows compares count of file rows with rows written by ClickHouse if errors are allowed
+func (u *Uploader) checkSkippedRows(logger *zap.Logger, filename string, tablename string, written int64) {
+	if written < 0 || u.preUpload != nil || (u.allowErrorsNum == 0 && u.allowErrorsRatio == 0) {
+		return
+	}
+
+	reader, err := RowBinary.NewReader(filename)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	reader.SetPrefixFilter(u.dataTableFilter(tablename))
+
+	var rows int64
+	for {
+		if _, err = reader.ReadRecord(); err != nil {
+			break
+		}
+		rows++
+	}
+
+	u.countSkippedRows(logger, tablename, rows, written)
+}
+
+// countSkippedRows counts difference of sent rows and rows written by ClickHouse. Transformed rows are not counted
+func (u *Uploader) countSkippedRows(logger *zap.Logger, tablename string, rows int64, written int64) {
+	if written < 0 || u.preUpload != nil || (u.allowErrorsNum == 0 && u.allowErrorsRatio == 0) {
+		return
+	}
+
+	if rows > written {
+		atomic.AddUint32(&u.stat.skippedRows, uint32(rows-written))
+		logger.Warn("clickhouse skipped bad rows",
+			zap.String("table", tablename),
+			zap.Int64("skipped", rows-written),
+			zap.Int64("written", written),
+		)
+	}
 }
 
 func (u *Uploader) uploadDataTable(filename string, tablename string) error {
 	logger := u.logger.With(zap.String("filename", filename))
+	options := u.dataTableOptions(tablename)
+	format := u.dataTableFormat(options)
 
 	file, err := os.Open(filename)
 	if err != nil {
@@ -221,12 +1125,47 @@ func (u *Uploader) uploadDataTable(filename string, tablename string) error {
 		logger.Info("file is empty")
 		return nil
 	}
-	err = uploadData(
-		u.clickHouseDSN,
-		fmt.Sprintf("%s (Path, Value, Time, Date, Timestamp)", tablename),
+
+	if u.chunked(fi.Size()) {
+		return u.uploadChunks(logger, filename, tablename, false, fi.Size())
+	}
+
+	var shards uint32
+	if options.ShardKeyColumn != "" {
+		shards, err = u.dataTableShards(tablename, options)
+		if err != nil {
+			return err
+		}
+	}
+
+	prefixes, include := u.dataTableFilter(tablename)
+
+	var data io.Reader = file
+	if options.DateColumnType != RowBinary.DateTypeDate || shards > 0 || len(prefixes) > 0 || u.preUpload != nil {
+		// file stores Date without shard key and rows of all tenants. convert records while reading
+		var reader *RowBinary.Reader
+		reader, err = RowBinary.NewReader(filename)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		reader.SetDateType(options.DateColumnType)
+		reader.SetShards(shards)
+		reader.SetPrefixFilter(prefixes, include)
+		reader.SetTransform(u.preUpload)
+		data = reader
+	}
+
+	data, stopReadAhead := u.readAhead(data)
+	written, err := u.insertData(
+		u.tableURL(tablename),
+		fmt.Sprintf("%s %s", tablename, dataTableColumns(options)),
+		format,
+		u.dataQuerySettings(),
 		u.dataTimeout,
-		file,
+		withHeader(format, data, dataTableHeader(options)),
 	)
+	stopReadAhead()
 
 	if err != nil {
 		if strings.Index(err.Error(), "Code: 33, e.displayText() = DB::Exception: Cannot read all data") >= 0 {
@@ -237,13 +1176,20 @@ func (u *Uploader) uploadDataTable(filename string, tablename string) error {
 			if err != nil {
 				return err
 			}
+			defer reader.Close()
+			reader.SetDateType(options.DateColumnType)
+			reader.SetShards(shards)
+			reader.SetPrefixFilter(prefixes, include)
+			reader.SetTransform(u.preUpload)
 
 			// try slow read method with skip bad records
-			err = uploadData(
-				u.clickHouseDSN,
-				fmt.Sprintf("%s (Path, Value, Time, Date, Timestamp)", tablename),
+			written, err = u.insertData(
+				u.tableURL(tablename),
+				fmt.Sprintf("%s %s", tablename, dataTableColumns(options)),
+				format,
+				u.dataQuerySettings(),
 				u.dataTimeout,
-				reader,
+				withHeader(format, reader, dataTableHeader(options)),
 			)
 			if err != nil {
 				return err
@@ -251,30 +1197,70 @@ func (u *Uploader) uploadDataTable(filename string, tablename string) error {
 		}
 	}
 
+	if err == nil {
+		u.checkSkippedRows(logger, filename, tablename, written)
+	}
+
 	return err
 }
 
 func (u *Uploader) uploadReverseDataTable(filename string, tablename string) error {
+	options := u.dataTableOptions(tablename)
+	format := u.dataTableFormat(options)
+
+	if u.uploadChunkSize > 0 || u.maxInsertBlockSize > 0 {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if u.chunked(fi.Size()) {
+			return u.uploadChunks(u.logger.With(zap.String("filename", filename)), filename, tablename, true, fi.Size())
+		}
+	}
+
+	var shards uint32
+	if options.ShardKeyColumn != "" {
+		var err error
+		shards, err = u.dataTableShards(tablename, options)
+		if err != nil {
+			return err
+		}
+	}
+
 	reader, err := RowBinary.NewReverseReader(filename)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
+	reader.SetDateType(options.DateColumnType)
+	reader.SetShards(shards)
+	reader.SetPrefixFilter(u.dataTableFilter(tablename))
+	reader.SetTransform(u.preUpload)
 
 	// try slow read method with skip bad records
-	err = uploadData(
-		u.clickHouseDSN,
-		fmt.Sprintf("%s (Path, Value, Time, Date, Timestamp)", tablename),
+	data, stopReadAhead := u.readAhead(reader)
+	written, err := u.insertData(
+		u.tableURL(tablename),
+		fmt.Sprintf("%s %s", tablename, dataTableColumns(options)),
+		format,
+		u.dataQuerySettings(),
 		u.dataTimeout,
-		reader,
+		withHeader(format, data, dataTableHeader(options)),
 	)
+	stopReadAhead()
 	if err != nil {
 		return err
 	}
 
+	u.checkSkippedRows(u.logger.With(zap.String("filename", filename)), filename, tablename, written)
+
 	return err
 }
 
 func (u *Uploader) upload(exit chan struct{}, filename string) (err error) {
+	u.configLock.RLock()
+	defer u.configLock.RUnlock()
+
 	startTime := time.Now()
 
 	logger := u.logger.With(zap.String("filename", filename))
@@ -288,6 +1274,9 @@ func (u *Uploader) upload(exit chan struct{}, filename string) (err error) {
 				zap.Duration("time", time.Now().Sub(startTime)),
 			)
 		} else {
+			if u.dryRunRows > 0 {
+				u.markDryRun(filename)
+			}
 			atomic.AddUint32(&u.stat.uploaded, 1)
 			logger.Info("handle success",
 				zap.Duration("time", time.Now().Sub(startTime)),
@@ -295,20 +1284,52 @@ func (u *Uploader) upload(exit chan struct{}, filename string) (err error) {
 		}
 	}()
 
+	// files of table data paths are written only for own tables
+	if tables := u.pathTables(path.Dir(filename)); tables != nil {
+		for _, tablename := range tables {
+			upload := u.uploadDataTable
+			if u.isReverseDataTable(tablename) {
+				upload = u.uploadReverseDataTable
+			}
+			if err = u.uploadWithFallback(logger, filename, tablename, upload); err != nil {
+				return u.tableError(tablename, err)
+			}
+		}
+		return nil
+	}
+
 	for _, tablename := range u.dataTables {
-		err = u.uploadDataTable(filename, tablename)
+		if u.hasOwnPath(tablename) {
+			continue
+		}
+		err = u.uploadWithFallback(logger, filename, tablename, u.uploadDataTable)
 		if err != nil {
-			return err
+			return u.tableError(tablename, err)
 		}
 	}
 
 	for _, tablename := range u.reverseDataTables {
-		err = u.uploadReverseDataTable(filename, tablename)
+		if u.hasOwnPath(tablename) {
+			continue
+		}
+		err = u.uploadWithFallback(logger, filename, tablename, u.uploadReverseDataTable)
 		if err != nil {
-			return err
+			return u.tableError(tablename, err)
 		}
 	}
 
+	for _, tablename := range u.tenantTableNames() {
+		err = u.uploadWithFallback(logger, filename, tablename, u.uploadDataTable)
+		if err != nil {
+			return u.tableError(tablename, err)
+		}
+	}
+
+	err = u.uploadTagsIndex(filename)
+	if err != nil {
+		return u.tableError(u.tagsTable, err)
+	}
+
 	if u.treeTable == "" { // don't make index in clickhouse
 		return nil
 	}
@@ -319,28 +1340,15 @@ func (u *Uploader) upload(exit chan struct{}, filename string) (err error) {
 		return err
 	}
 
-	if tree.data.Len() > 0 {
-		err = uploadData(
-			u.clickHouseDSN,
-			fmt.Sprintf("%s (Date, Level, Path, Version)", u.treeTable),
-			u.treeTimeout,
-			tree.data,
-		)
+	defer func() {
 		if err != nil {
-			return err
+			tree.Release()
 		}
-	}
+	}()
 
-	if u.reverseTreeTable != "" && tree.dataReverse.Len() > 0 {
-		err = uploadData(
-			u.clickHouseDSN,
-			fmt.Sprintf("%s (Date, Level, Path, Version)", u.reverseTreeTable),
-			u.treeTimeout,
-			tree.dataReverse,
-		)
-		if err != nil {
-			return err
-		}
+	err = u.insertTree(tree)
+	if err != nil {
+		return u.tableError(u.treeTable, err)
 	}
 
 	tree.Success()
@@ -356,16 +1364,18 @@ func (u *Uploader) uploadWorker(exit chan struct{}) {
 		case filename := <-u.queue:
 			err := u.upload(exit, filename)
 			if err == nil {
-				err := os.Remove(filename)
-				if err != nil {
-					u.logger.Error("file delete failed",
-						zap.String("filename", filename),
-						zap.Error(err),
-					)
-				} else {
-					u.logger.Info("file deleted",
-						zap.String("filename", filename),
-					)
+				if u.keepDryRunFile(filename) {
+					continue
+				}
+				u.removeFile(filename)
+			} else {
+				// file stays in inQueue until retry worker uploads it. Upload worker isn't blocked by full queue
+				// of retry worker, dropped file is queued again by next scan of path
+				select {
+				case u.retryChan <- filename:
+					continue
+				default:
+					atomic.AddUint32(&u.stat.retryDropped, 1)
 				}
 			}
 			u.Lock()
@@ -375,32 +1385,144 @@ func (u *Uploader) uploadWorker(exit chan struct{}) {
 	}
 }
 
-func (u *Uploader) watch(exit chan struct{}) {
-	flist, err := ioutil.ReadDir(u.path)
+// oldestFile returns creation time (unixnano) of oldest file. Files are named default.<unixnano>[.<date>]
+func oldestFile(files []string) int64 {
+	var oldest int64
+	for _, fn := range files {
+		ts, err := strconv.ParseInt(strings.SplitN(strings.TrimPrefix(path.Base(fn), "default."), ".", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if oldest == 0 || ts < oldest {
+			oldest = ts
+		}
+	}
+	return oldest
+}
+
+// fileDays returns date of date partitioned file named default.<unixnano>.<date>
+func fileDays(filename string) (uint16, bool) {
+	parts := strings.Split(path.Base(filename), ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	t, err := time.Parse(writer.DateFormat, parts[2])
 	if err != nil {
-		u.logger.Error("ReadDir failed", zap.Error(err))
-		return
+		return 0, false
 	}
 
+	return uint16(t.Unix() / 86400), true
+}
+
+// byFileName orders files of several data paths by name, it contains creation time
+type byFileName []string
+
+func (s byFileName) Len() int      { return len(s) }
+func (s byFileName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byFileName) Less(i, j int) bool {
+	a, b := path.Base(s[i]), path.Base(s[j])
+	if a != b {
+		return a < b
+	}
+	return s[i] < s[j]
+}
+
+// sortFiles sorts files by creation time (filename contains it) in upload order
+func sortFiles(files []string, order string) {
+	sort.Sort(byFileName(files))
+
+	switch order {
+	case UploadOrderNewestFirst:
+		sort.Sort(sort.Reverse(byFileName(files)))
+	case UploadOrderRoundRobin:
+		// oldest, newest, second oldest, second newest, ...
+		sorted := make([]string, len(files))
+		copy(sorted, files)
+
+		for i := 0; i < len(files); i++ {
+			if i%2 == 0 {
+				files[i] = sorted[i/2]
+			} else {
+				files[i] = sorted[len(sorted)-1-i/2]
+			}
+		}
+	}
+}
+
+// listFiles returns data files in path and data paths of tables
+func (u *Uploader) listFiles() ([]string, error) {
 	files := make([]string, 0)
-	for _, f := range flist {
-		if f.IsDir() {
-			continue
+	for _, dir := range u.dataPaths() {
+		flist, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
 		}
-		if !strings.HasPrefix(f.Name(), "default.") {
-			continue
+
+		for _, f := range flist {
+			if f.IsDir() {
+				continue
+			}
+			if !strings.HasPrefix(f.Name(), "default.") {
+				continue
+			}
+
+			files = append(files, path.Join(dir, f.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// Pending returns count of files waiting for upload or uploading now. Files in progress of writing are not counted
+func (u *Uploader) Pending() (int, error) {
+	files, err := u.listFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, fn := range files {
+		if !u.inProgressCallback(fn) {
+			count++
 		}
+	}
+
+	return count, nil
+}
 
-		files = append(files, path.Join(u.path, f.Name()))
+func (u *Uploader) watch(exit chan struct{}) {
+	files, err := u.listFiles()
+	if err != nil {
+		u.logger.Error("ReadDir failed", zap.Error(err))
+		return
 	}
 
 	atomic.StoreUint32(&u.stat.unhandled, uint32(len(files)))
+	atomic.StoreInt64(&u.stat.oldest, oldestFile(files))
+
+	waiting := 0
+	for _, fn := range files {
+		if !u.inProgressCallback(fn) {
+			waiting++
+		}
+	}
+	atomic.StoreUint32(&u.stat.waiting, uint32(waiting))
 
 	if len(files) == 0 {
 		return
 	}
 
-	sort.Strings(files)
+	u.configLock.RLock()
+	uploadOrder := u.uploadOrder
+	dryRun := u.dryRunRows > 0
+	u.configLock.RUnlock()
+
+	if !dryRun {
+		u.releaseDryRunFiles()
+	}
+
+	sortFiles(files, uploadOrder)
 
 	for _, fn := range files {
 		if u.inProgressCallback(fn) { // write in progress
@@ -425,16 +1547,30 @@ func (u *Uploader) watch(exit chan struct{}) {
 	}
 }
 
-func (u *Uploader) watchWorker(exit chan struct{}) {
-	t := time.NewTicker(time.Second)
-	defer t.Stop()
+// ForceFlush requests scan of path for new files without waiting for scan interval. Doesn't block
+func (u *Uploader) ForceFlush() {
+	select {
+	case u.flushChan <- struct{}{}:
+	default:
+		// scan is already requested
+	}
+}
 
+func (u *Uploader) watchWorker(exit chan struct{}) {
 	for {
+		u.configLock.RLock()
+		t := time.NewTimer(u.scanInterval)
+		u.configLock.RUnlock()
+
 		select {
 		case <-exit:
+			t.Stop()
 			return
 		case <-t.C:
 			u.watch(exit)
+		case <-u.flushChan:
+			t.Stop()
+			u.watch(exit)
 		}
 	}
 }
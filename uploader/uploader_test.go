@@ -0,0 +1,1224 @@
+package uploader
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+	"github.com/lomik/carbon-clickhouse/writer"
+)
+
+func benchmarkUploadConcurrent(b *testing.B, http2 bool) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	srv.EnableHTTP2 = http2
+	srv.StartTLS()
+	defer srv.Close()
+
+	u := New(ClickHouse(srv.URL), HTTP2(http2))
+	transport := u.transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	transport.MaxIdleConnsPerHost = 1000
+
+	data := bytes.Repeat([]byte("x"), 128)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < 1000; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := u.uploadData(u.clickHouseDSN, "graphite", RowBinary.FormatRowBinary, nil, time.Minute, bytes.NewReader(data)); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func BenchmarkUploadHTTP1(b *testing.B) {
+	benchmarkUploadConcurrent(b, false)
+}
+
+func BenchmarkUploadHTTP2(b *testing.B) {
+	benchmarkUploadConcurrent(b, true)
+}
+
+// benchmarkUploadWriterConcurrency uploads records written to concurrency files by same count of threads.
+// Mocked clickhouse spends time proportional to size of INSERT
+func benchmarkUploadWriterConcurrency(b *testing.B, concurrency int) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		time.Sleep(time.Duration(n) * 20 * time.Nanosecond)
+	}))
+	defer srv.Close()
+
+	now := uint32(time.Now().Unix())
+	days := (&days1970.Days{}).TimestampWithNow(now, now)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dir, err := ioutil.TempDir("", "carbon-clickhouse")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		fb := writer.NewFileBackend(dir, time.Hour, false, concurrency)
+		fb.Start()
+		for j := 0; j < 10; j++ {
+			wb := RowBinary.GetWriteBuffer()
+			for k := 0; k < 10000; k++ {
+				wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%d.%d", j, k)), 42, now, days, now)
+			}
+			if err = fb.Append(wb); err != nil {
+				b.Fatal(err)
+			}
+		}
+		fb.Stop()
+
+		u := New(Path(dir), ClickHouse(srv.URL), DataTables([]string{"graphite"}), Threads(concurrency), ScanInterval(time.Millisecond))
+		b.StartTimer()
+
+		u.Start()
+		for {
+			pending, err := u.Pending()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if pending == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		u.Stop()
+
+		b.StopTimer()
+		os.RemoveAll(dir)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkUploadWriterConcurrency1(b *testing.B) {
+	benchmarkUploadWriterConcurrency(b, 1)
+}
+
+func BenchmarkUploadWriterConcurrencyMaxProcs(b *testing.B) {
+	benchmarkUploadWriterConcurrency(b, runtime.GOMAXPROCS(0))
+}
+
+func TestWatchUploadOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Now().UnixNano()
+	files := make([]string, 100)
+	for i := 0; i < 100; i++ {
+		files[i] = path.Join(dir, fmt.Sprintf("default.%d", start+int64(i)*int64(time.Second)))
+		if err = ioutil.WriteFile(files[i], []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := [](struct {
+		order    string
+		expected func(i int) string
+	}){
+		{UploadOrderOldestFirst, func(i int) string { return files[i] }},
+		{UploadOrderNewestFirst, func(i int) string { return files[99-i] }},
+		{UploadOrderRoundRobin, func(i int) string {
+			if i%2 == 0 {
+				return files[i/2]
+			}
+			return files[99-i/2]
+		}},
+	}
+
+	for _, p := range table {
+		u := New(Path(dir), UploadOrder(p.order))
+		u.watch(nil)
+
+		for i := 0; i < 100; i++ {
+			fn := <-u.queue
+			if fn != p.expected(i) {
+				t.Fatalf("%s: %d: %#v != %#v", p.order, i, fn, p.expected(i))
+			}
+		}
+	}
+}
+
+func writeTestDataFile(t *testing.T, filename string) {
+	wb := RowBinary.GetWriteBuffer()
+	defer wb.Release()
+
+	now := uint32(time.Now().Unix())
+	wb.WriteGraphitePoint([]byte("hello.world"), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+
+	if err := ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconfigureClickHouse(t *testing.T) {
+	var requests [2]uint32
+
+	newServer := func(index int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			atomic.AddUint32(&requests[index], 1)
+		}))
+	}
+
+	srv1 := newServer(0)
+	defer srv1.Close()
+	srv2 := newServer(1)
+	defer srv2.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(ClickHouse(srv1.URL), HTTPClient(srv1.Client()), DataTables([]string{"graphite"}))
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	u.Reconfigure(ClickHouse(srv2.URL), HTTPClient(srv2.Client()))
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadUint32(&requests[0]) != 1 || atomic.LoadUint32(&requests[1]) != 1 {
+		t.Fatalf("requests: %d, %d", requests[0], requests[1])
+	}
+}
+
+func TestUploadDataTableDateColumn(t *testing.T) {
+	var query string
+	var bodySize int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query = r.URL.Query().Get("query")
+		bodySize = len(body)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite": {DateColumn: "EventTime", DateColumnType: RowBinary.DateTypeDateTime},
+		}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "INSERT INTO graphite (Path, Value, Time, EventTime, Timestamp) FORMAT RowBinary" {
+		t.Fatalf("query: %#v", query)
+	}
+
+	// DateTime is 2 bytes longer than Date
+	if bodySize != int(fi.Size())+2 {
+		t.Fatalf("body size %d, file size %d", bodySize, fi.Size())
+	}
+}
+
+func TestUploadAggregatingMergeTree(t *testing.T) {
+	var query string
+	var body []byte
+
+	// mocked clickhouse checks types of RowBinaryWithNamesAndTypes header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite_agg"}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite_agg": {Engine: EngineAggregatingMergeTree},
+		}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "INSERT INTO graphite_agg (Path, Value, Time, Date, Timestamp) FORMAT RowBinaryWithNamesAndTypes" {
+		t.Fatalf("query: %#v", query)
+	}
+
+	header := RowBinary.NewWriteBufferWithNames(
+		[]string{"Path", "Value", "Time", "Date", "Timestamp"},
+		[]string{"String", "SimpleAggregateFunction(sum, Float64)", "UInt32", "Date", "UInt32"},
+	)
+
+	// values of SimpleAggregateFunction are serialized same as Float64
+	expected := append(append([]byte(nil), header.Bytes()...), data...)
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("%#v != %#v", body, expected)
+	}
+}
+
+func TestUploadShardKey(t *testing.T) {
+	var lock sync.Mutex
+	bodies := make(map[string][]byte)
+	var clusterQueries uint32
+
+	// mocked clickhouse with 3 shards in cluster "metrics"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if strings.HasPrefix(query, "SELECT count() FROM system.clusters") {
+			atomic.AddUint32(&clusterQueries, 1)
+			if !strings.Contains(query, "cluster='metrics'") {
+				w.Write([]byte("0\n"))
+				return
+			}
+			w.Write([]byte("3\n"))
+			return
+		}
+
+		lock.Lock()
+		bodies[query] = body
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"hello.world", "carbon.agents.host1.cpu", "a.b.c.d", "x", "foo.bar"}
+
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for _, name := range names {
+		wb.WriteGraphitePoint([]byte(name), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	options := TableOptions{ShardKeyColumn: "ShardKey", Cluster: "metrics"}
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite_dist"}),
+		ReverseDataTables([]string{"graphite_reverse_dist"}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite_dist":         options,
+			"graphite_reverse_dist": options,
+			"graphite_unknown":      {ShardKeyColumn: "ShardKey", Cluster: "unknown"},
+		}),
+	)
+
+	for i := 0; i < 2; i++ {
+		if err = u.upload(nil, filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// count of shards is cached
+	if atomic.LoadUint32(&clusterQueries) != 2 {
+		t.Fatalf("cluster queries: %d", clusterQueries)
+	}
+
+	check := func(table string, reverse bool) {
+		body := bodies[fmt.Sprintf("INSERT INTO %s (Path, Value, Time, Date, Timestamp, ShardKey) FORMAT RowBinary", table)]
+		if body == nil {
+			t.Fatalf("%s is not inserted: %#v", table, bodies)
+		}
+
+		for _, name := range names {
+			p := []byte(name)
+			if reverse {
+				p = RowBinary.ReverseBytes(p)
+			}
+
+			// Path{uvarint length, bytes}, Value{8}, Time{4}, Date{2}, Timestamp{4}, ShardKey{4}
+			size := 1 + len(p) + 22
+			if len(body) < size || !bytes.Equal(body[1:1+len(p)], p) {
+				t.Fatalf("%s: unexpected record %#v of %s", table, body, p)
+			}
+
+			shard := binary.LittleEndian.Uint32(body[size-4 : size])
+			if shard != crc32.ChecksumIEEE(p)%3 {
+				t.Fatalf("%s: shard of %s is %d", table, p, shard)
+			}
+			body = body[size:]
+		}
+
+		if len(body) != 0 {
+			t.Fatalf("%s: unexpected tail %#v", table, body)
+		}
+	}
+
+	check("graphite_dist", false)
+	check("graphite_reverse_dist", true)
+
+	u.Reconfigure(DataTables([]string{"graphite_unknown"}), ReverseDataTables([]string{}))
+	if err = u.upload(nil, filename); err == nil {
+		t.Fatal("upload to table of unknown cluster succeeded")
+	}
+}
+
+func TestUploadQuerySettings(t *testing.T) {
+	var lock sync.Mutex
+	params := make(map[string]url.Values)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		q := r.URL.Query()
+		lock.Lock()
+		params[strings.Fields(q.Get("query"))[2]] = q
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL+"/?max_execution_time=10"),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		TreeTable("graphite_tree"),
+		QuerySettings(map[string]string{"max_memory_usage": "4000000000", "max_execution_time": "60"}),
+		TreeQuerySettings(map[string]string{"priority": "1"}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	data := params["graphite"]
+	if data.Get("max_memory_usage") != "4000000000" || data.Get("max_execution_time") != "60" || data.Get("priority") != "" {
+		t.Fatalf("data params: %#v", data)
+	}
+
+	tree := params["graphite_tree"]
+	if tree.Get("priority") != "1" || tree.Get("max_execution_time") != "10" || tree.Get("max_memory_usage") != "" {
+		t.Fatalf("tree params: %#v", tree)
+	}
+}
+
+func TestUploadRequestSettings(t *testing.T) {
+	var lock sync.Mutex
+	settings := make(map[string]url.Values)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		query := strings.Fields(r.URL.Query().Get("query"))
+		if len(query) < 3 || query[0] != "INSERT" {
+			if r.URL.Query().Get("async_insert") != "" {
+				t.Errorf("per-request settings in %#v", r.URL.Query().Get("query"))
+			}
+			return
+		}
+		lock.Lock()
+		settings[query[2]] = r.URL.Query()
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		TreeTable("graphite_tree"),
+		QuerySettings(map[string]string{"max_threads": "2"}),
+		RequestSettings(map[string]string{"async_insert": "1", "insert_quorum": "2"}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"graphite", "graphite_tree"} {
+		q := settings[table]
+		if q == nil {
+			t.Fatalf("%s not inserted", table)
+		}
+		if q.Get("async_insert") != "1" || q.Get("insert_quorum") != "2" {
+			t.Fatalf("%s settings: %#v", table, q)
+		}
+	}
+	if settings["graphite"].Get("max_threads") != "2" || settings["graphite_tree"].Get("max_threads") != "" {
+		t.Fatalf("query settings: %#v", settings)
+	}
+
+	if unknown := UnknownRequestSettings(map[string]string{"async_insert": "1", "b": "", "a": ""}); len(unknown) != 2 ||
+		unknown[0] != "a" || unknown[1] != "b" {
+		t.Fatalf("unknown: %#v", unknown)
+	}
+}
+
+func TestTableStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if strings.HasPrefix(r.URL.Query().Get("query"), "INSERT INTO graphite_broken ") {
+			http.Error(w, "Code: 60, e.displayText() = DB::Exception: Table doesn't exist", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-ClickHouse-Summary", `{"written_rows":"1"}`)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite", "graphite_broken"}),
+		TreeTable("graphite_tree"),
+	)
+
+	if s := u.TableStatus(); len(s) != 3 || s["graphite"].TotalRowsUploaded != 0 {
+		t.Fatalf("%#v", s)
+	}
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err = u.upload(nil, filename); err == nil {
+			t.Fatal("upload to graphite_broken should fail")
+		}
+	}
+
+	status := u.TableStatus()
+
+	ok := status["graphite"]
+	if ok.LastUploadTime.Before(start) || ok.LastUploadRows != 1 || ok.TotalRowsUploaded != 2 ||
+		ok.LastUploadError != "" || ok.TotalErrors != 0 {
+		t.Fatalf("graphite: %#v", ok)
+	}
+
+	broken := status["graphite_broken"]
+	if !broken.LastUploadTime.IsZero() || broken.TotalRowsUploaded != 0 || broken.TotalErrors != 2 ||
+		!strings.Contains(broken.LastUploadError, "Table doesn't exist") {
+		t.Fatalf("graphite_broken: %#v", broken)
+	}
+
+	// tree isn't uploaded after failure of data table
+	if tree := status["graphite_tree"]; tree.TotalErrors != 0 || !tree.LastUploadTime.IsZero() {
+		t.Fatalf("graphite_tree: %#v", tree)
+	}
+}
+
+func TestTableStatusRedactedError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL+"/?user=u&password=secret"),
+		DataTables([]string{"graphite"}),
+	)
+	if err = u.upload(nil, filename); err == nil {
+		t.Fatal("upload to closed server should fail")
+	}
+
+	// password of dsn isn't exposed by status
+	e := u.TableStatus()["graphite"].LastUploadError
+	if e == "" || strings.Contains(e, "secret") || !strings.Contains(e, "password=xxxxx") {
+		t.Fatalf("%#v", e)
+	}
+}
+
+func TestUploadTableURL(t *testing.T) {
+	var lock sync.Mutex
+	queries := make(map[string][]string)
+
+	server := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			lock.Lock()
+			queries[name] = append(queries[name], strings.Fields(r.URL.Query().Get("query"))[2])
+			lock.Unlock()
+		}))
+	}
+
+	srv1 := server("srv1")
+	defer srv1.Close()
+	srv2 := server("srv2")
+	defer srv2.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv1.URL),
+		DataTables([]string{"graphite", "graphite60"}),
+		TreeTable("graphite_tree"),
+		DataTableOptions(map[string]TableOptions{
+			"graphite60":    {URL: srv2.URL},
+			"graphite_tree": {URL: srv2.URL},
+		}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"srv1": {"graphite"},
+		"srv2": {"graphite60", "graphite_tree"},
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("%#v != %#v", queries, expected)
+	}
+}
+
+func TestUploadDatabase(t *testing.T) {
+	var lock sync.Mutex
+	var queries []string // <database> <query>
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		lock.Lock()
+		queries = append(queries, r.URL.Query().Get("database")+" "+r.URL.Query().Get("query"))
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL),
+		Database("metrics"),
+		DataTables([]string{"graphite", "archive.graphite"}),
+		TreeTable("graphite_tree"),
+		DataTableOptions(map[string]TableOptions{
+			"graphite_tree": {URL: srv.URL + "/?database=tree"},
+		}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"metrics INSERT INTO graphite",
+		"metrics INSERT INTO archive.graphite",
+		"tree INSERT INTO graphite_tree",
+		"metrics SELECT 1",
+	}
+	if len(queries) != len(expected) {
+		t.Fatalf("queries: %#v", queries)
+	}
+	for i, q := range expected {
+		if !strings.HasPrefix(queries[i], q+" ") && queries[i] != q {
+			t.Fatalf("query %d: %#v, expected %#v", i, queries[i], q)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query") != "SELECT 1" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "bad query")
+			return
+		}
+		io.WriteString(w, "1\n")
+	}))
+	defer srv.Close()
+
+	u := New(ClickHouse(srv.URL), HTTPClient(srv.Client()))
+
+	body, err := u.Query("SELECT 1", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "1\n" {
+		t.Fatalf("%#v", string(body))
+	}
+
+	if _, err = u.Query("SELECT 2", time.Second); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestQueryMaxResponseSize(t *testing.T) {
+	chunk := bytes.Repeat([]byte("Code: 1000. DB::Exception: stack trace\n"), 1<<10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		// 100MB error
+		for written := 0; written < 100<<20; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	// allocated memory is limited by buffer of response and error message
+	limit := int64(256 << 10)
+	u := New(ClickHouse(srv.URL), HTTPClient(srv.Client()), MaxResponseSize(limit))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	_, err := u.Query("SELECT 1", 10*time.Second)
+	runtime.ReadMemStats(&after)
+
+	if err == nil || !strings.HasPrefix(err.Error(), "clickhouse response status 500: Code: 1000.") {
+		t.Fatalf("%v", err)
+	}
+	if n := int64(len(err.Error())); n > limit+100 {
+		t.Fatalf("error of %d bytes", n)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2<<20 {
+		t.Fatalf("allocated %d bytes", allocated)
+	}
+
+	// successful result longer than limit is an error instead of truncated result
+	result := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := limit
+		if r.URL.Query().Get("query") == "SELECT long" {
+			size++
+		}
+		w.Write(bytes.Repeat([]byte("1"), int(size)))
+	}))
+	defer result.Close()
+
+	u = New(ClickHouse(result.URL), HTTPClient(result.Client()), MaxResponseSize(limit))
+	if body, err := u.Query("SELECT short", 10*time.Second); err != nil || int64(len(body)) != limit {
+		t.Fatalf("%d bytes, %v", len(body), err)
+	}
+	if body, err := u.Query("SELECT long", 10*time.Second); err == nil {
+		t.Fatalf("%d bytes of truncated result", len(body))
+	}
+}
+
+type countingTransport struct {
+	requests  uint32
+	transport http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddUint32(&t.requests, 1)
+	return t.transport.RoundTrip(req)
+}
+
+func TestHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query") == "SELECT sleep(1)" {
+			time.Sleep(time.Second)
+		}
+		io.WriteString(w, "1\n")
+	}))
+	defer srv.Close()
+
+	transport := &countingTransport{transport: srv.Client().Transport}
+	u := New(ClickHouse(srv.URL), HTTPClient(&http.Client{Transport: transport}))
+
+	if _, err := u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// request timeout is applied to custom client
+	if _, err := u.Query("SELECT sleep(1)", 100*time.Millisecond); err == nil {
+		t.Fatal("timeout expected")
+	}
+
+	// custom client survives reconfigure
+	u.Reconfigure(HTTP2(false))
+
+	if _, err := u.Query("SELECT 1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadUint32(&transport.requests); n != 3 {
+		t.Fatalf("requests: %d", n)
+	}
+}
+
+func TestForceFlush(t *testing.T) {
+	requests := make(chan struct{}, 16)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		requests <- struct{}{}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	u := New(Path(dir), ClickHouse(srv.URL), HTTPClient(srv.Client()), DataTables([]string{"graphite"}))
+	u.Start()
+	defer u.Stop()
+
+	// skip first regular scan
+	time.Sleep(10 * time.Millisecond)
+
+	writeTestDataFile(t, path.Join(dir, "default.1"))
+	u.ForceFlush()
+	// repeated request doesn't block
+	u.ForceFlush()
+
+	select {
+	case <-requests:
+		// pass
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("file is not uploaded in 100ms")
+	}
+}
+
+func TestUploadAllowInsertErrors(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	days := (&days1970.Days{}).TimestampWithNow(now, now)
+
+	wb := RowBinary.GetWriteBuffer()
+	defer wb.Release()
+	for i := 0; i < 20; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%d", i)), 42, now, days, now)
+	}
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		query = r.URL.Query()
+		// 10 bad rows are skipped
+		w.Header().Set("X-ClickHouse-Summary", `{"read_rows":"0","read_bytes":"0","written_rows":"10","written_bytes":"380"}`)
+	}))
+	defer srv.Close()
+
+	u := New(ClickHouse(srv.URL), DataTables([]string{"graphite"}),
+		QuerySettings(map[string]string{"max_insert_block_size": "1000"}),
+		AllowInsertErrors(10, 0.5),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if query.Get("input_format_allow_errors_num") != "10" || query.Get("input_format_allow_errors_ratio") != "0.5" ||
+		query.Get("max_insert_block_size") != "1000" {
+		t.Fatalf("%#v", query)
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["skippedRows"] != 10 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// settings are not sent by default
+	u = New(ClickHouse(srv.URL), DataTables([]string{"graphite"}))
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := query["input_format_allow_errors_num"]; exists {
+		t.Fatalf("%#v", query)
+	}
+}
+
+func TestUploadTenantTables(t *testing.T) {
+	var lock sync.Mutex
+	bodies := make(map[string][]byte)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		table := strings.Fields(r.URL.Query().Get("query"))[2]
+		lock.Lock()
+		bodies[table] = body
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"acme.cpu", "hello.world", "globex.eu.cpu", "acme.mem", "globex.us.cpu", "acmex.cpu"}
+
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for _, name := range names {
+		wb.WriteGraphitePoint([]byte(name), 42, now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		ReverseDataTables([]string{"graphite_reverse"}),
+		TenantTables(map[string][]string{
+			"graphite_acme":   {"acme."},
+			"graphite_globex": {"globex.eu.", "globex.us."},
+		}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite_globex": {DateColumnType: RowBinary.DateTypeDateTime},
+		}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// names of RowBinary rows with Path{uvarint length, bytes} and 18 (Date) or 20 (DateTime) bytes tail
+	check := func(table string, tail int, expected ...string) {
+		var received []string
+		for body := bodies[table]; len(body) > 0; {
+			l, n := binary.Uvarint(body)
+			received = append(received, string(body[n:n+int(l)]))
+			body = body[n+int(l)+tail:]
+		}
+		if strings.Join(received, " ") != strings.Join(expected, " ") {
+			t.Fatalf("%s: %#v", table, received)
+		}
+	}
+
+	check("graphite", 18, "hello.world", "acmex.cpu")
+	check("graphite_reverse", 18, "world.hello", "cpu.acmex")
+	check("graphite_acme", 18, "acme.cpu", "acme.mem")
+	check("graphite_globex", 20, "globex.eu.cpu", "globex.us.cpu")
+}
+
+func TestUploadSchemaMismatchFallback(t *testing.T) {
+	var lock sync.Mutex
+	var inserted []string
+	var insertedBytes int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		query := r.URL.Query().Get("query")
+		switch {
+		case strings.HasPrefix(query, "INSERT INTO graphite "), strings.HasPrefix(query, "INSERT INTO graphite_tenant "):
+			http.Error(w, "Code: 16. DB::Exception: No such column Timestamp in table default.graphite", http.StatusInternalServerError)
+			return
+		case strings.HasPrefix(query, "INSERT INTO graphite_reverse "):
+			http.Error(w, "Code: 47. DB::Exception: Missing columns: 'Timestamp'", http.StatusNotFound)
+			return
+		case strings.HasPrefix(query, "INSERT INTO graphite_broken "):
+			http.Error(w, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		inserted = append(inserted, strings.Fields(query)[2])
+		insertedBytes += n
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "default.1")
+	writeTestDataFile(t, filename)
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		ReverseDataTables([]string{"graphite_reverse"}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite":         {FallbackTable: "graphite_staging"},
+			"graphite_reverse": {FallbackTable: "graphite_reverse_staging"},
+			"graphite_broken":  {FallbackTable: "graphite_broken_staging"},
+		}),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(inserted, ",") != "graphite_staging,graphite_reverse_staging" {
+		t.Fatalf("%#v", inserted)
+	}
+
+	stat := make(map[string]float64)
+	u.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["schemaMismatchFallbackTotal"] != 2 {
+		t.Fatalf("%#v", stat)
+	}
+
+	// other errors are not routed to fallback table
+	inserted = nil
+	u = New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite_broken"}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite_broken": {FallbackTable: "graphite_broken_staging"},
+		}),
+	)
+	if err = u.upload(nil, filename); err == nil || !strings.Contains(err.Error(), "Syntax error") {
+		t.Fatalf("%#v", err)
+	}
+	if len(inserted) != 0 {
+		t.Fatalf("%#v", inserted)
+	}
+
+	// rows of tenant table are uploaded to its fallback table
+	inserted, insertedBytes = nil, 0
+	u = New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		TenantTables(map[string][]string{"graphite_tenant": {"hello."}}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite_tenant": {FallbackTable: "graphite_tenant_staging"},
+		}),
+	)
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(inserted, ",") != "graphite_tenant_staging" || insertedBytes == 0 {
+		t.Fatalf("%#v, %d bytes", inserted, insertedBytes)
+	}
+}
+
+func TestUploadSchemaMismatchFallbackChunks(t *testing.T) {
+	var lock sync.Mutex
+	inserts := make(map[string]int)
+	rows := make(map[string]int)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		query := strings.Fields(r.URL.Query().Get("query"))
+		if len(query) < 3 || query[0] != "INSERT" {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		inserts[query[2]]++
+		// schema of table is changed after 2 chunks
+		if query[2] == "graphite" && inserts[query[2]] > 2 {
+			http.Error(w, "Code: 10. DB::Exception: Not found column Timestamp in block", http.StatusInternalServerError)
+			return
+		}
+		rows[query[2]] += bytes.Count(body, []byte("hello.world."))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wb := RowBinary.GetWriteBuffer()
+	now := uint32(time.Now().Unix())
+	for i := 0; i < 100; i++ {
+		wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%03d", i)), float64(i), now, (&days1970.Days{}).TimestampWithNow(now, now), now)
+	}
+	filename := path.Join(dir, "default.1")
+	if err = ioutil.WriteFile(filename, wb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wb.Release()
+
+	u := New(
+		ClickHouse(srv.URL),
+		HTTPClient(srv.Client()),
+		DataTables([]string{"graphite"}),
+		DataTableOptions(map[string]TableOptions{
+			"graphite": {FallbackTable: "graphite_staging"},
+		}),
+		UploadChunkSize(1000),
+	)
+
+	if err = u.upload(nil, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 records of 32 bytes by chunks of 1000 bytes, fallback table receives only chunks after failure
+	lock.Lock()
+	defer lock.Unlock()
+	if inserts["graphite"] != 3 || inserts["graphite_staging"] != 2 ||
+		rows["graphite"]+rows["graphite_staging"] != 100 || rows["graphite_staging"] == 0 {
+		t.Fatalf("inserts: %#v, rows: %#v", inserts, rows)
+	}
+}
+
+func TestSlack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	create := func(names ...string) {
+		for _, name := range names {
+			if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	inProgress := path.Join(dir, "default.3")
+	u := New(
+		Path(dir),
+		MaxPendingFiles(3),
+		InProgressCallback(func(fn string) bool { return fn == inProgress }),
+	)
+	exit := make(chan struct{})
+	defer close(exit)
+
+	if s := u.Slack(); s != 3 {
+		t.Fatal(s)
+	}
+
+	// file in progress of writing is not counted
+	create("default.1", "default.2", "default.3")
+	u.watch(exit)
+	if s := u.Slack(); s != 1 {
+		t.Fatal(s)
+	}
+
+	create("default.4", "default.5")
+	u.watch(exit)
+	if s := u.Slack(); s != 0 {
+		t.Fatal(s)
+	}
+
+	if s := New(Path(dir)).Slack(); s != -1 {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,758 @@
+package writer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
+	"github.com/lomik/stop"
+	"go.uber.org/zap"
+)
+
+var (
+	errNotOpened = errors.New("file is not opened")
+	errCorrupted = errors.New("corrupted row")
+)
+
+// DateFormat is format of date in names of date partitioned files
+const DateFormat = "20060102"
+
+// interval of counting files waiting for upload
+const filesScanInterval = 10 * time.Second
+
+// maxDateFiles is limit of open files of dates by shard of date partitioned backend. Least recently written
+// file is closed before open of next one
+const maxDateFiles = 32
+
+// dataFile is opened data file
+type dataFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+func openDataFile(filename string) (dataFile, error) {
+	return os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+type fileChunk struct {
+	filename string
+	out      dataFile
+	outBuf   *bufio.Writer
+	size     int64
+	records  int64
+	index    []byte // row index entries, written on close. nil if index is disabled
+	written  uint64 // appended buffers of backend at last write
+}
+
+// intact returns true if all written rows are in file on disk
+func (c *fileChunk) intact() bool {
+	st, err := os.Stat(c.filename)
+	return err == nil && st.Size() == c.size
+}
+
+// writeIndex writes row index of closed file
+func (c *fileChunk) writeIndex(fsync bool) error {
+	idx, err := os.OpenFile(RowBinary.IndexFilename(c.filename), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = idx.Write(c.index)
+	if err == nil && fsync {
+		err = idx.Sync()
+	}
+	if closeErr := idx.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// dayShard is key of date partitioned file
+type dayShard struct {
+	days  uint16
+	shard int
+}
+
+// FileBackend writes data to files in path. New file is created every fileInterval, previous one is ready for upload.
+// Files are named default.<unixnano>. Date partitioned files are named default.<unixnano>.<date> and contain rows of one date.
+// With concurrency N rows are written to N files of interval by hash of metric name
+type FileBackend struct {
+	stop.Struct
+	sync.RWMutex    // guards inProgress and currentStat
+	writeLock       sync.Mutex
+	path            string
+	fileInterval    time.Duration
+	datePartitioned bool
+	concurrency     int             // count of files written at once
+	inProgress      map[string]bool // current writing files
+	current         []*fileChunk    // current files by shard if not date partitioned
+	days            map[dayShard]*fileChunk
+	maxDays         int           // limit of open files of dates
+	lastChunk       *fileChunk    // last written file
+	lastNano        int64         // timestamp of last opened file, names of files opened at once are unique
+	currentStat     fileChunk     // copy of name, size and rows of current files. Updated after each Append
+	scanInterval    time.Duration // interval of waiting update
+	waiting         int32         // atomic. closed files in path
+	diskUsage       int64         // atomic. size of files in path
+	fsync           bool          // sync closed files to disk
+	deadLetterPath  string        // directory of corrupt files failed on close. Empty - files are left for upload
+	rowIndex        bool          // write row index of files
+	flushErrors     uint64        // atomic. since start
+	fsyncErrors     uint64        // atomic. since start
+	closeErrors     uint64        // atomic. since start
+	openFile        func(filename string) (dataFile, error)
+	appended        uint64 // buffers written by Append since start. Guarded by writeLock
+	ackStopped      bool   // buffer is not stored, close callback is not called until restart. Guarded by writeLock
+	openFailed      bool   // current files failed to open, open is retried by next Append. Guarded by writeLock
+	interrupted     int32  // atomic. file opening retries of rotation are stopped until next Start
+	onClose         func(appended uint64)
+	slack           func() int    // files uploader can receive. Rotation is delayed while 0
+	maxFileInterval time.Duration // limit of delayed rotation
+	logger          *zap.Logger
+}
+
+// NewFileBackend creates backend writing concurrency files at once. Values less than 1 are same as 1
+func NewFileBackend(path string, fileInterval time.Duration, datePartitioned bool, concurrency int) *FileBackend {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &FileBackend{
+		path:            path,
+		fileInterval:    fileInterval,
+		datePartitioned: datePartitioned,
+		concurrency:     concurrency,
+		inProgress:      make(map[string]bool),
+		days:            make(map[dayShard]*fileChunk),
+		maxDays:         maxDateFiles * concurrency,
+		scanInterval:    filesScanInterval,
+		fsync:           true,
+		openFile:        openDataFile,
+		logger:          logging.Logger("writer"),
+	}
+}
+
+// SetFsync enables sync of closed files to disk. Enabled by default. Should be called before Start
+func (fb *FileBackend) SetFsync(enabled bool) {
+	fb.fsync = enabled
+}
+
+// SetDeadLetterPath sets directory of files corrupted by failed flush: size of file on disk differs from written
+// rows. Such files are moved there and are not uploaded. Files failed on fsync or close with all rows written
+// are left for upload. Corrupt files are left in path too if p is empty. Should be called before Start
+func (fb *FileBackend) SetDeadLetterPath(p string) {
+	fb.deadLetterPath = p
+}
+
+// SetRowIndex enables row index of files used by RowBinary.Reader.SeekRow. Index is written on close of file.
+// Should be called before Start
+func (fb *FileBackend) SetRowIndex(enabled bool) {
+	fb.rowIndex = enabled
+}
+
+// SetCloseCallback sets callback called after close of files with count of buffers written by Append since start.
+// All these buffers are stored in closed files. Callback is not called after first buffer failed on write or
+// close of its file, so not stored buffers are kept by caller until restart. Should be called before Start
+func (fb *FileBackend) SetCloseCallback(f func(appended uint64)) {
+	fb.onClose = f
+}
+
+// SetFlowControl delays rotation while slack returns 0. Each delay is twice longer than previous one,
+// files are rotated at latest after maxInterval. Disabled if slack is nil. Should be called before Start
+func (fb *FileBackend) SetFlowControl(slack func() int, maxInterval time.Duration) {
+	fb.slack = slack
+	fb.maxFileInterval = maxInterval
+}
+
+// delay returns next rotation delay of files opened age ago and delayed last time. 0 - files should be rotated
+func (fb *FileBackend) delay(age time.Duration, last time.Duration) time.Duration {
+	if fb.slack == nil || fb.slack() != 0 {
+		return 0
+	}
+
+	d := 2 * last
+	if rest := fb.maxFileInterval - age; d > rest {
+		d = rest
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d
+}
+
+// FlushErrors returns count of files failed on flush of buffer since start
+func (fb *FileBackend) FlushErrors() uint64 {
+	return atomic.LoadUint64(&fb.flushErrors)
+}
+
+// FsyncErrors returns count of files failed on fsync since start
+func (fb *FileBackend) FsyncErrors() uint64 {
+	return atomic.LoadUint64(&fb.fsyncErrors)
+}
+
+// CloseErrors returns count of files failed on close since start
+func (fb *FileBackend) CloseErrors() uint64 {
+	return atomic.LoadUint64(&fb.closeErrors)
+}
+
+func (fb *FileBackend) Start() error {
+	return fb.StartFunc(func() error {
+		atomic.StoreInt32(&fb.interrupted, 0)
+
+		// Append is blocked until first file is opened
+		fb.writeLock.Lock()
+
+		fb.Go(func(exit chan struct{}) {
+			fb.rotate(exit)
+			fb.writeLock.Unlock()
+
+			opened := time.Now()
+			wait := fb.fileInterval
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			for {
+				select {
+				case <-timer.C:
+					if d := fb.delay(time.Since(opened), wait); d > 0 {
+						fb.logger.Debug("rotation is delayed, uploader has no slack", zap.Duration("delay", d))
+						wait = d
+						timer.Reset(wait)
+						continue
+					}
+
+					fb.writeLock.Lock()
+					fb.rotate(exit)
+					fb.writeLock.Unlock()
+
+					opened = time.Now()
+					wait = fb.fileInterval
+					timer.Reset(wait)
+				case <-exit:
+					return
+				}
+			}
+		})
+
+		fb.Go(func(exit chan struct{}) {
+			fb.scan()
+
+			ticker := time.NewTicker(fb.scanInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					fb.scan()
+				case <-exit:
+					return
+				}
+			}
+		})
+
+		return nil
+	})
+}
+
+// scan counts closed files and size of all files in path
+func (fb *FileBackend) scan() {
+	flist, err := ioutil.ReadDir(fb.path)
+	if err != nil {
+		fb.logger.Error("ReadDir failed", zap.Error(err))
+		return
+	}
+
+	count := 0
+	var size int64
+	for _, f := range flist {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), "default.") {
+			continue
+		}
+		size += f.Size()
+		if fb.IsInProgress(path.Join(fb.path, f.Name())) {
+			continue
+		}
+		count++
+	}
+
+	atomic.StoreInt32(&fb.waiting, int32(count))
+	atomic.StoreInt64(&fb.diskUsage, size)
+}
+
+// DiskUsage returns size of data files in path including current files. Value is updated every 10 seconds
+func (fb *FileBackend) DiskUsage() int64 {
+	return atomic.LoadInt64(&fb.diskUsage)
+}
+
+// FilesWaiting returns count of closed files waiting for upload. Value is updated every 10 seconds
+func (fb *FileBackend) FilesWaiting() int {
+	return int(atomic.LoadInt32(&fb.waiting))
+}
+
+// CurrentFile returns name, size and count of rows of last written file.
+// Size and rows are summed for all open files of date partitioned backend
+func (fb *FileBackend) CurrentFile() (string, int64, int64) {
+	fb.RLock()
+	defer fb.RUnlock()
+	return fb.currentStat.filename, fb.currentStat.size, fb.currentStat.records
+}
+
+// updateCurrentStat copies state of current files for CurrentFile. writeLock should be locked by caller
+func (fb *FileBackend) updateCurrentStat() {
+	var stat fileChunk
+
+	for _, c := range fb.current {
+		stat.size += c.size
+		stat.records += c.records
+	}
+	if len(fb.current) > 0 {
+		stat.filename = fb.current[0].filename
+	}
+
+	for _, c := range fb.days {
+		stat.size += c.size
+		stat.records += c.records
+	}
+	if fb.lastChunk != nil {
+		stat.filename = fb.lastChunk.filename
+	}
+
+	fb.Lock()
+	fb.currentStat = stat
+	fb.Unlock()
+}
+
+// Interrupt stops file opening retries of rotation, so Append blocked by failed rotation returns before Stop
+func (fb *FileBackend) Interrupt() {
+	atomic.StoreInt32(&fb.interrupted, 1)
+}
+
+// Stop flushes and closes current files
+func (fb *FileBackend) Stop() {
+	fb.StopFunc(func() {
+		fb.writeLock.Lock()
+		defer fb.writeLock.Unlock()
+		fb.close()
+		fb.openFailed = false
+	})
+}
+
+func (fb *FileBackend) IsInProgress(filename string) bool {
+	fb.RLock()
+	v := fb.inProgress[filename]
+	fb.RUnlock()
+	return v
+}
+
+func (fb *FileBackend) Append(buf *RowBinary.WriteBuffer) error {
+	defer buf.Release()
+
+	fb.writeLock.Lock()
+	defer fb.writeLock.Unlock()
+	defer fb.updateCurrentStat()
+
+	var err error
+	if !fb.datePartitioned && fb.current == nil && fb.openFailed {
+		if openErr := fb.openCurrent(); openErr != nil {
+			fb.logger.Error("create failed", zap.Error(openErr))
+		}
+	}
+
+	if !fb.datePartitioned && fb.current == nil {
+		err = errNotOpened
+	} else if !fb.datePartitioned && fb.concurrency == 1 {
+		err = fb.current[0].write(buf.Body[:buf.Used])
+	} else {
+		err = fb.appendRows(buf.Body[:buf.Used])
+	}
+
+	// rows before corrupted one are stored, buffer can't be stored better
+	if err == nil || err == errCorrupted {
+		fb.appended++
+		return err
+	}
+	fb.stopAck(err)
+
+	if err != errNotOpened {
+		// buffered writer of failed file is broken, next rows are written to new files
+		fb.close()
+		if !fb.datePartitioned {
+			if openErr := fb.openCurrent(); openErr != nil {
+				fb.logger.Error("create failed", zap.Error(openErr))
+			}
+		}
+	}
+	return err
+}
+
+// write appends rows to file. writeLock should be locked by caller
+func (c *fileChunk) write(p []byte) error {
+	n, err := c.outBuf.Write(p)
+	if c.index != nil {
+		c.indexRows(p[:n])
+	}
+	c.size += int64(n)
+	c.records += int64(countRows(p[:n]))
+	return err
+}
+
+// indexRows appends offsets of every IndexInterval row of p to index. Should be called before update of size and records
+func (c *fileChunk) indexRows(p []byte) {
+	offset := c.size
+	for row := c.records; len(p) > 0; row++ {
+		_, _, size, err := parseRow(p)
+		if err != nil {
+			return
+		}
+		if row%RowBinary.IndexInterval == 0 {
+			c.index = RowBinary.AppendIndexEntry(c.index, offset)
+		}
+		offset += int64(size)
+		p = p[size:]
+	}
+}
+
+// countRows returns count of complete rows in p
+func countRows(p []byte) int {
+	count := 0
+	for len(p) > 0 {
+		_, _, size, err := parseRow(p)
+		if err != nil {
+			break
+		}
+		p = p[size:]
+		count++
+	}
+	return count
+}
+
+// parseRow returns name, Date column and size of first row in p
+func parseRow(p []byte) ([]byte, uint16, int, error) {
+	l, n := binary.Uvarint(p)
+	if n <= 0 {
+		return nil, 0, 0, errCorrupted
+	}
+
+	// name, value{8}, timestamp{4}, days(date){2}, version{4}
+	size := n + int(l) + 18
+	if size > len(p) {
+		return nil, 0, 0, errCorrupted
+	}
+
+	return p[n : n+int(l)], binary.LittleEndian.Uint16(p[n+int(l)+12:]), size, nil
+}
+
+// shard returns index of file for metric name
+func (fb *FileBackend) shard(name []byte) int {
+	if fb.concurrency == 1 {
+		return 0
+	}
+	return int(crc32.ChecksumIEEE(name) % uint32(fb.concurrency))
+}
+
+// rowKey returns file key of row. Days are 0 if backend is not date partitioned
+func (fb *FileBackend) rowKey(p []byte) (dayShard, int, error) {
+	name, days, size, err := parseRow(p)
+	if err != nil {
+		return dayShard{}, 0, err
+	}
+
+	key := dayShard{shard: fb.shard(name)}
+	if fb.datePartitioned {
+		key.days = days
+	}
+	return key, size, nil
+}
+
+// appendRows writes rows to files of their dates and shards. writeLock should be locked by caller
+func (fb *FileBackend) appendRows(body []byte) error {
+	for offset := 0; offset < len(body); {
+		start := offset
+
+		key, size, err := fb.rowKey(body[offset:])
+		if err != nil {
+			return err
+		}
+		offset += size
+
+		// sequential rows of same file are written at once
+		for offset < len(body) {
+			k, size, err := fb.rowKey(body[offset:])
+			if err != nil || k != key {
+				break
+			}
+			offset += size
+		}
+
+		var c *fileChunk
+		if fb.datePartitioned {
+			c, err = fb.dayChunk(key)
+			if err != nil {
+				return err
+			}
+		} else {
+			c = fb.current[key.shard]
+		}
+
+		fb.lastChunk = c
+		c.written = fb.appended
+		if err = c.write(body[start:offset]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dayChunk returns opened file of date and shard. writeLock should be locked by caller
+func (fb *FileBackend) dayChunk(key dayShard) (*fileChunk, error) {
+	if c := fb.days[key]; c != nil {
+		return c, nil
+	}
+
+	if len(fb.days) >= fb.maxDays {
+		fb.closeIdleDay()
+	}
+
+	date := time.Unix(int64(key.days)*86400, 0).UTC().Format(DateFormat)
+	c, err := fb.open(fmt.Sprintf("default.%d.%s", fb.nextNano(), date))
+	if err != nil {
+		return nil, err
+	}
+
+	fb.days[key] = c
+	return c, nil
+}
+
+// closeIdleDay closes least recently written file of date, it is ready for upload. writeLock should be locked by caller
+func (fb *FileBackend) closeIdleDay() {
+	var idle dayShard
+	var c *fileChunk
+	for key, chunk := range fb.days {
+		if c == nil || chunk.written < c.written {
+			idle, c = key, chunk
+		}
+	}
+	if c == nil {
+		return
+	}
+
+	if err := fb.closeChunk(c); err != nil {
+		fb.stopAck(err)
+	}
+	delete(fb.days, idle)
+	if fb.lastChunk == c {
+		fb.lastChunk = nil
+	}
+
+	fb.Lock()
+	delete(fb.inProgress, c.filename)
+	fb.Unlock()
+}
+
+// nextNano returns current unixnano greater than timestamp of previous file. writeLock should be locked by caller
+func (fb *FileBackend) nextNano() int64 {
+	ts := time.Now().UnixNano()
+	if ts <= fb.lastNano {
+		ts = fb.lastNano + 1
+	}
+	fb.lastNano = ts
+	return ts
+}
+
+// openCurrent opens concurrency files of interval. Opened files are closed on error. writeLock should be locked by caller
+func (fb *FileBackend) openCurrent() error {
+	current := make([]*fileChunk, 0, fb.concurrency)
+	for i := 0; i < fb.concurrency; i++ {
+		c, err := fb.open(fmt.Sprintf("default.%d", fb.nextNano()))
+		if err != nil {
+			fb.current = current
+			fb.close()
+			fb.openFailed = true
+			return err
+		}
+		current = append(current, c)
+	}
+
+	fb.current = current
+	fb.openFailed = false
+	fb.updateCurrentStat()
+	return nil
+}
+
+func (fb *FileBackend) open(name string) (*fileChunk, error) {
+	fn := path.Join(fb.path, name)
+
+	fb.Lock()
+	fb.inProgress[fn] = true
+	fb.Unlock()
+
+	out, err := fb.openFile(fn)
+	if err != nil {
+		fb.Lock()
+		delete(fb.inProgress, fn)
+		fb.Unlock()
+		return nil, err
+	}
+
+	c := &fileChunk{
+		filename: fn,
+		out:      out,
+		outBuf:   bufio.NewWriterSize(out, 1024*1024),
+	}
+	if fb.rowIndex {
+		c.index = make([]byte, 0, 64)
+	}
+	return c, nil
+}
+
+// stopAck stops close callback after buffer which is not stored. writeLock should be locked by caller
+func (fb *FileBackend) stopAck(err error) {
+	if fb.onClose == nil || fb.ackStopped {
+		return
+	}
+	fb.ackStopped = true
+	fb.logger.Error("buffer is not stored, acknowledgment of buffers is stopped until restart", zap.Error(err))
+}
+
+// close flushes and closes current files. Closed files are ready for upload. writeLock should be locked by caller
+func (fb *FileBackend) close() {
+	closed := make([]string, 0)
+
+	for _, c := range fb.current {
+		if err := fb.closeChunk(c); err != nil {
+			fb.stopAck(err)
+		}
+		closed = append(closed, c.filename)
+	}
+	fb.current = nil
+
+	fb.lastChunk = nil
+
+	for days, c := range fb.days {
+		if err := fb.closeChunk(c); err != nil {
+			fb.stopAck(err)
+		}
+		closed = append(closed, c.filename)
+		delete(fb.days, days)
+	}
+
+	fb.Lock()
+	for _, fn := range closed {
+		delete(fb.inProgress, fn)
+	}
+	fb.currentStat = fileChunk{}
+	fb.Unlock()
+
+	if fb.onClose != nil && !fb.ackStopped {
+		fb.onClose(fb.appended)
+	}
+}
+
+// closeChunk flushes buffer, syncs file to disk if fsync is enabled and closes file. First error is returned,
+// corrupt file is moved to dead letter path. writeLock should be locked by caller
+func (fb *FileBackend) closeChunk(c *fileChunk) error {
+	err := c.outBuf.Flush()
+	if err != nil {
+		atomic.AddUint64(&fb.flushErrors, 1)
+	} else if fb.fsync {
+		if err = c.out.Sync(); err != nil {
+			atomic.AddUint64(&fb.fsyncErrors, 1)
+		}
+	}
+	if closeErr := c.out.Close(); closeErr != nil {
+		atomic.AddUint64(&fb.closeErrors, 1)
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	if err == nil {
+		if c.index != nil {
+			if indexErr := c.writeIndex(fb.fsync); indexErr != nil {
+				// file is read sequentially without index
+				os.Remove(RowBinary.IndexFilename(c.filename))
+				fb.logger.Error("row index write failed", zap.String("filename", c.filename), zap.Error(indexErr))
+			}
+		}
+		return nil
+	}
+
+	logger := fb.logger.With(zap.String("filename", c.filename))
+	if fb.deadLetterPath == "" || c.intact() {
+		// rows of intact file are readable by uploader, file is read sequentially without index
+		logger.Error("close failed, file is left for upload", zap.Error(err))
+		return err
+	}
+
+	target := path.Join(fb.deadLetterPath, path.Base(c.filename))
+	moveErr := os.MkdirAll(fb.deadLetterPath, 0755)
+	if moveErr == nil {
+		moveErr = os.Rename(c.filename, target)
+	}
+	if moveErr != nil {
+		logger.Error("close failed, file can't be moved to dead letter path", zap.Error(err), zap.String("move_error", moveErr.Error()))
+		return err
+	}
+	logger.Error("close failed, file is moved to dead letter path", zap.String("target", target), zap.Error(err))
+	return err
+}
+
+// Flush closes current files, so they are ready for upload. New file is opened without delay, failed open
+// is retried by next Append. Regular rotation retries on error
+func (fb *FileBackend) Flush() error {
+	fb.writeLock.Lock()
+	defer fb.writeLock.Unlock()
+
+	fb.close()
+
+	if fb.datePartitioned {
+		return nil
+	}
+
+	return fb.openCurrent()
+}
+
+// rotate closes old files, opens new. Date partitioned files are opened on first row of date.
+// writeLock should be locked by caller
+func (fb *FileBackend) rotate(exit chan struct{}) {
+	fb.close()
+
+	if fb.datePartitioned {
+		return
+	}
+
+	for {
+		err := fb.openCurrent()
+		if err == nil {
+			return
+		}
+
+		fb.logger.Error("create failed", zap.Error(err))
+
+		// check exit channel
+		select {
+		case <-exit:
+			return
+		default:
+		}
+		if atomic.LoadInt32(&fb.interrupted) != 0 {
+			return
+		}
+
+		// try and spam to error log every second
+		time.Sleep(time.Second)
+	}
+}
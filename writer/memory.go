@@ -0,0 +1,39 @@
+package writer
+
+import (
+	"sync"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// MemoryBackend keeps received buffers in memory until Drain. Data is not uploaded to ClickHouse
+type MemoryBackend struct {
+	sync.Mutex
+	buffers []*RowBinary.WriteBuffer
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		buffers: make([]*RowBinary.WriteBuffer, 0),
+	}
+}
+
+func (mb *MemoryBackend) Append(buf *RowBinary.WriteBuffer) error {
+	mb.Lock()
+	mb.buffers = append(mb.buffers, buf)
+	mb.Unlock()
+	return nil
+}
+
+// Stop does nothing. Buffers are available for Drain after stop
+func (mb *MemoryBackend) Stop() {}
+
+// Drain returns all appended buffers and forgets them. Caller should release buffers
+func (mb *MemoryBackend) Drain() []*RowBinary.WriteBuffer {
+	mb.Lock()
+	defer mb.Unlock()
+
+	buffers := mb.buffers
+	mb.buffers = make([]*RowBinary.WriteBuffer, 0)
+	return buffers
+}
@@ -0,0 +1,177 @@
+package writer
+
+import (
+	"sync"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+)
+
+// MultiBackend writes each buffer to main backend and to backends of tables with own data path.
+// Tables with same path share one backend. Current file of Writer is file of main backend
+type MultiBackend struct {
+	main     *FileBackend
+	tables   map[string]*FileBackend
+	backends []*FileBackend // main first, each backend once
+	closeMu  sync.Mutex
+	appended []uint64 // by backends, last values of close callbacks
+}
+
+// NewMultiBackend creates backend of main path and paths of tables
+func NewMultiBackend(main *FileBackend, tables map[string]*FileBackend) *MultiBackend {
+	mb := &MultiBackend{
+		main:     main,
+		tables:   tables,
+		backends: []*FileBackend{main},
+	}
+
+	for _, fb := range tables {
+		exists := false
+		for _, b := range mb.backends {
+			exists = exists || b == fb
+		}
+		if !exists {
+			mb.backends = append(mb.backends, fb)
+		}
+	}
+
+	mb.appended = make([]uint64, len(mb.backends))
+	return mb
+}
+
+// SetCloseCallback sets callback of FileBackend.SetCloseCallback. Buffers are reported after close of
+// files of all backends. Should be called before Start
+func (mb *MultiBackend) SetCloseCallback(f func(appended uint64)) {
+	for i, fb := range mb.backends {
+		i := i
+		fb.SetCloseCallback(func(appended uint64) {
+			mb.closeMu.Lock()
+			defer mb.closeMu.Unlock()
+
+			mb.appended[i] = appended
+			min := appended
+			for _, n := range mb.appended {
+				if n < min {
+					min = n
+				}
+			}
+			f(min)
+		})
+	}
+}
+
+// Append writes copy of buffer to each backend of tables and buffer to main backend. Returns first error
+func (mb *MultiBackend) Append(buf *RowBinary.WriteBuffer) error {
+	var err error
+	for _, fb := range mb.backends[1:] {
+		wb := RowBinary.GetWriteBuffer()
+		wb.Write(buf.Body[:buf.Used])
+		if appendErr := fb.Append(wb); err == nil {
+			err = appendErr
+		}
+	}
+
+	if appendErr := mb.main.Append(buf); err == nil {
+		err = appendErr
+	}
+	return err
+}
+
+func (mb *MultiBackend) Start() error {
+	for i, fb := range mb.backends {
+		if err := fb.Start(); err != nil {
+			for _, started := range mb.backends[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Interrupt stops file opening retries of all backends
+func (mb *MultiBackend) Interrupt() {
+	for _, fb := range mb.backends {
+		fb.Interrupt()
+	}
+}
+
+func (mb *MultiBackend) Stop() {
+	for _, fb := range mb.backends {
+		fb.Stop()
+	}
+}
+
+// Flush closes current files of all backends. Returns first error
+func (mb *MultiBackend) Flush() error {
+	var err error
+	for _, fb := range mb.backends {
+		if flushErr := fb.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+func (mb *MultiBackend) IsInProgress(filename string) bool {
+	for _, fb := range mb.backends {
+		if fb.IsInProgress(filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentFile returns current file of main backend
+func (mb *MultiBackend) CurrentFile() (string, int64, int64) {
+	return mb.main.CurrentFile()
+}
+
+// FilesWaiting returns count of closed files in all paths
+func (mb *MultiBackend) FilesWaiting() int {
+	count := 0
+	for _, fb := range mb.backends {
+		count += fb.FilesWaiting()
+	}
+	return count
+}
+
+// FlushErrors returns count of files of all backends failed on flush of buffer since start
+func (mb *MultiBackend) FlushErrors() uint64 {
+	var count uint64
+	for _, fb := range mb.backends {
+		count += fb.FlushErrors()
+	}
+	return count
+}
+
+// FsyncErrors returns count of files of all backends failed on fsync since start
+func (mb *MultiBackend) FsyncErrors() uint64 {
+	var count uint64
+	for _, fb := range mb.backends {
+		count += fb.FsyncErrors()
+	}
+	return count
+}
+
+// CloseErrors returns count of files of all backends failed on close since start
+func (mb *MultiBackend) CloseErrors() uint64 {
+	var count uint64
+	for _, fb := range mb.backends {
+		count += fb.CloseErrors()
+	}
+	return count
+}
+
+// DiskUsage returns size of files in main path
+func (mb *MultiBackend) DiskUsage() int64 {
+	return mb.main.DiskUsage()
+}
+
+// TablesDiskUsage returns size of files in data path by table
+func (mb *MultiBackend) TablesDiskUsage() map[string]int64 {
+	usage := make(map[string]int64, len(mb.tables))
+	for table, fb := range mb.tables {
+		usage[table] = fb.DiskUsage()
+	}
+	return usage
+}
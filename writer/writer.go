@@ -1,130 +1,205 @@
 package writer
 
 import (
-	"bufio"
-	"fmt"
-	"os"
-	"path"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/logging"
 	"github.com/lomik/stop"
-	"github.com/lomik/zapwriter"
 	"go.uber.org/zap"
 )
 
+// Backend stores data received by Writer. Append takes ownership of buf
+type Backend interface {
+	Append(buf *RowBinary.WriteBuffer) error
+	Stop()
+}
+
+// WriterStats is current state of Writer. File fields are empty for backends without files
+type WriterStats struct {
+	CurrentFileName    string
+	CurrentFileSize    int64
+	CurrentFileRecords int64
+	FilesWaitingUpload int // updated every 10 seconds
+	TotalBytesWritten  int64
+	FlushErrorsTotal   uint64           // files failed on flush of buffer
+	FsyncErrorsTotal   uint64           // files failed on fsync
+	CloseErrorsTotal   uint64           // files failed on close
+	DiskUsageBytes     int64            // files in path, updated every 10 seconds
+	TablesDiskUsage    map[string]int64 // files in data paths of tables by table
+}
+
 // Writer dumps all received data in prepared for clickhouse format
 type Writer struct {
 	stop.Struct
-	sync.RWMutex
 	stat struct {
-		writtenBytes uint32
+		totalBytesWritten int64 // atomic. since start
+		writtenBytes      uint32
 	}
-	inputChan    chan *RowBinary.WriteBuffer
-	path         string
-	fileInterval time.Duration
-	inProgress   map[string]bool // current writing files
-	logger       *zap.Logger
+	inputChan chan *RowBinary.WriteBuffer
+	syncChan  chan chan struct{}
+	backend   Backend
+	logger    *zap.Logger
 }
 
+// New creates Writer with FileBackend
 func New(in chan *RowBinary.WriteBuffer, path string, fileInterval time.Duration) *Writer {
+	return NewWithBackend(in, NewFileBackend(path, fileInterval, false, 1))
+}
+
+func NewWithBackend(in chan *RowBinary.WriteBuffer, backend Backend) *Writer {
 	return &Writer{
-		inputChan:    in,
-		path:         path,
-		fileInterval: fileInterval,
-		inProgress:   make(map[string]bool),
-		logger:       zapwriter.Logger("writer"),
+		inputChan: in,
+		syncChan:  make(chan chan struct{}),
+		backend:   backend,
+		logger:    logging.Logger("writer"),
 	}
 }
 
 func (w *Writer) Start() error {
 	return w.StartFunc(func() error {
+		if s, ok := w.backend.(interface {
+			Start() error
+		}); ok {
+			if err := s.Start(); err != nil {
+				return err
+			}
+		}
+
 		w.Go(w.worker)
 		return nil
 	})
 }
 
+// Stop stops worker and backend. Worker is stopped first, so no buffer is appended to stopped backend.
+// File opening retries of backend are interrupted before, so worker isn't blocked in Append
+func (w *Writer) Stop() {
+	if b, ok := w.backend.(interface {
+		Interrupt()
+	}); ok {
+		b.Interrupt()
+	}
+	w.StopFunc(func() {})
+	w.backend.Stop()
+}
+
 func (w *Writer) Stat(send func(metric string, value float64)) {
 	writtenBytes := atomic.LoadUint32(&w.stat.writtenBytes)
 	atomic.AddUint32(&w.stat.writtenBytes, -writtenBytes)
 	send("writtenBytes", float64(writtenBytes))
-}
 
-func (w *Writer) IsInProgress(filename string) bool {
-	w.RLock()
-	v := w.inProgress[filename]
-	w.RUnlock()
-	return v
+	s := w.Stats()
+	send("currentFileSize", float64(s.CurrentFileSize))
+	send("currentFileRecords", float64(s.CurrentFileRecords))
+	send("filesWaitingUpload", float64(s.FilesWaitingUpload))
+	send("totalBytesWritten", float64(s.TotalBytesWritten))
+	send("flushErrorsTotal", float64(s.FlushErrorsTotal))
+	send("fsyncErrorsTotal", float64(s.FsyncErrorsTotal))
+	send("closeErrorsTotal", float64(s.CloseErrorsTotal))
+
+	if _, ok := w.backend.(interface {
+		DiskUsage() int64
+	}); ok {
+		send("diskUsageBytes", float64(s.DiskUsageBytes))
+	}
+	for table, size := range s.TablesDiskUsage {
+		send("tables."+table+".diskUsageBytes", float64(size))
+	}
 }
 
-func (w *Writer) worker(exit chan struct{}) {
-	var out *os.File
-	var outBuf *bufio.Writer
-	var fn string // current filename
+// Stats returns state of current file and backlog
+func (w *Writer) Stats() WriterStats {
+	s := WriterStats{
+		TotalBytesWritten: atomic.LoadInt64(&w.stat.totalBytesWritten),
+	}
 
-	defer func() {
-		if out != nil {
-			out.Close()
-		}
-	}()
-
-	// close old file, open new
-	rotate := func() {
-		if out != nil {
-			outBuf.Flush()
-			out.Close()
-			out = nil
-			outBuf = nil
-		}
+	if b, ok := w.backend.(interface {
+		CurrentFile() (string, int64, int64)
+		FilesWaiting() int
+	}); ok {
+		s.CurrentFileName, s.CurrentFileSize, s.CurrentFileRecords = b.CurrentFile()
+		s.FilesWaitingUpload = b.FilesWaiting()
+	}
 
-		var err error
+	if b, ok := w.backend.(interface {
+		FlushErrors() uint64
+		FsyncErrors() uint64
+		CloseErrors() uint64
+	}); ok {
+		s.FlushErrorsTotal = b.FlushErrors()
+		s.FsyncErrorsTotal = b.FsyncErrors()
+		s.CloseErrorsTotal = b.CloseErrors()
+	}
 
-	OpenLoop:
-		for {
-			// replace fn in inProgress
-			w.Lock()
-			delete(w.inProgress, fn)
-			fn = path.Join(w.path, fmt.Sprintf("default.%d", time.Now().UnixNano()))
-			w.inProgress[fn] = true
-			w.Unlock()
+	if b, ok := w.backend.(interface {
+		DiskUsage() int64
+	}); ok {
+		s.DiskUsageBytes = b.DiskUsage()
+	}
 
-			out, err = os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if b, ok := w.backend.(interface {
+		TablesDiskUsage() map[string]int64
+	}); ok {
+		s.TablesDiskUsage = b.TablesDiskUsage()
+	}
 
-			if err != nil {
-				w.logger.Error("create failed", zap.String("filename", fn), zap.Error(err))
+	return s
+}
 
-				// check exit channel
-				select {
-				case <-exit:
-					break OpenLoop
-				default:
-				}
+// Sync waits until all buffers received from input channel before call are passed to backend.
+// Returns false on timeout
+func (w *Writer) Sync(timeout time.Duration) bool {
+	done := make(chan struct{})
+	deadline := time.After(timeout)
 
-				// try and spam to error log every second
-				time.Sleep(time.Second)
+	select {
+	case w.syncChan <- done:
+	case <-deadline:
+		return false
+	}
 
-				continue OpenLoop
-			}
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
 
-			outBuf = bufio.NewWriterSize(out, 1024*1024)
-			break OpenLoop
-		}
+// FlushNow closes current file of backend for immediate upload. Buffers in queue of Writer are not flushed
+func (w *Writer) FlushNow() error {
+	if b, ok := w.backend.(interface {
+		Flush() error
+	}); ok {
+		return b.Flush()
 	}
+	return nil
+}
 
-	// open first file
-	rotate()
+// IsInProgress returns true if file is currently written by backend
+func (w *Writer) IsInProgress(filename string) bool {
+	if b, ok := w.backend.(interface {
+		IsInProgress(filename string) bool
+	}); ok {
+		return b.IsInProgress(filename)
+	}
+	return false
+}
 
-	ticker := time.NewTicker(w.fileInterval)
+func (w *Writer) worker(exit chan struct{}) {
 	for {
 		select {
 		case b := <-w.inputChan:
-			outBuf.Write(b.Body[:b.Used])
-			atomic.AddUint32(&w.stat.writtenBytes, uint32(b.Used))
-			b.Release()
-		case <-ticker.C:
-			rotate()
+			used := b.Used
+			if err := w.backend.Append(b); err != nil {
+				w.logger.Error("append failed", zap.Error(err))
+				continue
+			}
+			atomic.AddUint32(&w.stat.writtenBytes, uint32(used))
+			atomic.AddInt64(&w.stat.totalBytesWritten, int64(used))
+		case done := <-w.syncChan:
+			close(done)
 		case <-exit:
 			return
 		}
@@ -0,0 +1,1074 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lomik/carbon-clickhouse/helper/RowBinary"
+	"github.com/lomik/carbon-clickhouse/helper/days1970"
+)
+
+func testWriteBuffer(name string) *RowBinary.WriteBuffer {
+	wb := RowBinary.GetWriteBuffer()
+	wb.WriteGraphitePoint([]byte(name), 42, 1422642189, 16466, 1422642189)
+	return wb
+}
+
+func TestWriterMemoryBackend(t *testing.T) {
+	in := make(chan *RowBinary.WriteBuffer)
+	backend := NewMemoryBackend()
+
+	w := NewWithBackend(in, backend)
+	w.Start()
+
+	in <- testWriteBuffer("hello.world")
+	in <- testWriteBuffer("hello.test")
+	w.Stop()
+
+	buffers := backend.Drain()
+	if len(buffers) != 2 {
+		t.Fatalf("buffers: %d", len(buffers))
+	}
+
+	written := 0
+	for i, name := range []string{"hello.world", "hello.test"} {
+		expected := testWriteBuffer(name)
+		if !bytes.Equal(buffers[i].Bytes(), expected.Bytes()) {
+			t.Fatalf("%d: %#v != %#v", i, buffers[i].Bytes(), expected.Bytes())
+		}
+		written += expected.Used
+		expected.Release()
+		buffers[i].Release()
+	}
+
+	stat := make(map[string]float64)
+	w.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["writtenBytes"] != float64(written) {
+		t.Fatalf("%#v", stat)
+	}
+
+	if len(backend.Drain()) != 0 {
+		t.Fatal("backend is not drained")
+	}
+}
+
+func TestWriterFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := make(chan *RowBinary.WriteBuffer)
+	w := New(in, dir, time.Hour)
+	w.Start()
+
+	in <- testWriteBuffer("hello.world")
+	in <- testWriteBuffer("hello.test")
+
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !w.IsInProgress(files[0]) {
+		t.Fatalf("files: %#v", files)
+	}
+
+	// wait for append of last buffer
+	expected := testWriteBuffer("hello.world")
+	expected.Write(testWriteBuffer("hello.test").Bytes())
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&w.stat.writtenBytes) != uint32(expected.Used); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("written: %d", atomic.LoadUint32(&w.stat.writtenBytes))
+		}
+	}
+
+	// data is flushed on stop
+	w.Stop()
+
+	body, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(body, expected.Bytes()) {
+		t.Fatalf("%#v != %#v", body, expected.Bytes())
+	}
+}
+
+// blockingBackend blocks Append until release is closed
+type blockingBackend struct {
+	appending chan struct{}
+	release   chan struct{}
+	stopped   int32
+}
+
+func (b *blockingBackend) Append(buf *RowBinary.WriteBuffer) error {
+	buf.Release()
+	b.appending <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func (b *blockingBackend) Stop() {
+	atomic.StoreInt32(&b.stopped, 1)
+}
+
+func TestWriterStopOrder(t *testing.T) {
+	in := make(chan *RowBinary.WriteBuffer)
+	backend := &blockingBackend{appending: make(chan struct{}), release: make(chan struct{})}
+
+	w := NewWithBackend(in, backend)
+	w.Start()
+
+	in <- testWriteBuffer("hello.world")
+	<-backend.appending
+
+	done := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(done)
+	}()
+
+	// backend is stopped after worker
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&backend.stopped) != 0 {
+		t.Fatal("backend is stopped while buffer is appended")
+	}
+	close(backend.release)
+	<-done
+	if atomic.LoadInt32(&backend.stopped) != 1 {
+		t.Fatal("backend is not stopped")
+	}
+}
+
+func TestWriterStopOpenError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.openFile = func(filename string) (dataFile, error) {
+		return nil, syscall.EMFILE
+	}
+
+	in := make(chan *RowBinary.WriteBuffer)
+	w := NewWithBackend(in, fb)
+	w.Start()
+
+	// worker is blocked in Append by file opening retries
+	in <- testWriteBuffer("hello.world")
+
+	done := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer isn't stopped")
+	}
+}
+
+func TestFileBackendDatePartitioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := NewFileBackend(dir, time.Hour, true, 1)
+	fb.Start()
+
+	// 2015-01-30 and 2015-01-31
+	wb := RowBinary.GetWriteBuffer()
+	wb.WriteGraphitePoint([]byte("hello.world"), 42, 1422642189, 16465, 1422642189)
+	wb.WriteGraphitePoint([]byte("hello.world"), 43, 1422642190, 16465, 1422642189)
+	wb.WriteGraphitePoint([]byte("hello.world"), 44, 1422728589, 16466, 1422642189)
+	wb.WriteGraphitePoint([]byte("hello.test"), 45, 1422642191, 16465, 1422642189)
+
+	if err = fb.Append(wb); err != nil {
+		t.Fatal(err)
+	}
+	fb.Stop()
+
+	expected := map[string]int{"20150130": 3, "20150131": 1}
+
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("files: %#v", files)
+	}
+
+	for _, fn := range files {
+		date := filepath.Ext(fn)[1:]
+
+		r, err := RowBinary.NewReader(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows := 0
+		for {
+			if _, err = r.ReadRecord(); err != nil {
+				break
+			}
+			if time.Unix(int64(r.Days())*86400, 0).UTC().Format(DateFormat) != date {
+				t.Fatalf("%s: days %d", fn, r.Days())
+			}
+			rows++
+		}
+		r.Close()
+
+		if rows != expected[date] {
+			t.Fatalf("%s: rows %d", fn, rows)
+		}
+	}
+}
+
+func TestFileBackendMaxDays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := NewFileBackend(dir, time.Hour, true, 1)
+	fb.maxDays = 2
+	fb.Start()
+
+	// 2015-01-30, 2015-01-31 and 2015-02-01 by two open files
+	for _, days := range []uint16{16465, 16466, 16465, 16466, 16467, 16465} {
+		wb := RowBinary.GetWriteBuffer()
+		wb.WriteGraphitePoint([]byte("hello.world"), 42, 1422642189, days, 1422642189)
+		if err = fb.Append(wb); err != nil {
+			t.Fatal(err)
+		}
+		if len(fb.days) > 2 {
+			t.Fatalf("open files: %d", len(fb.days))
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+
+	rows := make([]string, 0)
+	for _, fn := range files {
+		stat, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, fmt.Sprintf("%s %d %v", filepath.Ext(fn)[1:], stat.Size()/30, fb.IsInProgress(fn)))
+	}
+	fb.Stop()
+
+	// least recently written files are closed and flushed to disk, open files are buffered
+	expected := "[20150130 2 false 20150131 2 false 20150201 0 true 20150130 0 true]"
+	if fmt.Sprint(rows) != expected {
+		t.Fatalf("%#v", rows)
+	}
+}
+
+func TestWriterStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// closed file of previous run
+	if err = ioutil.WriteFile(filepath.Join(dir, "default.1"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan *RowBinary.WriteBuffer)
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.scanInterval = 10 * time.Millisecond
+	w := NewWithBackend(in, fb)
+	w.Start()
+	defer w.Stop()
+
+	expected := testWriteBuffer("hello.world")
+	expected.Write(testWriteBuffer("hello.test").Bytes())
+	expected.Write(testWriteBuffer("hello.again").Bytes())
+
+	in <- testWriteBuffer("hello.world")
+	wb := testWriteBuffer("hello.test")
+	wb.Write(testWriteBuffer("hello.again").Bytes())
+	in <- wb
+
+	var s WriterStats
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s = w.Stats()
+		if s.TotalBytesWritten == int64(expected.Used) && s.FilesWaitingUpload == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%#v", s)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || s.CurrentFileName != files[1] {
+		t.Fatalf("%#v, files: %#v", s, files)
+	}
+
+	if s.CurrentFileSize != int64(expected.Used) || s.CurrentFileRecords != 3 {
+		t.Fatalf("%#v", s)
+	}
+
+	// rotated file is counted as waiting after scan
+	fb.writeLock.Lock()
+	fb.rotate(nil)
+	fb.writeLock.Unlock()
+
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		s = w.Stats()
+		if s.FilesWaitingUpload == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%#v", s)
+		}
+	}
+
+	if s.CurrentFileName == files[1] || s.CurrentFileSize != 0 || s.CurrentFileRecords != 0 || s.TotalBytesWritten != int64(expected.Used) {
+		t.Fatalf("%#v", s)
+	}
+
+	stat := make(map[string]float64)
+	w.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["filesWaitingUpload"] != 2 || stat["totalBytesWritten"] != float64(expected.Used) {
+		t.Fatalf("%#v", stat)
+	}
+}
+
+func TestWriterFlushNow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := make(chan *RowBinary.WriteBuffer)
+	w := New(in, dir, time.Hour)
+	w.Start()
+	defer w.Stop()
+
+	// wait for first file
+	var before string
+	for deadline := time.Now().Add(time.Second); before == ""; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("file is not opened")
+		}
+		before = w.Stats().CurrentFileName
+	}
+
+	if err = w.FlushNow(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.IsInProgress(before) {
+		t.Fatalf("%s is in progress after flush", before)
+	}
+	if after := w.Stats().CurrentFileName; after == before || !w.IsInProgress(after) {
+		t.Fatalf("current file: %#v", after)
+	}
+}
+
+func TestFileBackendConcurrency(t *testing.T) {
+	for _, datePartitioned := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "carbon-clickhouse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		fb := NewFileBackend(dir, time.Hour, datePartitioned, 4)
+		fb.Start()
+
+		wb := RowBinary.GetWriteBuffer()
+		for i := 0; i < 1000; i++ {
+			wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%d", i)), 42, 1422642189, 16465, 1422642189)
+		}
+		if err = fb.Append(wb); err != nil {
+			t.Fatal(err)
+		}
+		fb.Stop()
+
+		files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 4 {
+			t.Fatalf("date partitioned %v, files: %#v", datePartitioned, files)
+		}
+		sort.Strings(files)
+
+		// files are named in order of shards. Date partitioned files are opened on first row
+		rows := 0
+		shards := make(map[int]bool)
+		for i, fn := range files {
+			r, err := RowBinary.NewReader(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			shard := -1
+			if !datePartitioned {
+				shard = i
+			}
+
+			count := 0
+			for {
+				name, err := r.ReadRecord()
+				if err != nil {
+					break
+				}
+				if shard < 0 {
+					shard = int(crc32.ChecksumIEEE(name) % 4)
+					shards[shard] = true
+				}
+				if int(crc32.ChecksumIEEE(name)%4) != shard {
+					t.Fatalf("%s: %s of shard %d", fn, name, shard)
+				}
+				count++
+			}
+			r.Close()
+
+			if count == 0 {
+				t.Fatalf("%s is empty", fn)
+			}
+			rows += count
+		}
+
+		if rows != 1000 || datePartitioned && len(shards) != 4 {
+			t.Fatalf("date partitioned %v, rows: %d, shards: %#v", datePartitioned, rows, shards)
+		}
+	}
+}
+
+// failSyncFile fails Sync of first files
+type failSyncFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *failSyncFile) Sync() error {
+	if f.fail {
+		return syscall.ENOSPC
+	}
+	return f.File.Sync()
+}
+
+// failWriteFile writes half of data and fails Write of first files
+type failWriteFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *failWriteFile) Write(p []byte) (int, error) {
+	if f.fail {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, syscall.ENOSPC
+	}
+	return f.File.Write(p)
+}
+
+// failCloseFile fails Close of first files after close of file
+type failCloseFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *failCloseFile) Close() error {
+	err := f.File.Close()
+	if f.fail {
+		return syscall.EIO
+	}
+	return err
+}
+
+// testCloseError writes two files, first one is opened by open. Returns name of first file and stats of writer
+func testCloseError(t *testing.T, dir string, open func(f *os.File, first bool) dataFile) (string, WriterStats) {
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.SetDeadLetterPath(filepath.Join(dir, "dead"))
+
+	var opened int32
+	fb.openFile = func(filename string) (dataFile, error) {
+		f, err := openDataFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return open(f.(*os.File), atomic.AddInt32(&opened, 1) == 1), nil
+	}
+
+	in := make(chan *RowBinary.WriteBuffer)
+	w := NewWithBackend(in, fb)
+	w.Start()
+
+	in <- testWriteBuffer("hello.lost")
+	if !w.Sync(time.Second) {
+		t.Fatal("sync timed out")
+	}
+	failed, _, _ := fb.CurrentFile()
+
+	// first file fails on close, rows are written to new file
+	if err := fb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	in <- testWriteBuffer("hello.world")
+	if !w.Sync(time.Second) {
+		t.Fatal("sync timed out")
+	}
+	w.Stop()
+
+	return failed, w.Stats()
+}
+
+// checkFile checks that filename contains rows of names
+func checkFile(t *testing.T, filename string, names ...string) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []byte
+	for _, name := range names {
+		wb := testWriteBuffer(name)
+		expected = append(expected, wb.Bytes()...)
+		wb.Release()
+	}
+	if !bytes.Equal(body, expected) {
+		t.Fatalf("%s: %#v", filename, body)
+	}
+}
+
+func TestFileBackendFsyncError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	failed, stats := testCloseError(t, dir, func(f *os.File, first bool) dataFile {
+		return &failSyncFile{File: f, fail: first}
+	})
+	if stats.FsyncErrorsTotal != 1 || stats.FlushErrorsTotal != 0 || stats.CloseErrorsTotal != 0 {
+		t.Fatalf("%#v", stats)
+	}
+
+	// all rows of file failed on fsync are written, file is left for upload
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0] != failed {
+		t.Fatalf("files: %#v", files)
+	}
+	checkFile(t, files[0], "hello.lost")
+	checkFile(t, files[1], "hello.world")
+	if _, err = os.Stat(filepath.Join(dir, "dead")); !os.IsNotExist(err) {
+		t.Fatalf("dead letter path: %v", err)
+	}
+}
+
+func TestFileBackendCloseError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	failed, stats := testCloseError(t, dir, func(f *os.File, first bool) dataFile {
+		return &failCloseFile{File: f, fail: first}
+	})
+	if stats.CloseErrorsTotal != 1 || stats.FlushErrorsTotal != 0 || stats.FsyncErrorsTotal != 0 {
+		t.Fatalf("%#v", stats)
+	}
+	checkFile(t, failed, "hello.lost")
+}
+
+func TestFileBackendFlushError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	failed, stats := testCloseError(t, dir, func(f *os.File, first bool) dataFile {
+		return &failWriteFile{File: f, fail: first}
+	})
+	if stats.FlushErrorsTotal != 1 || stats.FsyncErrorsTotal != 0 || stats.CloseErrorsTotal != 0 {
+		t.Fatalf("%#v", stats)
+	}
+
+	// file with partially written rows is moved to dead letter path
+	if _, err = os.Stat(filepath.Join(dir, "dead", filepath.Base(failed))); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "default.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] == failed {
+		t.Fatalf("files: %#v", files)
+	}
+	checkFile(t, files[0], "hello.world")
+}
+
+func TestFileBackendCloseCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var closed []uint64
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.SetCloseCallback(func(appended uint64) {
+		closed = append(closed, appended)
+	})
+	fb.Start()
+
+	for _, name := range []string{"hello.world", "hello.test"} {
+		if err = fb.Append(testWriteBuffer(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	fb.Append(testWriteBuffer("hello.again"))
+	fb.Stop()
+
+	// first rotation on start, flush and stop
+	if fmt.Sprint(closed) != "[0 2 3]" {
+		t.Fatalf("%#v", closed)
+	}
+}
+
+func TestFileBackendCloseCallbackError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var closed []uint64
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.SetCloseCallback(func(appended uint64) {
+		closed = append(closed, appended)
+	})
+
+	var opened int32
+	fb.openFile = func(filename string) (dataFile, error) {
+		f, err := openDataFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return &failSyncFile{File: f.(*os.File), fail: atomic.AddInt32(&opened, 1) == 2}, nil
+	}
+	fb.Start()
+
+	if err = fb.Append(testWriteBuffer("hello.world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// second file fails on fsync, its buffer and next ones are not acknowledged
+	if err = fb.Append(testWriteBuffer("hello.lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err = fb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	fb.Append(testWriteBuffer("hello.again"))
+	fb.Stop()
+
+	if fmt.Sprint(closed) != "[0 1]" {
+		t.Fatalf("%#v", closed)
+	}
+}
+
+func TestFileBackendFlushOpenError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+
+	var opened int32
+	fb.openFile = func(filename string) (dataFile, error) {
+		if atomic.AddInt32(&opened, 1) == 2 {
+			return nil, syscall.EMFILE
+		}
+		return openDataFile(filename)
+	}
+	fb.Start()
+	defer fb.Stop()
+
+	// file isn't opened after flush, open is retried by next Append
+	if err = fb.Flush(); err != syscall.EMFILE {
+		t.Fatal(err)
+	}
+	if err = fb.Append(testWriteBuffer("hello.world")); err != nil {
+		t.Fatal(err)
+	}
+
+	filename, _, records := fb.CurrentFile()
+	if records != 1 || atomic.LoadInt32(&opened) != 3 {
+		t.Fatalf("%s: %d rows, %d opened", filename, records, atomic.LoadInt32(&opened))
+	}
+	if err = fb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filename, "hello.world")
+}
+
+func TestFileBackendCloseCallbackNotOpened(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var closed []uint64
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.SetCloseCallback(func(appended uint64) {
+		closed = append(closed, appended)
+	})
+
+	// buffer passed before start is dropped
+	if err = fb.Append(testWriteBuffer("hello.lost")); err != errNotOpened {
+		t.Fatal(err)
+	}
+	fb.Start()
+	fb.Append(testWriteBuffer("hello.world"))
+	fb.Stop()
+
+	if len(closed) != 0 {
+		t.Fatalf("%#v", closed)
+	}
+}
+
+func TestFileBackendFlowControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const maxPending = 3
+	fb := NewFileBackend(dir, 10*time.Millisecond, false, 1)
+
+	// closed files in path like uploader
+	waiting := func() []string {
+		files, _ := filepath.Glob(filepath.Join(dir, "default.*"))
+		closed := make([]string, 0, len(files))
+		for _, fn := range files {
+			if !fb.IsInProgress(fn) {
+				closed = append(closed, fn)
+			}
+		}
+		sort.Strings(closed)
+		return closed
+	}
+
+	var created int32
+	fb.openFile = func(filename string) (dataFile, error) {
+		atomic.AddInt32(&created, 1)
+		return openDataFile(filename)
+	}
+	fb.SetFlowControl(func() int {
+		if slack := maxPending - len(waiting()); slack > 0 {
+			return slack
+		}
+		return 0
+	}, 200*time.Millisecond)
+	fb.Start()
+	defer fb.Stop()
+
+	// slow uploader removes oldest file every 100ms, writer rotates file every 10ms
+	exit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if files := waiting(); len(files) > 0 {
+					os.Remove(files[0])
+				}
+			case <-exit:
+				return
+			}
+		}
+	}()
+
+	maxWaiting := 0
+	var maxBytes, appended int64 // of waiting files
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		wb := testWriteBuffer("hello.world")
+		appended += int64(len(wb.Bytes()))
+		if err = fb.Append(wb); err != nil {
+			t.Fatal(err)
+		}
+
+		files := waiting()
+		if len(files) > maxWaiting {
+			maxWaiting = len(files)
+		}
+		var size int64
+		for _, fn := range files {
+			if st, err := os.Stat(fn); err == nil {
+				size += st.Size()
+			}
+		}
+		if size > maxBytes {
+			maxBytes = size
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(exit)
+	<-done
+
+	// without flow control about 100 files are created and 90 are waiting
+	if maxWaiting > maxPending+1 {
+		t.Fatalf("waiting files: %d", maxWaiting)
+	}
+	if n := atomic.LoadInt32(&created); n > 40 {
+		t.Fatalf("created files: %d", n)
+	}
+	// flow control bounds count of files, not bytes. Each file has at most bytes appended within max file interval
+	if maxFileBytes := appended / 5; maxBytes > (maxPending+1)*maxFileBytes {
+		t.Fatalf("waiting bytes: %d of %d", maxBytes, appended)
+	}
+}
+
+func TestFileBackendDelay(t *testing.T) {
+	slack := 0
+	fb := NewFileBackend("", time.Second, false, 1)
+
+	// disabled
+	if d := fb.delay(time.Second, time.Second); d != 0 {
+		t.Fatal(d)
+	}
+
+	fb.SetFlowControl(func() int { return slack }, 10*time.Second)
+	table := []struct {
+		age      time.Duration
+		last     time.Duration
+		expected time.Duration
+	}{
+		{time.Second, time.Second, 2 * time.Second},
+		{3 * time.Second, 2 * time.Second, 4 * time.Second},
+		{7 * time.Second, 4 * time.Second, 3 * time.Second},
+		{10 * time.Second, 3 * time.Second, 0},
+	}
+	for _, c := range table {
+		if d := fb.delay(c.age, c.last); d != c.expected {
+			t.Fatalf("%s, %s: %s != %s", c.age, c.last, d, c.expected)
+		}
+	}
+
+	slack = 1
+	if d := fb.delay(time.Second, time.Second); d != 0 {
+		t.Fatal(d)
+	}
+}
+
+func TestMultiBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dirs := []string{filepath.Join(dir, "main"), filepath.Join(dir, "hot")}
+	for _, d := range dirs {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	main := NewFileBackend(dirs[0], time.Hour, false, 1)
+	hot := NewFileBackend(dirs[1], time.Hour, false, 1)
+	for _, fb := range []*FileBackend{main, hot} {
+		fb.scanInterval = 10 * time.Millisecond
+	}
+
+	// tables of one path share backend
+	mb := NewMultiBackend(main, map[string]*FileBackend{"graphite_hot": hot, "graphite_hot_reverse": hot})
+	if len(mb.backends) != 2 {
+		t.Fatalf("backends: %d", len(mb.backends))
+	}
+
+	var closed []uint64
+	mb.SetCloseCallback(func(appended uint64) {
+		closed = append(closed, appended)
+	})
+
+	w := NewWithBackend(make(chan *RowBinary.WriteBuffer), mb)
+	if err = w.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"hello.world", "hello.test"} {
+		if err = mb.Append(testWriteBuffer(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.FlushNow(); err != nil {
+		t.Fatal(err)
+	}
+
+	// all buffers are reported after close of files in both paths
+	if fmt.Sprint(closed) != "[0 0 0 2]" {
+		t.Fatalf("%#v", closed)
+	}
+
+	expected := append(testWriteBuffer("hello.world").Bytes(), testWriteBuffer("hello.test").Bytes()...)
+	var sizes []int64
+	for _, d := range dirs {
+		files, err := filepath.Glob(filepath.Join(d, "default.*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body []byte
+		for _, fn := range files {
+			if !mb.IsInProgress(fn) {
+				body, _ = ioutil.ReadFile(fn)
+			}
+		}
+		if !bytes.Equal(body, expected) {
+			t.Fatalf("%s: %#v", d, files)
+		}
+		sizes = append(sizes, int64(len(body)))
+	}
+
+	// disk usage of paths after scan
+	for i := 0; ; i++ {
+		s := w.Stats()
+		if s.DiskUsageBytes == sizes[0] && s.TablesDiskUsage["graphite_hot"] == sizes[1] && s.TablesDiskUsage["graphite_hot_reverse"] == sizes[1] {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("%#v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stat := make(map[string]float64)
+	w.Stat(func(metric string, value float64) {
+		stat[metric] = value
+	})
+	if stat["diskUsageBytes"] != float64(sizes[0]) || stat["tables.graphite_hot.diskUsageBytes"] != float64(sizes[1]) || stat["filesWaitingUpload"] != 2 {
+		t.Fatalf("%#v", stat)
+	}
+
+	w.Stop()
+}
+
+func TestFileBackendRowIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "carbon-clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb := NewFileBackend(dir, time.Hour, false, 1)
+	fb.SetRowIndex(true)
+	if err = fb.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Stop()
+
+	// buffers of 7 rows, indexed rows are inside of buffers
+	const rows = 3000
+	now := uint32(time.Now().Unix())
+	days := &days1970.Days{}
+	for i := 0; i < rows; i += 7 {
+		wb := RowBinary.GetWriteBuffer()
+		for j := i; j < i+7 && j < rows; j++ {
+			wb.WriteGraphitePoint([]byte(fmt.Sprintf("hello.world.%d", j)), 42, now, days.TimestampWithNow(now, now), now)
+		}
+		if err = fb.Append(wb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filename, _, _ := fb.CurrentFile()
+	if err = fb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := ioutil.ReadFile(RowBinary.IndexFilename(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 3*8 {
+		t.Fatalf("index size: %d", len(index))
+	}
+
+	reader, err := RowBinary.NewReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for _, n := range []int64{2999, 0, 1023, 1024, 2048, 1500} {
+		if err = reader.SeekRow(n); err != nil {
+			t.Fatalf("%d: %s", n, err)
+		}
+		name, err := reader.ReadRecord()
+		if err != nil {
+			t.Fatalf("%d: %s", n, err)
+		}
+		if string(name) != fmt.Sprintf("hello.world.%d", n) {
+			t.Fatalf("%d: %s", n, name)
+		}
+	}
+
+	if err = reader.SeekRow(rows); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reader.ReadRecord(); err != io.EOF {
+		t.Fatalf("%#v", err)
+	}
+	if err = reader.SeekRow(rows + 1); err != io.EOF {
+		t.Fatalf("%#v", err)
+	}
+}